@@ -4,79 +4,217 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/Microsoft/go-winio"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
-	AgentMaxMessageLength = 1<<14 - 1
+	// OpenSSH's own limit for agent messages, also the default limit of every proxy transport
+	AGENT_MAX_MESSAGE_LENGTH = 256 * 1024
+	AGENT_DIAL_TIMEOUT       = 5 * time.Second
+	// default of UpstreamRequestTimeoutSeconds, long enough for the confirmation prompt of a key
+	AGENT_REQUEST_TIMEOUT = 60 * time.Second
+	// the error of x/crypto's agent client when the agent answers SSH_AGENT_FAILURE
+	AGENT_CLIENT_FAILURE = "agent: failure"
+
+	// Message numbers from the ssh-agent protocol specification.
+	SSH_AGENT_FAILURE             = 5
+	SSH_AGENT_SUCCESS             = 6
+	SSH_AGENTC_REQUEST_IDENTITIES = 11
+	SSH_AGENT_IDENTITIES_ANSWER   = 12
+	SSH_AGENTC_SIGN_REQUEST       = 13
+	SSH_AGENT_SIGN_RESPONSE       = 14
+
+	SSH_AGENTC_ADD_IDENTITY                  = 17
+	SSH_AGENTC_REMOVE_IDENTITY               = 18
+	SSH_AGENTC_REMOVE_ALL_IDENTITIES         = 19
+	SSH_AGENTC_ADD_SMARTCARD_KEY             = 20
+	SSH_AGENTC_REMOVE_SMARTCARD_KEY          = 21
+	SSH_AGENTC_LOCK                          = 22
+	SSH_AGENTC_UNLOCK                        = 23
+	SSH_AGENTC_ADD_ID_CONSTRAINED            = 25
+	SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED = 26
+	SSH_AGENTC_EXTENSION                     = 27
+	SSH_AGENT_EXTENSION_FAILURE              = 28
+
+	// Flags of SSH_AGENTC_SIGN_REQUEST
+	SSH_AGENT_RSA_SHA2_256 = 2
+	SSH_AGENT_RSA_SHA2_512 = 4
+
+	NAMED_PIPE_PREFIX = `\\.\pipe\`
 )
 
-// QueryAgent provides a way to query the named windows openssh agent pipe
-func QueryAgent(pipeName string, buf []byte) (result []byte, err error) {
-	if len(buf) > AgentMaxMessageLength {
-		Logger.Error("Message too long")
-		return nil, fmt.Errorf("Message too long")
+// ConfiguredUpstreamAgent is the agent from the configs, or the windows openssh-agent when none is configured
+func ConfiguredUpstreamAgent() string {
+	if Configs.UpstreamAgent != "" {
+		return Configs.UpstreamAgent
 	}
+	return SSH_AGENT_PIPE
+}
 
-	conn, err := winio.DialPipe(pipeName, nil)
+// AgentRequestTimeout is how long an agent may take to answer a request, UpstreamRequestTimeoutSeconds of the configs
+func AgentRequestTimeout() time.Duration {
+	if Configs.UpstreamRequestTimeoutSeconds <= 0 {
+		return AGENT_REQUEST_TIMEOUT
+	}
+	return time.Duration(Configs.UpstreamRequestTimeoutSeconds) * time.Second
+}
+
+// AgentFailureFrame returns a length prefixed SSH_AGENT_FAILURE message
+func AgentFailureFrame() []byte {
+	return []byte{0, 0, 0, 1, SSH_AGENT_FAILURE}
+}
+
+// DialAgent connects to an agent listening either on a windows named pipe or on an AF_UNIX socket
+func DialAgent(address string, timeout time.Duration) (net.Conn, error) {
+	if strings.HasPrefix(strings.ToLower(address), NAMED_PIPE_PREFIX) {
+		return winio.DialPipe(address, &timeout)
+	}
+	return net.DialTimeout("unix", address, timeout)
+}
+
+// AddKeyToAgent adds a decrypted private key to the agent at address
+func AddKeyToAgent(address string, key *PpkKeyType, constraints AgentConstraintsType) error {
+	conn, err := DialAgent(address, AGENT_DIAL_TIMEOUT)
 	if err != nil {
-		Logger.Error("cannot connect to pipe %s: %w", pipeName, err)
-		return nil, fmt.Errorf("cannot connect to pipe %s: %w", pipeName, err)
+		return fmt.Errorf("%w: %v", AGENTERR_UNREACHABLE, err)
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(AGENT_DIAL_TIMEOUT))
+
+	return agent.NewClient(conn).Add(agent.AddedKey{
+		PrivateKey:       key.PrivateKey,
+		Comment:          key.Comment,
+		LifetimeSecs:     constraints.LifetimeSecs,
+		ConfirmBeforeUse: constraints.ConfirmBeforeUse,
+	})
+}
 
-	l, err := conn.Write(buf)
+// AddCertificateToAgent adds a private key with its ssh certificate to the agent at address,
+// the agent drops them when the certificate expires. An agent that answers the lifetime constraint with
+// SSH_AGENT_FAILURE gets them without it, the user is told and they are removed when the certificate expires.
+func AddCertificateToAgent(address string, key *PpkKeyType, certificate *ssh.Certificate) error {
+	conn, err := DialAgent(address, AGENT_DIAL_TIMEOUT)
 	if err != nil {
-		Logger.Error("cannot write to pipe %s: %w", pipeName, err)
-		return nil, fmt.Errorf("cannot write to pipe %s: %w", pipeName, err)
+		return fmt.Errorf("%w: %v", AGENTERR_UNREACHABLE, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(AGENT_DIAL_TIMEOUT))
+
+	var lifetimeSecs uint32
+	if certificate.ValidBefore != ssh.CertTimeInfinity {
+		remaining := int64(certificate.ValidBefore) - time.Now().Unix()
+		if remaining <= 0 {
+			return STEPERR_USERCERT_EXPIRED
+		}
+		lifetimeSecs = uint32(remaining)
 	}
 
-	reader := bufio.NewReader(conn)
+	client := agent.NewClient(conn)
+	addedKey := agent.AddedKey{
+		PrivateKey:   key.PrivateKey,
+		Certificate:  certificate,
+		Comment:      certificate.KeyId,
+		LifetimeSecs: lifetimeSecs,
+	}
+	err = client.Add(addedKey)
+	if err == nil || addedKey.LifetimeSecs == 0 || err.Error() != AGENT_CLIENT_FAILURE {
+		return err
+	}
 
-	// Magic numbers from the ssh-agent protocol specification.
-	// <https://github.com/openssh/openssh-portable/blob/4e636cf/PROTOCOL.agent>
-	// first 4 bytes are magic numbers related to the named pipe
-	magic := make([]byte, 4)
-	l, err = reader.Read(magic)
+	Logger.Info("Agent: %v refused certificate %v with a lifetime of %vs, adding it without", address, certificate.KeyId, addedKey.LifetimeSecs)
+	addedKey.LifetimeSecs = 0
+	if err = client.Add(addedKey); err != nil {
+		return err
+	}
+	expiresAt := time.Unix(int64(certificate.ValidBefore), 0)
+	App.PushWarnNoti("%v does not support key lifetimes. Certificate %v is removed from it when it expires at %v.",
+		address, certificate.KeyId, expiresAt.Format(time.RFC1123))
+	time.AfterFunc(time.Until(expiresAt), func() {
+		Logger.Info("Agent: certificate %v expired, removing it from %v", certificate.KeyId, address)
+		if err := RemoveKeyFromAgent(address, certificate.Marshal()); err != nil {
+			Logger.Error("Agent: cannot remove expired certificate %v from %v. Error: %v", certificate.KeyId, address, err)
+		}
+	})
+	return nil
+}
+
+// RemoveKeyFromAgent removes the key with the public key blob from the agent at address
+func RemoveKeyFromAgent(address string, keyBlob []byte) error {
+	request := frameAgentMessage(appendAgentString([]byte{SSH_AGENTC_REMOVE_IDENTITY}, keyBlob))
+	result, err := QueryAgent(address, request)
 	if err != nil {
-		Logger.Error("cannot read from pipe %s: %w", pipeName, err)
-		return nil, fmt.Errorf("cannot read from pipe %s: %w", pipeName, err)
+		return err
+	}
+	if messageTypeOf(result) != SSH_AGENT_SUCCESS {
+		return fmt.Errorf("%w: %v", AGENTERR_UNEXPECTED_REPLY, AgentMessageName(byte(messageTypeOf(result))))
 	}
-	// next byte is the SSH2_AGENT_IDENTITIES_ANSWER
-	sshHeader := make([]byte, 1)
-	l, err = reader.Read(sshHeader)
+	return nil
+}
+
+// ListAgentIdentities asks the agent at address for its keys
+func ListAgentIdentities(address string) ([]AgentIdentityType, error) {
+	result, err := QueryAgent(address, []byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES})
 	if err != nil {
-		Logger.Error("cannot read from pipe %s: %w", pipeName, err)
-		return nil, fmt.Errorf("cannot read from pipe %s: %w", pipeName, err)
+		return nil, err
+	}
+	return ParseIdentitiesAnswer(result)
+}
+
+// ReadAgentFrame reads one length prefixed agent message, including its 4 byte length
+func ReadAgentFrame(reader io.Reader, maxLength int) ([]byte, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, lenBuf); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lenBuf)
+	if uint64(length)+4 > uint64(maxLength) {
+		return nil, fmt.Errorf("%w: length = %v, limit = %v", AGENTERR_MESSAGE_TOO_LONG, length, maxLength)
+	}
+
+	frame := make([]byte, 4+length)
+	copy(frame, lenBuf)
+	if _, err := io.ReadFull(reader, frame[4:]); err != nil {
+		return nil, err
 	}
-	// next 4 bytes (Uint32) is the number of keys
-	keyCountSlice := make([]byte, 4)
-	l, err = reader.Read(keyCountSlice)
+	return frame, nil
+}
+
+// QueryAgent forwards one length prefixed request to the agent at address and reads back one response frame.
+// An agent that does not answer within AgentRequestTimeout fails the request.
+func QueryAgent(address string, buf []byte) (result []byte, err error) {
+	if len(buf) > AGENT_MAX_MESSAGE_LENGTH {
+		Logger.Error("Message too long")
+		return nil, AGENTERR_MESSAGE_TOO_LONG
+	}
+
+	conn, err := DialAgent(address, AGENT_DIAL_TIMEOUT)
 	if err != nil {
-		Logger.Error("cannot read from pipe %s: %w", pipeName, err)
-		return nil, fmt.Errorf("cannot read from pipe %s: %w", pipeName, err)
-	}
-	// convert to Uint32
-	keyCount := binary.BigEndian.Uint32(keyCountSlice)
-
-	// set to max agent message length minus the previous 9 bytes
-	res := make([]byte, AgentMaxMessageLength-9)
-	// verify the key count is > 0, otherwise skip
-	if keyCount > 0 {
-		l, err = reader.Read(res)
-		if err != nil {
-			Logger.Error("cannot read from pipe %s: %w", pipeName, err)
-			return nil, fmt.Errorf("cannot read from pipe %s: %w", pipeName, err)
-		}
-	} else {
-		l = 0
+		Logger.Error("cannot connect to agent %s: %v", address, err)
+		return nil, fmt.Errorf("cannot connect to agent %s: %w", address, err)
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(AgentRequestTimeout()))
 
-	// Concat all slices together
-	concatRes := append(magic, sshHeader...)
-	concatRes = append(concatRes, keyCountSlice...)
-	concatRes = append(concatRes, res[0:l]...)
+	_, err = conn.Write(buf)
+	if err != nil {
+		Logger.Error("cannot write to agent %s: %v", address, err)
+		return nil, fmt.Errorf("cannot write to agent %s: %w", address, err)
+	}
 
-	return concatRes, nil
+	// Framing from the ssh-agent protocol specification: a 4 byte big endian length, then the message.
+	// <https://github.com/openssh/openssh-portable/blob/4e636cf/PROTOCOL.agent>
+	result, err = ReadAgentFrame(bufio.NewReader(conn), AGENT_MAX_MESSAGE_LENGTH)
+	if err != nil {
+		Logger.Error("cannot read from agent %s: %v", address, err)
+		return nil, fmt.Errorf("cannot read from agent %s: %w", address, err)
+	}
+	return result, nil
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestQueryAgentTimeout(t *testing.T) {
+	timeout := Configs.UpstreamRequestTimeoutSeconds
+	t.Cleanup(func() { Configs.UpstreamRequestTimeoutSeconds = timeout })
+	Configs.UpstreamRequestTimeoutSeconds = 1
+
+	// a hung upstream agent: it accepts the connection and never answers
+	address := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	startedAt := time.Now()
+	if _, err = QueryAgent(address, []byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}); err == nil {
+		t.Fatal("hung agent answered")
+	}
+	if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+		t.Errorf("request failed after %v, expected about a second", elapsed)
+	}
+}
+
+// newTestCertificate certifies a new ed25519 key for alice until validBefore
+func newTestCertificate(t *testing.T, validBefore time.Time) (*PpkKeyType, *ssh.Certificate) {
+	privateKey := newTestEd25519Key(t)
+	key, err := NewPpkKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.ParsePublicKey(key.PublicBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ssh.NewSignerFromKey(newTestEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@example.com",
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err = certificate.SignCert(rand.Reader, caKey); err != nil {
+		t.Fatal(err)
+	}
+	return key, certificate
+}
+
+func TestAddCertificateToAgentWithoutLifetime(t *testing.T) {
+	notifications := recordNotifications(t)
+	keyring := agent.NewKeyring()
+	address := serveTestAgent(t, noLifetimeAgentType{keyring})
+	key, certificate := newTestCertificate(t, time.Now().Add(2*time.Second))
+
+	if err := AddCertificateToAgent(address, key, certificate); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := keyring.List(); err != nil || len(keys) != 1 {
+		t.Fatalf("upstream keys = %v, error %v", keys, err)
+	}
+	if list := notifications.list(); len(list) != 1 || !strings.HasPrefix(list[0], "WARNING: "+address+" does not support key lifetimes.") {
+		t.Errorf("notifications = %q", list)
+	}
+
+	// removed by the proxy when the certificate expires
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		keys, err := keyring.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired certificate is still in the agent: %v", keys)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAddCertificateToAgentConnectionError(t *testing.T) {
+	notifications := recordNotifications(t)
+
+	// an agent that drops the connection after reading the request
+	address := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var requests int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err = ReadAgentFrame(conn, AGENT_MAX_MESSAGE_LENGTH); err == nil {
+				atomic.AddInt32(&requests, 1)
+			}
+			conn.Close()
+		}
+	}()
+
+	key, certificate := newTestCertificate(t, time.Now().Add(time.Hour))
+	if err = AddCertificateToAgent(address, key, certificate); err == nil || err.Error() == AGENT_CLIENT_FAILURE {
+		t.Errorf("err = %v, expected the connection error", err)
+	}
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Errorf("%v add requests, expected 1 without a retry", count)
+	}
+	if list := notifications.list(); len(list) != 0 {
+		t.Errorf("notifications = %q", list)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const AGENT_PROBE_TIMEOUT = 5 * time.Second
+
+type AgentProbeResultType struct {
+	Address  string
+	Latency  time.Duration
+	KeyCount int
+}
+
+func (r *AgentProbeResultType) String() string {
+	return fmt.Sprintf("%v keys, %v", r.KeyCount, r.Latency.Round(time.Millisecond))
+}
+
+// ProbeAgent asks the agent at address for its identities and checks the answer.
+// A hung agent fails the probe once timeout is over, instead of just existing as a process.
+func ProbeAgent(address string, timeout time.Duration) (*AgentProbeResultType, error) {
+	startedAt := time.Now()
+	conn, err := DialAgent(address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", AGENTERR_UNREACHABLE, err)
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(startedAt.Add(timeout)); err != nil {
+		return nil, fmt.Errorf("%w: %v", AGENTERR_UNREACHABLE, err)
+	}
+
+	if _, err = conn.Write([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}); err != nil {
+		return nil, fmt.Errorf("%w: cannot send request: %v", AGENTERR_UNREACHABLE, err)
+	}
+
+	frame, err := ReadAgentFrame(conn, AGENT_MAX_MESSAGE_LENGTH)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read reply: %v", AGENTERR_UNREACHABLE, err)
+	}
+
+	if len(frame) < 9 || frame[4] != SSH_AGENT_IDENTITIES_ANSWER {
+		return nil, fmt.Errorf("%w: %v bytes, message type %v", AGENTERR_UNEXPECTED_REPLY, len(frame), messageTypeOf(frame))
+	}
+
+	return &AgentProbeResultType{
+		Address:  address,
+		Latency:  time.Since(startedAt),
+		KeyCount: int(binary.BigEndian.Uint32(frame[5:9])),
+	}, nil
+}
+
+func messageTypeOf(frame []byte) int {
+	if len(frame) < 5 {
+		return -1
+	}
+	return int(frame[4])
+}
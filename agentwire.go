@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+var AGENT_MESSAGE_NAMES = map[byte]string{
+	SSH_AGENT_FAILURE:                        "SSH_AGENT_FAILURE",
+	SSH_AGENT_SUCCESS:                        "SSH_AGENT_SUCCESS",
+	SSH_AGENTC_REQUEST_IDENTITIES:            "SSH_AGENTC_REQUEST_IDENTITIES",
+	SSH_AGENT_IDENTITIES_ANSWER:              "SSH_AGENT_IDENTITIES_ANSWER",
+	SSH_AGENTC_SIGN_REQUEST:                  "SSH_AGENTC_SIGN_REQUEST",
+	SSH_AGENT_SIGN_RESPONSE:                  "SSH_AGENT_SIGN_RESPONSE",
+	SSH_AGENTC_ADD_IDENTITY:                  "SSH_AGENTC_ADD_IDENTITY",
+	SSH_AGENTC_REMOVE_IDENTITY:               "SSH_AGENTC_REMOVE_IDENTITY",
+	SSH_AGENTC_REMOVE_ALL_IDENTITIES:         "SSH_AGENTC_REMOVE_ALL_IDENTITIES",
+	SSH_AGENTC_ADD_SMARTCARD_KEY:             "SSH_AGENTC_ADD_SMARTCARD_KEY",
+	SSH_AGENTC_REMOVE_SMARTCARD_KEY:          "SSH_AGENTC_REMOVE_SMARTCARD_KEY",
+	SSH_AGENTC_LOCK:                          "SSH_AGENTC_LOCK",
+	SSH_AGENTC_UNLOCK:                        "SSH_AGENTC_UNLOCK",
+	SSH_AGENTC_ADD_ID_CONSTRAINED:            "SSH_AGENTC_ADD_ID_CONSTRAINED",
+	SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED: "SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED",
+	SSH_AGENTC_EXTENSION:                     "SSH_AGENTC_EXTENSION",
+	SSH_AGENT_EXTENSION_FAILURE:              "SSH_AGENT_EXTENSION_FAILURE",
+}
+
+func AgentMessageName(messageType byte) string {
+	if name, ok := AGENT_MESSAGE_NAMES[messageType]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%v)", messageType)
+}
+
+// agentWireReader reads the ssh wire encoding (RFC 4251) of an agent message body.
+// The first failed read sticks in err, so a message can be read field by field and checked once.
+type agentWireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *agentWireReader) fail(field string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: truncated %v", AGENTERR_MALFORMED_MESSAGE, field)
+	}
+}
+
+func (r *agentWireReader) readByte(field string) byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.fail(field)
+		return 0
+	}
+	value := r.buf[0]
+	r.buf = r.buf[1:]
+	return value
+}
+
+func (r *agentWireReader) readUint32(field string) uint32 {
+	if r.err != nil || len(r.buf) < 4 {
+		r.fail(field)
+		return 0
+	}
+	value := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return value
+}
+
+func (r *agentWireReader) readString(field string) []byte {
+	length := r.readUint32(field)
+	if r.err != nil || uint64(len(r.buf)) < uint64(length) {
+		r.fail(field)
+		return nil
+	}
+	value := r.buf[:length]
+	r.buf = r.buf[length:]
+	return value
+}
+
+func (r *agentWireReader) rest() []byte {
+	value := r.buf
+	r.buf = nil
+	return value
+}
+
+func appendAgentUint32(buf []byte, value uint32) []byte {
+	return append(buf, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func appendAgentString(buf []byte, value []byte) []byte {
+	return append(appendAgentUint32(buf, uint32(len(value))), value...)
+}
+
+// appendAgentMpint appends x as SSH mpint, a string with a leading zero byte when the high bit is set
+func appendAgentMpint(buf []byte, x *big.Int) []byte {
+	value := x.Bytes()
+	if len(value) > 0 && value[0]&0x80 != 0 {
+		value = append([]byte{0}, value...)
+	}
+	return appendAgentString(buf, value)
+}
+
+// frameAgentMessage prefixes a message body with its length
+func frameAgentMessage(body []byte) []byte {
+	return append(appendAgentUint32(make([]byte, 0, 4+len(body)), uint32(len(body))), body...)
+}
+
+// KeyTypeOf returns the algorithm name a public key blob starts with
+func KeyTypeOf(keyBlob []byte) string {
+	reader := &agentWireReader{buf: keyBlob}
+	keyType := reader.readString("key type")
+	if reader.err != nil {
+		return "unknown"
+	}
+	return string(keyType)
+}
+
+// KeyFingerprint renders a public key blob the way ssh-keygen -l does, e.g. SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s
+func KeyFingerprint(keyBlob []byte) string {
+	hash := sha256.Sum256(keyBlob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// AgentIdentityType is one key of an SSH_AGENT_IDENTITIES_ANSWER
+type AgentIdentityType struct {
+	Blob    []byte
+	Comment []byte
+}
+
+// ParseIdentitiesAnswer reads the keys of a length prefixed SSH_AGENT_IDENTITIES_ANSWER
+func ParseIdentitiesAnswer(frame []byte) ([]AgentIdentityType, error) {
+	if messageTypeOf(frame) != SSH_AGENT_IDENTITIES_ANSWER {
+		return nil, fmt.Errorf("%w: message type %v", AGENTERR_UNEXPECTED_REPLY, messageTypeOf(frame))
+	}
+	reader := &agentWireReader{buf: frame[5:]}
+	count := reader.readUint32("key count")
+	identities := []AgentIdentityType{}
+	for i := uint32(0); i < count && reader.err == nil; i++ {
+		identity := AgentIdentityType{Blob: reader.readString("key blob"), Comment: reader.readString("comment")}
+		identities = append(identities, identity)
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return identities, nil
+}
+
+// BuildIdentitiesAnswer returns a length prefixed SSH_AGENT_IDENTITIES_ANSWER with identities
+func BuildIdentitiesAnswer(identities []AgentIdentityType) []byte {
+	body := appendAgentUint32([]byte{SSH_AGENT_IDENTITIES_ANSWER}, uint32(len(identities)))
+	for _, identity := range identities {
+		body = appendAgentString(body, identity.Blob)
+		body = appendAgentString(body, identity.Comment)
+	}
+	return frameAgentMessage(body)
+}
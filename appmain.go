@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/lxn/walk"
@@ -14,6 +18,8 @@ const (
 	TRAY_ICON_OK_PATH      = "./img/trayIconOK.ico"
 	TRAY_ICON_ERR_PATH     = "./img/trayIconError.ico"
 	TRAY_ICON_LOADING_PATH = "./img/trayIconLoading.ico"
+
+	TRAY_TOOLTIP_MAX_LENGTH = 127
 )
 
 type AppStatusType int
@@ -31,6 +37,9 @@ type UIAppType struct {
 	trayIcon                  *walk.NotifyIcon
 	dashboardDlg, settingsDlg *walk.Dialog
 
+	profilesMenu       *walk.Menu
+	profilesMenuAction *walk.Action
+
 	stepCaHealthLabel       *walk.Label
 	pageantProxyHealthLabel *walk.Label
 	opensshHealthLabel      *walk.Label
@@ -142,6 +151,19 @@ func (app *UIAppType) Init() {
 		}
 	})
 
+	if app.profilesMenu, err = walk.NewMenu(); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	if app.profilesMenuAction, err = app.trayIcon.ContextMenu().Actions().AddMenu(app.profilesMenu); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	if err = app.profilesMenuAction.SetText("Profiles"); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+	app.RebuildProfilesMenu(nil)
+
 	if err = app.trayIcon.ContextMenu().Actions().Add(walk.NewSeparatorAction()); err != nil {
 		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
 	}
@@ -159,6 +181,19 @@ func (app *UIAppType) Init() {
 		OpenHomeDir()
 	})
 
+	importPpkAction := walk.NewAction()
+	if err = importPpkAction.SetText("Import PuTTY Key..."); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	if err = app.trayIcon.ContextMenu().Actions().Add(importPpkAction); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	importPpkAction.Triggered().Attach(func() {
+		app.OpenImportPpkDialog()
+	})
+
 	if err = app.trayIcon.ContextMenu().Actions().Add(walk.NewSeparatorAction()); err != nil {
 		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
 	}
@@ -176,6 +211,35 @@ func (app *UIAppType) Init() {
 		PageantProxy.SendRestartSignal()
 	})
 
+	captureAction := walk.NewAction()
+	if err = captureAction.SetText("Capture Agent Traffic"); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	if err = captureAction.SetCheckable(true); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	if err = captureAction.SetChecked(Configs.CaptureEnabled); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	if err = app.trayIcon.ContextMenu().Actions().Add(captureAction); err != nil {
+		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
+	}
+
+	captureAction.Triggered().Attach(func() {
+		Configs.CaptureEnabled = !Configs.CaptureEnabled
+		captureAction.SetChecked(Configs.CaptureEnabled)
+		Configs.StoreConfigs()
+		if Configs.CaptureEnabled {
+			app.PushInfoNoti("Capturing agent traffic to %v", Capture.Path())
+		} else {
+			Capture.Close()
+			app.PushInfoNoti("Stopped capturing agent traffic")
+		}
+	})
+
 	if err = app.trayIcon.ContextMenu().Actions().Add(walk.NewSeparatorAction()); err != nil {
 		Logger.Panic("Failed to initialize application tray icon. Error %v", err)
 	}
@@ -216,8 +280,12 @@ func (app *UIAppType) Start() {
 		walk.MsgBox(app.mainWindow, APP_NAME+": Error", fmt.Sprintf("Failed to initialized Step CLI handler. Due to error: %s. Please check logs in %s for more detail", stepErr, APP_LOGS_DIR), walk.MsgBoxIconError|walk.MsgBoxOK)
 		return
 	}
+	if profile := Profiles.Active(); profile != nil {
+		SetPrincipals(profile.Principals)
+	}
 	app.CheckStepCliConfiguration()
 
+	ManagedAgent.EnsureUpstream()
 	go PageantProxy.Start()
 	app.SetTrayIcon(TrayIconErrorIcon)
 	app.trayIcon.SetToolTip("WinSSH Pageant Proxy")
@@ -259,10 +327,12 @@ func (app *UIAppType) OpenDashboardDialog() (int, error) {
 						Text:       "Provisoner: ",
 					},
 					ComboBox{
-						ColumnSpan: 3,
-						AssignTo:   &proivisionerCombox,
-						Value:      Bind("StepDefaultProvisioner"),
-						Model:      app.GetProvisoners(),
+						ColumnSpan:    3,
+						AssignTo:      &proivisionerCombox,
+						Value:         Bind("StepDefaultProvisioner"),
+						BindingMember: "Name",
+						DisplayMember: "Display",
+						Model:         app.GetProvisoners(),
 					},
 					PushButton{
 						AssignTo:   &refreshProvisionerBtn,
@@ -288,11 +358,11 @@ func (app *UIAppType) OpenDashboardDialog() (int, error) {
 						ColumnSpan: 1,
 						OnClicked: func() {
 							if app.authBtn.Text() == "Login" {
-								err := StepCli.Login()
+								err := StepCli.Login(app.openPassphraseDialog)
 								if err != nil {
 									Logger.Error("Failed to login user %v. Error: %v", Configs.StepUsername, err)
 									app.PushErrNoti("Failed to login user %v. Error: %v", Configs.StepUsername, err)
-									walk.MsgBox(app.mainWindow, APP_NAME+": Error", fmt.Sprintf("Failed to login user %v. Error: %v", Configs.StepUsername, err), walk.MsgBoxIconError|walk.MsgBoxOK)
+									walk.MsgBox(app.mainWindow, APP_NAME+": Error", fmt.Sprintf("Failed to login user %v.\n\n%v", Configs.StepUsername, StepErrorText(err)), walk.MsgBoxIconError|walk.MsgBoxOK)
 								} else {
 									app.PushInfoNoti("User %v logged in. Certificate has been updated.", Configs.StepUsername)
 								}
@@ -303,7 +373,7 @@ func (app *UIAppType) OpenDashboardDialog() (int, error) {
 								if err != nil {
 									Logger.Error("Failed to logout user %v. Error: %v", Configs.StepUsername, err)
 									app.PushErrNoti("Failed to logout user %v. Error: %v", Configs.StepUsername, err)
-									walk.MsgBox(app.mainWindow, APP_NAME+": Error", fmt.Sprintf("Failed to logout user %v. Error: %v", Configs.StepUsername, err), walk.MsgBoxIconError|walk.MsgBoxOK)
+									walk.MsgBox(app.mainWindow, APP_NAME+": Error", fmt.Sprintf("Failed to logout user %v.\n\n%v", Configs.StepUsername, StepErrorText(err)), walk.MsgBoxIconError|walk.MsgBoxOK)
 								} else {
 									app.PushInfoNoti("User %v logged out. Certificate of user has been removed.", Configs.StepUsername)
 								}
@@ -363,17 +433,30 @@ func (app *UIAppType) OpenDashboardDialog() (int, error) {
 	return dlg.Run(), err
 }
 
-func (app *UIAppType) GetProvisoners() []string {
+// ProvisionerChoiceType is an entry of the provisioner combo box, Display shows the provisioner type
+type ProvisionerChoiceType struct {
+	Name    string
+	Display string
+}
+
+func (app *UIAppType) GetProvisoners() []*ProvisionerChoiceType {
 	provisionerSet, stepErr := StepCli.GetProvisionersSetNoRefresh()
 	if stepErr != nil {
-		output := [1]string{fmt.Sprintf("<Error: %v>", stepErr)}
-		return output[:]
+		text := fmt.Sprintf("<Error: %v>", stepErr)
+		return []*ProvisionerChoiceType{{Name: text, Display: text}}
 	}
+	types := StepCli.ProvisionerTypes()
 	keys := make([]string, 0, len(provisionerSet.set))
 	for k := range provisionerSet.set {
 		keys = append(keys, k)
 	}
-	return keys
+	sort.Strings(keys)
+
+	choices := make([]*ProvisionerChoiceType, 0, len(keys))
+	for _, k := range keys {
+		choices = append(choices, &ProvisionerChoiceType{Name: k, Display: fmt.Sprintf("%v (%v)", k, types[k])})
+	}
+	return choices
 }
 
 func (app *UIAppType) OpenStepConfigDialog() (int, error) {
@@ -396,7 +479,7 @@ func (app *UIAppType) OpenStepConfigDialog() (int, error) {
 				Configs.StoreConfigs()
 				stepErr := StepCli.ReConfigure()
 				if stepErr != nil {
-					walk.MsgBox(app.mainWindow, APP_NAME+": Error", fmt.Sprintf("Failed to reconfigure StepCli for your user. Error: %v!", stepErr), walk.MsgBoxIconError|walk.MsgBoxOK)
+					walk.MsgBox(app.mainWindow, APP_NAME+": Error", fmt.Sprintf("Failed to reconfigure StepCli for your user.\n\n%v", StepErrorText(stepErr)), walk.MsgBoxIconError|walk.MsgBoxOK)
 				} else {
 					_, stepErr := StepCli.GetProvisionersSetWithRefreshing()
 					if stepErr != nil {
@@ -461,6 +544,165 @@ func (app *UIAppType) OpenStepConfigDialog() (int, error) {
 	}.Run(nil)
 }
 
+// RebuildProfilesMenu lists the profiles with the state of their user certificate among certificates,
+// the active profile is checked. The menu is hidden without profiles.
+func (app *UIAppType) RebuildProfilesMenu(certificates []*SshCertificateType) {
+	app.profilesMenuAction.SetVisible(len(Configs.Profiles) > 0)
+	if err := app.profilesMenu.Actions().Clear(); err != nil {
+		Logger.Error("Failed to clear profiles menu. Error: %v", err)
+		return
+	}
+
+	for _, profile := range Profiles.List() {
+		name := profile.Name
+		action := walk.NewAction()
+		text := name
+		if certificates != nil {
+			text = fmt.Sprintf("%v (%v)", name, Profiles.CertificateStatus(&profile, certificates))
+		}
+		action.SetText(text)
+		action.SetCheckable(true)
+		action.SetChecked(name == Configs.ActiveProfile)
+		action.Triggered().Attach(func() {
+			app.SwitchProfile(name)
+		})
+		if err := app.profilesMenu.Actions().Add(action); err != nil {
+			Logger.Error("Failed to add profile '%v' to profiles menu. Error: %v", name, err)
+		}
+	}
+}
+
+// SwitchProfile reconfigures step for the profile name in the background, it runs step.exe
+func (app *UIAppType) SwitchProfile(name string) {
+	go func() {
+		err := Profiles.Switch(name)
+		app.mainWindow.Synchronize(func() {
+			app.RebuildProfilesMenu(nil)
+		})
+		if err != nil {
+			Logger.Error("Failed to switch to profile '%v'. Error: %v", name, err)
+			app.PushErrNoti("Failed to switch to profile %v. Error: %v", name, err)
+			return
+		}
+		app.PushInfoNoti("Switched to profile %v", name)
+		refreshCaCheck <- true
+		refreshCertCheck <- true
+	}()
+}
+
+// OpenImportPpkDialog lets the user pick a .ppk file and adds its key to the upstream agent.
+// Decryption runs in the background, the passphrase prompt needs the UI thread.
+func (app *UIAppType) OpenImportPpkDialog() {
+	fileDlg := &walk.FileDialog{
+		Title:          fmt.Sprintf("%v: %v", APP_NAME, "Import PuTTY Key"),
+		Filter:         "PuTTY Private Key Files (*.ppk)|*.ppk|All Files (*.*)|*.*",
+		InitialDirPath: USER_HOME_DIR,
+	}
+	ok, err := fileDlg.ShowOpen(app.mainWindow)
+	if err != nil {
+		Logger.Error("AppMain: failed to open file dialog. Error: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	path := fileDlg.FilePath
+	go func() {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			Logger.Error("AppMain: failed to read %v. Error: %v", path, err)
+			app.PushErrNoti("Could not read %v. Error: %v", path, err)
+			return
+		}
+
+		key, err := ImportPpk(content, PageantProxy.UpstreamAddress(), AgentConstraintsType{}, app.PromptPassphrase)
+		if errors.Is(err, PPKERR_PASSPHRASE_REQUIRED) {
+			Logger.Info("AppMain: import of %v cancelled", path)
+			return
+		}
+		if err != nil {
+			Logger.Error("AppMain: failed to import %v. Error: %v", path, err)
+			app.PushErrNoti("Could not import %v. Error: %v", path, err)
+			return
+		}
+		app.PushInfoNoti("Added PuTTY key '%v' to the agent", key.Comment)
+	}()
+}
+
+// PromptPassphrase shows a passphrase dialog on the UI thread and waits for the answer.
+// It must not be called from the UI thread itself.
+func (app *UIAppType) PromptPassphrase(title string, message string) (string, bool) {
+	if app.mainWindow == nil {
+		Logger.Error("AppMain: cannot prompt for a passphrase, the UI is not initialized")
+		return "", false
+	}
+
+	type answerType struct {
+		passphrase string
+		ok         bool
+	}
+	answerChn := make(chan answerType, 1)
+	app.mainWindow.Synchronize(func() {
+		passphrase, ok := app.openPassphraseDialog(title, message)
+		answerChn <- answerType{passphrase, ok}
+	})
+	answer := <-answerChn
+	return answer.passphrase, answer.ok
+}
+
+func (app *UIAppType) openPassphraseDialog(title string, message string) (string, bool) {
+	var dlg *walk.Dialog
+	var passphraseTxt *walk.LineEdit
+	var okBtn, cancelBtn *walk.PushButton
+	passphrase := ""
+
+	result, err := Dialog{
+		AssignTo:      &dlg,
+		Icon:          AppIcon,
+		Title:         fmt.Sprintf("%v: %v", APP_NAME, title),
+		DefaultButton: &okBtn,
+		CancelButton:  &cancelBtn,
+		MinSize:       Size{400, 100},
+		Layout:        VBox{},
+		Children: []Widget{
+			Label{
+				Text: message,
+			},
+			LineEdit{
+				AssignTo:     &passphraseTxt,
+				PasswordMode: true,
+			},
+			Composite{
+				Layout: HBox{},
+				Children: []Widget{
+					HSpacer{},
+					PushButton{
+						AssignTo: &okBtn,
+						Text:     "OK",
+						OnClicked: func() {
+							passphrase = passphraseTxt.Text()
+							dlg.Accept()
+						},
+					},
+					PushButton{
+						AssignTo: &cancelBtn,
+						Text:     "Cancel",
+						OnClicked: func() {
+							dlg.Cancel()
+						},
+					},
+				},
+			},
+		},
+	}.Run(app.mainWindow)
+	if err != nil {
+		Logger.Error("AppMain: failed to open passphrase dialog. Error: %v", err)
+		return "", false
+	}
+	return passphrase, result == walk.DlgCmdOK
+}
+
 func (app *UIAppType) CheckStatusLoop() {
 	caHealthChan := app.CheckCaHealth()
 	userCertHealthChan := app.CheckUserCertHealth()
@@ -475,7 +717,7 @@ func (app *UIAppType) CheckStatusLoop() {
 		case caHealth = <-caHealthChan:
 			caHealthOk = (caHealth == "OK")
 		case openSSH = <-openSSHHealthChan:
-			openSSHOk = openSSH == "OK"
+			openSSHOk = strings.HasPrefix(openSSH, "OK")
 		case userCert = <-userCertHealthChan:
 			userCertOk = userCert == "OK"
 		case pageantProxy = <-pageantProxyHealthChan:
@@ -524,7 +766,7 @@ func (app *UIAppType) CheckStatusLoop() {
 			} else {
 				if app.opensshHealthLabel != nil {
 					lastText := app.opensshHealthLabel.Text()
-					newText := "<OK>         OpenSSH Agent is running"
+					newText := fmt.Sprintf("<OK>         OpenSSH Agent is responding (%s)", strings.TrimPrefix(openSSH, "OK: "))
 					if lastText != newText {
 						app.opensshHealthLabel.SetText(newText)
 						app.opensshHealthLabel.SetTextColor(walk.RGB(0, 255, 0))
@@ -598,8 +840,18 @@ func (app *UIAppType) CheckUserCertHealth() <-chan string {
 	go func() {
 		timeoutchan := make(chan bool)
 		for {
-			userCertOk, stepErr := StepCli.GetUserCertOk()
-			if !userCertOk {
+			userCert, stepErr := StepCli.UserCertificate()
+			CertRenewal.Observe(userCert, stepErr)
+			if len(Configs.Profiles) > 0 {
+				certificates, err := ListAgentCertificates(PageantProxy.UpstreamAddress())
+				if err != nil {
+					Logger.Error("Failed to list certificates for the profiles menu. Error: %v", err)
+				}
+				app.mainWindow.Synchronize(func() {
+					app.RebuildProfilesMenu(certificates)
+				})
+			}
+			if stepErr != nil {
 				output <- fmt.Sprintf("User's certificate invalid. Error: %v", stepErr)
 			} else {
 				output <- "OK"
@@ -631,6 +883,10 @@ func (app *UIAppType) CheckCaHealth() <-chan string {
 			if !stepCaHealthOk {
 				output <- fmt.Sprintf("CA Health Check Failed. Error: %v", stepErr)
 			} else {
+				// picks up rotated host CA keys and deleted profiles
+				if err := KnownHosts.Sync(); err != nil {
+					Logger.Error("Failed to update the host CAs in known_hosts. Error: %v", err)
+				}
 				output <- "OK"
 			}
 
@@ -656,11 +912,16 @@ func (app *UIAppType) CheckOpenSSHHealth() <-chan string {
 	go func() {
 		timeoutchan := make(chan bool)
 		for {
-			opensshAgentRunning := IsProcessNameExist("ssh-agent", false)
-			if !opensshAgentRunning {
-				output <- "OpenSSH Agent not running"
+			upstreamHealth := PageantProxy.Health.Get(HEALTH_UPSTREAM)
+			probe, err := ProbeAgent(PageantProxy.UpstreamAddress(), AGENT_PROBE_TIMEOUT)
+			if err != nil {
+				Logger.Error("OpenSSH Agent probe of %v failed. Error: %v", PageantProxy.UpstreamAddress(), err)
+				upstreamHealth.RecordFailure(err)
+				output <- fmt.Sprintf("OpenSSH Agent not responding. Error: %v", err)
+				ManagedAgent.EnsureUpstream()
 			} else {
-				output <- "OK"
+				upstreamHealth.RecordSuccess()
+				output <- "OK: " + probe.String()
 			}
 
 			go func() {
@@ -685,20 +946,25 @@ func (app *UIAppType) CheckPageantProxyHealth() <-chan string {
 	go func() {
 		timeoutchan := make(chan bool)
 		for {
-			pageantProxyOk := (PageantProxy.NamedPipe_OK && PageantProxy.WM_CopyData_OK)
+			pageantProxyOk := PageantProxy.IsHealthy()
 			if !pageantProxyOk {
 				errorMsg := ""
-				if !PageantProxy.NamedPipe_OK {
-					errorMsg = errorMsg + "| NamedPipe proxy has errors"
+				for _, snapshot := range PageantProxy.Health.Snapshots() {
+					if snapshot.State != HEALTH_STATE_OK {
+						errorMsg = errorMsg + "| " + snapshot.String()
+					}
 				}
 
-				if !PageantProxy.WM_CopyData_OK {
-					errorMsg = errorMsg + "| WM_CopyData proxy has errors"
+				for _, stats := range PageantProxy.SupervisorStats() {
+					if stats.Restarts > 0 {
+						errorMsg = errorMsg + fmt.Sprintf("| %v restarted %v times, last failure: %v", stats.Name, stats.Restarts, stats.LastFailure)
+					}
 				}
 				output <- errorMsg
 			} else {
 				output <- "OK"
 			}
+			app.SetTrayToolTip("WinSSH Pageant Proxy: " + PageantProxy.Health.Summary())
 
 			go func() {
 				<-time.After(PAGEANT_PROXY_CHECK_DURATION)
@@ -721,6 +987,14 @@ func (app *UIAppType) SetTrayIcon(icon *walk.Icon) error {
 	return app.trayIcon.SetIcon(icon)
 }
 
+func (app *UIAppType) SetTrayToolTip(text string) error {
+	// the notification area does not show longer tool tips
+	if len(text) > TRAY_TOOLTIP_MAX_LENGTH {
+		text = text[:TRAY_TOOLTIP_MAX_LENGTH-3] + "..."
+	}
+	return app.trayIcon.SetToolTip(text)
+}
+
 func (app *UIAppType) ErrorMsgBox(message string) {
 	app.MsgBox("ERROR", message)
 }
@@ -755,6 +1029,16 @@ func (app *UIAppType) PushErrNoti(format string, v ...interface{}) {
 
 func (app *UIAppType) PushNoti(msgtype string, format string, v ...interface{}) {
 	message := fmt.Sprintf(format, v...)
+	if notify := currentNotifier(); notify != nil {
+		notify(msgtype, message)
+		return
+	}
+	if app.trayIcon == nil {
+		// e.g. before the UI is initialized
+		Logger.Info("AppMain: no tray icon to show %v notification: %v", msgtype, message)
+		return
+	}
+
 	if msgtype == "INFO" {
 		go app.trayIcon.ShowInfo(APP_NAME, message)
 	}
@@ -821,7 +1105,7 @@ func (app *UIAppType) CheckStepCliConfiguration() {
 		}
 		return
 	} else {
-		if stepErr == STEPERR_STEPCA_NOT_CONFIGURED {
+		if errors.Is(stepErr, STEPERR_STEPCA_NOT_CONFIGURED) {
 			walk.MsgBox(app.mainWindow, APP_NAME+": Error", "StepCli have not been configured for your user. Please configured it manually using 'Config StepCli' in tray menu!", walk.MsgBoxIconError|walk.MsgBoxOK)
 			return
 		} else {
@@ -859,6 +1143,10 @@ func (NonEmpty) Create() (walk.Validator, error) {
 }
 
 func (app *UIAppType) CleanUp() {
+	CertRenewal.Stop()
+	ManagedAgent.Stop()
+	Capture.Close()
+
 	Logger.Info("Cleaning up UI app resource")
 	if app.dashboardDlg != nil {
 		app.dashboardDlg.Dispose()
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CAPTURE_FILE_NAME = "agent-capture.jsonl"
+	CAPTURE_FILE_MODE = 0600
+)
+
+// CaptureRecordType is one line of a capture file: a request, the response to it and how long it took.
+// Request and Response are redacted frames, Redacted lists what was removed from them.
+type CaptureRecordType struct {
+	Time           time.Time
+	DurationMicros int64
+	Upstream       string
+	Request        []byte   `json:",omitempty"`
+	Response       []byte   `json:",omitempty"`
+	Error          string   `json:",omitempty"`
+	Redacted       []string `json:",omitempty"`
+}
+
+// CaptureType appends the agent traffic passing through the proxy to a capture file, while
+// Configs.CaptureEnabled is set. Private keys, passphrases, signed data and signatures are never written.
+type CaptureType struct {
+	mu   sync.Mutex
+	file *os.File
+	path string
+}
+
+var (
+	Capture *CaptureType = &CaptureType{}
+)
+
+// Path is the capture file, under APP_LOGS_DIR unless configured otherwise
+func (c *CaptureType) Path() string {
+	if Configs.CaptureFile != "" {
+		return Configs.CaptureFile
+	}
+	return filepath.Join(APP_LOGS_DIR, CAPTURE_FILE_NAME)
+}
+
+func (c *CaptureType) Record(upstream string, request []byte, response []byte, duration time.Duration, err error) {
+	if !Configs.CaptureEnabled {
+		return
+	}
+
+	record := CaptureRecordType{
+		Time:           time.Now().Add(-duration),
+		DurationMicros: duration.Microseconds(),
+		Upstream:       upstream,
+	}
+	var redacted []string
+	record.Request, redacted = RedactAgentFrame(request, false)
+	record.Redacted = append(record.Redacted, redacted...)
+	if response != nil {
+		record.Response, redacted = RedactAgentFrame(response, true)
+		record.Redacted = append(record.Redacted, redacted...)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		Logger.Error("Capture: failed to marshal capture record. Error: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.Path()
+	if c.file == nil || c.path != path {
+		c.closeFile()
+		c.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, CAPTURE_FILE_MODE)
+		if err != nil {
+			c.file = nil
+			Logger.Error("Capture: failed to open capture file %v. Error: %v", path, err)
+			return
+		}
+		c.path = path
+		Logger.Info("Capture: recording agent traffic to %v", path)
+	}
+	if _, err = c.file.Write(append(line, '\n')); err != nil {
+		Logger.Error("Capture: failed to write capture file %v. Error: %v", path, err)
+	}
+}
+
+func (c *CaptureType) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeFile()
+}
+
+func (c *CaptureType) closeFile() {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// RedactAgentFrame returns a copy of an agent message without secrets, and what was taken out.
+// Public keys, comments, flags and extension names are kept, so the capture can still be decoded.
+// Messages that cannot be parsed keep only their type.
+func RedactAgentFrame(frame []byte, isResponse bool) ([]byte, []string) {
+	if len(frame) < 5 {
+		return frame, nil
+	}
+	messageType := frame[4]
+	reader := &agentWireReader{buf: frame[5:]}
+	body := []byte{messageType}
+	redacted := []string{}
+
+	switch {
+	case !isResponse && messageType == SSH_AGENTC_SIGN_REQUEST:
+		keyBlob := reader.readString("key blob")
+		data := reader.readString("data")
+		flags := reader.readUint32("flags")
+		body = appendAgentString(body, keyBlob)
+		body = appendAgentString(body, nil)
+		body = appendAgentUint32(body, flags)
+		redacted = append(redacted, fmt.Sprintf("signed data (%v bytes)", len(data)))
+
+	case !isResponse && (messageType == SSH_AGENTC_ADD_IDENTITY || messageType == SSH_AGENTC_ADD_ID_CONSTRAINED):
+		keyType := reader.readString("key type")
+		secret := reader.rest()
+		body = appendAgentString(body, keyType)
+		redacted = append(redacted, fmt.Sprintf("private key, comment and constraints (%v bytes)", len(secret)))
+
+	case !isResponse && (messageType == SSH_AGENTC_ADD_SMARTCARD_KEY || messageType == SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED ||
+		messageType == SSH_AGENTC_REMOVE_SMARTCARD_KEY):
+		readerId := reader.readString("reader id")
+		secret := reader.rest()
+		body = appendAgentString(body, readerId)
+		redacted = append(redacted, fmt.Sprintf("PIN and constraints (%v bytes)", len(secret)))
+
+	case !isResponse && (messageType == SSH_AGENTC_LOCK || messageType == SSH_AGENTC_UNLOCK):
+		secret := reader.rest()
+		redacted = append(redacted, fmt.Sprintf("passphrase (%v bytes)", len(secret)))
+
+	case !isResponse && messageType == SSH_AGENTC_EXTENSION:
+		name := reader.readString("extension name")
+		contents := reader.rest()
+		body = appendAgentString(body, name)
+		if len(contents) > 0 {
+			redacted = append(redacted, fmt.Sprintf("extension contents (%v bytes)", len(contents)))
+		}
+
+	case !isResponse && (messageType == SSH_AGENTC_REQUEST_IDENTITIES || messageType == SSH_AGENTC_REMOVE_IDENTITY ||
+		messageType == SSH_AGENTC_REMOVE_ALL_IDENTITIES):
+		body = append(body, reader.rest()...)
+
+	case isResponse && messageType == SSH_AGENT_SIGN_RESPONSE:
+		signature := reader.readString("signature")
+		signatureReader := &agentWireReader{buf: signature}
+		format := signatureReader.readString("signature format")
+		blob := signatureReader.readString("signature blob")
+		body = appendAgentString(body, appendAgentString(nil, format))
+		redacted = append(redacted, fmt.Sprintf("signature (%v bytes)", len(blob)))
+		if reader.err == nil {
+			reader.err = signatureReader.err
+		}
+
+	case isResponse && (messageType == SSH_AGENT_IDENTITIES_ANSWER || messageType == SSH_AGENT_FAILURE ||
+		messageType == SSH_AGENT_EXTENSION_FAILURE):
+		body = append(body, reader.rest()...)
+
+	default:
+		// includes SSH_AGENT_SUCCESS, which carries the extension specific reply of SSH_AGENTC_EXTENSION
+		contents := reader.rest()
+		if len(contents) > 0 {
+			redacted = append(redacted, fmt.Sprintf("contents of %v (%v bytes)", AgentMessageName(messageType), len(contents)))
+		}
+	}
+
+	if reader.err != nil {
+		return frameAgentMessage([]byte{messageType}), []string{fmt.Sprintf("malformed %v (%v bytes)", AgentMessageName(messageType), len(frame))}
+	}
+	return frameAgentMessage(body), redacted
+}
+
+// DecodeCapture pretty-prints every record of a capture file
+func DecodeCapture(reader io.Reader, writer io.Writer) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*AGENT_MAX_MESSAGE_LENGTH)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		record := CaptureRecordType{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return fmt.Errorf("line %v: %w", lineNumber, err)
+		}
+
+		duration := time.Duration(record.DurationMicros) * time.Microsecond
+		fmt.Fprintf(writer, "%v  %v  upstream %v\n", record.Time.Local().Format("2006-01-02 15:04:05.000"), duration, record.Upstream)
+		fmt.Fprintf(writer, "  > %v\n", describeAgentFrame(record.Request, false))
+		if record.Response != nil {
+			fmt.Fprintf(writer, "  < %v\n", describeAgentFrame(record.Response, true))
+		}
+		if record.Error != "" {
+			fmt.Fprintf(writer, "  ! %v\n", record.Error)
+		}
+		for _, redacted := range record.Redacted {
+			fmt.Fprintf(writer, "  # redacted %v\n", redacted)
+		}
+	}
+	return scanner.Err()
+}
+
+func describeAgentFrame(frame []byte, isResponse bool) string {
+	if len(frame) < 5 {
+		return fmt.Sprintf("<%v bytes, no message>", len(frame))
+	}
+	messageType := frame[4]
+	reader := &agentWireReader{buf: frame[5:]}
+	text := AgentMessageName(messageType)
+
+	switch {
+	case !isResponse && messageType == SSH_AGENTC_SIGN_REQUEST:
+		keyBlob := reader.readString("key blob")
+		reader.readString("data")
+		flags := reader.readUint32("flags")
+		text += fmt.Sprintf(" key=%v %v flags=%v", KeyTypeOf(keyBlob), KeyFingerprint(keyBlob), describeSignFlags(flags))
+
+	case !isResponse && messageType == SSH_AGENTC_REMOVE_IDENTITY:
+		keyBlob := reader.readString("key blob")
+		text += fmt.Sprintf(" key=%v %v", KeyTypeOf(keyBlob), KeyFingerprint(keyBlob))
+
+	case !isResponse && (messageType == SSH_AGENTC_ADD_IDENTITY || messageType == SSH_AGENTC_ADD_ID_CONSTRAINED):
+		text += fmt.Sprintf(" type=%v", string(reader.readString("key type")))
+
+	case !isResponse && (messageType == SSH_AGENTC_ADD_SMARTCARD_KEY || messageType == SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED ||
+		messageType == SSH_AGENTC_REMOVE_SMARTCARD_KEY):
+		text += fmt.Sprintf(" reader=%q", reader.readString("reader id"))
+
+	case !isResponse && messageType == SSH_AGENTC_EXTENSION:
+		text += fmt.Sprintf(" name=%v", string(reader.readString("extension name")))
+
+	case isResponse && messageType == SSH_AGENT_IDENTITIES_ANSWER:
+		count := reader.readUint32("key count")
+		text += fmt.Sprintf(" %v keys", count)
+		for i := uint32(0); i < count && reader.err == nil; i++ {
+			keyBlob := reader.readString("key blob")
+			comment := reader.readString("comment")
+			if reader.err == nil {
+				text += fmt.Sprintf("\n      %v %v %q", KeyTypeOf(keyBlob), KeyFingerprint(keyBlob), comment)
+			}
+		}
+
+	case isResponse && messageType == SSH_AGENT_SIGN_RESPONSE:
+		signatureReader := &agentWireReader{buf: reader.readString("signature")}
+		text += fmt.Sprintf(" format=%v", string(signatureReader.readString("signature format")))
+		if reader.err == nil {
+			reader.err = signatureReader.err
+		}
+	}
+
+	if reader.err != nil {
+		return fmt.Sprintf("%v <%v>", AgentMessageName(messageType), reader.err)
+	}
+	return text
+}
+
+func describeSignFlags(flags uint32) string {
+	names := []string{}
+	if flags&SSH_AGENT_RSA_SHA2_256 != 0 {
+		names = append(names, "rsa-sha2-256")
+		flags &^= SSH_AGENT_RSA_SHA2_256
+	}
+	if flags&SSH_AGENT_RSA_SHA2_512 != 0 {
+		names = append(names, "rsa-sha2-512")
+		flags &^= SSH_AGENT_RSA_SHA2_512
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("0x%x", flags))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestCapture records to a capture file in a temporary directory
+func useTestCapture(t *testing.T) string {
+	useTestConfigs(t)
+	t.Cleanup(Capture.Close)
+	Configs.CaptureEnabled = true
+	Configs.CaptureFile = filepath.Join(t.TempDir(), CAPTURE_FILE_NAME)
+	return Configs.CaptureFile
+}
+
+func agentTestMessage(messageType byte, fields ...[]byte) []byte {
+	body := []byte{messageType}
+	for _, field := range fields {
+		body = append(body, field...)
+	}
+	return frameAgentMessage(body)
+}
+
+func TestCaptureRedactsSecrets(t *testing.T) {
+	path := useTestCapture(t)
+	keyBlob := readTestPublicKey(t, "ed25519").Marshal()
+	secret := func(name string) []byte { return []byte("SECRET-" + name) }
+	str := func(value []byte) []byte { return appendAgentString(nil, value) }
+	privateKey := append(append(str(keyBlob[19:]), str(secret("PRIVATE-KEY"))...), str([]byte("alice@example.com"))...)
+	signature := str(append(str([]byte("ssh-ed25519")), str(secret("SIGNATURE"))...))
+	identities := append(appendAgentUint32(nil, 1), append(str(keyBlob), str([]byte("alice@example.com"))...)...)
+
+	tests := []struct {
+		name     string
+		request  []byte
+		response []byte
+		redacted []string
+		decoded  []string
+	}{
+		{"sign", agentTestMessage(SSH_AGENTC_SIGN_REQUEST, str(keyBlob), str(secret("SIGN-DATA")), appendAgentUint32(nil, SSH_AGENT_RSA_SHA2_256)),
+			agentTestMessage(SSH_AGENT_SIGN_RESPONSE, signature),
+			[]string{"signed data (16 bytes)", "signature (16 bytes)"},
+			[]string{"> SSH_AGENTC_SIGN_REQUEST key=ssh-ed25519 " + KeyFingerprint(keyBlob) + " flags=rsa-sha2-256", "< SSH_AGENT_SIGN_RESPONSE format=ssh-ed25519"}},
+		{"add identity", agentTestMessage(SSH_AGENTC_ADD_IDENTITY, str([]byte("ssh-ed25519")), privateKey),
+			agentTestMessage(SSH_AGENT_SUCCESS),
+			[]string{"private key, comment and constraints"},
+			[]string{"> SSH_AGENTC_ADD_IDENTITY type=ssh-ed25519", "< SSH_AGENT_SUCCESS"}},
+		{"add constrained identity", agentTestMessage(SSH_AGENTC_ADD_ID_CONSTRAINED, str([]byte("ssh-ed25519")), privateKey, []byte{SSH_AGENT_CONSTRAIN_LIFETIME}, appendAgentUint32(nil, 60)),
+			agentTestMessage(SSH_AGENT_SUCCESS),
+			[]string{"private key, comment and constraints"},
+			[]string{"> SSH_AGENTC_ADD_ID_CONSTRAINED type=ssh-ed25519"}},
+		{"add smartcard key", agentTestMessage(SSH_AGENTC_ADD_SMARTCARD_KEY, str([]byte("opensc-pkcs11.dll")), str(secret("PIN"))),
+			agentTestMessage(SSH_AGENT_FAILURE),
+			[]string{"PIN and constraints (14 bytes)"},
+			[]string{`> SSH_AGENTC_ADD_SMARTCARD_KEY reader="opensc-pkcs11.dll"`, "< SSH_AGENT_FAILURE"}},
+		{"remove smartcard key", agentTestMessage(SSH_AGENTC_REMOVE_SMARTCARD_KEY, str([]byte("opensc-pkcs11.dll")), str(secret("PIN"))),
+			agentTestMessage(SSH_AGENT_SUCCESS),
+			[]string{"PIN and constraints (14 bytes)"},
+			[]string{`> SSH_AGENTC_REMOVE_SMARTCARD_KEY reader="opensc-pkcs11.dll"`}},
+		{"lock", agentTestMessage(SSH_AGENTC_LOCK, str(secret("LOCK"))), agentTestMessage(SSH_AGENT_SUCCESS),
+			[]string{"passphrase (15 bytes)"}, []string{"> SSH_AGENTC_LOCK"}},
+		{"unlock", agentTestMessage(SSH_AGENTC_UNLOCK, str(secret("UNLOCK"))), agentTestMessage(SSH_AGENT_SUCCESS),
+			[]string{"passphrase (17 bytes)"}, []string{"> SSH_AGENTC_UNLOCK"}},
+		{"extension", agentTestMessage(SSH_AGENTC_EXTENSION, str([]byte("session-bind@openssh.com")), str(secret("SESSION-ID"))),
+			agentTestMessage(SSH_AGENT_SUCCESS, secret("EXTENSION-REPLY")),
+			[]string{"extension contents (21 bytes)", "contents of SSH_AGENT_SUCCESS (22 bytes)"},
+			[]string{"> SSH_AGENTC_EXTENSION name=session-bind@openssh.com"}},
+		{"malformed sign", agentTestMessage(SSH_AGENTC_SIGN_REQUEST, str(keyBlob), appendAgentUint32(nil, 100), secret("SIGN-DATA")), nil,
+			[]string{"malformed SSH_AGENTC_SIGN_REQUEST"},
+			[]string{"> SSH_AGENTC_SIGN_REQUEST"}},
+		{"identities", agentTestMessage(SSH_AGENTC_REQUEST_IDENTITIES), agentTestMessage(SSH_AGENT_IDENTITIES_ANSWER, identities),
+			[]string{},
+			[]string{"> SSH_AGENTC_REQUEST_IDENTITIES", "< SSH_AGENT_IDENTITIES_ANSWER 1 keys", `ssh-ed25519 ` + KeyFingerprint(keyBlob) + ` "alice@example.com"`}},
+	}
+	for _, test := range tests {
+		Capture.Record("upstream.sock", test.request, test.response, time.Millisecond, nil)
+	}
+	Capture.Record("upstream.sock", agentTestMessage(SSH_AGENTC_REQUEST_IDENTITIES), nil, time.Second, errors.New("connection refused"))
+	Capture.Close()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != len(tests)+1 {
+		t.Fatalf("%v records, expected %v", len(lines), len(tests)+1)
+	}
+	for i, test := range tests {
+		record := CaptureRecordType{}
+		if err = json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range [][]byte{record.Request, record.Response, []byte(lines[i])} {
+			if bytes.Contains(frame, []byte("SECRET-")) {
+				t.Errorf("%v: a secret was captured: %q", test.name, frame)
+			}
+		}
+		if len(record.Redacted) != len(test.redacted) {
+			t.Errorf("%v: redacted %q, expected %q", test.name, record.Redacted, test.redacted)
+			continue
+		}
+		for j, redacted := range test.redacted {
+			if !strings.HasPrefix(record.Redacted[j], redacted) {
+				t.Errorf("%v: redacted %q, expected %q", test.name, record.Redacted[j], redacted)
+			}
+		}
+	}
+
+	// a capture decodes to what was sent, without the secrets
+	decoded := &bytes.Buffer{}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err = DecodeCapture(file, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(decoded.String(), "SECRET-") {
+		t.Errorf("a secret was decoded:\n%v", decoded)
+	}
+	for _, test := range tests {
+		for _, text := range append(test.decoded, test.redacted...) {
+			if !strings.Contains(decoded.String(), text) {
+				t.Errorf("%v: %q not decoded in\n%v", test.name, text, decoded)
+			}
+		}
+	}
+	if !strings.Contains(decoded.String(), "1s  upstream upstream.sock\n  > SSH_AGENTC_REQUEST_IDENTITIES\n  ! connection refused\n") {
+		t.Errorf("failed request not decoded in\n%v", decoded)
+	}
+}
+
+func TestCaptureDisabled(t *testing.T) {
+	path := useTestCapture(t)
+	Configs.CaptureEnabled = false
+	Capture.Record("upstream.sock", agentTestMessage(SSH_AGENTC_REQUEST_IDENTITIES), nil, time.Millisecond, nil)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("capture file written while disabled: %v", err)
+	}
+}
+
+func TestDecodeCaptureInvalidLine(t *testing.T) {
+	err := DecodeCapture(strings.NewReader("\n{\"Upstream\": \"a\"}\nnot json\n"), ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("err = %v, expected one for line 3", err)
+	}
+}
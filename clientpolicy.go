@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const CLIENT_POLICY_HASH_PREFIX = "sha256:"
+
+// ClientPolicyType decides which client executables may talk to the proxy, based on ClientAllowList/ClientDenyList in Configs.
+type ClientPolicyType struct{}
+
+var (
+	ClientPolicy *ClientPolicyType = &ClientPolicyType{}
+)
+
+// Evaluate returns nil when the executable may use the proxy.
+// The denylist wins over the allowlist, an empty allowlist allows everything not denied.
+func (cp *ClientPolicyType) Evaluate(executable string) error {
+	allowList, denyList := Configs.ClientAllowList, Configs.ClientDenyList
+	if len(allowList) == 0 && len(denyList) == 0 {
+		return nil
+	}
+
+	if executable == "" {
+		return PROXYERR_CLIENT_UNKNOWN_EXECUTABLE
+	}
+
+	if cp.matchesAny(executable, denyList) {
+		return PROXYERR_CLIENT_DENIED
+	}
+
+	if len(allowList) > 0 && !cp.matchesAny(executable, allowList) {
+		return PROXYERR_CLIENT_NOT_ALLOWED
+	}
+	return nil
+}
+
+func (cp *ClientPolicyType) matchesAny(executable string, entries []string) bool {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(entry), CLIENT_POLICY_HASH_PREFIX) {
+			hash, err := cp.executableHash(executable)
+			if err != nil {
+				Logger.Error("ClientPolicy: failed to hash executable %v. Error: %v", executable, err)
+				continue
+			}
+			if strings.EqualFold(strings.TrimSpace(entry[len(CLIENT_POLICY_HASH_PREFIX):]), hash) {
+				return true
+			}
+			continue
+		}
+
+		if matchExecutableGlob(entry, executable) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchExecutableGlob matches case-insensitively against the full path and against the file name only,
+// so both "putty.exe" and `C:\Program Files\PuTTY\*.exe` work as patterns.
+func matchExecutableGlob(pattern string, executable string) bool {
+	pattern = strings.ToLower(pattern)
+	executable = strings.ToLower(executable)
+
+	if ok, _ := filepath.Match(pattern, executable); ok {
+		return true
+	}
+	ok, _ := filepath.Match(pattern, filepath.Base(executable))
+	return ok
+}
+
+// executableHash hashes the executable on every check. Size and times of a file can be restored after it
+// was replaced, even its change time on Windows, so they cannot tell whether a cached hash is still right.
+func (cp *ClientPolicyType) executableHash(executable string) (string, error) {
+	file, err := os.Open(executable)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestClientLists sets the client lists until the test ends
+func useTestClientLists(t *testing.T, allowList []string, denyList []string) {
+	previousAllowList, previousDenyList := Configs.ClientAllowList, Configs.ClientDenyList
+	t.Cleanup(func() { Configs.ClientAllowList, Configs.ClientDenyList = previousAllowList, previousDenyList })
+	Configs.ClientAllowList, Configs.ClientDenyList = allowList, denyList
+}
+
+func TestClientPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowList  []string
+		denyList   []string
+		executable string
+		err        error
+	}{
+		{"no lists", nil, nil, "", nil},
+		{"allowed file name", []string{"putty.exe"}, nil, filepath.Join("PuTTY", "PUTTY.EXE"), nil},
+		{"allowed path", []string{filepath.Join("PuTTY", "*.exe")}, nil, filepath.Join("PuTTY", "plink.exe"), nil},
+		{"not allowed", []string{"putty.exe"}, nil, filepath.Join("Tools", "script.exe"), PROXYERR_CLIENT_NOT_ALLOWED},
+		{"denied", nil, []string{"script.exe"}, filepath.Join("Tools", "script.exe"), PROXYERR_CLIENT_DENIED},
+		{"denylist wins", []string{"*.exe"}, []string{"script.exe"}, filepath.Join("Tools", "script.exe"), PROXYERR_CLIENT_DENIED},
+		{"only denylist", nil, []string{"script.exe"}, filepath.Join("PuTTY", "putty.exe"), nil},
+		// e.g. a WM_COPYDATA client
+		{"unknown", []string{"putty.exe"}, nil, "", PROXYERR_CLIENT_UNKNOWN_EXECUTABLE},
+		{"unknown with denylist", nil, []string{"script.exe"}, "", PROXYERR_CLIENT_UNKNOWN_EXECUTABLE},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestClientLists(t, test.allowList, test.denyList)
+			if err := ClientPolicy.Evaluate(test.executable); !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+				t.Errorf("err = %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestClientPolicyHashOfReplacedExecutable(t *testing.T) {
+	executable := filepath.Join(t.TempDir(), "putty.exe")
+	original := []byte("the allowlisted client")
+	if err := ioutil.WriteFile(executable, original, 0700); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(original)
+	useTestClientLists(t, []string{CLIENT_POLICY_HASH_PREFIX + hex.EncodeToString(hash[:])}, nil)
+
+	if err := ClientPolicy.Evaluate(executable); err != nil {
+		t.Fatalf("allowlisted executable: %v", err)
+	}
+
+	// same size and modification time, other content
+	info, err := os.Stat(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(executable, []byte("a replaced executable!"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(executable, time.Now(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err = ClientPolicy.Evaluate(executable); !errors.Is(err, PROXYERR_CLIENT_NOT_ALLOWED) {
+		t.Errorf("replaced executable: err = %v, expected %v", err, PROXYERR_CLIENT_NOT_ALLOWED)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// CommandRunType is one program run. Argv[0] is the program and is looked up in PATH, the arguments are
+// passed as they are, no shell is involved. Env is added to the environment of this process, or replaces
+// it when ClearEnv is set.
+type CommandRunType struct {
+	Argv     []string `json:"argv"`
+	Stdin    string   `json:"stdin,omitempty"`
+	Env      []string `json:"env,omitempty"`
+	ClearEnv bool     `json:"clearEnv,omitempty"`
+}
+
+// CommandResultType is what a program printed and how it exited
+type CommandResultType struct {
+	Stdout   StdOut `json:"stdout"`
+	Stderr   StdErr `json:"stderr"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// CommandRunner runs programs. err is only set when the program could not run at all,
+// a program that exits with a non-zero code reports it in ExitCode.
+type CommandRunner interface {
+	Run(command CommandRunType) (CommandResultType, error)
+}
+
+func (c CommandRunType) String() string {
+	quoted := make([]string, len(c.Argv))
+	for i, arg := range c.Argv {
+		quoted[i] = arg
+		if arg == "" || strings.ContainsAny(arg, " \t\"&|<>^%") {
+			quoted[i] = fmt.Sprintf("%q", arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ExecCommandRunnerType runs programs with os/exec, without a console window
+type ExecCommandRunnerType struct{}
+
+var ExecCommandRunner *ExecCommandRunnerType = &ExecCommandRunnerType{}
+
+func (r *ExecCommandRunnerType) Run(command CommandRunType) (CommandResultType, error) {
+	if len(command.Argv) == 0 {
+		return CommandResultType{}, CMDERR_EMPTY_COMMAND
+	}
+
+	cmd := exec.Command(command.Argv[0], command.Argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Stdin = strings.NewReader(command.Stdin)
+	if command.ClearEnv {
+		cmd.Env = command.Env
+	} else if len(command.Env) > 0 {
+		cmd.Env = append(os.Environ(), command.Env...)
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	result := CommandResultType{Stdout: StdOut(stdout.String()), Stderr: StdErr(stderr.String())}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		Logger.Error("Command '%v' exited with code %v. StdErr: %v", command, result.ExitCode, result.Stderr)
+		return result, nil
+	}
+	if err != nil {
+		Logger.Error("Failed to run command '%v'. Error: %v", command, err)
+		return result, fmt.Errorf("%w: %v", CMDERR_EXECUTION_FAILED, err)
+	}
+	return result, nil
+}
+
+// CommandRecordType is one recorded run, as replayed by ReplayCommandRunnerType
+type CommandRecordType struct {
+	Command CommandRunType    `json:"command"`
+	Result  CommandResultType `json:"result"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// RecordingCommandRunnerType runs programs with Runner and remembers every run, Save writes them in the
+// format ReplayCommandRunnerType reads
+type RecordingCommandRunnerType struct {
+	Runner CommandRunner
+
+	mu      sync.Mutex
+	records []CommandRecordType
+}
+
+func NewRecordingCommandRunner(runner CommandRunner) *RecordingCommandRunnerType {
+	return &RecordingCommandRunnerType{Runner: runner}
+}
+
+func (r *RecordingCommandRunnerType) Run(command CommandRunType) (CommandResultType, error) {
+	result, err := r.Runner.Run(command)
+	record := CommandRecordType{Command: command, Result: result}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	r.records = append(r.records, record)
+	r.mu.Unlock()
+	return result, err
+}
+
+func (r *RecordingCommandRunnerType) Save(writer io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r.records)
+}
+
+// ReplayCommandRunnerType answers runs from a recording instead of running programs. The runs must come
+// in the recorded order with the recorded arguments and stdin, anything else is an error.
+type ReplayCommandRunnerType struct {
+	mu      sync.Mutex
+	records []CommandRecordType
+}
+
+func NewReplayCommandRunner(records []CommandRecordType) *ReplayCommandRunnerType {
+	return &ReplayCommandRunnerType{records: records}
+}
+
+// LoadReplayCommandRunner reads a recording saved by RecordingCommandRunnerType
+func LoadReplayCommandRunner(reader io.Reader) (*ReplayCommandRunnerType, error) {
+	records := []CommandRecordType{}
+	if err := json.NewDecoder(reader).Decode(&records); err != nil {
+		return nil, fmt.Errorf("cannot read command recording: %w", err)
+	}
+	return NewReplayCommandRunner(records), nil
+}
+
+func (r *ReplayCommandRunnerType) Run(command CommandRunType) (CommandResultType, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.records) == 0 {
+		return CommandResultType{}, fmt.Errorf("%w: %v", CMDERR_RECORDING_EXHAUSTED, command)
+	}
+	record := r.records[0]
+	if !reflect.DeepEqual(record.Command.Argv, command.Argv) || record.Command.Stdin != command.Stdin {
+		return CommandResultType{}, fmt.Errorf("%w: expected '%v', got '%v'", CMDERR_UNEXPECTED_COMMAND, record.Command, command)
+	}
+	r.records = r.records[1:]
+
+	if record.Error != "" {
+		return record.Result, errors.New(record.Error)
+	}
+	return record.Result, nil
+}
+
+// Remaining is the number of recorded runs that were not replayed yet
+func (r *ReplayCommandRunnerType) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.records)
+}
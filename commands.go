@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	COMMAND_EXIT_OK    = 0
+	COMMAND_EXIT_ERROR = 1
+	COMMAND_EXIT_USAGE = 2
+)
+
+var COMMAND_ERR_USAGE = errors.New("invalid arguments")
+
+// CommandType is a subcommand run from a console, e.g. "winssh-pageant-ui.exe decode-capture <file>",
+// instead of starting the tray application.
+type CommandType struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(args []string, stdout io.Writer) error
+}
+
+var COMMANDS = []CommandType{
+	{
+		Name:        "decode-capture",
+		Usage:       "decode-capture <capture file>",
+		Description: "print a capture recorded with CaptureEnabled",
+		Run:         runDecodeCapture,
+	},
+	{
+		Name:        "doctor",
+		Usage:       "doctor [--json]",
+		Description: "check the agent chain from ssh-agent to the step CA",
+		Run:         runDoctor,
+	},
+	{
+		Name:        "import-ppk",
+		Usage:       "import-ppk [--lifetime <seconds>] [--confirm] <ppk file>",
+		Description: "add the key of a PuTTY private key file to the agent",
+		Run:         runImportPpk,
+	},
+	{
+		Name:        "convert-key",
+		Usage:       "convert-key [--to ppk|openssh|authorized-keys|rfc4716] [--ppk-version 2|3] [--encrypt] [--out <file>] <key file>",
+		Description: "convert between PuTTY and OpenSSH key formats, or export the public key",
+		Run:         runConvertKey,
+	},
+}
+
+// RunCommand runs the subcommand named by args[0] and returns the exit code of the process
+func RunCommand(args []string) int {
+	attachParentConsole()
+
+	for _, command := range COMMANDS {
+		if command.Name != args[0] {
+			continue
+		}
+
+		Logger.Info("Commands: running %v", args)
+		err := command.Run(args[1:], os.Stdout)
+		if errors.Is(err, COMMAND_ERR_USAGE) {
+			fmt.Fprintf(os.Stderr, "usage: %v %v\n", APP_NAME, command.Usage)
+			return COMMAND_EXIT_USAGE
+		}
+		if err != nil {
+			Logger.Error("Commands: %v failed. Error: %v", command.Name, err)
+			fmt.Fprintf(os.Stderr, "%v: %v\n", command.Name, err)
+			return COMMAND_EXIT_ERROR
+		}
+		return COMMAND_EXIT_OK
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q, available commands:\n", args[0])
+	for _, command := range COMMANDS {
+		fmt.Fprintf(os.Stderr, "  %-60v%v\n", command.Usage, command.Description)
+	}
+	return COMMAND_EXIT_USAGE
+}
+
+// attachParentConsole makes output visible in the console we were started from. The application is
+// built as a GUI program, which has no console of its own. Redirected output is left alone.
+func attachParentConsole() {
+	handle, err := windows.GetStdHandle(windows.STD_OUTPUT_HANDLE)
+	if err == nil && handle != 0 && handle != windows.InvalidHandle {
+		return
+	}
+
+	r1, _, err := PROC_ATTACH_CONSOLE.Call(ATTACH_PARENT_PROCESS)
+	if r1 == 0 {
+		Logger.Error("Commands: failed to attach to parent console. Error: %v", err)
+		return
+	}
+
+	console, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+	if err != nil {
+		Logger.Error("Commands: failed to open console output. Error: %v", err)
+		return
+	}
+	os.Stdout = console
+	os.Stderr = console
+	// the prompt of the parent shell was already printed, start on a fresh line
+	fmt.Fprintln(console)
+}
+
+func runDecodeCapture(args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return COMMAND_ERR_USAGE
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return DecodeCapture(file, stdout)
+}
+
+func runDoctor(args []string, stdout io.Writer) error {
+	asJson := false
+	for _, arg := range args {
+		switch arg {
+		case "--json":
+			asJson = true
+		default:
+			return COMMAND_ERR_USAGE
+		}
+	}
+
+	Configs.LoadConfigs()
+	report := RunDoctor()
+	if asJson {
+		if err := report.WriteJson(stdout); err != nil {
+			return err
+		}
+	} else {
+		report.WriteText(stdout)
+	}
+	return report.Failures()
+}
+
+func runImportPpk(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import-ppk", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	lifetime := flags.Uint("lifetime", 0, "")
+	confirm := flags.Bool("confirm", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return COMMAND_ERR_USAGE
+	}
+
+	content, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	Configs.LoadConfigs()
+	address := ConfiguredUpstreamAgent()
+	if _, err = ProbeAgent(address, AGENT_PROBE_TIMEOUT); err != nil && Configs.ManagedAgentEnabled {
+		address = ManagedAgent.Address()
+	}
+
+	constraints := AgentConstraintsType{LifetimeSecs: uint32(*lifetime), ConfirmBeforeUse: *confirm}
+	key, err := ImportPpk(content, address, constraints, promptConsolePassphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Added %v key '%v' (%v) to %v\n", key.Algorithm, key.Comment, KeyFingerprint(key.PublicBlob), address)
+	return nil
+}
+
+func runConvertKey(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("convert-key", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	format := flags.String("to", "", "")
+	ppkVersion := flags.Int("ppk-version", 3, "")
+	encrypt := flags.Bool("encrypt", false, "")
+	out := flags.String("out", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return COMMAND_ERR_USAGE
+	}
+
+	content, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	conversion := KeyConversionType{Format: *format, PpkVersion: *ppkVersion}
+	if conversion.Format == "" {
+		// without --to, a PuTTY key becomes an OpenSSH key and everything else a PuTTY key
+		conversion.Format = KEY_FORMAT_PPK
+		if isPpk(content) {
+			conversion.Format = KEY_FORMAT_OPENSSH
+		}
+	}
+	if !containsString(KEY_FORMATS, conversion.Format) || (*ppkVersion != 2 && *ppkVersion != 3) {
+		return COMMAND_ERR_USAGE
+	}
+
+	if *encrypt && (conversion.Format == KEY_FORMAT_PPK || conversion.Format == KEY_FORMAT_OPENSSH) {
+		passphrase, ok := promptConsolePassphrase("New passphrase", "New passphrase (empty for none):")
+		if !ok {
+			return PPKERR_PASSPHRASE_REQUIRED
+		}
+		confirmation, ok := promptConsolePassphrase("New passphrase", "Repeat the new passphrase:")
+		if !ok || confirmation != passphrase {
+			return KEYERR_PASSPHRASE_MISMATCH
+		}
+		conversion.Passphrase = []byte(passphrase)
+	}
+
+	converted, err := ConvertKey(content, conversion, promptConsolePassphrase)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = stdout.Write(converted)
+		return err
+	}
+
+	// never overwrite a key by accident
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(converted); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// promptConsolePassphrase reads a passphrase from the console without echoing it.
+// Input that is not a console, e.g. a pipe, is read as is.
+func promptConsolePassphrase(title string, message string) (string, bool) {
+	var mode uint32
+	stdin := windows.Handle(os.Stdin.Fd())
+	if stdin != 0 && stdin != windows.InvalidHandle && windows.GetConsoleMode(stdin, &mode) != nil {
+		return readPassphraseLine(os.Stdin)
+	}
+
+	input, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return readPassphraseLine(os.Stdin)
+	}
+	defer input.Close()
+
+	fmt.Fprintf(os.Stderr, "%v ", message)
+	handle := windows.Handle(input.Fd())
+	if err = windows.GetConsoleMode(handle, &mode); err == nil {
+		windows.SetConsoleMode(handle, mode&^windows.ENABLE_ECHO_INPUT)
+		defer windows.SetConsoleMode(handle, mode)
+	}
+	defer fmt.Fprintln(os.Stderr)
+
+	return readPassphraseLine(input)
+}
+
+// readPassphraseLine reads byte by byte, a buffered reader would swallow the passphrases piped in after this one
+func readPassphraseLine(reader io.Reader) (string, bool) {
+	line := strings.Builder{}
+	next := make([]byte, 1)
+	for {
+		n, err := reader.Read(next)
+		if n == 1 && next[0] == '\n' {
+			break
+		}
+		if n == 1 {
+			line.WriteByte(next[0])
+		}
+		if err != nil {
+			if line.Len() == 0 {
+				return "", false
+			}
+			break
+		}
+	}
+	return strings.TrimRight(line.String(), "\r"), true
+}
@@ -11,6 +11,85 @@ type ConfigType struct {
 	StepTeamName           string
 	StepDefaultProvisioner string
 	StepUsername           string
+
+	// Credentials of the non-OIDC provisioners. StepPasswordFile holds the JWK provisioner password, or the
+	// password of StepX5cKey; without it a JWK login asks for the password.
+	StepPasswordFile string
+	StepX5cCert      string
+	StepX5cKey       string
+	StepSshpopCert   string
+	StepSshpopKey    string
+	// OIDC provisioners log in through step ssh login instead of the built-in authorization code flow
+	StepCliOidcLogin bool
+
+	// Named CA profiles, e.g. production and staging. The Step* fields above hold the values of ActiveProfile.
+	Profiles      []StepProfileType
+	ActiveProfile string
+
+	// AF_UNIX socket the proxy additionally serves the agent protocol on. Empty disables it.
+	AgentSocketPath string
+
+	// Agent every request is forwarded to, a named pipe or an AF_UNIX socket path. Empty means the windows openssh-agent.
+	UpstreamAgent string
+
+	// Start and supervise an own ssh-agent when the upstream agent is not reachable. ManagedAgentArgs
+	// may contain {address}, which is replaced by ManagedAgentAddress (default: a socket in APP_HOME_DIR).
+	ManagedAgentEnabled bool
+	ManagedAgentExe     string
+	ManagedAgentArgs    []string
+	ManagedAgentAddress string
+
+	// Client executables allowed/denied to use the proxy. Entries are glob patterns matched against
+	// the full path or the file name, or "sha256:<hex>" hashes of the executable. WM_COPYDATA does not
+	// tell who sent a request, with either list set its clients (PuTTY, WinSCP) are rejected as unknown.
+	ClientAllowList []string
+	ClientDenyList  []string
+
+	// Largest request/response in bytes per transport, at most 256 KiB. WM_COPYDATA is further limited by the client's file map.
+	MaxMessageLengthNamedPipe  int
+	MaxMessageLengthUnixSocket int
+	MaxMessageLengthWMCopyData int
+
+	// Backpressure of the proxy: concurrent client sessions, concurrent upstream requests,
+	// and how many requests may queue for how long before they are answered with SSH_AGENT_FAILURE.
+	// An upstream request that is not answered within UpstreamRequestTimeoutSeconds fails.
+	MaxClientSessions             int
+	MaxInFlightRequests           int
+	RequestQueueLength            int
+	RequestQueueTimeoutSeconds    int
+	UpstreamRequestTimeoutSeconds int
+
+	// Restart policy of failed proxy listeners, exponential backoff between base and max seconds
+	ListenerMaxRestarts        int
+	ListenerBackoffBaseSeconds int
+	ListenerBackoffMaxSeconds  int
+
+	// Record the agent traffic through the proxy, redacted, to CaptureFile (default: a file in APP_LOGS_DIR).
+	// Decode it with "winssh-pageant-ui.exe decode-capture <file>".
+	CaptureEnabled bool
+	CaptureFile    string
+
+	// Encrypted PuTTY keys loaded through add-ppk are decrypted on first use. After this many seconds the
+	// decrypted key is removed from the upstream agent again and the next use asks for the passphrase. 0 keeps it.
+	ReencryptTimeoutSeconds int
+
+	// The user certificate is renewed at this percentage of its lifetime. Provisioners that need a browser
+	// login only announce the renewal, unless CertRenewalBrowserLogin allows opening the browser unasked.
+	CertRenewalDisabled     bool
+	CertRenewalPercent      int
+	CertRenewalBrowserLogin bool
+
+	// Keep a block of @cert-authority lines with the host CA keys of step-ca in KnownHostsPath (default:
+	// ~/.ssh/known_hosts), for the hosts matching KnownHostsPatterns (default: all hosts).
+	ManagedKnownHosts  bool
+	KnownHostsPath     string
+	KnownHostsPatterns []string
+
+	// Generate SshConfigPath (default: ~/.ssh/winssh-pageant-ui.conf) with a Host entry per host of step-ca,
+	// from SshConfigTemplateFile when set, and include it from ~/.ssh/config
+	ManagedSshConfig      bool
+	SshConfigPath         string
+	SshConfigTemplateFile string
 }
 
 var (
@@ -19,6 +98,53 @@ var (
 		StepTeamName:           "",
 		StepDefaultProvisioner: "",
 		StepUsername:           "",
+		StepPasswordFile:       "",
+		StepX5cCert:            "",
+		StepX5cKey:             "",
+		StepSshpopCert:         "",
+		StepSshpopKey:          "",
+		StepCliOidcLogin:       false,
+		Profiles:               nil,
+		ActiveProfile:          "",
+		AgentSocketPath:        "",
+		UpstreamAgent:          "",
+		ManagedAgentEnabled:    false,
+		ManagedAgentExe:        "",
+		ManagedAgentArgs:       nil,
+		ManagedAgentAddress:    "",
+		ClientAllowList:        nil,
+		ClientDenyList:         nil,
+
+		MaxMessageLengthNamedPipe:  AGENT_MAX_MESSAGE_LENGTH,
+		MaxMessageLengthUnixSocket: AGENT_MAX_MESSAGE_LENGTH,
+		MaxMessageLengthWMCopyData: AGENT_MAX_MESSAGE_LENGTH,
+
+		MaxClientSessions:             16,
+		MaxInFlightRequests:           4,
+		RequestQueueLength:            32,
+		RequestQueueTimeoutSeconds:    5,
+		UpstreamRequestTimeoutSeconds: 60,
+
+		ListenerMaxRestarts:        8,
+		ListenerBackoffBaseSeconds: 1,
+		ListenerBackoffMaxSeconds:  60,
+
+		CaptureEnabled: false,
+		CaptureFile:    "",
+
+		ReencryptTimeoutSeconds: 0,
+
+		CertRenewalDisabled:     false,
+		CertRenewalPercent:      75,
+		CertRenewalBrowserLogin: false,
+
+		ManagedKnownHosts:  false,
+		KnownHostsPath:     "",
+		KnownHostsPatterns: nil,
+
+		ManagedSshConfig:      false,
+		SshConfigPath:         "",
+		SshConfigTemplateFile: "",
 	}
 )
 
@@ -79,8 +205,210 @@ func (currentConfig *ConfigType) UpdateConfig(newConfig ConfigType) {
 		currentConfig.StepDefaultProvisioner = newConfig.StepDefaultProvisioner
 	}
 
+	if newConfig.Profiles != nil {
+		Logger.Info("Updating new profiles '%v' into configs", len(newConfig.Profiles))
+		currentConfig.Profiles = newConfig.Profiles
+	}
+
+	if newConfig.ActiveProfile != "" {
+		Logger.Info("Updating new active profile '%v' into configs", newConfig.ActiveProfile)
+		currentConfig.ActiveProfile = newConfig.ActiveProfile
+	}
+
 	if newConfig.StepTeamName != "" {
 		Logger.Info("Updating new step team '%v' into configs", newConfig.StepTeamName)
 		currentConfig.StepTeamName = newConfig.StepTeamName
 	}
+
+	if newConfig.StepPasswordFile != "" {
+		Logger.Info("Updating new step password file '%v' into configs", newConfig.StepPasswordFile)
+		currentConfig.StepPasswordFile = newConfig.StepPasswordFile
+	}
+
+	if newConfig.StepX5cCert != "" {
+		Logger.Info("Updating new step x5c certificate '%v' into configs", newConfig.StepX5cCert)
+		currentConfig.StepX5cCert = newConfig.StepX5cCert
+	}
+
+	if newConfig.StepX5cKey != "" {
+		Logger.Info("Updating new step x5c key '%v' into configs", newConfig.StepX5cKey)
+		currentConfig.StepX5cKey = newConfig.StepX5cKey
+	}
+
+	if newConfig.StepSshpopCert != "" {
+		Logger.Info("Updating new step sshpop certificate '%v' into configs", newConfig.StepSshpopCert)
+		currentConfig.StepSshpopCert = newConfig.StepSshpopCert
+	}
+
+	if newConfig.StepSshpopKey != "" {
+		Logger.Info("Updating new step sshpop key '%v' into configs", newConfig.StepSshpopKey)
+		currentConfig.StepSshpopKey = newConfig.StepSshpopKey
+	}
+
+	if newConfig.StepCliOidcLogin != currentConfig.StepCliOidcLogin {
+		Logger.Info("Updating step cli oidc login '%v' into configs", newConfig.StepCliOidcLogin)
+		currentConfig.StepCliOidcLogin = newConfig.StepCliOidcLogin
+	}
+
+	if newConfig.AgentSocketPath != "" {
+		Logger.Info("Updating new agent socket path '%v' into configs", newConfig.AgentSocketPath)
+		currentConfig.AgentSocketPath = newConfig.AgentSocketPath
+	}
+
+	if newConfig.UpstreamAgent != "" {
+		Logger.Info("Updating new upstream agent '%v' into configs", newConfig.UpstreamAgent)
+		currentConfig.UpstreamAgent = newConfig.UpstreamAgent
+	}
+
+	if newConfig.ManagedAgentEnabled != currentConfig.ManagedAgentEnabled {
+		Logger.Info("Updating managed agent enabled '%v' into configs", newConfig.ManagedAgentEnabled)
+		currentConfig.ManagedAgentEnabled = newConfig.ManagedAgentEnabled
+	}
+
+	if newConfig.ManagedAgentExe != "" {
+		Logger.Info("Updating new managed agent executable '%v' into configs", newConfig.ManagedAgentExe)
+		currentConfig.ManagedAgentExe = newConfig.ManagedAgentExe
+	}
+
+	if newConfig.ManagedAgentArgs != nil {
+		Logger.Info("Updating new managed agent arguments %v into configs", newConfig.ManagedAgentArgs)
+		currentConfig.ManagedAgentArgs = newConfig.ManagedAgentArgs
+	}
+
+	if newConfig.ManagedAgentAddress != "" {
+		Logger.Info("Updating new managed agent address '%v' into configs", newConfig.ManagedAgentAddress)
+		currentConfig.ManagedAgentAddress = newConfig.ManagedAgentAddress
+	}
+
+	if newConfig.ClientAllowList != nil {
+		Logger.Info("Updating new client allowlist %v into configs", newConfig.ClientAllowList)
+		currentConfig.ClientAllowList = newConfig.ClientAllowList
+	}
+
+	if newConfig.ClientDenyList != nil {
+		Logger.Info("Updating new client denylist %v into configs", newConfig.ClientDenyList)
+		currentConfig.ClientDenyList = newConfig.ClientDenyList
+	}
+
+	if newConfig.MaxMessageLengthNamedPipe > 0 {
+		Logger.Info("Updating new named pipe max message length '%v' into configs", newConfig.MaxMessageLengthNamedPipe)
+		currentConfig.MaxMessageLengthNamedPipe = newConfig.MaxMessageLengthNamedPipe
+	}
+
+	if newConfig.MaxMessageLengthUnixSocket > 0 {
+		Logger.Info("Updating new unix socket max message length '%v' into configs", newConfig.MaxMessageLengthUnixSocket)
+		currentConfig.MaxMessageLengthUnixSocket = newConfig.MaxMessageLengthUnixSocket
+	}
+
+	if newConfig.MaxMessageLengthWMCopyData > 0 {
+		Logger.Info("Updating new WM_COPYDATA max message length '%v' into configs", newConfig.MaxMessageLengthWMCopyData)
+		currentConfig.MaxMessageLengthWMCopyData = newConfig.MaxMessageLengthWMCopyData
+	}
+
+	if newConfig.MaxClientSessions > 0 {
+		Logger.Info("Updating new max client sessions '%v' into configs", newConfig.MaxClientSessions)
+		currentConfig.MaxClientSessions = newConfig.MaxClientSessions
+	}
+
+	if newConfig.MaxInFlightRequests > 0 {
+		Logger.Info("Updating new max in-flight requests '%v' into configs", newConfig.MaxInFlightRequests)
+		currentConfig.MaxInFlightRequests = newConfig.MaxInFlightRequests
+	}
+
+	if newConfig.RequestQueueLength > 0 {
+		Logger.Info("Updating new request queue length '%v' into configs", newConfig.RequestQueueLength)
+		currentConfig.RequestQueueLength = newConfig.RequestQueueLength
+	}
+
+	if newConfig.RequestQueueTimeoutSeconds > 0 {
+		Logger.Info("Updating new request queue timeout '%v' into configs", newConfig.RequestQueueTimeoutSeconds)
+		currentConfig.RequestQueueTimeoutSeconds = newConfig.RequestQueueTimeoutSeconds
+	}
+
+	if newConfig.UpstreamRequestTimeoutSeconds > 0 {
+		Logger.Info("Updating new upstream request timeout '%v' into configs", newConfig.UpstreamRequestTimeoutSeconds)
+		currentConfig.UpstreamRequestTimeoutSeconds = newConfig.UpstreamRequestTimeoutSeconds
+	}
+
+	if newConfig.ListenerMaxRestarts > 0 {
+		Logger.Info("Updating new listener max restarts '%v' into configs", newConfig.ListenerMaxRestarts)
+		currentConfig.ListenerMaxRestarts = newConfig.ListenerMaxRestarts
+	}
+
+	if newConfig.ListenerBackoffBaseSeconds > 0 {
+		Logger.Info("Updating new listener backoff base '%v' into configs", newConfig.ListenerBackoffBaseSeconds)
+		currentConfig.ListenerBackoffBaseSeconds = newConfig.ListenerBackoffBaseSeconds
+	}
+
+	if newConfig.ListenerBackoffMaxSeconds > 0 {
+		Logger.Info("Updating new listener backoff max '%v' into configs", newConfig.ListenerBackoffMaxSeconds)
+		currentConfig.ListenerBackoffMaxSeconds = newConfig.ListenerBackoffMaxSeconds
+	}
+
+	if newConfig.CaptureEnabled != currentConfig.CaptureEnabled {
+		Logger.Info("Updating agent traffic capture enabled '%v' into configs", newConfig.CaptureEnabled)
+		currentConfig.CaptureEnabled = newConfig.CaptureEnabled
+	}
+
+	if newConfig.CaptureFile != "" {
+		Logger.Info("Updating new capture file '%v' into configs", newConfig.CaptureFile)
+		currentConfig.CaptureFile = newConfig.CaptureFile
+	}
+
+	if newConfig.ReencryptTimeoutSeconds > 0 {
+		Logger.Info("Updating new re-encrypt timeout '%v' into configs", newConfig.ReencryptTimeoutSeconds)
+		currentConfig.ReencryptTimeoutSeconds = newConfig.ReencryptTimeoutSeconds
+	}
+
+	if newConfig.CertRenewalDisabled != currentConfig.CertRenewalDisabled {
+		Logger.Info("Updating certificate renewal disabled '%v' into configs", newConfig.CertRenewalDisabled)
+		currentConfig.CertRenewalDisabled = newConfig.CertRenewalDisabled
+	}
+
+	if newConfig.CertRenewalPercent > 0 && newConfig.CertRenewalPercent < 100 {
+		Logger.Info("Updating new certificate renewal percent '%v' into configs", newConfig.CertRenewalPercent)
+		currentConfig.CertRenewalPercent = newConfig.CertRenewalPercent
+	}
+
+	if newConfig.CertRenewalBrowserLogin != currentConfig.CertRenewalBrowserLogin {
+		Logger.Info("Updating certificate renewal browser login '%v' into configs", newConfig.CertRenewalBrowserLogin)
+		currentConfig.CertRenewalBrowserLogin = newConfig.CertRenewalBrowserLogin
+	}
+
+	if newConfig.ManagedKnownHosts != currentConfig.ManagedKnownHosts {
+		Logger.Info("Updating managed known hosts '%v' into configs", newConfig.ManagedKnownHosts)
+		currentConfig.ManagedKnownHosts = newConfig.ManagedKnownHosts
+	}
+
+	if newConfig.KnownHostsPath != "" {
+		Logger.Info("Updating new known hosts path '%v' into configs", newConfig.KnownHostsPath)
+		currentConfig.KnownHostsPath = newConfig.KnownHostsPath
+	}
+
+	if newConfig.KnownHostsPatterns != nil {
+		Logger.Info("Updating new known hosts patterns '%v' into configs", newConfig.KnownHostsPatterns)
+		currentConfig.KnownHostsPatterns = newConfig.KnownHostsPatterns
+	}
+
+	if newConfig.ManagedSshConfig != currentConfig.ManagedSshConfig {
+		Logger.Info("Updating managed ssh config '%v' into configs", newConfig.ManagedSshConfig)
+		currentConfig.ManagedSshConfig = newConfig.ManagedSshConfig
+	}
+
+	if newConfig.SshConfigPath != "" {
+		Logger.Info("Updating new ssh config path '%v' into configs", newConfig.SshConfigPath)
+		currentConfig.SshConfigPath = newConfig.SshConfigPath
+	}
+
+	if newConfig.SshConfigTemplateFile != "" {
+		Logger.Info("Updating new ssh config template file '%v' into configs", newConfig.SshConfigTemplateFile)
+		currentConfig.SshConfigTemplateFile = newConfig.SshConfigTemplateFile
+	}
+
+	// also when the configs were changed while the app was not running
+	if !currentConfig.ManagedSshConfig {
+		if err := SshConfig.Remove(); err != nil {
+			Logger.Error("Failed to remove the generated ssh config. Error: %v", err)
+		}
+	}
 }
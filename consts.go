@@ -27,6 +27,16 @@ const (
 
 	SE_KERNAL_OBJECT           = 6
 	OWNER_SECURITY_INFORMATION = 1
+
+	// AF_UNIX socket consts
+	SIO_AF_UNIX_GETPEERPID = 0x58000100
+	AGENT_SOCKET_FILE_MODE = 0600
+
+	// AttachConsole: the console of the process that started us
+	ATTACH_PARENT_PROCESS = 0xFFFFFFFF
+
+	// SendMessageTimeout: return early when the receiving window does not process messages
+	SMTO_ABORTIFHUNG = 0x0002
 )
 
 var (
@@ -42,6 +52,14 @@ var (
 	MOD_KERNEL32            = syscall.NewLazyDLL("kernel32.dll")
 	PROC_OPENFILE_MAPPING_A = MOD_KERNEL32.NewProc("OpenFileMappingA")
 
+	PROC_GET_NAMED_PIPE_CLIENT_PROCESS_ID = MOD_KERNEL32.NewProc("GetNamedPipeClientProcessId")
+	PROC_VIRTUAL_QUERY                    = MOD_KERNEL32.NewProc("VirtualQuery")
+	PROC_ATTACH_CONSOLE                   = MOD_KERNEL32.NewProc("AttachConsole")
+
+	MOD_USER32                            = windows.NewLazySystemDLL("user32.dll")
+	PROC_SEND_MESSAGE_TIMEOUT_W           = MOD_USER32.NewProc("SendMessageTimeoutW")
+	PROC_MSG_WAIT_FOR_MULTIPLE_OBJECTS_EX = MOD_USER32.NewProc("MsgWaitForMultipleObjectsEx")
+
 	MOD_ADV_API32          = windows.NewLazySystemDLL("advapi32.dll")
 	PROC_GET_SECURITY_INFO = MOD_ADV_API32.NewProc("GetSecurityInfo")
 
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// deferredKeyType is an encrypted PuTTY key whose public part is offered before it is decrypted
+type deferredKeyType struct {
+	// serializes decryption, so concurrent signatures with a locked key ask for the passphrase only once
+	mu             sync.Mutex
+	file           *PpkFileType
+	constraints    AgentConstraintsType
+	expiresAt      time.Time
+	expiryTimer    *time.Timer
+	reencryptTimer *time.Timer
+	// guarded by the registry: whether the upstream agent holds the decrypted key
+	loaded bool
+}
+
+// DeferredKeyRegistryType keeps the encrypted keys loaded through add-ppk, the way PuTTY's Pageant keeps
+// encrypted keys: their public parts appear in SSH_AGENT_IDENTITIES_ANSWER and the passphrase is asked on
+// the first SSH_AGENTC_SIGN_REQUEST. The decrypted key then lives in the upstream agent until
+// ReencryptTimeoutSeconds passes.
+type DeferredKeyRegistryType struct {
+	// PromptPassphrase asks for the passphrase of a key, App.PromptPassphrase when nil
+	PromptPassphrase PassphrasePromptFunc
+
+	mu   sync.Mutex
+	keys map[string]*deferredKeyType
+}
+
+var DeferredKeys *DeferredKeyRegistryType = &DeferredKeyRegistryType{keys: map[string]*deferredKeyType{}}
+
+// Add registers an encrypted PPK file. A key that is already registered is replaced.
+func (r *DeferredKeyRegistryType) Add(file *PpkFileType, constraints AgentConstraintsType) {
+	entry := &deferredKeyType{file: file, constraints: constraints}
+	blob := string(file.PublicBlob)
+	if constraints.LifetimeSecs > 0 {
+		lifetime := time.Duration(constraints.LifetimeSecs) * time.Second
+		entry.expiresAt = time.Now().Add(lifetime)
+		entry.expiryTimer = time.AfterFunc(lifetime, func() {
+			Logger.Info("DeferredKeys: lifetime of key '%v' is over", file.Comment)
+			r.remove(blob, entry)
+			RemoveKeyFromAgent(PageantProxy.UpstreamAddress(), file.PublicBlob)
+		})
+	}
+
+	r.mu.Lock()
+	previous := r.keys[blob]
+	r.keys[blob] = entry
+	r.mu.Unlock()
+
+	if previous != nil {
+		previous.stopTimers()
+	}
+	Logger.Info("DeferredKeys: registered encrypted key '%v' (%v)", file.Comment, KeyFingerprint(file.PublicBlob))
+}
+
+// Prepare handles the requests that concern registered keys before they reach the upstream agent.
+// A signature with a key that is not decrypted yet asks for the passphrase and adds the key upstream,
+// the signature itself is then forwarded as usual. The Pageant window keeps dispatching messages while it
+// waits, see forwardWhileDispatching. handled is true when response answers the request.
+func (r *DeferredKeyRegistryType) Prepare(request []byte, query AgentQueryFunc) (response []byte, handled bool) {
+	switch messageTypeOf(request) {
+	case SSH_AGENTC_SIGN_REQUEST:
+		reader := &agentWireReader{buf: request[5:]}
+		blob := reader.readString("key blob")
+		entry := r.get(blob)
+		if reader.err != nil || entry == nil || r.isLoaded(entry) {
+			return nil, false
+		}
+		if err := r.unlock(entry, query); err != nil {
+			r.reportUnlockError(entry, err)
+			return AgentFailureFrame(), true
+		}
+		return nil, false
+
+	case SSH_AGENTC_REMOVE_IDENTITY:
+		reader := &agentWireReader{buf: request[5:]}
+		blob := reader.readString("key blob")
+		entry := r.get(blob)
+		if reader.err != nil || entry == nil {
+			return nil, false
+		}
+		r.remove(string(blob), entry)
+		Logger.Info("DeferredKeys: removed key '%v'", entry.file.Comment)
+		// the key is only upstream when it was used since the last re-encryption, removing it there may fail
+		query(request)
+		return frameAgentMessage([]byte{SSH_AGENT_SUCCESS}), true
+
+	case SSH_AGENTC_REMOVE_ALL_IDENTITIES:
+		r.mu.Lock()
+		keys := r.keys
+		r.keys = map[string]*deferredKeyType{}
+		r.mu.Unlock()
+		for _, entry := range keys {
+			entry.stopTimers()
+		}
+	}
+	return nil, false
+}
+
+// Complete adds the registered keys the upstream agent does not hold to an SSH_AGENT_IDENTITIES_ANSWER.
+// The answers of the upstream agent also tell which registered keys it holds: a failed signature or a
+// key missing from its identities means the decrypted key is gone, e.g. after ssh-add -D.
+func (r *DeferredKeyRegistryType) Complete(request []byte, response []byte) []byte {
+	if messageTypeOf(request) == SSH_AGENTC_SIGN_REQUEST && messageTypeOf(response) == SSH_AGENT_FAILURE {
+		reader := &agentWireReader{buf: request[5:]}
+		if entry := r.get(reader.readString("key blob")); reader.err == nil && entry != nil {
+			r.setLoaded(entry, false)
+		}
+		return response
+	}
+	if messageTypeOf(request) != SSH_AGENTC_REQUEST_IDENTITIES || messageTypeOf(response) != SSH_AGENT_IDENTITIES_ANSWER {
+		return response
+	}
+
+	identities, err := ParseIdentitiesAnswer(response)
+	if err != nil {
+		Logger.Error("DeferredKeys: cannot add encrypted keys to the upstream identities. Error: %v", err)
+		return response
+	}
+
+	r.mu.Lock()
+	if len(r.keys) == 0 {
+		r.mu.Unlock()
+		return response
+	}
+	deferred := make([]AgentIdentityType, 0, len(r.keys))
+	for _, entry := range r.keys {
+		entry.loaded = containsIdentity(identities, entry.file.PublicBlob)
+		deferred = append(deferred, AgentIdentityType{Blob: entry.file.PublicBlob, Comment: []byte(entry.file.Comment)})
+	}
+	r.mu.Unlock()
+
+	for _, identity := range deferred {
+		if !containsIdentity(identities, identity.Blob) {
+			identities = append(identities, identity)
+		}
+	}
+
+	completed := BuildIdentitiesAnswer(identities)
+	if len(completed) > AGENT_MAX_MESSAGE_LENGTH {
+		Logger.Error("DeferredKeys: encrypted keys left out of the identities. Error: %v", AGENTERR_MESSAGE_TOO_LONG)
+		return response
+	}
+	return completed
+}
+
+func (r *DeferredKeyRegistryType) reportUnlockError(entry *deferredKeyType, err error) {
+	Logger.Error("DeferredKeys: cannot unlock key '%v'. Error: %v", entry.file.Comment, err)
+	if !errors.Is(err, PPKERR_PASSPHRASE_REQUIRED) {
+		App.PushErrNoti("Could not unlock PuTTY key '%v'. Error: %v", entry.file.Comment, err)
+	}
+}
+
+// unlock makes sure the upstream agent holds the decrypted key of entry, asking for the passphrase when it does not.
+// The upstream identities are only asked for while the key is not known to be loaded.
+func (r *DeferredKeyRegistryType) unlock(entry *deferredKeyType, query AgentQueryFunc) error {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if r.isLoaded(entry) {
+		return nil
+	}
+
+	result, err := query([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES})
+	if err != nil {
+		return err
+	}
+	identities, err := ParseIdentitiesAnswer(result)
+	if err != nil {
+		return err
+	}
+	if containsIdentity(identities, entry.file.PublicBlob) {
+		r.setLoaded(entry, true)
+		return nil
+	}
+
+	prompt := r.PromptPassphrase
+	if prompt == nil {
+		prompt = App.PromptPassphrase
+	}
+	Logger.Info("DeferredKeys: key '%v' is used for the first time, asking for its passphrase", entry.file.Comment)
+	key, err := DecryptPpk(entry.file, prompt)
+	if err != nil {
+		return err
+	}
+
+	constraints := entry.constraints
+	if !entry.expiresAt.IsZero() {
+		constraints.LifetimeSecs = 1
+		if remaining := time.Until(entry.expiresAt); remaining > time.Second {
+			constraints.LifetimeSecs = uint32(remaining / time.Second)
+		}
+	}
+	address := PageantProxy.UpstreamAddress()
+	if err = AddKeyToAgent(address, key, constraints); err != nil {
+		return err
+	}
+	Logger.Info("DeferredKeys: added decrypted key '%v' to %v", key.Comment, address)
+	r.setLoaded(entry, true)
+
+	if Configs.ReencryptTimeoutSeconds > 0 {
+		if entry.reencryptTimer != nil {
+			entry.reencryptTimer.Stop()
+		}
+		entry.reencryptTimer = time.AfterFunc(time.Duration(Configs.ReencryptTimeoutSeconds)*time.Second, func() {
+			Logger.Info("DeferredKeys: re-encrypting key '%v'", entry.file.Comment)
+			r.setLoaded(entry, false)
+			if err := RemoveKeyFromAgent(PageantProxy.UpstreamAddress(), entry.file.PublicBlob); err != nil {
+				Logger.Error("DeferredKeys: cannot remove decrypted key '%v'. Error: %v", entry.file.Comment, err)
+			}
+		})
+	}
+	return nil
+}
+
+func (r *DeferredKeyRegistryType) get(blob []byte) *deferredKeyType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[string(blob)]
+}
+
+func (r *DeferredKeyRegistryType) isLoaded(entry *deferredKeyType) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return entry.loaded
+}
+
+func (r *DeferredKeyRegistryType) setLoaded(entry *deferredKeyType, loaded bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.loaded = loaded
+}
+
+// remove drops the registration of blob, unless it was replaced by another entry meanwhile
+func (r *DeferredKeyRegistryType) remove(blob string, entry *deferredKeyType) {
+	r.mu.Lock()
+	if r.keys[blob] == entry {
+		delete(r.keys, blob)
+	}
+	r.mu.Unlock()
+	entry.stopTimers()
+}
+
+func (k *deferredKeyType) stopTimers() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.expiryTimer != nil {
+		k.expiryTimer.Stop()
+	}
+	if k.reencryptTimer != nil {
+		k.reencryptTimer.Stop()
+	}
+}
+
+func containsIdentity(identities []AgentIdentityType, blob []byte) bool {
+	for _, identity := range identities {
+		if bytes.Equal(identity.Blob, blob) {
+			return true
+		}
+	}
+	return false
+}
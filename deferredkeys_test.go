@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const deferredKeyTestPassphrase = "correct horse"
+
+// deferredKeyTestType is a registry with one encrypted key, an upstream keyring on a unix socket and
+// counters of what the registry asked for
+type deferredKeyTestType struct {
+	registry *DeferredKeyRegistryType
+	keyring  agent.Agent
+	file     *PpkFileType
+	address  string
+
+	mu                 sync.Mutex
+	prompts            int
+	identitiesRequests int
+}
+
+func newDeferredKeyTest(t *testing.T, prompt PassphrasePromptFunc) *deferredKeyTestType {
+	test := &deferredKeyTestType{}
+	test.keyring, test.address = startTestAgent(t)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewPpkKey(privateKey, "deferred test key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := MarshalPpk(key, 2, []byte(deferredKeyTestPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.file, err = ParsePpk(content); err != nil {
+		t.Fatal(err)
+	}
+
+	if prompt == nil {
+		prompt = func(title string, message string) (string, bool) {
+			return deferredKeyTestPassphrase, true
+		}
+	}
+	test.registry = &DeferredKeyRegistryType{
+		keys: map[string]*deferredKeyType{},
+		PromptPassphrase: func(title string, message string) (string, bool) {
+			test.mu.Lock()
+			test.prompts++
+			test.mu.Unlock()
+			return prompt(title, message)
+		},
+	}
+	test.registry.Add(test.file, AgentConstraintsType{})
+	t.Cleanup(func() {
+		test.registry.Prepare(frameAgentMessage([]byte{SSH_AGENTC_REMOVE_ALL_IDENTITIES}), test.query)
+	})
+	return test
+}
+
+func (test *deferredKeyTestType) query(request []byte) ([]byte, error) {
+	if messageTypeOf(request) == SSH_AGENTC_REQUEST_IDENTITIES {
+		test.mu.Lock()
+		test.identitiesRequests++
+		test.mu.Unlock()
+	}
+	return QueryAgent(test.address, request)
+}
+
+func (test *deferredKeyTestType) counts() (prompts int, identitiesRequests int) {
+	test.mu.Lock()
+	defer test.mu.Unlock()
+	return test.prompts, test.identitiesRequests
+}
+
+func (test *deferredKeyTestType) signRequest() []byte {
+	body := appendAgentString([]byte{SSH_AGENTC_SIGN_REQUEST}, test.file.PublicBlob)
+	body = appendAgentString(body, []byte("data to sign"))
+	return frameAgentMessage(appendAgentUint32(body, 0))
+}
+
+func (test *deferredKeyTestType) upstreamHoldsKey(t *testing.T) bool {
+	keys, err := test.keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if bytes.Equal(key.Blob, test.file.PublicBlob) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDeferredKeyUnlocksOnFirstSignature(t *testing.T) {
+	test := newDeferredKeyTest(t, nil)
+
+	response, handled := test.registry.Prepare(test.signRequest(), test.query)
+	if handled {
+		t.Fatalf("first signature was answered with %x, expected it to be forwarded", response)
+	}
+	if !test.upstreamHoldsKey(t) {
+		t.Fatal("decrypted key was not added upstream")
+	}
+	result, err := test.query(test.signRequest())
+	if err != nil || messageTypeOf(result) != SSH_AGENT_SIGN_RESPONSE {
+		t.Fatalf("upstream signature = %x, %v", result, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, handled = test.registry.Prepare(test.signRequest(), test.query); handled {
+			t.Fatal("signature with the loaded key was not forwarded")
+		}
+	}
+	if prompts, identitiesRequests := test.counts(); prompts != 1 || identitiesRequests != 1 {
+		t.Errorf("prompts = %v, identities requests = %v, expected 1 and 1", prompts, identitiesRequests)
+	}
+}
+
+func TestDeferredKeyIsCheckedAgainAfterFailedSignature(t *testing.T) {
+	test := newDeferredKeyTest(t, nil)
+	test.registry.Prepare(test.signRequest(), test.query)
+
+	// e.g. ssh-add -D removed the decrypted key upstream
+	test.keyring.RemoveAll()
+	test.registry.Complete(test.signRequest(), AgentFailureFrame())
+
+	if _, handled := test.registry.Prepare(test.signRequest(), test.query); handled {
+		t.Fatal("signature after unlocking again was not forwarded")
+	}
+	if !test.upstreamHoldsKey(t) {
+		t.Fatal("decrypted key was not added upstream again")
+	}
+	if prompts, identitiesRequests := test.counts(); prompts != 2 || identitiesRequests != 2 {
+		t.Errorf("prompts = %v, identities requests = %v, expected 2 and 2", prompts, identitiesRequests)
+	}
+}
+
+func TestDeferredKeyConcurrentSignaturesPromptOnce(t *testing.T) {
+	notifications := recordNotifications(t)
+	release := make(chan struct{})
+	test := newDeferredKeyTest(t, func(title string, message string) (string, bool) {
+		<-release
+		return deferredKeyTestPassphrase, true
+	})
+
+	// e.g. a signature from the Pageant window and one from the named pipe
+	handled := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, answered := test.registry.Prepare(test.signRequest(), test.query)
+			handled <- answered
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for prompts, _ := test.counts(); prompts == 0; prompts, _ = test.counts() {
+		if time.Now().After(deadline) {
+			t.Fatal("passphrase was not asked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if <-handled {
+			t.Error("signature waiting for the passphrase was not forwarded")
+		}
+	}
+	if !test.upstreamHoldsKey(t) {
+		t.Error("decrypted key was not added upstream")
+	}
+	if prompts, _ := test.counts(); prompts != 1 {
+		t.Errorf("prompts = %v, expected 1", prompts)
+	}
+	if list := notifications.list(); len(list) != 0 {
+		t.Errorf("notifications = %q", list)
+	}
+}
+
+func TestDeferredKeyWrongPassphrase(t *testing.T) {
+	notifications := recordNotifications(t)
+	test := newDeferredKeyTest(t, func(title string, message string) (string, bool) {
+		return "wrong", true
+	})
+
+	response, handled := test.registry.Prepare(test.signRequest(), test.query)
+	if !handled || messageTypeOf(response) != SSH_AGENT_FAILURE {
+		t.Fatalf("signature after wrong passphrases = %x, %v, expected SSH_AGENT_FAILURE", response, handled)
+	}
+	if prompts, _ := test.counts(); prompts != PPK_PASSPHRASE_ATTEMPTS {
+		t.Errorf("prompts = %v, expected %v", prompts, PPK_PASSPHRASE_ATTEMPTS)
+	}
+	expected := []string{"ERROR: Could not unlock PuTTY key 'deferred test key'. Error: " + PPKERR_WRONG_PASSPHRASE.Error()}
+	if !reflect.DeepEqual(notifications.list(), expected) {
+		t.Errorf("notifications = %q", notifications.list())
+	}
+}
+
+func TestDeferredKeyCancelledPrompt(t *testing.T) {
+	notifications := recordNotifications(t)
+	test := newDeferredKeyTest(t, func(title string, message string) (string, bool) {
+		return "", false
+	})
+
+	response, handled := test.registry.Prepare(test.signRequest(), test.query)
+	if !handled || messageTypeOf(response) != SSH_AGENT_FAILURE {
+		t.Fatalf("signature after a cancelled prompt = %x, %v, expected SSH_AGENT_FAILURE", response, handled)
+	}
+	if test.upstreamHoldsKey(t) {
+		t.Error("key was added upstream without its passphrase")
+	}
+	// the user cancelled, there is nothing to tell
+	if list := notifications.list(); len(list) != 0 {
+		t.Errorf("notifications = %q", list)
+	}
+}
+
+func TestDeferredKeyCompletesIdentities(t *testing.T) {
+	test := newDeferredKeyTest(t, nil)
+	request := []byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}
+
+	upstream, err := test.query(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := ParseIdentitiesAnswer(test.registry.Complete(request, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || !bytes.Equal(identities[0].Blob, test.file.PublicBlob) || string(identities[0].Comment) != test.file.Comment {
+		t.Fatalf("identities = %+v, expected the encrypted key", identities)
+	}
+
+	// once decrypted, the key is listed by the upstream agent and not added a second time
+	test.registry.Prepare(test.signRequest(), test.query)
+	upstream, _ = test.query(request)
+	identities, _ = ParseIdentitiesAnswer(test.registry.Complete(request, upstream))
+	if len(identities) != 1 {
+		t.Errorf("identities = %+v, expected the key once", identities)
+	}
+	test.keyring.RemoveAll()
+	upstream, _ = test.query(request)
+	test.registry.Complete(request, upstream)
+	if test.registry.isLoaded(test.registry.get(test.file.PublicBlob)) {
+		t.Error("key is still marked loaded after it left the upstream agent")
+	}
+}
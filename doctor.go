@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type DoctorStatusType string
+
+const (
+	DOCTOR_PASS DoctorStatusType = "PASS"
+	DOCTOR_WARN DoctorStatusType = "WARN"
+	DOCTOR_FAIL DoctorStatusType = "FAIL"
+	DOCTOR_SKIP DoctorStatusType = "SKIP"
+)
+
+const (
+	DOCTOR_TIMEOUT          = 10 * time.Second
+	DOCTOR_SIGN_DATA_LENGTH = 32
+	DOCTOR_CLOCK_SKEW_WARN  = 30 * time.Second
+	DOCTOR_CLOCK_SKEW_FAIL  = 5 * time.Minute
+	DOCTOR_CERT_EXPIRY_WARN = 1 * time.Hour
+	DOCTOR_STEP_CA_HEALTH   = "/health"
+)
+
+type DoctorCheckType struct {
+	Name           string
+	Status         DoctorStatusType
+	Message        string
+	Details        []string `json:",omitempty"`
+	DurationMillis int64
+}
+
+// DoctorReportType is the result of every check of the agent chain, from the upstream agent over
+// the Pageant endpoints to the step CA and the user certificate.
+type DoctorReportType struct {
+	Time    time.Time
+	Checks  []DoctorCheckType
+	Passed  int
+	Warned  int
+	Failed  int
+	Skipped int
+}
+
+// DoctorType runs the checks in order, later checks use what earlier ones found out
+type DoctorType struct {
+	report    *DoctorReportType
+	upstream  string
+	conn      net.Conn
+	client    agent.ExtendedAgent
+	keys      []*agent.Key
+	skew      time.Duration
+	skewKnown bool
+}
+
+func RunDoctor() *DoctorReportType {
+	d := &DoctorType{report: &DoctorReportType{Time: time.Now()}}
+
+	d.run("Upstream agent", d.checkUpstream)
+	d.run("Identities", d.checkIdentities)
+	for _, key := range d.keys {
+		key := key
+		name := key.Comment
+		if name == "" {
+			name = KeyFingerprint(key.Blob)
+		}
+		d.run("Signature "+name, func() (DoctorStatusType, string, []string) { return d.checkSignature(key) })
+	}
+	if d.conn != nil {
+		d.conn.Close()
+	}
+	d.run("Pageant "+HEALTH_NAMEDPIPE, d.checkPageantNamedPipe)
+	d.run("Pageant "+HEALTH_WM_COPYDATA, d.checkPageantWindow)
+	d.run("Pageant "+HEALTH_UNIXSOCKET, d.checkPageantUnixSocket)
+	d.run("Step CLI", d.checkStepCli)
+	d.run("Step CA", d.checkStepCa)
+	d.run("Clock skew", d.checkClockSkew)
+	d.run("User certificate", d.checkUserCertificate)
+
+	return d.report
+}
+
+func (d *DoctorType) run(name string, check func() (DoctorStatusType, string, []string)) {
+	startedAt := time.Now()
+	status, message, details := check()
+	result := DoctorCheckType{
+		Name:           name,
+		Status:         status,
+		Message:        message,
+		Details:        details,
+		DurationMillis: time.Since(startedAt).Milliseconds(),
+	}
+	Logger.Info("Doctor: [%v] %v: %v", status, name, message)
+
+	d.report.Checks = append(d.report.Checks, result)
+	switch status {
+	case DOCTOR_PASS:
+		d.report.Passed++
+	case DOCTOR_WARN:
+		d.report.Warned++
+	case DOCTOR_FAIL:
+		d.report.Failed++
+	default:
+		d.report.Skipped++
+	}
+}
+
+func (d *DoctorType) checkUpstream() (DoctorStatusType, string, []string) {
+	address := ConfiguredUpstreamAgent()
+	result, err := ProbeAgent(address, DOCTOR_TIMEOUT)
+	if err == nil {
+		d.upstream = address
+		return DOCTOR_PASS, fmt.Sprintf("%v answered (%v)", address, result), nil
+	}
+
+	if Configs.ManagedAgentEnabled {
+		managedResult, managedErr := ProbeAgent(ManagedAgent.Address(), DOCTOR_TIMEOUT)
+		if managedErr == nil {
+			d.upstream = ManagedAgent.Address()
+			return DOCTOR_WARN, fmt.Sprintf("%v is not reachable, the managed agent on %v answered (%v)", address, d.upstream, managedResult),
+				[]string{err.Error()}
+		}
+		return DOCTOR_FAIL, fmt.Sprintf("neither %v nor the managed agent on %v answered", address, ManagedAgent.Address()),
+			[]string{err.Error(), managedErr.Error()}
+	}
+	return DOCTOR_FAIL, fmt.Sprintf("%v did not answer", address),
+		[]string{err.Error(), "is the OpenSSH Authentication Agent service running?"}
+}
+
+func (d *DoctorType) checkIdentities() (DoctorStatusType, string, []string) {
+	if d.upstream == "" {
+		return DOCTOR_SKIP, "no upstream agent", nil
+	}
+
+	conn, err := DialAgent(d.upstream, DOCTOR_TIMEOUT)
+	if err != nil {
+		return DOCTOR_FAIL, fmt.Sprintf("cannot connect to %v", d.upstream), []string{err.Error()}
+	}
+	// the connection stays open for the signature checks, RunDoctor closes it after them
+	d.conn = conn
+	d.extendDeadline()
+	d.client = agent.NewClient(conn)
+
+	keys, err := d.client.List()
+	if err != nil {
+		return DOCTOR_FAIL, "cannot list identities", []string{err.Error()}
+	}
+	d.keys = keys
+
+	details := []string{}
+	for _, key := range keys {
+		details = append(details, fmt.Sprintf("%v %v %v", key.Type(), KeyFingerprint(key.Blob), key.Comment))
+	}
+	if len(keys) == 0 {
+		return DOCTOR_WARN, "the agent holds no keys", []string{"add a key with ssh-add, or log in with step ssh login"}
+	}
+	return DOCTOR_PASS, fmt.Sprintf("%v keys", len(keys)), details
+}
+
+// checkSignature has the agent sign random data with key and verifies the signature locally.
+// Keys added with confirmation (ssh-add -c) will ask the user.
+func (d *DoctorType) checkSignature(key *agent.Key) (DoctorStatusType, string, []string) {
+	data := make([]byte, DOCTOR_SIGN_DATA_LENGTH)
+	if _, err := rand.Read(data); err != nil {
+		return DOCTOR_FAIL, "cannot generate test data", []string{err.Error()}
+	}
+
+	publicKey, err := ssh.ParsePublicKey(key.Blob)
+	if err != nil {
+		return DOCTOR_FAIL, "cannot parse public key", []string{err.Error()}
+	}
+
+	var flags agent.SignatureFlags
+	if strings.HasPrefix(publicKey.Type(), ssh.KeyAlgoRSA) || publicKey.Type() == ssh.CertAlgoRSAv01 {
+		flags = agent.SignatureFlagRsaSha256
+	}
+
+	d.extendDeadline()
+	signature, err := d.client.SignWithFlags(publicKey, data, flags)
+	if err != nil {
+		return DOCTOR_FAIL, fmt.Sprintf("%v %v could not sign", key.Type(), KeyFingerprint(key.Blob)), []string{err.Error()}
+	}
+
+	if err = publicKey.Verify(data, signature); err != nil {
+		return DOCTOR_FAIL, fmt.Sprintf("%v signature of %v does not verify", signature.Format, KeyFingerprint(key.Blob)), []string{err.Error()}
+	}
+	return DOCTOR_PASS, fmt.Sprintf("%v signature of %v verified", signature.Format, KeyFingerprint(key.Blob)), nil
+}
+
+func (d *DoctorType) extendDeadline() {
+	d.conn.SetDeadline(time.Now().Add(DOCTOR_TIMEOUT))
+}
+
+func (d *DoctorType) checkPageantNamedPipe() (DoctorStatusType, string, []string) {
+	pipeName, err := PageantProxy.GetPagentPipeName()
+	if err != nil {
+		return DOCTOR_FAIL, "cannot determine the pipe name", []string{err.Error()}
+	}
+	result, err := ProbeAgent(pipeName, DOCTOR_TIMEOUT)
+	if err != nil {
+		return DOCTOR_FAIL, fmt.Sprintf("%v did not answer", pipeName), []string{err.Error(), "is " + APP_NAME + " running?"}
+	}
+	return d.compareKeyCount(fmt.Sprintf("%v answered (%v)", pipeName, result), result.KeyCount)
+}
+
+func (d *DoctorType) checkPageantWindow() (DoctorStatusType, string, []string) {
+	startedAt := time.Now()
+	frame, err := QueryPageantWindow([]byte{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES}, DOCTOR_TIMEOUT)
+	if err != nil {
+		return DOCTOR_FAIL, fmt.Sprintf("the %v window did not answer", WND_CLASSNAME), []string{err.Error(), "is " + APP_NAME + " running?"}
+	}
+	if len(frame) < 9 || frame[4] != SSH_AGENT_IDENTITIES_ANSWER {
+		return DOCTOR_FAIL, fmt.Sprintf("the %v window answered with %v", WND_CLASSNAME, AgentMessageName(byte(messageTypeOf(frame)))), nil
+	}
+	result := &AgentProbeResultType{Latency: time.Since(startedAt), KeyCount: int(binary.BigEndian.Uint32(frame[5:9]))}
+	return d.compareKeyCount(fmt.Sprintf("the %v window answered (%v)", WND_CLASSNAME, result), result.KeyCount)
+}
+
+func (d *DoctorType) checkPageantUnixSocket() (DoctorStatusType, string, []string) {
+	if Configs.AgentSocketPath == "" {
+		return DOCTOR_SKIP, "AgentSocketPath is not configured", nil
+	}
+	result, err := ProbeAgent(Configs.AgentSocketPath, DOCTOR_TIMEOUT)
+	if err != nil {
+		return DOCTOR_FAIL, fmt.Sprintf("%v did not answer", Configs.AgentSocketPath), []string{err.Error()}
+	}
+	return d.compareKeyCount(fmt.Sprintf("%v answered (%v)", Configs.AgentSocketPath, result), result.KeyCount)
+}
+
+// compareKeyCount checks that a Pageant endpoint hands out the same identities as the upstream agent
+func (d *DoctorType) compareKeyCount(message string, keyCount int) (DoctorStatusType, string, []string) {
+	if d.client != nil && keyCount != len(d.keys) {
+		return DOCTOR_WARN, message, []string{fmt.Sprintf("the upstream agent listed %v keys, a client policy or another agent may be in the way", len(d.keys))}
+	}
+	return DOCTOR_PASS, message, nil
+}
+
+func (d *DoctorType) checkStepCli() (DoctorStatusType, string, []string) {
+	path, err := exec.LookPath("step.exe")
+	if err != nil {
+		return DOCTOR_FAIL, STEPERR_STEPCLI_NOT_FOUND.Error(), []string{err.Error()}
+	}
+	return DOCTOR_PASS, path, nil
+}
+
+func (d *DoctorType) checkStepCa() (DoctorStatusType, string, []string) {
+	defaults, err := LoadStepDefaults()
+	if err != nil {
+		return DOCTOR_FAIL, "no step CA configured", []string{err.Error()}
+	}
+	details := []string{fmt.Sprintf("ca-url %v from %v", defaults.CaUrl, defaults.Path)}
+
+	client, err := NewStepCaClient(defaults)
+	if err != nil {
+		return DOCTOR_FAIL, "cannot load the root certificate", append(details, err.Error())
+	}
+	if err = client.Health(); err != nil {
+		return DOCTOR_FAIL, "step ca health failed", append(details, err.Error())
+	}
+
+	if provisioners, err := client.Provisioners(); err != nil {
+		details = append(details, "cannot list provisioners: "+err.Error())
+	} else {
+		details = append(details, fmt.Sprintf("%v provisioners", len(provisioners)))
+	}
+	if sshRoots, err := client.SshRoots(); err != nil {
+		details = append(details, "cannot read SSH CA keys: "+err.Error())
+	} else {
+		details = append(details, fmt.Sprintf("%v SSH user CA keys, %v SSH host CA keys", len(sshRoots.UserKeys), len(sshRoots.HostKeys)))
+	}
+	return DOCTOR_PASS, "step ca health ok", details
+}
+
+// checkClockSkew compares the local clock with the Date header of the CA. The header has a resolution
+// of one second, so is the measurement.
+func (d *DoctorType) checkClockSkew() (DoctorStatusType, string, []string) {
+	defaults, err := LoadStepDefaults()
+	if err != nil {
+		return DOCTOR_SKIP, "no step CA configured", []string{err.Error()}
+	}
+
+	client, err := newStepCaHttpClient(defaults, DOCTOR_TIMEOUT)
+	if err != nil {
+		return DOCTOR_FAIL, "cannot load the root certificate", []string{err.Error()}
+	}
+
+	url := strings.TrimSuffix(defaults.CaUrl, "/") + DOCTOR_STEP_CA_HEALTH
+	sentAt := time.Now()
+	response, err := client.Get(url)
+	receivedAt := time.Now()
+	if err != nil {
+		return DOCTOR_FAIL, fmt.Sprintf("%v did not answer", url), []string{err.Error()}
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	serverTime, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return DOCTOR_WARN, fmt.Sprintf("%v sent no usable Date header", url), []string{err.Error()}
+	}
+
+	d.skew = sentAt.Add(receivedAt.Sub(sentAt) / 2).Sub(serverTime)
+	d.skewKnown = true
+	message := fmt.Sprintf("local clock is %v %v the CA", absDuration(d.skew).Round(time.Second), aheadOrBehind(d.skew))
+	details := []string{fmt.Sprintf("round trip %v, HTTP %v", receivedAt.Sub(sentAt).Round(time.Millisecond), response.Status)}
+
+	switch {
+	case absDuration(d.skew) > DOCTOR_CLOCK_SKEW_FAIL:
+		return DOCTOR_FAIL, message, append(details, "certificates will look expired or not yet valid, sync the clock with w32tm /resync")
+	case absDuration(d.skew) > DOCTOR_CLOCK_SKEW_WARN:
+		return DOCTOR_WARN, message, details
+	}
+	return DOCTOR_PASS, message, details
+}
+
+// checkUserCertificate looks for user certificates among the agent's identities and checks them
+// against the local clock and, if it was measured, the clock of the CA.
+func (d *DoctorType) checkUserCertificate() (DoctorStatusType, string, []string) {
+	if d.client == nil {
+		return DOCTOR_SKIP, "no upstream agent", nil
+	}
+
+	now := time.Now()
+	caNow := now.Add(-d.skew)
+	status := DOCTOR_FAIL
+	message := "no user certificate in the agent"
+	details := []string{}
+	for _, key := range d.keys {
+		cert, err := ParseSshCertificate(key.Blob, key.Comment)
+		if err != nil || cert.Type != SSH_CERT_TYPE_USER {
+			continue
+		}
+		if Configs.StepUsername != "" && !cert.HasPrincipal(Configs.StepUsername) {
+			details = append(details, fmt.Sprintf("%v is not for %v (principals %v)", cert.KeyId, Configs.StepUsername, cert.Principals))
+			continue
+		}
+
+		validAfter, validBefore := cert.ValidAfter, cert.ValidBefore
+		details = append(details, fmt.Sprintf("%v: serial %v, principals %v, valid %v to %v, signed by %v", cert.KeyId, cert.Serial,
+			cert.Principals, validAfter.Format(time.RFC3339), cert.ValidBeforeText(), cert.SigningCa))
+
+		validLocally := cert.ValidAt(now)
+		validForCa := cert.ValidAt(caNow)
+		switch {
+		case validLocally && validForCa && validBefore.Sub(now) > DOCTOR_CERT_EXPIRY_WARN:
+			return DOCTOR_PASS, fmt.Sprintf("%v is valid for %v", cert.KeyId, validBefore.Sub(now).Round(time.Minute)), details
+		case validLocally && validForCa:
+			status, message = DOCTOR_WARN, fmt.Sprintf("%v expires in %v", cert.KeyId, validBefore.Sub(now).Round(time.Second))
+		case validLocally != validForCa && status == DOCTOR_FAIL:
+			status, message = DOCTOR_WARN, fmt.Sprintf("%v is valid by one clock only, local clock is %v %v the CA",
+				cert.KeyId, absDuration(d.skew).Round(time.Second), aheadOrBehind(d.skew))
+		case status == DOCTOR_FAIL && now.Before(validAfter):
+			message = fmt.Sprintf("%v is not yet valid", cert.KeyId)
+		case status == DOCTOR_FAIL:
+			message = fmt.Sprintf("%v expired %v ago", cert.KeyId, now.Sub(validBefore).Round(time.Second))
+		}
+	}
+	if !d.skewKnown {
+		details = append(details, "clock skew to the CA is unknown, only the local clock was checked")
+	}
+	return status, message, details
+}
+
+// Failures is an error when at least one check failed
+func (r *DoctorReportType) Failures() error {
+	if r.Failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v of %v checks failed", r.Failed, len(r.Checks))
+}
+
+func (r *DoctorReportType) WriteText(writer io.Writer) {
+	fmt.Fprintf(writer, "%v doctor, %v\n\n", APP_NAME, r.Time.Format("2006-01-02 15:04:05"))
+	for _, check := range r.Checks {
+		fmt.Fprintf(writer, "[%v] %v: %v\n", check.Status, check.Name, check.Message)
+		for _, detail := range check.Details {
+			fmt.Fprintf(writer, "       %v\n", detail)
+		}
+	}
+	fmt.Fprintf(writer, "\n%v passed, %v warnings, %v failed, %v skipped\n", r.Passed, r.Warned, r.Failed, r.Skipped)
+}
+
+func (r *DoctorReportType) WriteJson(writer io.Writer) error {
+	content, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(content, '\n'))
+	return err
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func aheadOrBehind(skew time.Duration) string {
+	if skew < 0 {
+		return "behind"
+	}
+	return "ahead of"
+}
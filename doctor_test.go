@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveTestDoctorCa serves the step-ca endpoints the doctor checks, with its clock offset from the local one
+func serveTestDoctorCa(t *testing.T, offset time.Duration) {
+	hostKey := readTestPublicKey(t, "ed25519")
+	serveTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+		switch r.URL.Path {
+		case STEP_CA_HEALTH_PATH:
+			writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+		case STEP_CA_PROVISIONERS_PATH:
+			writeJson(w, http.StatusOK, map[string]interface{}{"provisioners": []map[string]string{{"type": "OIDC", "name": "google"}}})
+		case STEP_CA_SSH_ROOTS_PATH:
+			writeJson(w, http.StatusOK, map[string][][]byte{"hostKey": {hostKey.Marshal()}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// newTestDoctorKey returns a user certificate of the agent, signed by a new CA
+func newTestDoctorKey(t *testing.T, certType uint32, principal string, validAfter time.Time, validBefore time.Time) *agent.Key {
+	signer, err := ssh.NewSignerFromKey(newTestEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ssh.NewSignerFromKey(newTestEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        certType,
+		KeyId:           principal + "@example.com",
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err = certificate.SignCert(rand.Reader, caKey); err != nil {
+		t.Fatal(err)
+	}
+	return &agent.Key{Format: certificate.Type(), Blob: certificate.Marshal(), Comment: certificate.KeyId}
+}
+
+func TestRunDoctor(t *testing.T) {
+	useTestConfigs(t)
+	keyring, _ := startTestAgent(t)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: newTestEd25519Key(t), Comment: "plain key"}); err != nil {
+		t.Fatal(err)
+	}
+	key, certificate := newTestCertificate(t, time.Now().Add(8*time.Hour))
+	if err := AddCertificateToAgent(Configs.UpstreamAgent, key, certificate); err != nil {
+		t.Fatal(err)
+	}
+	serveTestDoctorCa(t, 0)
+
+	report := RunDoctor()
+	checks := map[string]DoctorCheckType{}
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	for name, status := range map[string]DoctorStatusType{
+		"Upstream agent":              DOCTOR_PASS,
+		"Identities":                  DOCTOR_PASS,
+		"Signature plain key":         DOCTOR_PASS,
+		"Signature alice@example.com": DOCTOR_PASS,
+		"Step CA":                     DOCTOR_PASS,
+		"Clock skew":                  DOCTOR_PASS,
+		"User certificate":            DOCTOR_PASS,
+	} {
+		if check, ok := checks[name]; !ok || check.Status != status {
+			t.Errorf("%v: %+v, expected %v", name, check, status)
+		}
+	}
+	if message := checks["Identities"].Message; message != "2 keys" {
+		t.Errorf("identities: %v", message)
+	}
+	if details := strings.Join(checks["Step CA"].Details, "\n"); !strings.Contains(details, "1 provisioners") || !strings.Contains(details, "0 SSH user CA keys, 1 SSH host CA keys") {
+		t.Errorf("step CA details: %v", details)
+	}
+	if report.Passed+report.Warned+report.Failed+report.Skipped != len(report.Checks) {
+		t.Errorf("%v checks counted as %v passed, %v warned, %v failed, %v skipped", len(report.Checks), report.Passed, report.Warned, report.Failed, report.Skipped)
+	}
+
+	text := &bytes.Buffer{}
+	report.WriteText(text)
+	if !strings.Contains(text.String(), "[PASS] User certificate: alice@example.com is valid for ") {
+		t.Errorf("text report:\n%v", text)
+	}
+	content := &bytes.Buffer{}
+	if err := report.WriteJson(content); err != nil {
+		t.Fatal(err)
+	}
+	decoded := DoctorReportType{}
+	if err := json.Unmarshal(content.Bytes(), &decoded); err != nil || len(decoded.Checks) != len(report.Checks) || decoded.Passed != report.Passed {
+		t.Errorf("json report %+v, error %v", decoded, err)
+	}
+}
+
+func TestRunDoctorWithoutUpstreamAgent(t *testing.T) {
+	useTestConfigs(t)
+	_, address := startTestAgent(t)
+	Configs.UpstreamAgent = address + ".missing"
+
+	report := RunDoctor()
+	for _, check := range report.Checks {
+		switch check.Name {
+		case "Upstream agent":
+			if check.Status != DOCTOR_FAIL {
+				t.Errorf("%v: %+v", check.Name, check)
+			}
+		case "Identities", "User certificate", "Clock skew":
+			if check.Status != DOCTOR_SKIP {
+				t.Errorf("%v: %+v", check.Name, check)
+			}
+		case "Step CA":
+			if check.Status != DOCTOR_FAIL || check.Message != "no step CA configured" {
+				t.Errorf("%v: %+v", check.Name, check)
+			}
+		}
+	}
+	if err := report.Failures(); err == nil {
+		t.Error("no failures")
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  time.Duration
+		status  DoctorStatusType
+		message string
+	}{
+		{"same clock", 0, DOCTOR_PASS, "ahead of the CA"},
+		{"local clock behind", 2 * time.Minute, DOCTOR_WARN, "behind the CA"},
+		{"local clock ahead", -10 * time.Minute, DOCTOR_FAIL, "ahead of the CA"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfigs(t)
+			serveTestDoctorCa(t, test.offset)
+
+			d := &DoctorType{}
+			status, message, _ := d.checkClockSkew()
+			if status != test.status || !d.skewKnown {
+				t.Errorf("status %v, skew known %v, expected %v", status, d.skewKnown, test.status)
+			}
+			// the Date header has a resolution of one second, so has the skew
+			if !strings.HasSuffix(message, test.message) {
+				t.Errorf("message %q, expected %q", message, test.message)
+			}
+		})
+	}
+
+	t.Run("no Date header", func(t *testing.T) {
+		useTestConfigs(t)
+		serveTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Date"] = nil
+			writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+		}))
+		d := &DoctorType{}
+		if status, message, _ := d.checkClockSkew(); status != DOCTOR_WARN || d.skewKnown {
+			t.Errorf("status %v %q, skew known %v", status, message, d.skewKnown)
+		}
+	})
+
+	t.Run("no step CA", func(t *testing.T) {
+		useTestConfigs(t)
+		if status, _, _ := (&DoctorType{}).checkClockSkew(); status != DOCTOR_SKIP {
+			t.Errorf("status %v, expected %v", status, DOCTOR_SKIP)
+		}
+	})
+}
+
+func TestCheckUserCertificate(t *testing.T) {
+	now := time.Now()
+	valid := func(validFor time.Duration) *agent.Key {
+		return newTestDoctorKey(t, ssh.UserCert, "alice", now.Add(-time.Minute), now.Add(validFor))
+	}
+	plainKey, err := ssh.NewSignerFromKey(newTestEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		keys      []*agent.Key
+		skew      time.Duration
+		skewKnown bool
+		status    DoctorStatusType
+		message   string
+		detail    string
+	}{
+		{"no keys", nil, 0, true, DOCTOR_FAIL, "no user certificate in the agent", ""},
+		{"plain key", []*agent.Key{{Format: ssh.KeyAlgoED25519, Blob: plainKey.PublicKey().Marshal()}}, 0, true, DOCTOR_FAIL, "no user certificate in the agent", ""},
+		{"host certificate", []*agent.Key{newTestDoctorKey(t, ssh.HostCert, "alice", now.Add(-time.Minute), now.Add(8*time.Hour))}, 0, true,
+			DOCTOR_FAIL, "no user certificate in the agent", ""},
+		{"valid", []*agent.Key{valid(8 * time.Hour)}, 0, true, DOCTOR_PASS, "alice@example.com is valid for 8h0m0s", "alice@example.com: serial 0, principals [alice]"},
+		{"expires soon", []*agent.Key{valid(30 * time.Minute)}, 0, true, DOCTOR_WARN, "alice@example.com expires in ", ""},
+		{"expired", []*agent.Key{newTestDoctorKey(t, ssh.UserCert, "alice", now.Add(-2*time.Hour), now.Add(-time.Hour))}, 0, true,
+			DOCTOR_FAIL, "alice@example.com expired ", ""},
+		{"not yet valid", []*agent.Key{newTestDoctorKey(t, ssh.UserCert, "alice", now.Add(time.Hour), now.Add(8*time.Hour))}, 0, true,
+			DOCTOR_FAIL, "alice@example.com is not yet valid", ""},
+		{"other user", []*agent.Key{newTestDoctorKey(t, ssh.UserCert, "bob", now.Add(-time.Minute), now.Add(8*time.Hour))}, 0, true,
+			DOCTOR_FAIL, "no user certificate in the agent", "bob@example.com is not for alice (principals [bob])"},
+		{"valid by the local clock only", []*agent.Key{valid(8 * time.Hour)}, 10 * time.Minute, true,
+			DOCTOR_WARN, "alice@example.com is valid by one clock only, local clock is 10m0s ahead of the CA", ""},
+		{"the longest valid wins", []*agent.Key{valid(30 * time.Minute), valid(8 * time.Hour)}, 0, true, DOCTOR_PASS, "alice@example.com is valid for 8h0m0s", ""},
+		{"unknown clock skew", []*agent.Key{valid(30 * time.Minute)}, 0, false,
+			DOCTOR_WARN, "alice@example.com expires in ", "clock skew to the CA is unknown, only the local clock was checked"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfigs(t)
+			d := &DoctorType{client: agent.NewKeyring().(agent.ExtendedAgent), keys: test.keys, skew: test.skew, skewKnown: test.skewKnown}
+			status, message, details := d.checkUserCertificate()
+			// the validity of certificates has a resolution of one second
+			if status != test.status || !strings.HasPrefix(message, test.message) {
+				t.Errorf("%v %q, expected %v %q", status, message, test.status, test.message)
+			}
+			if test.detail != "" && !strings.Contains(strings.Join(details, "\n"), test.detail) {
+				t.Errorf("details %q, expected %q", details, test.detail)
+			}
+		})
+	}
+
+	if status, _, _ := (&DoctorType{}).checkUserCertificate(); status != DOCTOR_SKIP {
+		t.Errorf("without an upstream agent: status %v, expected %v", status, DOCTOR_SKIP)
+	}
+}
@@ -31,10 +31,34 @@ var (
 	STEPERR_UNKNOWN_ERROR = errors.New("unknown step error")
 
 	STEPERR_IDENTITY_NOT_FOUND = errors.New("Identity not found")
+
+	STEPERR_INTERACTIVE_LOGIN_REQUIRED = errors.New("interactive login required")
+
+	STEPERR_PROFILE_NOT_FOUND = errors.New("profile not found")
+
+	STEPERR_UNSUPPORTED_PROVISIONER = errors.New("provisioner is not supported for login")
+	STEPERR_X5C_NOT_CONFIGURED      = errors.New("X5C provisioner needs a certificate and key in configs")
+	STEPERR_SSHPOP_NOT_CONFIGURED   = errors.New("SSHPOP provisioner needs an ssh certificate and key in configs")
+	STEPERR_LOGIN_CANCELLED         = errors.New("login cancelled")
+	STEPERR_LOGIN_IN_PROGRESS       = errors.New("another login is running, e.g. the renewal of the certificate")
+
+	STEPERR_UNAUTHORIZED = errors.New("CA rejected the credentials")
+	STEPERR_UNTRUSTED_CA = errors.New("CA certificate is not trusted")
 )
 
 // END: StepCli Errors Section
 
+// BEGIN: StepCa Client Errors Section
+
+var (
+	STEPCAERR_UNREACHABLE      = errors.New("step CA is not reachable")
+	STEPCAERR_UNHEALTHY        = errors.New("step CA is not healthy")
+	STEPCAERR_REQUEST_FAILED   = errors.New("step CA request failed")
+	STEPCAERR_INVALID_RESPONSE = errors.New("invalid response from step CA")
+)
+
+// END: StepCa Client Errors Section
+
 // BEGIN: PowerShell Errors Type
 
 var (
@@ -44,3 +68,114 @@ var (
 )
 
 // END: PowerShell Errors Type
+
+// BEGIN: Command Runner Errors Section
+
+var (
+	CMDERR_EMPTY_COMMAND       = errors.New("empty command")
+	CMDERR_EXECUTION_FAILED    = errors.New("command could not be run")
+	CMDERR_UNEXPECTED_COMMAND  = errors.New("command does not match the recording")
+	CMDERR_RECORDING_EXHAUSTED = errors.New("no recorded command left")
+)
+
+// END: Command Runner Errors Section
+
+// BEGIN: Agent Errors Section
+
+var (
+	AGENTERR_UNREACHABLE       = errors.New("ssh-agent is not reachable")
+	AGENTERR_MESSAGE_TOO_LONG  = errors.New("agent message too long")
+	AGENTERR_UNEXPECTED_REPLY  = errors.New("unexpected reply from ssh-agent")
+	AGENTERR_MALFORMED_MESSAGE = errors.New("malformed agent message")
+)
+
+// END: Agent Errors Section
+
+// BEGIN: PageantProxy Errors Section
+
+var (
+	PROXYERR_PEER_UNKNOWN      = errors.New("could not determine peer credentials")
+	PROXYERR_PEER_FOREIGN_USER = errors.New("peer connection belongs to another user")
+
+	PROXYERR_CLIENT_UNKNOWN_EXECUTABLE = errors.New("client executable could not be resolved")
+	PROXYERR_CLIENT_DENIED             = errors.New("client executable is denylisted")
+	PROXYERR_CLIENT_NOT_ALLOWED        = errors.New("client executable is not allowlisted")
+
+	PROXYERR_MAP_TOO_SMALL      = errors.New("shared memory view is too small")
+	PROXYERR_REQUEST_TOO_LARGE  = errors.New("agent request is too large")
+	PROXYERR_RESPONSE_TOO_LARGE = errors.New("agent response does not fit into shared memory")
+	PROXYERR_MALFORMED_RESPONSE = errors.New("agent response is malformed")
+	PROXYERR_UPSTREAM_FAILED    = errors.New("agent request failed upstream")
+	PROXYERR_REQUEST_TIMEOUT    = errors.New("agent request was not answered in time")
+
+	PROXYERR_QUEUE_FULL    = errors.New("proxy queue is full")
+	PROXYERR_QUEUE_TIMEOUT = errors.New("timed out waiting in proxy queue")
+
+	PROXYERR_LISTENER_EXITED = errors.New("proxy listener exited unexpectedly")
+)
+
+// END: PageantProxy Errors Section
+
+// BEGIN: PPK Errors Section
+
+var (
+	PPKERR_INVALID_FORMAT         = errors.New("not a valid PuTTY private key file")
+	PPKERR_UNSUPPORTED_VERSION    = errors.New("unsupported PuTTY private key file version")
+	PPKERR_UNSUPPORTED_ALGORITHM  = errors.New("unsupported key algorithm")
+	PPKERR_UNSUPPORTED_ENCRYPTION = errors.New("unsupported private key encryption")
+	PPKERR_UNSUPPORTED_DERIVATION = errors.New("unsupported key derivation")
+	PPKERR_PASSPHRASE_REQUIRED    = errors.New("private key is encrypted, a passphrase is required")
+	PPKERR_WRONG_PASSPHRASE       = errors.New("wrong passphrase")
+	PPKERR_MAC_MISMATCH           = errors.New("private key file is corrupt, MAC does not match")
+	PPKERR_INVALID_KEY            = errors.New("private key does not match its public key")
+)
+
+// END: PPK Errors Section
+
+// BEGIN: Key Format Errors Section
+
+var (
+	KEYERR_UNKNOWN_FORMAT      = errors.New("unknown key file format")
+	KEYERR_PASSPHRASE_MISMATCH = errors.New("passphrases do not match")
+)
+
+// END: Key Format Errors Section
+
+// BEGIN: SSH Certificate Errors Section
+
+var (
+	SSHCERTERR_NOT_A_CERTIFICATE   = errors.New("key is not a certificate")
+	SSHCERTERR_INVALID_CERTIFICATE = errors.New("invalid ssh certificate")
+)
+
+// END: SSH Certificate Errors Section
+
+// BEGIN: OIDC Login Errors Section
+
+var (
+	OIDCERR_NOT_OIDC_PROVISIONER = errors.New("provisioner is not an OIDC provisioner")
+	OIDCERR_DISCOVERY_FAILED     = errors.New("OIDC configuration discovery failed")
+	OIDCERR_STATE_MISMATCH       = errors.New("OIDC redirect state does not match")
+	OIDCERR_AUTHORIZATION_DENIED = errors.New("OIDC authorization denied")
+	OIDCERR_TOKEN_FAILED         = errors.New("OIDC token request failed")
+	OIDCERR_NONCE_MISMATCH       = errors.New("OIDC id_token nonce does not match")
+	OIDCERR_TIMEOUT              = errors.New("OIDC login timed out")
+)
+
+// END: OIDC Login Errors Section
+
+// BEGIN: Known Hosts Errors Section
+
+var (
+	KNOWNHOSTSERR_BROKEN_BLOCK = errors.New("managed block in known_hosts is broken, fix or remove it by hand")
+)
+
+// END: Known Hosts Errors Section
+
+// BEGIN: SSH Config Errors Section
+
+var (
+	SSHCONFIGERR_INVALID_TEMPLATE = errors.New("invalid ssh config template")
+)
+
+// END: SSH Config Errors Section
@@ -5,11 +5,11 @@ go 1.17
 require (
 	github.com/Microsoft/go-winio v0.5.0
 	github.com/lxn/walk v0.0.0-20210112085537-c389da54e794
-	github.com/lxn/win v0.0.0-20210218163916-a377121e959e // indirect
-	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
-	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
+	github.com/lxn/win v0.0.0-20210218163916-a377121e959e
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6
 )
 
-replace (
-   github.com/qng95/winssh-pageant-ui => ./
-)
\ No newline at end of file
+require gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
+
+replace github.com/qng95/winssh-pageant-ui => ./
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HealthStateType int
+
+const (
+	HEALTH_STATE_UNKNOWN HealthStateType = iota
+	HEALTH_STATE_OK
+	HEALTH_STATE_DEGRADED
+	HEALTH_STATE_DOWN
+)
+
+const (
+	HEALTH_WINDOW                = 5 * time.Minute
+	HEALTH_WINDOW_MAX_SAMPLES    = 256
+	HEALTH_DEGRADED_SUCCESS_RATE = 0.8
+	HEALTH_DOWN_AFTER_FAILURES   = 3
+)
+
+func (s HealthStateType) String() string {
+	switch s {
+	case HEALTH_STATE_OK:
+		return "OK"
+	case HEALTH_STATE_DEGRADED:
+		return "DEGRADED"
+	case HEALTH_STATE_DOWN:
+		return "DOWN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// HealthSnapshotType is a consistent copy of a HealthType taken at one point in time
+type HealthSnapshotType struct {
+	Name                string
+	State               HealthStateType
+	LastError           string
+	LastErrorAt         time.Time
+	ConsecutiveFailures int
+	SuccessRate         float64
+	Samples             int
+	LastSuccessAt       time.Time
+}
+
+func (s HealthSnapshotType) String() string {
+	text := fmt.Sprintf("%v: %v", s.Name, s.State)
+	if s.Samples > 0 {
+		text = text + fmt.Sprintf(", %.0f%% ok", s.SuccessRate*100)
+	}
+	if s.ConsecutiveFailures > 0 {
+		text = text + fmt.Sprintf(", %v failures in a row", s.ConsecutiveFailures)
+	}
+	if s.State != HEALTH_STATE_OK && s.LastError != "" {
+		text = text + fmt.Sprintf(", last error at %v: %v", s.LastErrorAt.Format("15:04:05"), s.LastError)
+	}
+	return text
+}
+
+type healthSampleType struct {
+	at time.Time
+	ok bool
+}
+
+// HealthType tracks one listener or upstream: whether it runs at all, and how its recent requests went
+type HealthType struct {
+	mu                  sync.Mutex
+	name                string
+	running             bool
+	down                bool
+	lastError           error
+	lastErrorAt         time.Time
+	consecutiveFailures int
+	lastSuccessAt       time.Time
+	samples             []healthSampleType
+}
+
+func NewHealth(name string) *HealthType {
+	return &HealthType{name: name}
+}
+
+// MarkUp records that the listener is accepting requests again
+func (h *HealthType) MarkUp() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = true
+	h.down = false
+	h.consecutiveFailures = 0
+}
+
+// MarkDown records that the listener or upstream is not able to serve requests at all
+func (h *HealthType) MarkDown(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = false
+	h.down = true
+	if err != nil {
+		h.lastError = err
+		h.lastErrorAt = time.Now()
+	}
+}
+
+// MarkStopped records an intentional stop, which is neither healthy nor a failure
+func (h *HealthType) MarkStopped() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = false
+	h.down = false
+}
+
+func (h *HealthType) RecordSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.consecutiveFailures = 0
+	h.lastSuccessAt = now
+	h.addSample(now, true)
+}
+
+func (h *HealthType) RecordFailure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.consecutiveFailures++
+	h.lastError = err
+	h.lastErrorAt = now
+	h.addSample(now, false)
+}
+
+func (h *HealthType) addSample(now time.Time, ok bool) {
+	h.samples = append(h.samples, healthSampleType{at: now, ok: ok})
+	h.pruneSamples(now)
+}
+
+func (h *HealthType) pruneSamples(now time.Time) {
+	first := 0
+	for first < len(h.samples) && (now.Sub(h.samples[first].at) > HEALTH_WINDOW || len(h.samples)-first > HEALTH_WINDOW_MAX_SAMPLES) {
+		first++
+	}
+	h.samples = h.samples[first:]
+}
+
+func (h *HealthType) Snapshot() HealthSnapshotType {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pruneSamples(time.Now())
+
+	snapshot := HealthSnapshotType{
+		Name:                h.name,
+		LastErrorAt:         h.lastErrorAt,
+		ConsecutiveFailures: h.consecutiveFailures,
+		Samples:             len(h.samples),
+		LastSuccessAt:       h.lastSuccessAt,
+	}
+	if h.lastError != nil {
+		snapshot.LastError = h.lastError.Error()
+	}
+
+	succeeded := 0
+	for _, sample := range h.samples {
+		if sample.ok {
+			succeeded++
+		}
+	}
+	if len(h.samples) > 0 {
+		snapshot.SuccessRate = float64(succeeded) / float64(len(h.samples))
+	}
+
+	switch {
+	case h.down || h.consecutiveFailures >= HEALTH_DOWN_AFTER_FAILURES:
+		snapshot.State = HEALTH_STATE_DOWN
+	case h.consecutiveFailures > 0 || (len(h.samples) > 0 && snapshot.SuccessRate < HEALTH_DEGRADED_SUCCESS_RATE):
+		snapshot.State = HEALTH_STATE_DEGRADED
+	case h.running || !h.lastSuccessAt.IsZero():
+		snapshot.State = HEALTH_STATE_OK
+	default:
+		snapshot.State = HEALTH_STATE_UNKNOWN
+	}
+	return snapshot
+}
+
+// HealthRegistryType holds the health of every listener and upstream by name
+type HealthRegistryType struct {
+	mu      sync.Mutex
+	entries map[string]*HealthType
+}
+
+func NewHealthRegistry() *HealthRegistryType {
+	return &HealthRegistryType{entries: make(map[string]*HealthType)}
+}
+
+// Get returns the health with that name, creating it on first use
+func (r *HealthRegistryType) Get(name string) *HealthType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	health, ok := r.entries[name]
+	if !ok {
+		health = NewHealth(name)
+		r.entries[name] = health
+	}
+	return health
+}
+
+func (r *HealthRegistryType) Remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, name)
+}
+
+func (r *HealthRegistryType) Snapshots() []HealthSnapshotType {
+	r.mu.Lock()
+	entries := make([]*HealthType, 0, len(r.entries))
+	for _, health := range r.entries {
+		entries = append(entries, health)
+	}
+	r.mu.Unlock()
+
+	snapshots := make([]HealthSnapshotType, 0, len(entries))
+	for _, health := range entries {
+		snapshots = append(snapshots, health.Snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots
+}
+
+// Summary renders one short "name STATE" entry per health, e.g. for a tray tooltip
+func (r *HealthRegistryType) Summary() string {
+	parts := []string{}
+	for _, snapshot := range r.Snapshots() {
+		parts = append(parts, fmt.Sprintf("%v %v", snapshot.Name, snapshot.State))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	KEY_FORMAT_PPK             = "ppk"
+	KEY_FORMAT_OPENSSH         = "openssh"
+	KEY_FORMAT_AUTHORIZED_KEYS = "authorized-keys"
+	KEY_FORMAT_RFC4716         = "rfc4716"
+
+	RFC4716_BEGIN       = "---- BEGIN SSH2 PUBLIC KEY ----"
+	RFC4716_END         = "---- END SSH2 PUBLIC KEY ----"
+	RFC4716_LINE_LENGTH = 70
+)
+
+var KEY_FORMATS = []string{KEY_FORMAT_PPK, KEY_FORMAT_OPENSSH, KEY_FORMAT_AUTHORIZED_KEYS, KEY_FORMAT_RFC4716}
+
+// KeyConversionType says what ConvertKey writes. PpkVersion is 2 or 3, Passphrase encrypts private keys
+// and may be empty.
+type KeyConversionType struct {
+	Format     string
+	PpkVersion int
+	Passphrase []byte
+}
+
+// ConvertKey reads a PPK file, an OpenSSH private key or a PEM private key and writes it in conversion.Format.
+// Public key formats also accept public keys and do not need the passphrase of PPK and OpenSSH files.
+func ConvertKey(content []byte, conversion KeyConversionType, prompt PassphrasePromptFunc) ([]byte, error) {
+	switch conversion.Format {
+	case KEY_FORMAT_PPK, KEY_FORMAT_OPENSSH:
+		key, err := ReadPrivateKey(content, prompt)
+		if err != nil {
+			return nil, err
+		}
+		if conversion.Format == KEY_FORMAT_PPK {
+			return MarshalPpk(key, conversion.PpkVersion, conversion.Passphrase)
+		}
+		return MarshalOpenSshKey(key, conversion.Passphrase)
+
+	case KEY_FORMAT_AUTHORIZED_KEYS, KEY_FORMAT_RFC4716:
+		publicBlob, comment, err := ReadPublicKey(content, prompt)
+		if err != nil {
+			return nil, err
+		}
+		if conversion.Format == KEY_FORMAT_AUTHORIZED_KEYS {
+			return MarshalAuthorizedKey(publicBlob, comment), nil
+		}
+		return MarshalRfc4716PublicKey(publicBlob, comment), nil
+	}
+	return nil, fmt.Errorf("%w: %v", KEYERR_UNKNOWN_FORMAT, conversion.Format)
+}
+
+// ReadPrivateKey decrypts a PPK file, an OpenSSH private key or a PEM private key (PKCS#1, SEC 1, PKCS#8),
+// asking for the passphrase with prompt if it is encrypted
+func ReadPrivateKey(content []byte, prompt PassphrasePromptFunc) (*PpkKeyType, error) {
+	if isPpk(content) {
+		ppkFile, err := ParsePpk(content)
+		if err != nil {
+			return nil, err
+		}
+		return DecryptPpk(ppkFile, prompt)
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, KEYERR_UNKNOWN_FORMAT
+	}
+	privateKey, err := ssh.ParseRawPrivateKey(content)
+	var passphraseMissing *ssh.PassphraseMissingError
+	if !errors.As(err, &passphraseMissing) {
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", KEYERR_UNKNOWN_FORMAT, err)
+		}
+		return NewPpkKey(privateKey, openSshKeyComment(block))
+	}
+
+	// legacy encrypted PEM keys are what ssh-keygen wrote before OpenSSH 7.8, they have no public key in the clear
+	title, name := "Unlock private key", block.Type
+	if passphraseMissing.PublicKey != nil {
+		title, name = "Unlock OpenSSH key", KeyFingerprint(passphraseMissing.PublicKey.Marshal())
+	}
+	return promptDecrypt(title, name, prompt, func(passphrase []byte) (*PpkKeyType, error) {
+		privateKey, err := ssh.ParseRawPrivateKeyWithPassphrase(content, passphrase)
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, PPKERR_WRONG_PASSPHRASE
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", KEYERR_UNKNOWN_FORMAT, err)
+		}
+		return NewPpkKey(privateKey, "")
+	})
+}
+
+// ReadPublicKey returns the public key and comment of a private key file or of a public key in the
+// authorized_keys or RFC 4716 format. Only legacy PEM keys need their passphrase for this.
+func ReadPublicKey(content []byte, prompt PassphrasePromptFunc) (publicBlob []byte, comment string, err error) {
+	if isPpk(content) {
+		ppkFile, err := ParsePpk(content)
+		if err != nil {
+			return nil, "", err
+		}
+		return ppkFile.PublicBlob, ppkFile.Comment, nil
+	}
+
+	if block, _ := pem.Decode(content); block != nil {
+		// the comment of an encrypted OpenSSH key is encrypted with the private key
+		_, err := ssh.ParseRawPrivateKey(content)
+		var passphraseMissing *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseMissing) && passphraseMissing.PublicKey != nil {
+			return passphraseMissing.PublicKey.Marshal(), "", nil
+		}
+		key, err := ReadPrivateKey(content, prompt)
+		if err != nil {
+			return nil, "", err
+		}
+		return key.PublicBlob, key.Comment, nil
+	}
+
+	if bytes.Contains(content, []byte(RFC4716_BEGIN)) {
+		return ParseRfc4716PublicKey(content)
+	}
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, "", KEYERR_UNKNOWN_FORMAT
+	}
+	return publicKey.Marshal(), comment, nil
+}
+
+// MarshalAuthorizedKey writes one authorized_keys line
+func MarshalAuthorizedKey(publicBlob []byte, comment string) []byte {
+	line := KeyTypeOf(publicBlob) + " " + base64.StdEncoding.EncodeToString(publicBlob)
+	if comment != "" {
+		line += " " + comment
+	}
+	return []byte(line + "\n")
+}
+
+// MarshalRfc4716PublicKey writes the SSH2 public key format of RFC 4716, which PuTTYgen and commercial
+// SSH servers use. Header lines longer than 72 bytes are continued with a backslash.
+func MarshalRfc4716PublicKey(publicBlob []byte, comment string) []byte {
+	out := &bytes.Buffer{}
+	out.WriteString(RFC4716_BEGIN + "\n")
+	if comment != "" {
+		header := fmt.Sprintf("Comment: \"%v\"", strings.ReplaceAll(comment, "\"", "\\\""))
+		for len(header) > RFC4716_LINE_LENGTH+2 {
+			out.WriteString(header[:RFC4716_LINE_LENGTH+1] + "\\\n")
+			header = header[RFC4716_LINE_LENGTH+1:]
+		}
+		out.WriteString(header + "\n")
+	}
+	encoded := base64.StdEncoding.EncodeToString(publicBlob)
+	for len(encoded) > RFC4716_LINE_LENGTH {
+		out.WriteString(encoded[:RFC4716_LINE_LENGTH] + "\n")
+		encoded = encoded[RFC4716_LINE_LENGTH:]
+	}
+	out.WriteString(encoded + "\n")
+	out.WriteString(RFC4716_END + "\n")
+	return out.Bytes()
+}
+
+// ParseRfc4716PublicKey reads the key and the Comment header of an RFC 4716 public key
+func ParseRfc4716PublicKey(content []byte) (publicBlob []byte, comment string, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	inside, header := false, ""
+	encoded := strings.Builder{}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == RFC4716_BEGIN:
+			inside = true
+		case !inside:
+		case line == RFC4716_END:
+			publicBlob, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err != nil {
+				return nil, "", fmt.Errorf("%w: %v", KEYERR_UNKNOWN_FORMAT, err)
+			}
+			if _, err = ssh.ParsePublicKey(publicBlob); err != nil {
+				return nil, "", fmt.Errorf("%w: %v", KEYERR_UNKNOWN_FORMAT, err)
+			}
+			return publicBlob, comment, nil
+		case header != "" || strings.Contains(line, ":"):
+			header += line
+			if strings.HasSuffix(header, "\\") {
+				header = strings.TrimSuffix(header, "\\")
+				continue
+			}
+			parts := strings.SplitN(header, ":", 2)
+			if strings.EqualFold(strings.TrimSpace(parts[0]), "Comment") {
+				comment = strings.Trim(strings.TrimSpace(parts[1]), "\"")
+				comment = strings.ReplaceAll(comment, "\\\"", "\"")
+			}
+			header = ""
+		default:
+			encoded.WriteString(line)
+		}
+	}
+	return nil, "", fmt.Errorf("%w: missing %v", KEYERR_UNKNOWN_FORMAT, RFC4716_END)
+}
+
+func isPpk(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimPrefix(content, []byte("\ufeff")), []byte(PPK_HEADER_PREFIX))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	KNOWN_HOSTS_BEGIN_MARKER    = "# BEGIN winssh-pageant-ui host CAs: "
+	KNOWN_HOSTS_END_MARKER      = "# END winssh-pageant-ui host CAs: "
+	KNOWN_HOSTS_CERT_AUTHORITY  = "@cert-authority"
+	KNOWN_HOSTS_ALL_HOSTS       = "*"
+	KNOWN_HOSTS_DEFAULT_BLOCK   = "default"
+	KNOWN_HOSTS_FILE_PERMISSION = 0644
+)
+
+// KnownHostsType keeps one block of @cert-authority lines per profile in the user's known_hosts, with
+// the host CA keys of the profile's step-ca. Lines outside of the blocks are never changed.
+type KnownHostsType struct {
+	mu sync.Mutex
+}
+
+var KnownHosts *KnownHostsType = &KnownHostsType{}
+
+// knownHostsBlockType is where a managed block is in the lines of known_hosts, begin and end are the marker lines
+type knownHostsBlockType struct {
+	begin int
+	end   int
+}
+
+// Path returns the known_hosts file of the configs, or the one of OpenSSH
+func (k *KnownHostsType) Path() string {
+	if Configs.KnownHostsPath != "" {
+		return Configs.KnownHostsPath
+	}
+	return filepath.Join(USER_HOME_DIR, ".ssh", "known_hosts")
+}
+
+// Sync writes the current host CA keys of the active profile into its block and removes the blocks of
+// deleted profiles. When ManagedKnownHosts is off, all managed blocks are removed.
+func (k *KnownHostsType) Sync() error {
+	if !Configs.ManagedKnownHosts {
+		return k.Prune(nil)
+	}
+
+	client, err := StepCli.caClient()
+	if err != nil {
+		return err
+	}
+	sshRoots, err := client.SshRoots()
+	if err != nil {
+		return err
+	}
+
+	name, patterns := KNOWN_HOSTS_DEFAULT_BLOCK, Configs.KnownHostsPatterns
+	if profile := Profiles.Active(); profile != nil {
+		name = profile.Name
+		if len(profile.KnownHostsPatterns) > 0 {
+			patterns = profile.KnownHostsPatterns
+		}
+	}
+	if err = k.Update(name, sshRoots.HostKeys, patterns); err != nil {
+		return err
+	}
+	return k.Prune(append(Profiles.Names(), name))
+}
+
+// Update replaces the block name with @cert-authority lines of hostKeys for the host patterns, all hosts
+// when there are none. Keys no longer served by the CA drop out, which is how a rotation ends.
+func (k *KnownHostsType) Update(name string, hostKeys []ssh.PublicKey, patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = []string{KNOWN_HOSTS_ALL_HOSTS}
+	}
+	lines := []string{KNOWN_HOSTS_BEGIN_MARKER + name}
+	for _, key := range hostKeys {
+		authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		lines = append(lines, fmt.Sprintf("%v %v %v %v host CA", KNOWN_HOSTS_CERT_AUTHORITY, strings.Join(patterns, ","), authorizedKey, name))
+	}
+	lines = append(lines, KNOWN_HOSTS_END_MARKER+name)
+
+	return k.edit(func(fileLines []string, blocks map[string]knownHostsBlockType) []string {
+		block, ok := blocks[name]
+		if !ok {
+			return append(fileLines, lines...)
+		}
+		updated := append([]string{}, fileLines[:block.begin]...)
+		updated = append(updated, lines...)
+		return append(updated, fileLines[block.end+1:]...)
+	})
+}
+
+// Remove deletes the block name
+func (k *KnownHostsType) Remove(name string) error {
+	return k.edit(func(fileLines []string, blocks map[string]knownHostsBlockType) []string {
+		block, ok := blocks[name]
+		if !ok {
+			return fileLines
+		}
+		return append(append([]string{}, fileLines[:block.begin]...), fileLines[block.end+1:]...)
+	})
+}
+
+// Prune deletes the blocks whose name is not in keep
+func (k *KnownHostsType) Prune(keep []string) error {
+	return k.edit(func(fileLines []string, blocks map[string]knownHostsBlockType) []string {
+		removed := map[int]bool{}
+		for name, block := range blocks {
+			if containsString(keep, name) {
+				continue
+			}
+			Logger.Info("KnownHosts: removing host CAs of '%v'", name)
+			for i := block.begin; i <= block.end; i++ {
+				removed[i] = true
+			}
+		}
+
+		kept := []string{}
+		for i, line := range fileLines {
+			if !removed[i] {
+				kept = append(kept, line)
+			}
+		}
+		return kept
+	})
+}
+
+// edit rewrites known_hosts with the lines change returns, when they differ from the current ones.
+// The file keeps its line endings.
+func (k *KnownHostsType) edit(change func(lines []string, blocks map[string]knownHostsBlockType) []string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	path := k.Path()
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	newline := "\n"
+	if strings.Contains(string(content), "\r\n") {
+		newline = "\r\n"
+	}
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	trailingNewline := text == "" || strings.HasSuffix(text, "\n")
+	lines := []string{}
+	if text != "" {
+		lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	}
+
+	blocks, err := parseKnownHostsBlocks(lines)
+	if err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	updated := change(lines, blocks)
+
+	newText := strings.Join(updated, "\n")
+	if len(updated) > 0 && trailingNewline {
+		newText += "\n"
+	}
+	if newText == text {
+		return nil
+	}
+	Logger.Info("KnownHosts: updating managed host CAs in %v", path)
+	return WriteFileAtomically(path, []byte(strings.ReplaceAll(newText, "\n", newline)), KNOWN_HOSTS_FILE_PERMISSION)
+}
+
+// parseKnownHostsBlocks finds the managed blocks. A block without its end marker, or nested in another
+// one, fails the parse: guessing where it ends could remove lines the user wrote.
+func parseKnownHostsBlocks(lines []string) (map[string]knownHostsBlockType, error) {
+	blocks := map[string]knownHostsBlockType{}
+	open, begin := "", -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, KNOWN_HOSTS_BEGIN_MARKER):
+			name := strings.TrimPrefix(line, KNOWN_HOSTS_BEGIN_MARKER)
+			if begin >= 0 {
+				return nil, fmt.Errorf("%w: '%v' begins inside '%v' on line %v", KNOWNHOSTSERR_BROKEN_BLOCK, name, open, i+1)
+			}
+			if _, ok := blocks[name]; ok {
+				return nil, fmt.Errorf("%w: '%v' appears twice", KNOWNHOSTSERR_BROKEN_BLOCK, name)
+			}
+			open, begin = name, i
+
+		case strings.HasPrefix(line, KNOWN_HOSTS_END_MARKER):
+			name := strings.TrimPrefix(line, KNOWN_HOSTS_END_MARKER)
+			if begin < 0 || name != open {
+				return nil, fmt.Errorf("%w: end of '%v' on line %v without its begin", KNOWNHOSTSERR_BROKEN_BLOCK, name, i+1)
+			}
+			blocks[name] = knownHostsBlockType{begin: begin, end: i}
+			open, begin = "", -1
+		}
+	}
+	if begin >= 0 {
+		return nil, fmt.Errorf("%w: '%v' has no end", KNOWNHOSTSERR_BROKEN_BLOCK, open)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// useTestKnownHosts writes content to a known_hosts in a temporary directory and makes it the one of the configs
+func useTestKnownHosts(t *testing.T, content string) string {
+	knownHostsPath := Configs.KnownHostsPath
+	t.Cleanup(func() { Configs.KnownHostsPath = knownHostsPath })
+	Configs.KnownHostsPath = filepath.Join(t.TempDir(), "known_hosts")
+	if content != "" {
+		if err := ioutil.WriteFile(Configs.KnownHostsPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Configs.KnownHostsPath
+}
+
+func readTestKnownHosts(t *testing.T) string {
+	content, err := ioutil.ReadFile(KnownHosts.Path())
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// knownHostsTestBlock is the block Update writes for name, with LF line endings
+func knownHostsTestBlock(name string, patterns string, keys ...ssh.PublicKey) string {
+	block := KNOWN_HOSTS_BEGIN_MARKER + name + "\n"
+	for _, key := range keys {
+		block += KNOWN_HOSTS_CERT_AUTHORITY + " " + patterns + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " " + name + " host CA\n"
+	}
+	return block + KNOWN_HOSTS_END_MARKER + name + "\n"
+}
+
+const knownHostsTestUserLines = "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n" +
+	"# a comment of the user\n"
+
+func TestKnownHostsUpdate(t *testing.T) {
+	ed25519Key, ecdsaKey := readTestPublicKey(t, "ed25519"), readTestPublicKey(t, "ecdsa256")
+	crlf := func(text string) string { return strings.ReplaceAll(text, "\n", "\r\n") }
+
+	tests := []struct {
+		name     string
+		content  string
+		keys     []ssh.PublicKey
+		patterns []string
+		expected string
+	}{
+		{"no known_hosts", "", []ssh.PublicKey{ed25519Key}, nil,
+			knownHostsTestBlock("production", "*", ed25519Key)},
+		{"appended after the lines of the user", knownHostsTestUserLines, []ssh.PublicKey{ed25519Key, ecdsaKey}, []string{"*.example.com", "10.0.0.*"},
+			knownHostsTestUserLines + knownHostsTestBlock("production", "*.example.com,10.0.0.*", ed25519Key, ecdsaKey)},
+		{"CRLF", crlf(knownHostsTestUserLines), []ssh.PublicKey{ed25519Key}, nil,
+			crlf(knownHostsTestUserLines + knownHostsTestBlock("production", "*", ed25519Key))},
+		{"no trailing newline", strings.TrimSuffix(knownHostsTestUserLines, "\n"), []ssh.PublicKey{ed25519Key}, nil,
+			knownHostsTestUserLines + strings.TrimSuffix(knownHostsTestBlock("production", "*", ed25519Key), "\n")},
+		{"rotation drops the old key",
+			knownHostsTestUserLines + knownHostsTestBlock("production", "*", ecdsaKey, ed25519Key) + "after.example.com ssh-ed25519 AAAA\n",
+			[]ssh.PublicKey{ed25519Key}, nil,
+			knownHostsTestUserLines + knownHostsTestBlock("production", "*", ed25519Key) + "after.example.com ssh-ed25519 AAAA\n"},
+		{"other profiles are kept",
+			knownHostsTestBlock("staging", "*", ecdsaKey) + knownHostsTestUserLines + knownHostsTestBlock("production", "*", ecdsaKey),
+			[]ssh.PublicKey{ed25519Key}, nil,
+			knownHostsTestBlock("staging", "*", ecdsaKey) + knownHostsTestUserLines + knownHostsTestBlock("production", "*", ed25519Key)},
+		{"CA without host keys", knownHostsTestUserLines + knownHostsTestBlock("production", "*", ecdsaKey), nil, nil,
+			knownHostsTestUserLines + knownHostsTestBlock("production", "*")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestKnownHosts(t, test.content)
+			if err := KnownHosts.Update("production", test.keys, test.patterns); err != nil {
+				t.Fatal(err)
+			}
+			if content := readTestKnownHosts(t); content != test.expected {
+				t.Errorf("known_hosts =\n%q\nexpected\n%q", content, test.expected)
+			}
+
+			// nothing changes when the keys are the same
+			info, _ := os.Stat(KnownHosts.Path())
+			if err := KnownHosts.Update("production", test.keys, test.patterns); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := os.Stat(KnownHosts.Path()); !again.ModTime().Equal(info.ModTime()) || readTestKnownHosts(t) != test.expected {
+				t.Error("known_hosts was written again")
+			}
+		})
+	}
+}
+
+func TestKnownHostsPrune(t *testing.T) {
+	key := readTestPublicKey(t, "ed25519")
+	useTestKnownHosts(t, strings.ReplaceAll(knownHostsTestBlock("deleted", "*", key)+knownHostsTestUserLines+
+		knownHostsTestBlock("production", "*", key)+knownHostsTestBlock(KNOWN_HOSTS_DEFAULT_BLOCK, "*", key), "\n", "\r\n"))
+
+	if err := KnownHosts.Prune([]string{"production"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.ReplaceAll(knownHostsTestUserLines+knownHostsTestBlock("production", "*", key), "\n", "\r\n")
+	if content := readTestKnownHosts(t); content != expected {
+		t.Errorf("known_hosts =\n%q\nexpected\n%q", content, expected)
+	}
+
+	// when ManagedKnownHosts is turned off
+	if err := KnownHosts.Prune(nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestKnownHosts(t); content != strings.ReplaceAll(knownHostsTestUserLines, "\n", "\r\n") {
+		t.Errorf("known_hosts = %q, expected the lines of the user", content)
+	}
+}
+
+func TestParseKnownHostsBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		blocks map[string]knownHostsBlockType
+	}{
+		{"no blocks", []string{"github.com ssh-ed25519 AAAA", ""}, map[string]knownHostsBlockType{}},
+		{"blocks", []string{"github.com ssh-ed25519 AAAA", KNOWN_HOSTS_BEGIN_MARKER + "a", "@cert-authority * ssh-ed25519 AAAA", KNOWN_HOSTS_END_MARKER + "a",
+			"  " + KNOWN_HOSTS_BEGIN_MARKER + "b  ", KNOWN_HOSTS_END_MARKER + "b"},
+			map[string]knownHostsBlockType{"a": {begin: 1, end: 3}, "b": {begin: 4, end: 5}}},
+		{"no end", []string{KNOWN_HOSTS_BEGIN_MARKER + "a", "@cert-authority * ssh-ed25519 AAAA", "github.com ssh-ed25519 AAAA"}, nil},
+		{"no begin", []string{"github.com ssh-ed25519 AAAA", KNOWN_HOSTS_END_MARKER + "a"}, nil},
+		{"end of another block", []string{KNOWN_HOSTS_BEGIN_MARKER + "a", KNOWN_HOSTS_END_MARKER + "b"}, nil},
+		{"nested", []string{KNOWN_HOSTS_BEGIN_MARKER + "a", KNOWN_HOSTS_BEGIN_MARKER + "b", KNOWN_HOSTS_END_MARKER + "b", KNOWN_HOSTS_END_MARKER + "a"}, nil},
+		{"twice", []string{KNOWN_HOSTS_BEGIN_MARKER + "a", KNOWN_HOSTS_END_MARKER + "a", KNOWN_HOSTS_BEGIN_MARKER + "a", KNOWN_HOSTS_END_MARKER + "a"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, err := parseKnownHostsBlocks(test.lines)
+			if test.blocks == nil {
+				if !errors.Is(err, KNOWNHOSTSERR_BROKEN_BLOCK) {
+					t.Errorf("err = %v, expected %v", err, KNOWNHOSTSERR_BROKEN_BLOCK)
+				}
+				return
+			}
+			if err != nil || len(blocks) != len(test.blocks) {
+				t.Fatalf("blocks = %v, error %v", blocks, err)
+			}
+			for name, block := range test.blocks {
+				if blocks[name] != block {
+					t.Errorf("block %v = %+v, expected %+v", name, blocks[name], block)
+				}
+			}
+		})
+	}
+}
+
+func TestKnownHostsBrokenBlockIsNotChanged(t *testing.T) {
+	key := readTestPublicKey(t, "ed25519")
+	// the user deleted the end marker, the lines after it may be theirs
+	content := knownHostsTestUserLines + KNOWN_HOSTS_BEGIN_MARKER + "production\n" + "mine.example.com ssh-ed25519 AAAA\n"
+	useTestKnownHosts(t, content)
+
+	if err := KnownHosts.Update("production", []ssh.PublicKey{key}, nil); !errors.Is(err, KNOWNHOSTSERR_BROKEN_BLOCK) {
+		t.Errorf("update: err = %v, expected %v", err, KNOWNHOSTSERR_BROKEN_BLOCK)
+	}
+	if err := KnownHosts.Prune(nil); !errors.Is(err, KNOWNHOSTSERR_BROKEN_BLOCK) {
+		t.Errorf("prune: err = %v, expected %v", err, KNOWNHOSTSERR_BROKEN_BLOCK)
+	}
+	if readTestKnownHosts(t) != content {
+		t.Errorf("known_hosts with a broken block was changed: %q", readTestKnownHosts(t))
+	}
+}
+
+func TestKnownHostsSyncRemovesDeletedProfile(t *testing.T) {
+	useTestProfiles(t, "empty.json")
+	Configs.ManagedKnownHosts = true
+	hostKey, oldKey := readTestPublicKey(t, "ed25519"), readTestPublicKey(t, "ecdsa256")
+	serveTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != STEP_CA_SSH_ROOTS_PATH {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJson(w, http.StatusOK, map[string][][]byte{"hostKey": {hostKey.Marshal()}})
+	}))
+	Configs.Profiles[0].KnownHostsPatterns = []string{"*.example.com"}
+	Profiles.apply(&Configs.Profiles[0])
+
+	// "development" was deleted from the profiles
+	useTestKnownHosts(t, knownHostsTestUserLines+knownHostsTestBlock("development", "*", oldKey)+
+		knownHostsTestBlock("staging", "*", oldKey)+knownHostsTestBlock("production", "*.example.com", oldKey))
+
+	if err := KnownHosts.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	expected := knownHostsTestUserLines + knownHostsTestBlock("staging", "*", oldKey) + knownHostsTestBlock("production", "*.example.com", hostKey)
+	if content := readTestKnownHosts(t); content != expected {
+		t.Errorf("known_hosts =\n%q\nexpected\n%q", content, expected)
+	}
+}
@@ -3,15 +3,20 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
-	defer exitHandler()
-
 	initPaths()
-	SignalHandler.Init()
 	Logger.Init()
 
+	if len(os.Args) > 1 {
+		os.Exit(RunCommand(os.Args[1:]))
+	}
+
+	defer exitHandler()
+	SignalHandler.Init()
+
 	log.Println(fmt.Sprintf(`
 	#########################################
 		%v STARTING UP %v
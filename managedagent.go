@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	MANAGED_AGENT_NAME            = "Managed ssh-agent"
+	MANAGED_AGENT_SOCKET_NAME     = "upstream-agent.sock"
+	MANAGED_AGENT_ADDRESS_ARG     = "{address}"
+	MANAGED_AGENT_STARTUP_TIMEOUT = 10 * time.Second
+)
+
+var (
+	// run in the foreground (-D) and bind to our own address (-a), so the child can be supervised
+	MANAGED_AGENT_DEFAULT_ARGS = []string{"-D", "-a", MANAGED_AGENT_ADDRESS_ARG}
+)
+
+// ManagedAgentType runs an ssh-agent child process when no upstream agent is reachable,
+// restarts it when it crashes and stops it when the application exits.
+type ManagedAgentType struct {
+	mu         sync.Mutex
+	active     bool
+	supervisor *SupervisorType
+}
+
+var (
+	ManagedAgent *ManagedAgentType = &ManagedAgentType{}
+)
+
+// Address is the socket or pipe the managed agent is bound to, under APP_HOME_DIR unless configured otherwise
+func (m *ManagedAgentType) Address() string {
+	if Configs.ManagedAgentAddress != "" {
+		return Configs.ManagedAgentAddress
+	}
+	return filepath.Join(APP_HOME_DIR, MANAGED_AGENT_SOCKET_NAME)
+}
+
+func (m *ManagedAgentType) IsActive() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+func (m *ManagedAgentType) Stats() (SupervisorStatsType, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.supervisor == nil {
+		return SupervisorStatsType{}, false
+	}
+	return m.supervisor.Stats(), true
+}
+
+// EnsureUpstream starts the managed agent if it is enabled and the configured upstream agent does not answer
+func (m *ManagedAgentType) EnsureUpstream() {
+	if !Configs.ManagedAgentEnabled || m.IsActive() {
+		return
+	}
+
+	upstream := ConfiguredUpstreamAgent()
+	_, err := ProbeAgent(upstream, AGENT_PROBE_TIMEOUT)
+	if err == nil {
+		Logger.Info("ManagedAgent: upstream agent %v is reachable, no managed agent needed", upstream)
+		return
+	}
+
+	Logger.Info("ManagedAgent: upstream agent %v is not reachable, starting managed agent. Error: %v", upstream, err)
+	m.Start()
+}
+
+func (m *ManagedAgentType) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active {
+		return
+	}
+
+	supervisor := NewSupervisor(MANAGED_AGENT_NAME, m.run)
+	supervisor.OnRestart = func(name string, attempt int, delay time.Duration, err error) {
+		App.PushWarnNoti("%v stopped, restarting in %v (attempt %v). Error: %v", name, delay.Round(time.Second), attempt, err)
+	}
+	supervisor.OnGiveUp = func(name string, attempts int, err error) {
+		App.PushErrNoti("%v failed %v times and was not restarted. Error: %v", name, attempts, err)
+		m.giveUp(supervisor)
+	}
+	m.supervisor = supervisor
+	m.active = true
+	supervisor.Start()
+	App.PushInfoNoti("No ssh-agent was reachable. Started %v on %v", MANAGED_AGENT_NAME, m.Address())
+}
+
+func (m *ManagedAgentType) Stop() {
+	m.mu.Lock()
+	supervisor := m.supervisor
+	m.supervisor = nil
+	m.active = false
+	m.mu.Unlock()
+
+	if supervisor != nil {
+		Logger.Info("ManagedAgent: stopping managed agent")
+		supervisor.Stop()
+	}
+}
+
+// giveUp marks the managed agent inactive once its supervisor stopped restarting it, so the proxy goes
+// back to the configured upstream and EnsureUpstream may start a new one
+func (m *ManagedAgentType) giveUp(supervisor *SupervisorType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.supervisor != supervisor {
+		return
+	}
+	Logger.Info("ManagedAgent: managed agent gave up, using upstream agent %v again", ConfiguredUpstreamAgent())
+	m.supervisor = nil
+	m.active = false
+	// OnGiveUp runs on the supervisor's goroutine, which Stop waits for
+	go supervisor.Stop()
+}
+
+func (m *ManagedAgentType) command() *exec.Cmd {
+	exe := Configs.ManagedAgentExe
+	if exe == "" {
+		exe = "ssh-agent.exe"
+	}
+	args := Configs.ManagedAgentArgs
+	if len(args) == 0 {
+		args = MANAGED_AGENT_DEFAULT_ARGS
+	}
+
+	address := m.Address()
+	expandedArgs := make([]string, 0, len(args))
+	for _, arg := range args {
+		expandedArgs = append(expandedArgs, strings.ReplaceAll(arg, MANAGED_AGENT_ADDRESS_ARG, address))
+	}
+
+	cmd := exec.Command(exe, expandedArgs...)
+	cmd.Dir = APP_HOME_DIR
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd
+}
+
+// run starts the agent, waits until it answers, and keeps it running until stop is closed
+func (m *ManagedAgentType) run(stop <-chan struct{}) error {
+	address := m.Address()
+	if !strings.HasPrefix(strings.ToLower(address), NAMED_PIPE_PREFIX) && IsFileExist(address) {
+		Logger.Info("ManagedAgent: removing stale socket %v", address)
+		os.Remove(address)
+	}
+
+	cmd := m.command()
+	Logger.Info("ManagedAgent: executing %v", cmd.String())
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %v: %w", cmd.Path, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	if err := m.waitUntilReady(address, exited); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	Logger.Info("ManagedAgent: managed agent pid %v is answering on %v", cmd.Process.Pid, address)
+
+	select {
+	case <-stop:
+		Logger.Info("ManagedAgent: shutting down managed agent pid %v", cmd.Process.Pid)
+		cmd.Process.Kill()
+		<-exited
+		if !strings.HasPrefix(strings.ToLower(address), NAMED_PIPE_PREFIX) {
+			os.Remove(address)
+		}
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("managed agent exited: %v", err)
+	}
+}
+
+func (m *ManagedAgentType) waitUntilReady(address string, exited chan error) error {
+	deadline := time.Now().Add(MANAGED_AGENT_STARTUP_TIMEOUT)
+	for {
+		select {
+		case err := <-exited:
+			exited <- err
+			return fmt.Errorf("managed agent exited during startup: %v", err)
+		default:
+		}
+
+		_, err := ProbeAgent(address, time.Second)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("managed agent did not answer on %v within %v: %w", address, MANAGED_AGENT_STARTUP_TIMEOUT, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
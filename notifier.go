@@ -0,0 +1,28 @@
+package main
+
+import "sync"
+
+// NotifierFunc shows a notification to the user, msgtype is INFO, WARNING or ERROR
+type NotifierFunc func(msgtype string, message string)
+
+var (
+	notifierMu sync.Mutex
+	notifier   NotifierFunc
+)
+
+// SetNotifier makes notify receive the notifications of App in place of the tray icon and returns the
+// notifier it replaces. nil gives the notifications back to the tray icon.
+func SetNotifier(notify NotifierFunc) NotifierFunc {
+	notifierMu.Lock()
+	defer notifierMu.Unlock()
+	previous := notifier
+	notifier = notify
+	return previous
+}
+
+// currentNotifier is the notifier set with SetNotifier, nil when the tray icon shows the notifications
+func currentNotifier() NotifierFunc {
+	notifierMu.Lock()
+	defer notifierMu.Unlock()
+	return notifier
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	OIDC_LOGIN_TIMEOUT        = 5 * time.Minute
+	OIDC_HTTP_TIMEOUT         = 30 * time.Second
+	OIDC_LOOPBACK_HOST        = "127.0.0.1"
+	OIDC_SCOPE                = "openid email"
+	OIDC_MAX_RESPONSE_SIZE    = 1 << 20
+	OIDC_RANDOM_LENGTH        = 32
+	OIDC_LOGIN_FINISHED_PAGE  = "<html><body><p>Login finished, you can close this window.</p></body></html>"
+	OIDC_LOGIN_FAILED_PAGE    = "<html><body><p>Login failed: %v</p></body></html>"
+	OIDC_PKCE_CHALLENGE_S256  = "S256"
+	OIDC_GRANT_AUTHORIZATION  = "authorization_code"
+	OIDC_RESPONSE_TYPE_CODE   = "code"
+	OIDC_BROWSER_OPEN_COMMAND = "rundll32"
+	OIDC_BROWSER_OPEN_HANDLER = "url.dll,FileProtocolHandler"
+)
+
+// OidcLoginType logs in with an OIDC provisioner of step-ca without the step CLI:
+//  1. reads the client and the configuration endpoint of the provisioner from /provisioners
+//  2. runs the authorization code flow with PKCE, the IdP redirects the browser to a loopback listener
+//  3. generates a key pair and sends its public key with the ID token to /ssh/sign
+//  4. adds the key with its certificate to the agent, for as long as the certificate is valid
+type OidcLoginType struct {
+	Ca          *StepCaClientType
+	Provisioner string
+	// LoginHint is passed to the IdP as login_hint when it is not empty
+	LoginHint string
+	// HttpClient talks to the IdP, OpenBrowser shows the authorization url to the user
+	HttpClient   *http.Client
+	OpenBrowser  func(authUrl string) error
+	AgentAddress string
+	Timeout      time.Duration
+}
+
+// OidcProvisionerType are the fields of an OIDC provisioner of /provisioners the login needs
+type OidcProvisionerType struct {
+	Name                  string `json:"name"`
+	ClientId              string `json:"clientID"`
+	ClientSecret          string `json:"clientSecret"`
+	ConfigurationEndpoint string `json:"configurationEndpoint"`
+	ListenAddress         string `json:"listenAddress"`
+}
+
+// OidcConfigurationType are the fields of the OpenID provider configuration the login needs
+type OidcConfigurationType struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+type oidcCallbackType struct {
+	code string
+	err  error
+}
+
+// NewOidcLogin returns a login with the provisioner of ca, adding the certificate to the upstream agent
+func NewOidcLogin(ca *StepCaClientType, provisioner string) *OidcLoginType {
+	return &OidcLoginType{
+		Ca:           ca,
+		Provisioner:  provisioner,
+		HttpClient:   &http.Client{Timeout: OIDC_HTTP_TIMEOUT, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+		OpenBrowser:  OpenBrowser,
+		AgentAddress: PageantProxy.UpstreamAddress(),
+		Timeout:      OIDC_LOGIN_TIMEOUT,
+	}
+}
+
+// OpenBrowser opens url with the default browser
+func OpenBrowser(url string) error {
+	_, err := ExecCommandRunner.Run(CommandRunType{Argv: []string{OIDC_BROWSER_OPEN_COMMAND, OIDC_BROWSER_OPEN_HANDLER, url}})
+	return err
+}
+
+// Login runs the whole flow and returns the certificate it added to the agent
+func (o *OidcLoginType) Login() (*ssh.Certificate, error) {
+	provisioner, err := o.provisioner()
+	if err != nil {
+		return nil, err
+	}
+	configuration, err := o.discover(provisioner)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := o.authorize(provisioner, configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := o.Ca.SshSign(StepSshSignRequestType{
+		PublicKey: signer.PublicKey().Marshal(),
+		Ott:       idToken,
+		CertType:  SSH_CERT_TYPE_USER,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewPpkKey(privateKey, certificate.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if err = AddCertificateToAgent(o.AgentAddress, key, certificate); err != nil {
+		return nil, err
+	}
+	Logger.Info("OidcLogin: Certificate %v of provisioner %v added to the agent", certificate.KeyId, o.Provisioner)
+	return certificate, nil
+}
+
+// provisioner looks up the OIDC provisioner in the provisioner list of the CA
+func (o *OidcLoginType) provisioner() (*OidcProvisionerType, error) {
+	provisioners, err := o.Ca.Provisioners()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range provisioners {
+		if entry.Name != o.Provisioner {
+			continue
+		}
+		if entry.Type != STEP_PROVISIONER_OIDC {
+			return nil, fmt.Errorf("%w: %v is a %v provisioner", OIDCERR_NOT_OIDC_PROVISIONER, entry.Name, entry.Type)
+		}
+		provisioner := &OidcProvisionerType{}
+		if err = json.Unmarshal(entry.Raw, provisioner); err != nil {
+			return nil, fmt.Errorf("%w: provisioner: %v", STEPCAERR_INVALID_RESPONSE, err)
+		}
+		if provisioner.ClientId == "" || provisioner.ConfigurationEndpoint == "" {
+			return nil, fmt.Errorf("%w: provisioner %v has no client or configuration endpoint", STEPCAERR_INVALID_RESPONSE, entry.Name)
+		}
+		return provisioner, nil
+	}
+	return nil, fmt.Errorf("%w: %v", STEPERR_UNSUPPORTED_PROVISIONER, o.Provisioner)
+}
+
+// discover reads the configuration endpoint of the provisioner
+func (o *OidcLoginType) discover(provisioner *OidcProvisionerType) (*OidcConfigurationType, error) {
+	response, err := o.HttpClient.Get(provisioner.ConfigurationEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", OIDCERR_DISCOVERY_FAILED, err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, OIDC_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", OIDCERR_DISCOVERY_FAILED, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %v: HTTP %v", OIDCERR_DISCOVERY_FAILED, provisioner.ConfigurationEndpoint, response.StatusCode)
+	}
+	configuration := &OidcConfigurationType{}
+	if err = json.Unmarshal(body, configuration); err != nil {
+		return nil, fmt.Errorf("%w: %v", OIDCERR_DISCOVERY_FAILED, err)
+	}
+	if configuration.AuthorizationEndpoint == "" || configuration.TokenEndpoint == "" {
+		return nil, fmt.Errorf("%w: no authorization or token endpoint", OIDCERR_DISCOVERY_FAILED)
+	}
+	return configuration, nil
+}
+
+// authorize runs the authorization code flow with PKCE and returns the ID token
+func (o *OidcLoginType) authorize(provisioner *OidcProvisionerType, configuration *OidcConfigurationType) (string, error) {
+	listener, err := net.Listen("tcp", oidcListenAddress(provisioner.ListenAddress))
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	// the same redirect uri the step CLI registers with the IdP
+	redirectUri := "http://" + listener.Addr().String()
+
+	verifier, err := randomUrlString(OIDC_RANDOM_LENGTH)
+	if err != nil {
+		return "", err
+	}
+	state, err := randomUrlString(OIDC_RANDOM_LENGTH)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomUrlString(OIDC_RANDOM_LENGTH)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	authUrl, err := url.Parse(configuration.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", OIDCERR_DISCOVERY_FAILED, err)
+	}
+	query := authUrl.Query()
+	query.Set("response_type", OIDC_RESPONSE_TYPE_CODE)
+	query.Set("client_id", provisioner.ClientId)
+	query.Set("redirect_uri", redirectUri)
+	query.Set("scope", OIDC_SCOPE)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", OIDC_PKCE_CHALLENGE_S256)
+	if o.LoginHint != "" {
+		query.Set("login_hint", o.LoginHint)
+	}
+	authUrl.RawQuery = query.Encode()
+
+	callbackChn := make(chan oidcCallbackType, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		// anything without our state is not the redirect of this login, keep waiting for it
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, OIDCERR_STATE_MISMATCH.Error(), http.StatusBadRequest)
+			return
+		}
+
+		callback := oidcCallbackType{code: query.Get("code")}
+		if reason := query.Get("error"); reason != "" {
+			callback.err = fmt.Errorf("%w: %v %v", OIDCERR_AUTHORIZATION_DENIED, reason, query.Get("error_description"))
+		} else if callback.code == "" {
+			callback.err = fmt.Errorf("%w: no authorization code", OIDCERR_AUTHORIZATION_DENIED)
+		}
+		if callback.err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			// error and error_description come from the query, whoever sent it
+			fmt.Fprintf(w, OIDC_LOGIN_FAILED_PAGE, html.EscapeString(callback.err.Error()))
+		} else {
+			fmt.Fprint(w, OIDC_LOGIN_FINISHED_PAGE)
+		}
+
+		select {
+		case callbackChn <- callback:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	Logger.Info("OidcLogin: Waiting for the redirect of provisioner %v on %v", provisioner.Name, redirectUri)
+	if err = o.OpenBrowser(authUrl.String()); err != nil {
+		return "", err
+	}
+
+	var callback oidcCallbackType
+	select {
+	case callback = <-callbackChn:
+	case <-time.After(o.Timeout):
+		return "", OIDCERR_TIMEOUT
+	}
+	if callback.err != nil {
+		return "", callback.err
+	}
+	idToken, err := o.exchange(provisioner, configuration, callback.code, verifier, redirectUri)
+	if err != nil {
+		return "", err
+	}
+	if err = checkIdTokenNonce(idToken, nonce); err != nil {
+		return "", err
+	}
+	return idToken, nil
+}
+
+// exchange trades the authorization code for the tokens at the token endpoint and returns the ID token
+func (o *OidcLoginType) exchange(provisioner *OidcProvisionerType, configuration *OidcConfigurationType, code string, verifier string, redirectUri string) (string, error) {
+	form := url.Values{
+		"grant_type":    {OIDC_GRANT_AUTHORIZATION},
+		"code":          {code},
+		"redirect_uri":  {redirectUri},
+		"client_id":     {provisioner.ClientId},
+		"code_verifier": {verifier},
+	}
+	if provisioner.ClientSecret != "" {
+		form.Set("client_secret", provisioner.ClientSecret)
+	}
+
+	response, err := o.HttpClient.PostForm(configuration.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", OIDCERR_TOKEN_FAILED, err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, OIDC_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", OIDCERR_TOKEN_FAILED, err)
+	}
+	tokens := struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	json.Unmarshal(body, &tokens)
+	if response.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf("%w: HTTP %v: %v %v", OIDCERR_TOKEN_FAILED, response.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IdToken == "" {
+		return "", fmt.Errorf("%w: no id_token", OIDCERR_TOKEN_FAILED)
+	}
+	return tokens.IdToken, nil
+}
+
+// checkIdTokenNonce compares the nonce claim of idToken with the nonce of the authorization request.
+// The signature of the token is checked by the CA, the token came straight from the token endpoint.
+func checkIdTokenNonce(idToken string, nonce string) error {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: id_token is not a JWT", OIDCERR_TOKEN_FAILED)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("%w: id_token: %v", OIDCERR_TOKEN_FAILED, err)
+	}
+	claims := struct {
+		Nonce string `json:"nonce"`
+	}{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("%w: id_token: %v", OIDCERR_TOKEN_FAILED, err)
+	}
+	if claims.Nonce != nonce {
+		return OIDCERR_NONCE_MISMATCH
+	}
+	return nil
+}
+
+// oidcListenAddress listens on the port of the provisioner's listenAddress, or on a free port when the
+// provisioner has none. Only the port is taken, the redirect with the authorization code never leaves
+// the loopback interface whatever host the provisioner names.
+func oidcListenAddress(listenAddress string) string {
+	port := "0"
+	if _, listenPort, err := net.SplitHostPort(listenAddress); err == nil && listenPort != "" {
+		port = listenPort
+	}
+	return net.JoinHostPort(OIDC_LOOPBACK_HOST, port)
+}
+
+// randomUrlString returns length random bytes, base64url encoded
+func randomUrlString(length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	oidcTestClientId     = "step-ssh"
+	oidcTestClientSecret = "client secret"
+	oidcTestCode         = "authorization code"
+)
+
+// oidcLoginTestType is an IdP with discovery and token endpoints, a CA with /provisioners and /ssh/sign,
+// and an upstream agent. The browser is a function that follows the authorization url.
+type oidcLoginTestType struct {
+	login   *OidcLoginType
+	keyring agent.Agent
+
+	mu        sync.Mutex
+	challenge string
+	nonce     string
+	// tokenNonce replaces the nonce of the authorization url in the ID token when it is set
+	tokenNonce    string
+	tokenRequests int
+	signRequests  int
+}
+
+func newOidcLoginTest(t *testing.T, keyring agent.Agent, browser func(t *testing.T, authUrl *url.URL)) *oidcLoginTestType {
+	test := &oidcLoginTestType{keyring: keyring}
+	address := serveTestAgent(t, keyring)
+
+	idp := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(idp.Close)
+	idp.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			writeJson(w, http.StatusOK, OidcConfigurationType{
+				Issuer:                idp.URL,
+				AuthorizationEndpoint: idp.URL + "/authorize",
+				TokenEndpoint:         idp.URL + "/token",
+			})
+		case "/token":
+			test.token(t, w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	caKey, err := ssh.NewSignerFromKey(newTestEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := newTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case STEP_CA_PROVISIONERS_PATH:
+			writeJson(w, http.StatusOK, map[string]interface{}{"provisioners": []interface{}{
+				map[string]string{"type": STEP_PROVISIONER_JWK, "name": "admin"},
+				map[string]string{"type": STEP_PROVISIONER_OIDC, "name": "google", "clientID": oidcTestClientId,
+					"clientSecret": oidcTestClientSecret, "configurationEndpoint": idp.URL + "/.well-known/openid-configuration"},
+			}})
+		case STEP_CA_SSH_SIGN_PATH:
+			test.sign(t, caKey, w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	test.login = NewOidcLogin(ca, "google")
+	test.login.LoginHint = "alice@example.com"
+	test.login.AgentAddress = address
+	test.login.Timeout = 5 * time.Second
+	test.login.OpenBrowser = func(authUrl string) error {
+		parsed, err := url.Parse(authUrl)
+		if err != nil {
+			return err
+		}
+		query := parsed.Query()
+		if parsed.Path != "/authorize" || query.Get("client_id") != oidcTestClientId || query.Get("response_type") != "code" ||
+			query.Get("login_hint") != "alice@example.com" || query.Get("code_challenge_method") != "S256" || query.Get("nonce") == "" {
+			t.Errorf("authorization url %v", authUrl)
+		}
+		test.mu.Lock()
+		test.challenge = query.Get("code_challenge")
+		test.nonce = query.Get("nonce")
+		test.mu.Unlock()
+		// the browser runs while Login waits for the redirect
+		go browser(t, parsed)
+		return nil
+	}
+	return test
+}
+
+// token checks the PKCE code_verifier against the challenge of the authorization url
+func (test *oidcLoginTestType) token(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	test.mu.Lock()
+	test.tokenRequests++
+	challenge := test.challenge
+	test.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("grant_type") != OIDC_GRANT_AUTHORIZATION || r.PostFormValue("code") != oidcTestCode ||
+		r.PostFormValue("client_id") != oidcTestClientId || r.PostFormValue("client_secret") != oidcTestClientSecret {
+		t.Errorf("token request %v", r.PostForm)
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+		t.Errorf("code_verifier %q does not match the code_challenge %q", r.PostFormValue("code_verifier"), challenge)
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	if redirectUri, err := url.Parse(r.PostFormValue("redirect_uri")); err != nil || redirectUri.Hostname() != OIDC_LOOPBACK_HOST {
+		t.Errorf("redirect_uri %v", r.PostFormValue("redirect_uri"))
+	}
+	writeJson(w, http.StatusOK, map[string]string{"id_token": test.idToken(), "token_type": "Bearer"})
+}
+
+// idToken is an unsigned ID token with the nonce of the authorization url, or with tokenNonce when it is set
+func (test *oidcLoginTestType) idToken() string {
+	test.mu.Lock()
+	nonce := test.nonce
+	if test.tokenNonce != "" {
+		nonce = test.tokenNonce
+	}
+	test.mu.Unlock()
+
+	claims, _ := json.Marshal(map[string]string{"email": "alice@example.com", "nonce": nonce})
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(claims) + ".c2lnbmF0dXJl"
+}
+
+// sign certifies the public key of an /ssh/sign request with the ID token for an hour
+func (test *oidcLoginTestType) sign(t *testing.T, caKey ssh.Signer, w http.ResponseWriter, r *http.Request) {
+	test.mu.Lock()
+	test.signRequests++
+	test.mu.Unlock()
+
+	request := StepSshSignRequestType{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Ott != test.idToken() || request.CertType != SSH_CERT_TYPE_USER {
+		t.Errorf("sign request %+v, error %v", request, err)
+		writeJson(w, http.StatusUnauthorized, map[string]string{"message": "invalid token"})
+		return
+	}
+	publicKey, err := ssh.ParsePublicKey(request.PublicKey)
+	if err != nil {
+		t.Errorf("sign request key: %v", err)
+		writeJson(w, http.StatusBadRequest, map[string]string{"message": "invalid key"})
+		return
+	}
+
+	now := time.Now()
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@example.com",
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if err = certificate.SignCert(rand.Reader, caKey); err != nil {
+		t.Fatal(err)
+	}
+	writeJson(w, http.StatusCreated, map[string][]byte{"crt": certificate.Marshal()})
+}
+
+func (test *oidcLoginTestType) counts() (tokenRequests int, signRequests int) {
+	test.mu.Lock()
+	defer test.mu.Unlock()
+	return test.tokenRequests, test.signRequests
+}
+
+// redirect follows the redirect of the IdP to the loopback listener with query and returns the status
+func redirect(t *testing.T, authUrl *url.URL, query url.Values) int {
+	redirectUri := authUrl.Query().Get("redirect_uri")
+	response, err := http.Get(redirectUri + "?" + query.Encode())
+	if err != nil {
+		t.Errorf("redirect to %v: %v", redirectUri, err)
+		return 0
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func newTestEd25519Key(t *testing.T) ed25519.PrivateKey {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey
+}
+
+func TestOidcLogin(t *testing.T) {
+	test := newOidcLoginTest(t, agent.NewKeyring(), func(t *testing.T, authUrl *url.URL) {
+		// a redirect of another login is rejected and does not end this one
+		if status := redirect(t, authUrl, url.Values{"state": {"another login"}, "code": {"stolen code"}}); status != http.StatusBadRequest {
+			t.Errorf("redirect with a mismatched state answered %v", status)
+		}
+		if status := redirect(t, authUrl, url.Values{"state": {authUrl.Query().Get("state")}, "code": {oidcTestCode}}); status != http.StatusOK {
+			t.Errorf("redirect answered %v", status)
+		}
+	})
+
+	certificate, err := test.login.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.KeyId != "alice@example.com" {
+		t.Errorf("certificate %v", certificate.KeyId)
+	}
+	if tokenRequests, signRequests := test.counts(); tokenRequests != 1 || signRequests != 1 {
+		t.Errorf("%v token requests, %v sign requests", tokenRequests, signRequests)
+	}
+
+	keys, err := test.keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Type() != ssh.CertAlgoED25519v01 || keys[0].Comment != "alice@example.com" {
+		t.Errorf("upstream keys = %v, expected the certificate", keys)
+	}
+}
+
+func TestOidcLoginRejectsMismatchedState(t *testing.T) {
+	test := newOidcLoginTest(t, agent.NewKeyring(), func(t *testing.T, authUrl *url.URL) {
+		status := redirect(t, authUrl, url.Values{"state": {authUrl.Query().Get("state") + "x"}, "code": {oidcTestCode}})
+		if status != http.StatusBadRequest {
+			t.Errorf("redirect with a mismatched state answered %v", status)
+		}
+	})
+	test.login.Timeout = 500 * time.Millisecond
+
+	if _, err := test.login.Login(); !errors.Is(err, OIDCERR_TIMEOUT) {
+		t.Errorf("err = %v, expected %v", err, OIDCERR_TIMEOUT)
+	}
+	if tokenRequests, signRequests := test.counts(); tokenRequests != 0 || signRequests != 0 {
+		t.Errorf("%v token requests, %v sign requests after a mismatched state", tokenRequests, signRequests)
+	}
+}
+
+func TestOidcLoginDenied(t *testing.T) {
+	test := newOidcLoginTest(t, agent.NewKeyring(), func(t *testing.T, authUrl *url.URL) {
+		query := url.Values{"state": {authUrl.Query().Get("state")}, "error": {"access_denied"}, "error_description": {"<script>alert(1)</script>"}}
+		response, err := http.Get(authUrl.Query().Get("redirect_uri") + "?" + query.Encode())
+		if err != nil {
+			t.Errorf("redirect: %v", err)
+			return
+		}
+		defer response.Body.Close()
+		page, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != http.StatusBadRequest || strings.Contains(string(page), "<script>") || !strings.Contains(string(page), "&lt;script&gt;") {
+			t.Errorf("failed login page %v: %s", response.StatusCode, page)
+		}
+	})
+
+	if _, err := test.login.Login(); !errors.Is(err, OIDCERR_AUTHORIZATION_DENIED) {
+		t.Errorf("err = %v, expected %v", err, OIDCERR_AUTHORIZATION_DENIED)
+	}
+}
+
+func TestOidcLoginNonceMismatch(t *testing.T) {
+	test := newOidcLoginTest(t, agent.NewKeyring(), func(t *testing.T, authUrl *url.URL) {
+		redirect(t, authUrl, url.Values{"state": {authUrl.Query().Get("state")}, "code": {oidcTestCode}})
+	})
+	// e.g. an ID token of another login
+	test.tokenNonce = "another login"
+
+	if _, err := test.login.Login(); !errors.Is(err, OIDCERR_NONCE_MISMATCH) {
+		t.Errorf("err = %v, expected %v", err, OIDCERR_NONCE_MISMATCH)
+	}
+	if _, signRequests := test.counts(); signRequests != 0 {
+		t.Errorf("%v sign requests with a mismatched nonce", signRequests)
+	}
+}
+
+func TestOidcLoginNotOidcProvisioner(t *testing.T) {
+	test := newOidcLoginTest(t, agent.NewKeyring(), func(t *testing.T, authUrl *url.URL) {
+		t.Error("browser opened for a JWK provisioner")
+	})
+	test.login.Provisioner = "admin"
+
+	if _, err := test.login.Login(); !errors.Is(err, OIDCERR_NOT_OIDC_PROVISIONER) {
+		t.Errorf("err = %v, expected %v", err, OIDCERR_NOT_OIDC_PROVISIONER)
+	}
+}
+
+// noLifetimeAgentType refuses keys with a lifetime constraint, like agents without constraint support
+type noLifetimeAgentType struct {
+	agent.Agent
+}
+
+func (a noLifetimeAgentType) Add(key agent.AddedKey) error {
+	if key.LifetimeSecs != 0 {
+		return errors.New("constraints are not supported")
+	}
+	return a.Agent.Add(key)
+}
+
+func TestOidcLoginAgentWithoutLifetime(t *testing.T) {
+	notifications := recordNotifications(t)
+	test := newOidcLoginTest(t, noLifetimeAgentType{agent.NewKeyring()}, func(t *testing.T, authUrl *url.URL) {
+		redirect(t, authUrl, url.Values{"state": {authUrl.Query().Get("state")}, "code": {oidcTestCode}})
+	})
+
+	if _, err := test.login.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := test.keyring.List(); err != nil || len(keys) != 1 {
+		t.Errorf("upstream keys = %v, error %v", keys, err)
+	}
+	if list := notifications.list(); len(list) != 1 || !strings.Contains(list[0], "does not support key lifetimes") {
+		t.Errorf("notifications = %q", list)
+	}
+}
+
+func TestOidcListenAddress(t *testing.T) {
+	tests := map[string]string{
+		"":                 "127.0.0.1:0",
+		":10000":           "127.0.0.1:10000",
+		"localhost:10000":  "127.0.0.1:10000",
+		"0.0.0.0:10000":    "127.0.0.1:10000",
+		"[::]:10000":       "127.0.0.1:10000",
+		"192.0.2.10:10000": "127.0.0.1:10000",
+		"127.0.0.1:10000":  "127.0.0.1:10000",
+		"not an address":   "127.0.0.1:0",
+		"example.com:":     "127.0.0.1:0",
+	}
+	for listenAddress, expected := range tests {
+		if address := oidcListenAddress(listenAddress); address != expected {
+			t.Errorf("oidcListenAddress(%q) = %v, expected %v", listenAddress, address, expected)
+		}
+	}
+}
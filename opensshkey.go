@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/blowfish"
+)
+
+const (
+	OPENSSH_KEY_MAGIC    = "openssh-key-v1\x00"
+	OPENSSH_PEM_TYPE     = "OPENSSH PRIVATE KEY"
+	OPENSSH_CIPHER_NONE  = "none"
+	OPENSSH_CIPHER_AES   = "aes256-ctr"
+	OPENSSH_KDF_NONE     = "none"
+	OPENSSH_KDF_BCRYPT   = "bcrypt"
+	OPENSSH_KDF_ROUNDS   = 16
+	OPENSSH_SALT_LENGTH  = 16
+	OPENSSH_BLOCK_LENGTH = 8
+	OPENSSH_KEY_LENGTH   = 32 // of aes256-ctr
+
+	BCRYPT_PBKDF_BLOCK_LENGTH = 32
+	// the text bcrypt_pbkdf encrypts, from OpenBSD's bcrypt_pbkdf.c
+	BCRYPT_PBKDF_MAGIC = "OxychromaticBlowfishSwatDynamite"
+)
+
+// OPENSSH_PRIVATE_FIELDS is the number of fields before the comment in the private section, by key type
+var OPENSSH_PRIVATE_FIELDS = map[string]int{
+	"ssh-rsa":             6,
+	"ecdsa-sha2-nistp256": 3,
+	"ecdsa-sha2-nistp384": 3,
+	"ecdsa-sha2-nistp521": 3,
+	"ssh-ed25519":         2,
+}
+
+// openSshKeyComment returns the comment of an unencrypted "openssh-key-v1" key, as described in OpenSSH's
+// PROTOCOL.key. ssh.ParseRawPrivateKey reads the key but drops its comment. Encrypted keys keep their
+// comment in the encrypted section, for them and for other blocks the comment is empty.
+func openSshKeyComment(block *pem.Block) string {
+	if block.Type != OPENSSH_PEM_TYPE || !bytes.HasPrefix(block.Bytes, []byte(OPENSSH_KEY_MAGIC)) {
+		return ""
+	}
+	reader := &agentWireReader{buf: block.Bytes[len(OPENSSH_KEY_MAGIC):]}
+	if string(reader.readString("cipher name")) != OPENSSH_CIPHER_NONE {
+		return ""
+	}
+	reader.readString("kdf name")
+	reader.readString("kdf options")
+	reader.readUint32("key count")
+	reader.readString("public key")
+
+	section := &agentWireReader{buf: reader.readString("private section")}
+	section.readUint32("check")
+	section.readUint32("check")
+	fields := OPENSSH_PRIVATE_FIELDS[string(section.readString("key type"))]
+	for i := 0; i < fields; i++ {
+		section.readString("key field")
+	}
+	comment := section.readString("comment")
+	if reader.err != nil || section.err != nil || fields == 0 {
+		return ""
+	}
+	return string(comment)
+}
+
+// MarshalOpenSshKey writes key in the "openssh-key-v1" format of ssh-keygen, see OpenSSH's PROTOCOL.key. The key is encrypted with
+// aes256-ctr and a bcrypt derived key when passphrase is not empty, like ssh-keygen does by default.
+func MarshalOpenSshKey(key *PpkKeyType, passphrase []byte) ([]byte, error) {
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	section := append(append([]byte{}, check...), check...)
+	section = appendAgentString(section, []byte(key.Algorithm))
+
+	switch privateKey := key.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		if len(privateKey.Primes) != 2 {
+			return nil, fmt.Errorf("%w: RSA key with %v primes", PPKERR_UNSUPPORTED_ALGORITHM, len(privateKey.Primes))
+		}
+		p, q := privateKey.Primes[0], privateKey.Primes[1]
+		section = appendAgentMpint(section, privateKey.N)
+		section = appendAgentMpint(section, big.NewInt(int64(privateKey.E)))
+		section = appendAgentMpint(section, privateKey.D)
+		section = appendAgentMpint(section, new(big.Int).ModInverse(q, p))
+		section = appendAgentMpint(section, p)
+		section = appendAgentMpint(section, q)
+	case *ecdsa.PrivateKey:
+		public := &agentWireReader{buf: key.PublicBlob}
+		public.readString("key type")
+		section = appendAgentString(section, public.readString("curve"))
+		section = appendAgentString(section, elliptic.Marshal(privateKey.Curve, privateKey.X, privateKey.Y))
+		section = appendAgentMpint(section, privateKey.D)
+	case ed25519.PrivateKey:
+		section = appendAgentString(section, privateKey.Public().(ed25519.PublicKey))
+		section = appendAgentString(section, privateKey)
+	default:
+		return nil, fmt.Errorf("%w: %T", PPKERR_UNSUPPORTED_ALGORITHM, privateKey)
+	}
+	section = appendAgentString(section, []byte(key.Comment))
+
+	cipherName, kdfName, kdfOptions, blockLength := OPENSSH_CIPHER_NONE, OPENSSH_KDF_NONE, []byte{}, OPENSSH_BLOCK_LENGTH
+	if len(passphrase) > 0 {
+		cipherName, kdfName, blockLength = OPENSSH_CIPHER_AES, OPENSSH_KDF_BCRYPT, aes.BlockSize
+	}
+	for i := 1; len(section)%blockLength != 0; i++ {
+		section = append(section, byte(i))
+	}
+
+	if len(passphrase) > 0 {
+		salt := make([]byte, OPENSSH_SALT_LENGTH)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		kdfOptions = appendAgentUint32(appendAgentString(nil, salt), OPENSSH_KDF_ROUNDS)
+
+		derived := bcryptPbkdf(passphrase, salt, OPENSSH_KDF_ROUNDS, OPENSSH_KEY_LENGTH+aes.BlockSize)
+		block, err := aes.NewCipher(derived[:OPENSSH_KEY_LENGTH])
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCTR(block, derived[OPENSSH_KEY_LENGTH:]).XORKeyStream(section, section)
+	}
+
+	body := []byte(OPENSSH_KEY_MAGIC)
+	body = appendAgentString(body, []byte(cipherName))
+	body = appendAgentString(body, []byte(kdfName))
+	body = appendAgentString(body, kdfOptions)
+	body = appendAgentUint32(body, 1)
+	body = appendAgentString(body, key.PublicBlob)
+	body = appendAgentString(body, section)
+	return pem.EncodeToMemory(&pem.Block{Type: OPENSSH_PEM_TYPE, Bytes: body}), nil
+}
+
+// bcryptPbkdf is OpenBSD's bcrypt_pbkdf, the key derivation of encrypted OpenSSH keys.
+// The output bytes of the blocks are interleaved, not concatenated.
+func bcryptPbkdf(password []byte, salt []byte, rounds int, keyLength int) []byte {
+	blocks := (keyLength + BCRYPT_PBKDF_BLOCK_LENGTH - 1) / BCRYPT_PBKDF_BLOCK_LENGTH
+	key := make([]byte, blocks*BCRYPT_PBKDF_BLOCK_LENGTH)
+	passwordHash := sha512.Sum512(password)
+
+	counter := make([]byte, 4)
+	for block := 1; block <= blocks; block++ {
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		saltHash := sha512.Sum512(append(append([]byte{}, salt...), counter...))
+		round := bcryptHash(passwordHash[:], saltHash[:])
+		out := append([]byte{}, round...)
+		for i := 2; i <= rounds; i++ {
+			saltHash = sha512.Sum512(round)
+			round = bcryptHash(passwordHash[:], saltHash[:])
+			for j := range out {
+				out[j] ^= round[j]
+			}
+		}
+		for i, value := range out {
+			key[i*blocks+block-1] = value
+		}
+	}
+	return key[:keyLength]
+}
+
+func bcryptHash(passwordHash []byte, saltHash []byte) []byte {
+	// both hashes are 64 bytes long, NewSaltedCipher only fails for an empty key
+	c, _ := blowfish.NewSaltedCipher(passwordHash, saltHash)
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(saltHash, c)
+		blowfish.ExpandKey(passwordHash, c)
+	}
+
+	out := []byte(BCRYPT_PBKDF_MAGIC)
+	for i := 0; i < len(out); i += blowfish.BlockSize {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+blowfish.BlockSize], out[i:i+blowfish.BlockSize])
+		}
+	}
+	// blowfish works on big endian words, bcrypt_pbkdf outputs them little endian
+	for i := 0; i < len(out); i += 4 {
+		out[i], out[i+1], out[i+2], out[i+3] = out[i+3], out[i+2], out[i+1], out[i]
+	}
+	return out
+}
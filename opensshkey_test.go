@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Known answers from OpenBSD's regress/lib/libutil/bcrypt_pbkdf and from other bcrypt_pbkdf implementations
+func TestBcryptPbkdf(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		rounds   int
+		key      string
+	}{
+		{"password", "salt", 4, "5bbf0cc293587f1c3635555c27796598d47e579071bf427e9d8fbe842aba34d9"},
+		{"password", "\x00", 4, "c12b566235eee04c212598970a579a67"},
+		{"\x00", "salt", 4, "6051be18c2f4f82cbf0efee5471b4bb9"},
+		{"password\x00", "salt\x00", 4, "7410e44cf4fa07bfaac8a928b1727fac001375e7bf7384370f48efd121743050"},
+		{"pass\x00wor", "sa\x00l", 4, "c2bffd9db38f6569efef4372f4de83c0"},
+		{"pass\x00word", "sa\x00lt", 4, "4ba4ac3925c0e8d7f0cdb6bb1684a56f"},
+		{"password", "salt", 8, "e1367ec5151a33faac4cc1c144cd23fa15d5548493ecc99b9b5d9c0d3b27bec76227ea66088b849b20ab7aa478010246e74bba51723fefa9f9474d6508845e8d"},
+		{"password", "salt", 42, "833cf0dcf56db65608e8f0dc0ce882bd"},
+		{"password", "salt", 12, "1ae42c05d487bc02f64921a4ebe4ea93bcacfe135fda99974c06b7b01fae149a"},
+		{"passwordy\x00PASSWORD\x00", "salty\x00SALT\x00", 3, "7f310bd3e78c3280c59ce4595211a2928e8d4ec744c1ed2efc9f764e3388e0ad"},
+		{"секретное слово", "посолить немножко", 8, "8df43fc6fe131fc47f0c9e39224bd94c70b6fcc8ee8135faddf61156e6cb2733ea765f315a3e1e4afc35bf8687d189254c1e05a6fe80c0617f9183d67260d6a115c6c94e3603e2303fbb43a76a64523ffda686b1d4518543"},
+		{"Lorem ipsum dolor sit amet, consectetur adipisicing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat. Duis aute irure dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur. Excepteur sint occaecat cupidatat non proident, sunt in culpa qui officia deserunt mollit anim id est laborum.", "salis\x00", 8, "10978b07253df57f71a162eb0e8ad30a"},
+	}
+	for _, test := range tests {
+		key := bcryptPbkdf([]byte(test.password), []byte(test.salt), test.rounds, len(test.key)/2)
+		if hex.EncodeToString(key) != test.key {
+			t.Errorf("bcryptPbkdf(%q, %q, %v) = %x, expected %v", test.password, test.salt, test.rounds, key, test.key)
+		}
+	}
+}
+
+func TestReadOpenSshKeys(t *testing.T) {
+	for _, testKey := range ppkTestKeys {
+		t.Run(testKey.name, func(t *testing.T) {
+			key := readOpenSshTestKey(t, testKey.name, nil)
+			assertTestKey(t, key, testKey.name, testKey.name+" test key")
+
+			publicBlob, comment, err := ReadPublicKey(readOpenSshTestFile(t, testKey.name), failingPrompt(t))
+			if err != nil || !bytes.Equal(publicBlob, key.PublicBlob) || comment != key.Comment {
+				t.Errorf("public key %x, comment %q, error %v", publicBlob, comment, err)
+			}
+			publicBlob, comment, err = ReadPublicKey(readOpenSshTestFile(t, testKey.name+".pub"), failingPrompt(t))
+			if err != nil || !bytes.Equal(publicBlob, key.PublicBlob) || comment != key.Comment {
+				t.Errorf(".pub key %x, comment %q, error %v", publicBlob, comment, err)
+			}
+		})
+	}
+}
+
+func TestReadEncryptedOpenSshKeys(t *testing.T) {
+	tests := []struct {
+		file    string
+		name    string
+		comment string
+	}{
+		// the comment of OpenSSH keys is encrypted, ssh.ParseRawPrivateKeyWithPassphrase drops it
+		{"ed25519-encrypted", "ed25519", ""},
+		{"rsa2048-encrypted", "rsa2048", ""},
+		// what ssh-keygen -m PEM writes
+		{"rsa2048-pem-encrypted", "rsa2048", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			answers := []string{"wrong", ppkTestPassphrase}
+			key := readOpenSshTestKey(t, test.file, func(title string, message string) (string, bool) {
+				answer := answers[0]
+				answers = answers[1:]
+				return answer, true
+			})
+			assertTestKey(t, key, test.name, test.comment)
+			if len(answers) != 0 {
+				t.Errorf("%v answers left", len(answers))
+			}
+
+			_, err := ReadPrivateKey(readOpenSshTestFile(t, test.file), func(title string, message string) (string, bool) { return "", false })
+			if !errors.Is(err, PPKERR_PASSPHRASE_REQUIRED) {
+				t.Errorf("cancelled prompt: %v", err)
+			}
+		})
+	}
+
+	// the public key of encrypted OpenSSH keys is in the clear
+	publicBlob, _, err := ReadPublicKey(readOpenSshTestFile(t, "ed25519-encrypted"), failingPrompt(t))
+	if err != nil || !bytes.Equal(publicBlob, readOpenSshTestKey(t, "ed25519", nil).PublicBlob) {
+		t.Errorf("public key %x, error %v", publicBlob, err)
+	}
+}
+
+func TestMarshalOpenSshKey(t *testing.T) {
+	for _, testKey := range ppkTestKeys {
+		for _, passphrase := range []string{"", ppkTestPassphrase} {
+			name := testKey.name
+			if passphrase != "" {
+				name += "-encrypted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				key := readOpenSshTestKey(t, testKey.name, nil)
+				content, err := MarshalOpenSshKey(key, []byte(passphrase))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// x/crypto reads what we write
+				var privateKey crypto.PrivateKey
+				if passphrase == "" {
+					privateKey, err = ssh.ParseRawPrivateKey(content)
+				} else {
+					privateKey, err = ssh.ParseRawPrivateKeyWithPassphrase(content, []byte(passphrase))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := NewPpkKey(privateKey, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertTestKey(t, parsed, testKey.name, "")
+
+				if passphrase == "" {
+					if comment := openSshKeyComment(mustDecodePem(t, content)); comment != key.Comment {
+						t.Errorf("comment = %q", comment)
+					}
+				}
+			})
+		}
+	}
+}
+
+func readOpenSshTestFile(t *testing.T, name string) []byte {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "keys", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func readOpenSshTestKey(t *testing.T, name string, prompt PassphrasePromptFunc) *PpkKeyType {
+	if prompt == nil {
+		prompt = failingPrompt(t)
+	}
+	key, err := ReadPrivateKey(readOpenSshTestFile(t, name), prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// assertTestKey compares key with the ssh-keygen key in testdata/keys/name
+func assertTestKey(t *testing.T, key *PpkKeyType, name string, comment string) {
+	t.Helper()
+	expected := readTestKey(t, name).(interface {
+		Equal(crypto.PrivateKey) bool
+	})
+	if !expected.Equal(key.PrivateKey) {
+		t.Error("key differs from the ssh-keygen key")
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(readOpenSshTestFile(t, name+".pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.PublicBlob, publicKey.Marshal()) {
+		t.Error("public blob differs from the .pub file")
+	}
+	if key.Comment != comment {
+		t.Errorf("comment = %q, expected %q", key.Comment, comment)
+	}
+}
+
+func failingPrompt(t *testing.T) PassphrasePromptFunc {
+	return func(title string, message string) (string, bool) {
+		t.Errorf("unexpected prompt %q", message)
+		return "", false
+	}
+}
+
+func mustDecodePem(t *testing.T, content []byte) *pem.Block {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		t.Fatal("no PEM block")
+	}
+	return block
+}
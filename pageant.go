@@ -2,13 +2,15 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os/user"
+	"runtime"
+	"sync"
 	"time"
 
-	//"runtime"
 	"strings"
 	"syscall"
 	"unsafe"
@@ -28,33 +30,58 @@ type copyDataStruct struct {
 	lpData uintptr
 }
 
+// memoryBasicInformation mirrors MEMORY_BASIC_INFORMATION, it tells the real size of a mapped view.
+// PartitionId is left out, it sits in what is padding before RegionSize on every architecture.
+type memoryBasicInformation struct {
+	BaseAddress       uintptr
+	AllocationBase    uintptr
+	AllocationProtect uint32
+	RegionSize        uintptr
+	State             uint32
+	Protect           uint32
+	Type              uint32
+}
+
+const (
+	// how long the Pageant window waits for the answer of a WM_COPYDATA request, a passphrase prompt included
+	PAGEANT_COPYDATA_TIMEOUT = 2 * time.Minute
+	// posted to the Pageant window when the answer of a WM_COPYDATA request is ready
+	WM_PAGEANT_ANSWERED = win.WM_APP + 1
+
+	// MsgWaitForMultipleObjectsEx: wake for any message, also for those already in the queue
+	QS_ALLINPUT         = 0x04FF
+	MWMO_INPUTAVAILABLE = 0x0004
+)
+
+const (
+	HEALTH_NAMEDPIPE   = "NamedPipe"
+	HEALTH_WM_COPYDATA = "WM_COPYDATA"
+	HEALTH_UNIXSOCKET  = "UnixSocket"
+	HEALTH_UPSTREAM    = "OpenSSH Agent"
+)
+
 type PageantProxyType struct {
-	WM_CopyData_OK         bool
-	NamedPipe_OK           bool
-	NamedPipe_Listener     net.Listener
-	NamedPipe_Connection   net.Conn
-	winWHND                win.HWND
-	isRestarting           bool
-	proxyRestartChn        chan int
-	NamedPipe_stoppedChn   chan int
-	NamedPipe_stopChn      chan int
-	WM_COPYDATA_stopChn    chan int
-	WM_COPYDATA_stoppedChn chan int
+	Health            *HealthRegistryType
+	winWHND           win.HWND
+	isRestarting      bool
+	unixSocketStarted bool
+	proxyRestartChn   chan int
+	supervisors       []*SupervisorType
+	sessionQueue      *BoundedQueueType
+	upstreamQueue     *BoundedQueueType
 }
 
 var (
 	PageantProxy *PageantProxyType = &PageantProxyType{
-		WM_CopyData_OK:         true,
-		NamedPipe_OK:           true,
-		NamedPipe_Listener:     nil,
-		NamedPipe_Connection:   nil,
-		winWHND:                win.HWND(0),
-		isRestarting:           false,
-		NamedPipe_stopChn:      make(chan int),
-		WM_COPYDATA_stopChn:    make(chan int),
-		NamedPipe_stoppedChn:   make(chan int),
-		WM_COPYDATA_stoppedChn: make(chan int),
+		Health:            NewHealthRegistry(),
+		winWHND:           win.HWND(0),
+		isRestarting:      false,
+		unixSocketStarted: false,
 	}
+
+	// a callback can only be created a limited number of times, so it is shared by every registration of the window class
+	wndProcCallBackOnce sync.Once
+	wndProcCallBackPtr  uintptr
 )
 
 func (p *PageantProxyType) openFileMap(dwDesiredAccess uint32, bInheritHandle uint32, mapNamePtr uintptr) (windows.Handle, error) {
@@ -65,7 +92,6 @@ func (p *PageantProxyType) openFileMap(dwDesiredAccess uint32, bInheritHandle ui
 
 	if err != nil {
 		Logger.Error("PageantProxy: Error openning file map. Error: %v", err)
-		p.WM_CopyData_OK = false
 	}
 
 	return windows.Handle(mapPtr), err
@@ -88,11 +114,12 @@ func (p *PageantProxyType) wndProcCallBack(hWnd win.HWND, message uint32, wParam
 	case win.WM_COPYDATA:
 		{
 			copyData := (*copyDataStruct)(unsafe.Pointer(lParam))
+			health := p.Health.Get(HEALTH_WM_COPYDATA)
 
 			fileMap, err := p.openFileMap(FILE_MAP_ALL_ACCESS, 0, copyData.lpData)
 			if err != nil {
 				Logger.Error("PageantProxy: Failed to open file map. Error: %v", err)
-				p.WM_CopyData_OK = false
+				health.RecordFailure(err)
 				return 0
 			}
 			defer windows.CloseHandle(fileMap)
@@ -101,24 +128,31 @@ func (p *PageantProxyType) wndProcCallBack(hWnd win.HWND, message uint32, wParam
 			ourself, err := GetUserSID()
 			if err != nil {
 				Logger.Error("PageantProxy: Failed to get UserSID. Error %v", err)
-				p.WM_CopyData_OK = false
+				health.RecordFailure(err)
 				return 0
 			}
 			ourself2, err := GetDefaultSID()
 			if err != nil {
 				Logger.Error("PageantProxy: Failed to get DefaultSID. Error %v", err)
-				p.WM_CopyData_OK = false
+				health.RecordFailure(err)
 				return 0
 			}
 			mapOwner, err := GetHandleSID(fileMap)
 			if err != nil {
 				Logger.Error("PageantProxy: Failed to get HandleSID. Error %v", err)
-				p.WM_CopyData_OK = false
+				health.RecordFailure(err)
 				return 0
 			}
 			if !windows.EqualSid(mapOwner, ourself) && !windows.EqualSid(mapOwner, ourself2) {
 				Logger.Error("PageantProxy: file map is already own by something else")
-				p.WM_CopyData_OK = false
+				health.RecordFailure(PROXYERR_PEER_FOREIGN_USER)
+				return 0
+			}
+
+			// Windows does not tell which process sent a message, the window in wParam and the name of the
+			// file map are both chosen by the client. The client policy sees WM_COPYDATA clients as unknown.
+			if err = ClientPolicy.Evaluate(""); err != nil {
+				Logger.Error("PageantProxy: WM_COPYDATA rejected request, its sender cannot be identified. Error: %v", err)
 				return 0
 			}
 
@@ -126,31 +160,36 @@ func (p *PageantProxyType) wndProcCallBack(hWnd win.HWND, message uint32, wParam
 			sharedMemory, err := windows.MapViewOfFile(fileMap, 2, 0, 0, 0)
 			if err != nil {
 				Logger.Error("PageantProxy: Failed to get shared memory. Error: %v", err)
-				p.WM_CopyData_OK = false
+				health.RecordFailure(err)
 				return 0
 			}
 			defer windows.UnmapViewOfFile(sharedMemory)
 
-			sharedMemoryArray := (*[AgentMaxMessageLength]byte)(unsafe.Pointer(sharedMemory))
-
-			size := binary.BigEndian.Uint32(sharedMemoryArray[:4]) + 4
-			// size += 4
-			if size > AgentMaxMessageLength {
-				Logger.Error("PageantProxy: Message size from file map is too large, size = %v", size)
-				p.WM_CopyData_OK = false
+			var memoryInfo memoryBasicInformation
+			r1, _, err := PROC_VIRTUAL_QUERY.Call(sharedMemory, uintptr(unsafe.Pointer(&memoryInfo)), unsafe.Sizeof(memoryInfo))
+			if r1 == 0 {
+				Logger.Error("PageantProxy: Failed to query size of shared memory. Error: %v", err)
+				health.RecordFailure(err)
 				return 0
 			}
+			sharedMemoryArray := unsafe.Slice((*byte)(unsafe.Pointer(sharedMemory)), memoryInfo.RegionSize)
 
-			// result, err := sshagent.QueryAgent(*sshPipe, sharedMemoryArray[:size], sshagent.AgentMaxMessageLength)
-			result, err := QueryAgent(SSH_AGENT_PIPE, sharedMemoryArray[:size])
+			replied, err := ProcessPageantRequest(sharedMemoryArray, p.maxMessageLength(HEALTH_WM_COPYDATA), p.forwardWhileDispatching)
 			if err != nil {
-				Logger.Error("PageantProxy: Failed to query for sshagent. Result: %v. Error: %v", result, err)
-				p.WM_CopyData_OK = false
+				Logger.Error("PageantProxy: Failed to process WM_COPYDATA request. Error: %v", err)
+				if replied || errors.Is(err, PROXYERR_UPSTREAM_FAILED) {
+					// the listener did its job, upstream failures are tracked by the upstream health
+					health.RecordSuccess()
+				} else {
+					health.RecordFailure(err)
+				}
+				if replied {
+					return 1 // client reads the failure frame from the file map
+				}
 				return 0
 			}
-			copy(sharedMemoryArray[:], result)
 			Logger.Info("PageantProxy: Successfully copied data from sshagent")
-			p.WM_CopyData_OK = true
+			health.RecordSuccess()
 			return 1
 		}
 	}
@@ -158,12 +197,60 @@ func (p *PageantProxyType) wndProcCallBack(hWnd win.HWND, message uint32, wParam
 	return win.DefWindowProc(hWnd, message, wParam, lParam)
 }
 
+// forwardWhileDispatching forwards a WM_COPYDATA request from a worker while the window thread keeps
+// dispatching messages, so the other Pageant clients are served while e.g. the passphrase of a deferred key
+// is asked. The client waits in SendMessage until the window procedure returns, so a request that is not
+// answered within PAGEANT_COPYDATA_TIMEOUT fails. A request that arrives meanwhile is answered first.
+func (p *PageantProxyType) forwardWhileDispatching(request []byte) ([]byte, error) {
+	type answerType struct {
+		response []byte
+		err      error
+	}
+	answerChn := make(chan answerType, 1)
+	hwnd := p.winWHND
+	go func() {
+		response, err := p.forwardAgentRequest(request)
+		answerChn <- answerType{response, err}
+		// wakes the wait below
+		win.PostMessage(hwnd, WM_PAGEANT_ANSWERED, 0, 0)
+	}()
+
+	deadline := time.Now().Add(PAGEANT_COPYDATA_TIMEOUT)
+	var msg win.MSG
+	for {
+		select {
+		case answer := <-answerChn:
+			return answer.response, answer.err
+		default:
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w: %v", PROXYERR_REQUEST_TIMEOUT, PAGEANT_COPYDATA_TIMEOUT)
+		}
+
+		PROC_MSG_WAIT_FOR_MULTIPLE_OBJECTS_EX.Call(0, 0, uintptr(remaining/time.Millisecond), QS_ALLINPUT, MWMO_INPUTAVAILABLE)
+		for win.PeekMessage(&msg, 0, 0, 0, win.PM_REMOVE) {
+			if msg.Message == win.WM_QUIT {
+				// the message loop of the window ends once this request returned
+				win.PostQuitMessage(int32(msg.WParam))
+				return nil, PROXYERR_LISTENER_EXITED
+			}
+			win.TranslateMessage(&msg)
+			win.DispatchMessage(&msg)
+		}
+	}
+}
+
 func (p *PageantProxyType) registerPageantWindow(hInstance win.HINSTANCE) (atom win.ATOM) {
+	wndProcCallBackOnce.Do(func() {
+		wndProcCallBackPtr = syscall.NewCallback(p.wndProcCallBack)
+	})
+
 	var wc win.WNDCLASSEX
 	wc.Style = 0
 
 	wc.CbSize = uint32(unsafe.Sizeof(wc))
-	wc.LpfnWndProc = syscall.NewCallback(p.wndProcCallBack)
+	wc.LpfnWndProc = wndProcCallBackPtr
 	wc.CbClsExtra = 0
 	wc.CbWndExtra = 0
 	wc.HInstance = hInstance
@@ -177,14 +264,24 @@ func (p *PageantProxyType) registerPageantWindow(hInstance win.HINSTANCE) (atom
 	return win.RegisterClassEx(&wc)
 }
 
-func (p *PageantProxyType) Start_Pageant_WM_COPYDATA_Proxy() {
+// run_Pageant_WM_COPYDATA_Proxy owns the Pageant window. Window and message loop live on one locked
+// OS thread, the loop ends when the window is destroyed.
+func (p *PageantProxyType) run_Pageant_WM_COPYDATA_Proxy(stop <-chan struct{}) error {
 	Logger.Info("PageantProxy: Starting up Pageant WM_COPYDATA Proxy Server")
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
 	inst := win.GetModuleHandle(nil)
 	atom := p.registerPageantWindow(inst)
 	if atom == 0 {
-		Logger.Error("PageantProxy: WM_COPYDATA RegisterClass failed: %d", win.GetLastError())
-		p.WM_CopyData_OK = false
+		return fmt.Errorf("WM_COPYDATA RegisterClass failed: %d", win.GetLastError())
 	}
+	defer func() {
+		Logger.Info("PageantProxy: checking and trying to unregister WM_COPYDATA proxy WNDClass")
+		if !win.UnregisterClass(syscall.StringToUTF16Ptr(WND_CLASSNAME)) {
+			Logger.Error("PageantProxy: Failed to unregister window class for WM_COPYDATA proxy. Error: %v", win.GetLastError())
+		}
+	}()
 
 	// CreateWindowEx
 	p.winWHND = win.CreateWindowEx(win.WS_EX_APPWINDOW,
@@ -197,67 +294,48 @@ func (p *PageantProxyType) Start_Pageant_WM_COPYDATA_Proxy() {
 		0,
 		inst,
 		nil)
+	if p.winWHND == 0 {
+		return fmt.Errorf("WM_COPYDATA CreateWindowEx failed: %d", win.GetLastError())
+	}
 
-	//runtime.LockOSThread()
-	msg := (*win.MSG)(unsafe.Pointer(win.GlobalAlloc(0, unsafe.Sizeof(win.MSG{}))))
-	defer win.GlobalFree(win.HGLOBAL(unsafe.Pointer(msg)))
+	loopDone := make(chan struct{})
+	defer close(loopDone)
 	go func() {
-		Logger.Info("PageantProxy: WM_COPYDATA event handler coroutine started")
-		for win.GetMessage(msg, 0, 0, 0) > 0 {
-			//if !win.IsDialogMessage(p.winWHND, msg) {
-			//	win.TranslateMessage(msg)
-			//	win.DispatchMessage(msg)
-			//}
-			//time.Sleep(100 * time.Millisecond)
+		select {
+		case <-stop:
+			Logger.Info("PageantProxy: Receive stop signal for WM_COPYDATA proxy. Now stopping!")
+			win.PostMessage(p.winWHND, win.WM_CLOSE, 0, 0)
+		case <-loopDone:
 		}
 	}()
 
-	close := false
-	for !close {
-		select {
-		case <-p.WM_COPYDATA_stopChn:
-			{
-				Logger.Info("PageantProxy: Receive stop signal for WM_COPYDATA proxy. Now stopping!")
-				p.Stop_Pageant_WM_COPYDATA_Proxy()
-				close = true
-			}
-		default:
-			time.Sleep(100 * time.Millisecond)
+	p.Health.Get(HEALTH_WM_COPYDATA).MarkUp()
+	Logger.Info("PageantProxy: WM_COPYDATA message loop started")
+	var msg win.MSG
+	for {
+		ret := win.GetMessage(&msg, 0, 0, 0)
+		if ret == 0 {
+			break
+		}
+		if ret == -1 {
+			return fmt.Errorf("WM_COPYDATA GetMessage failed: %d", win.GetLastError())
 		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
 	}
-	Logger.Info("PageantProxy: sending WM_COPYDATA stopped signal back to main handler")
-	p.WM_COPYDATA_stoppedChn <- 1
-	Logger.Info("PageantProxy: finished sending WM_COPYDATA stopped signal back to main handler")
-}
+	Logger.Info("PageantProxy: WM_COPYDATA message loop stopped")
 
-func (p *PageantProxyType) Stop_Pageant_WM_COPYDATA_Proxy() bool {
-	var stopped bool
-	var ok bool
-	Logger.Info("PageantProxy: sending WM_CLOSE message to WM_COPYDATA message handler")
-	ret := win.SendMessage(p.winWHND, win.WM_CLOSE, 0, 0)
-	Logger.Info("PageantProxy: finished sending WM_CLOSE message. Result %v", ret)
-
-	//Logger.Info("PageantProxy: checking and trying to cleanup WNDCLass resource of WM_COPYDATA proxy")
-	//ok = win.DestroyWindow(p.winWHND)
-	//if !ok {
-	//	Logger.Error("PageantProxy: Failed to destroy window class for WM_COPYDATA proxy. Error: %v", win.GetLastError())
-	//	stopped = false
-	//}
-
-	Logger.Info("PageantProxy: checking and trying to unregister WM_COPYDATA proxy WNDClass")
-	ok = win.UnregisterClass(syscall.StringToUTF16Ptr(WND_CLASSNAME))
-	if !ok {
-		Logger.Error("PageantProxy: Failed to unregister window class for WM_COPYDATA proxy. Error: %v", win.GetLastError())
-		stopped = false
-	}
-
-	Logger.Info("PageantProxy: finished closing WM_COPYDATA proxy resources")
-	return stopped
+	select {
+	case <-stop:
+		return nil
+	default:
+		return PROXYERR_LISTENER_EXITED
+	}
 }
 
 ///////////////////////////////////////
 
-func (p *PageantProxyType) pipeListen(pageantConn net.Conn) {
+func (p *PageantProxyType) pipeListen(pageantConn net.Conn, health *HealthType, maxLength int) {
 	defer func() {
 		if pageantConn != nil {
 			pageantConn.Close()
@@ -268,135 +346,233 @@ func (p *PageantProxyType) pipeListen(pageantConn net.Conn) {
 	for {
 		lenBuf := make([]byte, 4)
 		_, err := io.ReadFull(reader, lenBuf)
-		if err != nil {
-			p.NamedPipe_OK = false
-			Logger.Error("PageantProxy: failed to read query data length from named pipe. Error: %v", err)
+		if err == io.EOF {
+			Logger.Info("PageantProxy: client closed the connection")
 			return
 		}
-
-		bufferLen := binary.BigEndian.Uint32(lenBuf)
-		readBuf := make([]byte, bufferLen)
-		_, err = io.ReadFull(reader, readBuf)
 		if err != nil {
-			p.NamedPipe_OK = false
-			Logger.Error("PageantProxy: failed to read query data from named pipe. Error: %v", err)
+			health.RecordFailure(err)
+			Logger.Error("PageantProxy: failed to read query data length from client connection. Error: %v", err)
 			return
 		}
 
-		result, err := QueryAgent(SSH_AGENT_PIPE, append(lenBuf, readBuf...))
-		if err != nil {
-			p.NamedPipe_OK = false
-			Logger.Error("PageantProxy: failed to query from openssh-agent. Error: %v", err)
-			return
+		var result []byte
+		bufferLen := binary.BigEndian.Uint32(lenBuf)
+		if uint64(bufferLen)+4 > uint64(maxLength) {
+			// skip the request to stay in sync with the client, and refuse it
+			Logger.Error("PageantProxy: request of %v bytes exceeds the limit of %v bytes", uint64(bufferLen)+4, maxLength)
+			_, err = io.CopyN(io.Discard, reader, int64(bufferLen))
+			if err != nil {
+				health.RecordFailure(err)
+				Logger.Error("PageantProxy: failed to read query data from client connection. Error: %v", err)
+				return
+			}
+			result = AgentFailureFrame()
+		} else {
+			readBuf := make([]byte, bufferLen)
+			_, err = io.ReadFull(reader, readBuf)
+			if err != nil {
+				health.RecordFailure(err)
+				Logger.Error("PageantProxy: failed to read query data from client connection. Error: %v", err)
+				return
+			}
+
+			result, err = p.forwardAgentRequest(append(lenBuf, readBuf...))
+			if err != nil {
+				// upstream failures are tracked by the upstream health, the client still gets an answer
+				Logger.Error("PageantProxy: failed to query from openssh-agent. Error: %v", err)
+				result = AgentFailureFrame()
+			} else if len(result) > maxLength {
+				Logger.Error("PageantProxy: response of %v bytes exceeds the limit of %v bytes", len(result), maxLength)
+				result = AgentFailureFrame()
+			}
 		}
 
 		_, err = pageantConn.Write(result)
 		if err != nil {
-			p.NamedPipe_OK = false
-			Logger.Error("PageantProxy: failed to write result data to named pipe. Error: %v", err)
+			health.RecordFailure(err)
+			Logger.Error("PageantProxy: failed to write result data to client connection. Error: %v", err)
 			return
 		}
-		p.NamedPipe_OK = true
-		Logger.Info("PageantProxy: successfully write result data to named pipe. Result: %s", result)
+		health.RecordSuccess()
+		Logger.Info("PageantProxy: successfully write result data to client connection. Result: %v bytes", len(result))
+	}
+}
+
+// serveSession runs a client connection once a session slot is free.
+// Clients over the session limit get their first request answered with SSH_AGENT_FAILURE.
+func (p *PageantProxyType) serveSession(conn net.Conn, health *HealthType, maxLength int) {
+	queue := p.sessionQueue
+	err := queue.Acquire()
+	if err != nil {
+		Logger.Error("PageantProxy: rejecting client session. Error: %v", err)
+		p.rejectSession(conn)
+		return
 	}
+	defer queue.Release()
+
+	p.pipeListen(conn, health, maxLength)
+}
+
+func (p *PageantProxyType) rejectSession(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return
+	}
+	bufferLen := binary.BigEndian.Uint32(lenBuf)
+	if bufferLen > AGENT_MAX_MESSAGE_LENGTH {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(bufferLen)); err != nil {
+		return
+	}
+	conn.Write(AgentFailureFrame())
+}
+
+// forwardAgentRequest is the single path every proxy listener uses to hand a request to the upstream agent.
+// At most MaxInFlightRequests requests talk to the upstream agent at once, the rest queue and are
+// answered with SSH_AGENT_FAILURE once the queue is full or they waited too long.
+func (p *PageantProxyType) forwardAgentRequest(request []byte) ([]byte, error) {
+	if result, handled := p.handlePuttyExtension(request); handled {
+		Capture.Record(APP_NAME, request, result, 0, nil)
+		return result, nil
+	}
+
+	if result, handled := DeferredKeys.Prepare(request, p.queryUpstream); handled {
+		Capture.Record(APP_NAME, request, result, 0, nil)
+		return result, nil
+	}
+
+	result, err := p.queryUpstream(request)
+	if err != nil {
+		return nil, err
+	}
+	return DeferredKeys.Complete(request, result), nil
+}
+
+// queryUpstream sends one request to the upstream agent, as one of at most MaxInFlightRequests
+func (p *PageantProxyType) queryUpstream(request []byte) ([]byte, error) {
+	queue := p.upstreamQueue
+	err := queue.Acquire()
+	if err != nil {
+		Logger.Error("PageantProxy: answering request with SSH_AGENT_FAILURE. Error: %v", err)
+		return AgentFailureFrame(), nil
+	}
+	defer queue.Release()
+
+	upstreamHealth := p.Health.Get(HEALTH_UPSTREAM)
+	upstream := p.UpstreamAddress()
+	startedAt := time.Now()
+	result, err := QueryAgent(upstream, request)
+	Capture.Record(upstream, request, result, time.Since(startedAt), err)
+	if err != nil {
+		upstreamHealth.RecordFailure(err)
+		return nil, err
+	}
+	upstreamHealth.RecordSuccess()
+	return result, nil
+}
+
+// maxMessageLength is the configured limit for requests and responses on a transport.
+// The WM_COPYDATA transport is additionally limited by the size of the client's file map.
+func (p *PageantProxyType) maxMessageLength(transport string) int {
+	var configured int
+	switch transport {
+	case HEALTH_NAMEDPIPE:
+		configured = Configs.MaxMessageLengthNamedPipe
+	case HEALTH_UNIXSOCKET:
+		configured = Configs.MaxMessageLengthUnixSocket
+	case HEALTH_WM_COPYDATA:
+		configured = Configs.MaxMessageLengthWMCopyData
+	}
+	if configured <= 0 || configured > AGENT_MAX_MESSAGE_LENGTH {
+		return AGENT_MAX_MESSAGE_LENGTH
+	}
+	return configured
+}
+
+// UpstreamAddress is the agent every request is forwarded to
+func (p *PageantProxyType) UpstreamAddress() string {
+	if ManagedAgent.IsActive() {
+		return ManagedAgent.Address()
+	}
+	return ConfiguredUpstreamAgent()
 }
 
 func (p *PageantProxyType) GetPagentPipeName() (string, error) {
 	currentUser, err := user.Current()
 	if err != nil {
 		Logger.Error("PageantProxy: Failed to query current username from system. Error: %v", err)
-		p.NamedPipe_OK = false
 		return "", err
 	}
 	pipeName := fmt.Sprintf(AGENT_PIPE_NAME, strings.Split(currentUser.Username, `\`)[1], CapiObfuscateString(WND_CLASSNAME))
 	return pipeName, nil
 }
 
-func (p *PageantProxyType) Start_PageantNamedPipeProxy() {
+func (p *PageantProxyType) run_PageantNamedPipeProxy(stop <-chan struct{}) error {
 	Logger.Info("PageantProxy: Starting up NamedPipe Proxy Server")
-	var err error
 	pipeName, err := p.GetPagentPipeName()
 	if err != nil {
-		Logger.Error("PageantProxy: Failed to get name of named-pipe. Error: %v", err)
-		p.NamedPipe_OK = false
-		return
+		return fmt.Errorf("failed to get name of named-pipe: %w", err)
 	}
-	p.NamedPipe_Listener, err = winio.ListenPipe(pipeName, nil)
+	securityDescriptor, err := NamedPipeSecurityDescriptor()
 	if err != nil {
-		Logger.Error("PageantProxy: Failed to create listener on named pipe %v. Error: %v", pipeName, err)
-		p.NamedPipe_OK = false
-		return
+		return fmt.Errorf("failed to build security descriptor for named pipe %v: %w", pipeName, err)
+	}
+	pipeListener, err := winio.ListenPipe(pipeName, &winio.PipeConfig{SecurityDescriptor: securityDescriptor})
+	if err != nil {
+		return fmt.Errorf("failed to create listener on named pipe %v: %w", pipeName, err)
 	}
-	defer func() {
-		if p.NamedPipe_Listener != nil {
-			p.NamedPipe_Listener.Close()
-		}
-	}()
 
-	stopped := make(chan int)
-	go func() {
-		Logger.Info("PageantProxy: NamedPipe proxy message handler coroutine started")
-	out:
-		for {
-			select {
-			case <-stopped:
-				break out
-			default:
-				{
-					p.NamedPipe_Connection, err = p.NamedPipe_Listener.Accept()
-					if p.NamedPipe_Connection != nil {
-						if err != nil {
-							Logger.Error("PageantProxy: Failed to process message on named pipe. Error: %v", err)
-							p.NamedPipe_OK = false
-						} else {
-							Logger.Info("PageantProxy: receive new message on NamedPipe Proxy.")
-							go p.pipeListen(p.NamedPipe_Connection)
-						}
-					} else {
-						Logger.Info("PageantProxy: NamedPipe '%v' connection is closed!", pipeName)
-					}
-				}
-			}
-		}
-		Logger.Info("PageantProxy: NamedPipe proxy message handler coroutine stopped.")
-	}()
+	listener := NewVerifiedListener("NamedPipe "+pipeName, pipeListener, VerifyNamedPipePeer)
+	return p.serveListener(HEALTH_NAMEDPIPE, listener, stop)
+}
 
-	close := false
-	for !close {
-		select {
-		case <-p.NamedPipe_stopChn:
-			{
-				Logger.Info("PageantProxy: Receive stop signal for NamedPipe proxy. Now stopping!")
-				p.Stop_PageantNamedPipeProxy()
-				stopped <- 1
-				close = true
-			}
-		default:
-			time.Sleep(100 * time.Millisecond)
-		}
+func (p *PageantProxyType) run_PageantUnixSocketProxy(stop <-chan struct{}) error {
+	socketPath := Configs.AgentSocketPath
+	Logger.Info("PageantProxy: Starting up UnixSocket Proxy Server on %v", socketPath)
+	listener, err := ListenUnixSocket(socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to create listener on unix socket %v: %w", socketPath, err)
 	}
-	Logger.Info("PageantProxy: sending NamedPipe proxy stopped signal to main handler")
-	p.NamedPipe_stoppedChn <- 1
-	Logger.Info("PageantProxy: finsihed sending NamedPipe proxy stopped signal to main handler")
+
+	return p.serveListener(HEALTH_UNIXSOCKET, listener, stop)
 }
 
-func (p *PageantProxyType) Stop_PageantNamedPipeProxy() bool {
-	Logger.Info("PageantProxy: check and try to close NamedPipe proxy resource")
-	if p.NamedPipe_Connection != nil {
-		err := p.NamedPipe_Connection.Close()
-		if err != nil {
-			Logger.Error("PageantProxy: failed to close NamedPipe connection. Error %v", err)
-		}
-	}
+// serveListener accepts client sessions until stop is closed or the listener fails
+func (p *PageantProxyType) serveListener(name string, listener net.Listener, stop <-chan struct{}) error {
+	health := p.Health.Get(name)
+	health.MarkUp()
+	maxLength := p.maxMessageLength(name)
 
-	if p.NamedPipe_Listener != nil {
-		err := p.NamedPipe_Listener.Close()
-		if err != nil {
-			Logger.Error("PageantProxy: failed to close NamedPipe listener. Error %v", err)
+	acceptErr := make(chan error, 1)
+	go func() {
+		Logger.Info("PageantProxy: %v proxy message handler coroutine started", name)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			Logger.Info("PageantProxy: receive new message on %v Proxy.", name)
+			go p.serveSession(conn, health, maxLength)
 		}
+	}()
+
+	select {
+	case <-stop:
+		Logger.Info("PageantProxy: Receive stop signal for %v proxy. Now stopping!", name)
+		listener.Close()
+		<-acceptErr
+		Logger.Info("PageantProxy: finished closing %v proxy resource", name)
+		return nil
+	case err := <-acceptErr:
+		listener.Close()
+		return fmt.Errorf("%v listener failed: %w", name, err)
 	}
-	Logger.Info("PageantProxy: finished closing NamedPipe proxy resource")
-	return true
 }
 
 func (p *PageantProxyType) SendRestartSignal() {
@@ -410,41 +586,77 @@ func (p *PageantProxyType) SendRestartSignal() {
 func (p *PageantProxyType) Start() bool {
 	if p.proxyRestartChn == nil {
 		p.proxyRestartChn = make(chan int)
-	}
-	go func() {
-		for {
-			select {
-			case <-p.proxyRestartChn:
+		go func() {
+			for range p.proxyRestartChn {
 				Logger.Info("PageentProxy: receive restart signal. Restarting")
 				go p.Restart()
-			default:
-				time.Sleep(100 * time.Millisecond)
 			}
-		}
-	}()
+		}()
+	}
+	queueTimeout := time.Duration(Configs.RequestQueueTimeoutSeconds) * time.Second
+	p.sessionQueue = NewBoundedQueue("client sessions", Configs.MaxClientSessions, Configs.RequestQueueLength, queueTimeout)
+	p.upstreamQueue = NewBoundedQueue("upstream requests", Configs.MaxInFlightRequests, Configs.RequestQueueLength, queueTimeout)
 
-	go p.Start_PageantNamedPipeProxy()
-	go p.Start_Pageant_WM_COPYDATA_Proxy()
+	p.supervisors = []*SupervisorType{
+		p.newListenerSupervisor(HEALTH_NAMEDPIPE, p.run_PageantNamedPipeProxy),
+		p.newListenerSupervisor(HEALTH_WM_COPYDATA, p.run_Pageant_WM_COPYDATA_Proxy),
+	}
+	p.unixSocketStarted = Configs.AgentSocketPath != ""
+	if p.unixSocketStarted {
+		p.supervisors = append(p.supervisors, p.newListenerSupervisor(HEALTH_UNIXSOCKET, p.run_PageantUnixSocketProxy))
+	} else {
+		p.Health.Remove(HEALTH_UNIXSOCKET)
+	}
+	for _, supervisor := range p.supervisors {
+		supervisor.Start()
+	}
 
 	Logger.Info("PageantProxy: WM_COPYDATA proxy and NamedPipe proxy started")
 	p.isRestarting = false
 	return true
 }
 
-func (p *PageantProxyType) Stop() bool {
-	Logger.Info("PageantProxy: sending stop signal to NamedPipe proxy coroutine")
-	p.NamedPipe_stopChn <- 1
-	<-p.NamedPipe_stoppedChn
-	Logger.Info("PageantProxy: received signal from NamedPipe proxy that it is stopped")
-
-	Logger.Info("PageantProxy: sending stop signal to WM_COPYDATA proxy coroutine")
-	p.WM_COPYDATA_stopChn <- 1
-	<-p.WM_COPYDATA_stoppedChn
-	Logger.Info("PageantProxy: received signal from WM_COPYDATA proxy that it is stopped")
+func (p *PageantProxyType) newListenerSupervisor(name string, run ListenerRunFunc) *SupervisorType {
+	supervisor := NewSupervisor(name, run)
+	if Configs.ListenerMaxRestarts > 0 {
+		supervisor.MaxAttempts = Configs.ListenerMaxRestarts
+	}
+	if Configs.ListenerBackoffBaseSeconds > 0 {
+		supervisor.BaseDelay = time.Duration(Configs.ListenerBackoffBaseSeconds) * time.Second
+	}
+	if Configs.ListenerBackoffMaxSeconds > 0 {
+		supervisor.MaxDelay = time.Duration(Configs.ListenerBackoffMaxSeconds) * time.Second
+	}
+	supervisor.OnRestart = func(name string, attempt int, delay time.Duration, err error) {
+		p.Health.Get(name).MarkDown(err)
+		App.PushWarnNoti("%v proxy failed, restarting in %v (attempt %v). Error: %v", name, delay.Round(time.Second), attempt, err)
+	}
+	supervisor.OnGiveUp = func(name string, attempts int, err error) {
+		p.Health.Get(name).MarkDown(err)
+		App.PushErrNoti("%v proxy failed %v times and was not restarted. Use 'Refresh Pageant Proxy' to retry. Error: %v", name, attempts, err)
+	}
+	return supervisor
+}
 
+func (p *PageantProxyType) Stop() bool {
+	for _, supervisor := range p.supervisors {
+		Logger.Info("PageantProxy: stopping %v proxy", supervisor.Name)
+		supervisor.Stop()
+		p.Health.Get(supervisor.Name).MarkStopped()
+		Logger.Info("PageantProxy: %v proxy is stopped", supervisor.Name)
+	}
 	return true
 }
 
+// SupervisorStats reports restart counts and last failures of every proxy listener
+func (p *PageantProxyType) SupervisorStats() []SupervisorStatsType {
+	stats := make([]SupervisorStatsType, 0, len(p.supervisors))
+	for _, supervisor := range p.supervisors {
+		stats = append(stats, supervisor.Stats())
+	}
+	return stats
+}
+
 func (p *PageantProxyType) Restart() bool {
 	stopped := p.Stop()
 	if !stopped {
@@ -456,6 +668,18 @@ func (p *PageantProxyType) Restart() bool {
 	return true
 }
 
+// IsHealthy reports whether every listener is serving and the upstream agent is not down.
+// Degraded listeners still count as healthy, the dashboard shows their details.
 func (p *PageantProxyType) IsHealthy() bool {
-	return p.NamedPipe_OK && p.WM_CopyData_OK
+	for _, snapshot := range p.Health.Snapshots() {
+		switch snapshot.State {
+		case HEALTH_STATE_DOWN:
+			return false
+		case HEALTH_STATE_UNKNOWN:
+			if snapshot.Name != HEALTH_UPSTREAM {
+				return false
+			}
+		}
+	}
+	return true
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+const PAGEANT_CLIENT_MAP_NAME = "WinSSHPageantUIRequest%08x%08x"
+
+var pageantClientRequestCounter uint32
+
+// QueryPageantWindow sends one length prefixed request the way PuTTY does: through a named file map
+// announced to the Pageant window with WM_COPYDATA. It returns the length prefixed response.
+func QueryPageantWindow(request []byte, timeout time.Duration) ([]byte, error) {
+	if len(request) > AGENT_MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("%w: length = %v", AGENTERR_MESSAGE_TOO_LONG, len(request))
+	}
+
+	hwnd := win.FindWindow(syscall.StringToUTF16Ptr(WND_CLASSNAME), syscall.StringToUTF16Ptr(WND_CLASSNAME))
+	if hwnd == 0 {
+		return nil, fmt.Errorf("%w: no %v window found", AGENTERR_UNREACHABLE, WND_CLASSNAME)
+	}
+
+	mapName := fmt.Sprintf(PAGEANT_CLIENT_MAP_NAME, os.Getpid(), atomic.AddUint32(&pageantClientRequestCounter, 1))
+	fileMap, err := windows.CreateFileMapping(windows.InvalidHandle, nil, windows.PAGE_READWRITE, 0, AGENT_MAX_MESSAGE_LENGTH, syscall.StringToUTF16Ptr(mapName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create file map %v: %w", mapName, err)
+	}
+	defer windows.CloseHandle(fileMap)
+
+	sharedMemory, err := windows.MapViewOfFile(fileMap, windows.FILE_MAP_WRITE, 0, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot map file map %v: %w", mapName, err)
+	}
+	defer windows.UnmapViewOfFile(sharedMemory)
+	view := mappedView(sharedMemory, AGENT_MAX_MESSAGE_LENGTH)
+	copy(view, request)
+
+	// the receiver opens the map with OpenFileMappingA, so the name is passed as a NUL terminated ANSI string
+	mapNameBytes := append([]byte(mapName), 0)
+	copyData := copyDataStruct{
+		dwData: AGENT_COPYDATA_ID,
+		cbData: uint32(len(mapNameBytes)),
+		lpData: uintptr(unsafe.Pointer(&mapNameBytes[0])),
+	}
+
+	var result uintptr
+	r1, _, err := PROC_SEND_MESSAGE_TIMEOUT_W.Call(uintptr(hwnd), win.WM_COPYDATA, 0, uintptr(unsafe.Pointer(&copyData)),
+		SMTO_ABORTIFHUNG, uintptr(timeout.Milliseconds()), uintptr(unsafe.Pointer(&result)))
+	if r1 == 0 {
+		return nil, fmt.Errorf("%w: WM_COPYDATA was not answered within %v: %v", AGENTERR_UNREACHABLE, timeout, err)
+	}
+	if result == 0 {
+		return nil, fmt.Errorf("%w: WM_COPYDATA request was refused", AGENTERR_UNEXPECTED_REPLY)
+	}
+
+	frame, err := ReadAgentFrame(bytes.NewReader(view), AGENT_MAX_MESSAGE_LENGTH)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", AGENTERR_UNEXPECTED_REPLY, err)
+	}
+	return frame, nil
+}
+
+// mappedView returns size bytes of a mapped file view. The view is not Go memory, MapViewOfFile only
+// hands out its address as uintptr, so the address is read back as the unsafe.Pointer it is.
+func mappedView(address uintptr, size int) []byte {
+	pointer := *(*unsafe.Pointer)(unsafe.Pointer(&address))
+	return unsafe.Slice((*byte)(pointer), size)
+}
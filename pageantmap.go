@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// AgentQueryFunc forwards one length prefixed agent request and returns the length prefixed response.
+type AgentQueryFunc func(request []byte) ([]byte, error)
+
+// ProcessPageantRequest serves one Pageant request from view, which stands for the mapped file view
+// shared with the client: a 4 byte big endian length followed by the request. The response is copied
+// back into view. Neither the request nor the response may exceed len(view) or maxLength.
+//
+// replied reports whether view holds a reply for the client, either the agent response or a
+// SSH_AGENT_FAILURE frame written because of err. When query fails there is nothing to answer with,
+// view is left as it is and err wraps PROXYERR_UPSTREAM_FAILED.
+func ProcessPageantRequest(view []byte, maxLength int, query AgentQueryFunc) (replied bool, err error) {
+	if len(view) < len(AgentFailureFrame()) {
+		return false, fmt.Errorf("%w: size = %v", PROXYERR_MAP_TOO_SMALL, len(view))
+	}
+
+	limit := uint64(len(view))
+	if uint64(maxLength) < limit {
+		limit = uint64(maxLength)
+	}
+
+	size := uint64(binary.BigEndian.Uint32(view[:4])) + 4
+	if size > limit {
+		return writeAgentFailure(view), fmt.Errorf("%w: size = %v, limit = %v", PROXYERR_REQUEST_TOO_LARGE, size, limit)
+	}
+
+	// copy the request out so the response can never overlap with what is still being read
+	request := make([]byte, size)
+	copy(request, view[:size])
+
+	result, err := query(request)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", PROXYERR_UPSTREAM_FAILED, err)
+	}
+
+	if len(result) < 4 || uint64(binary.BigEndian.Uint32(result[:4]))+4 != uint64(len(result)) {
+		return writeAgentFailure(view), fmt.Errorf("%w: length = %v", PROXYERR_MALFORMED_RESPONSE, len(result))
+	}
+
+	if uint64(len(result)) > limit {
+		return writeAgentFailure(view), fmt.Errorf("%w: size = %v, limit = %v", PROXYERR_RESPONSE_TOO_LARGE, len(result), limit)
+	}
+
+	copy(view, result)
+	return true, nil
+}
+
+func writeAgentFailure(view []byte) bool {
+	frame := AgentFailureFrame()
+	if len(view) < len(frame) {
+		return false
+	}
+	copy(view, frame)
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestProcessPageantRequest(t *testing.T) {
+	request := frameAgentMessage([]byte{SSH_AGENTC_REQUEST_IDENTITIES})
+	response := frameAgentMessage([]byte{SSH_AGENT_IDENTITIES_ANSWER, 0, 0, 0, 0})
+	queryError := errors.New("upstream gone")
+
+	tests := []struct {
+		name      string
+		view      []byte
+		maxLength int
+		result    []byte
+		queryErr  error
+		replied   bool
+		err       error
+		expected  []byte
+	}{
+		{
+			name:      "forwards the request and copies the response",
+			view:      viewWith(request, 64),
+			maxLength: 8192,
+			result:    response,
+			replied:   true,
+			expected:  response,
+		},
+		{
+			name:      "truncated header",
+			view:      []byte{0, 0, 0},
+			maxLength: 8192,
+			err:       PROXYERR_MAP_TOO_SMALL,
+			expected:  []byte{0, 0, 0},
+		},
+		{
+			name:      "length prefix larger than the view",
+			view:      viewWith([]byte{0, 0, 1, 0, SSH_AGENTC_REQUEST_IDENTITIES}, 64),
+			maxLength: 8192,
+			replied:   true,
+			err:       PROXYERR_REQUEST_TOO_LARGE,
+			expected:  AgentFailureFrame(),
+		},
+		{
+			name:      "length prefix larger than maxLength",
+			view:      viewWith(frameAgentMessage(make([]byte, 32)), 64),
+			maxLength: 16,
+			replied:   true,
+			err:       PROXYERR_REQUEST_TOO_LARGE,
+			expected:  AgentFailureFrame(),
+		},
+		{
+			name:      "reply larger than the view",
+			view:      viewWith(request, 16),
+			maxLength: 8192,
+			result:    frameAgentMessage(make([]byte, 32)),
+			replied:   true,
+			err:       PROXYERR_RESPONSE_TOO_LARGE,
+			expected:  AgentFailureFrame(),
+		},
+		{
+			name:      "reply larger than maxLength",
+			view:      viewWith(request, 64),
+			maxLength: 16,
+			result:    frameAgentMessage(make([]byte, 32)),
+			replied:   true,
+			err:       PROXYERR_RESPONSE_TOO_LARGE,
+			expected:  AgentFailureFrame(),
+		},
+		{
+			name:      "reply with a wrong length prefix",
+			view:      viewWith(request, 64),
+			maxLength: 8192,
+			result:    []byte{0, 0, 0, 9, SSH_AGENT_SUCCESS},
+			replied:   true,
+			err:       PROXYERR_MALFORMED_RESPONSE,
+			expected:  AgentFailureFrame(),
+		},
+		{
+			name:      "query error leaves the view alone",
+			view:      viewWith(request, 64),
+			maxLength: 8192,
+			queryErr:  queryError,
+			err:       PROXYERR_UPSTREAM_FAILED,
+			expected:  request,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var forwarded []byte
+			replied, err := ProcessPageantRequest(test.view, test.maxLength, func(request []byte) ([]byte, error) {
+				forwarded = request
+				return test.result, test.queryErr
+			})
+
+			if replied != test.replied {
+				t.Errorf("replied = %v, expected %v", replied, test.replied)
+			}
+			if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+				t.Errorf("err = %v, expected %v", err, test.err)
+			}
+			if test.queryErr != nil && !bytes.Contains([]byte(err.Error()), []byte(test.queryErr.Error())) {
+				t.Errorf("err = %v, expected it to mention %v", err, test.queryErr)
+			}
+			if forwarded != nil && !bytes.Equal(forwarded, request) {
+				t.Errorf("forwarded %x, expected %x", forwarded, request)
+			}
+			if !bytes.HasPrefix(test.view, test.expected) {
+				t.Errorf("view starts with %x, expected %x", test.view[:len(test.expected)], test.expected)
+			}
+		})
+	}
+}
+
+// viewWith returns a file map view of size bytes that holds content
+func viewWith(content []byte, size int) []byte {
+	view := make([]byte, size)
+	copy(view, content)
+	return view
+}
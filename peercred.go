@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// PeerCredType describes the process on the other side of an accepted connection
+type PeerCredType struct {
+	PID        uint32
+	User       string
+	Executable string
+}
+
+type PeerVerifierFunc func(conn net.Conn) (*PeerCredType, error)
+
+// VerifiedListenerType wraps a listener and only hands out connections whose peer passed the verifier.
+// Rejected connections are logged and closed, Accept keeps waiting for the next one.
+type VerifiedListenerType struct {
+	net.Listener
+	name   string
+	verify PeerVerifierFunc
+}
+
+func NewVerifiedListener(name string, listener net.Listener, verify PeerVerifierFunc) *VerifiedListenerType {
+	return &VerifiedListenerType{
+		Listener: listener,
+		name:     name,
+		verify:   verify,
+	}
+}
+
+func (l *VerifiedListenerType) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+
+		peer, err := l.verify(conn)
+		if err == nil {
+			err = ClientPolicy.Evaluate(peer.Executable)
+		}
+		if err != nil {
+			if peer != nil {
+				Logger.Error("PeerCred: %v rejected connection from pid %v (user %v, executable %v). Error: %v", l.name, peer.PID, peer.User, peer.Executable, err)
+			} else {
+				Logger.Error("PeerCred: %v rejected connection. Error: %v", l.name, err)
+			}
+			conn.Close()
+			continue
+		}
+
+		Logger.Info("PeerCred: %v accepted connection from pid %v (user %v, executable %v)", l.name, peer.PID, peer.User, peer.Executable)
+		return conn, nil
+	}
+}
+
+// ListenUnixSocket creates an AF_UNIX listener only reachable by the current user.
+// The socket file is restricted to the owner and each peer is verified on accept.
+func ListenUnixSocket(path string) (net.Listener, error) {
+	if IsFileExist(path) {
+		Logger.Info("PeerCred: removing stale unix socket %v", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = RestrictFileToOwner(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return NewVerifiedListener("UnixSocket "+path, listener, VerifyUnixSocketPeer), nil
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// RestrictFileToOwner makes a file only accessible by its owner
+func RestrictFileToOwner(path string) error {
+	return os.Chmod(path, AGENT_SOCKET_FILE_MODE)
+}
+
+// VerifyUnixSocketPeer checks the SO_PEERCRED uid of an AF_UNIX connection against our own uid.
+func VerifyUnixSocketPeer(conn net.Conn) (*PeerCredType, error) {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, PROXYERR_PEER_UNKNOWN
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+
+	var ucred *syscall.Ucred
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: SO_PEERCRED failed: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+
+	peer := &PeerCredType{PID: uint32(ucred.Pid), User: strconv.Itoa(int(ucred.Uid))}
+	peer.Executable, err = os.Readlink(fmt.Sprintf("/proc/%d/exe", ucred.Pid))
+	if err != nil {
+		Logger.Error("PeerCred: cannot resolve executable of pid %v. Error: %v", ucred.Pid, err)
+	}
+	if int(ucred.Uid) != os.Getuid() {
+		return peer, PROXYERR_PEER_FOREIGN_USER
+	}
+	return peer, nil
+}
@@ -0,0 +1,127 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// NamedPipeSecurityDescriptor returns an SDDL string with a protected DACL that only grants the current user access.
+func NamedPipeSecurityDescriptor() (string, error) {
+	ourself, err := GetUserSID()
+	if err != nil {
+		return "", err
+	}
+	sid := ourself.String()
+	return fmt.Sprintf("O:%sD:P(A;;GA;;;%s)", sid, sid), nil
+}
+
+// RestrictFileToOwner replaces the DACL of a file with the one of NamedPipeSecurityDescriptor.
+// File modes mean nothing on Windows, os.Chmod only toggles the read-only attribute.
+func RestrictFileToOwner(path string) error {
+	sddl, err := NamedPipeSecurityDescriptor()
+	if err != nil {
+		return err
+	}
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
+
+// VerifyNamedPipePeer checks that the client process of a named pipe connection runs as the current user.
+func VerifyNamedPipePeer(conn net.Conn) (*PeerCredType, error) {
+	fdConn, ok := conn.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, PROXYERR_PEER_UNKNOWN
+	}
+
+	var pid uint32
+	r1, _, err := PROC_GET_NAMED_PIPE_CLIENT_PROCESS_ID.Call(fdConn.Fd(), uintptr(unsafe.Pointer(&pid)))
+	if r1 == 0 {
+		return nil, fmt.Errorf("%w: GetNamedPipeClientProcessId failed: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+
+	return verifyProcessOwner(pid)
+}
+
+// VerifyUnixSocketPeer checks that the peer process of an AF_UNIX connection runs as the current user.
+// Windows has no SO_PEERCRED, the peer pid is queried with SIO_AF_UNIX_GETPEERPID instead.
+func VerifyUnixSocketPeer(conn net.Conn) (*PeerCredType, error) {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, PROXYERR_PEER_UNKNOWN
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+
+	var pid uint32
+	var ioctlErr error
+	err = rawConn.Control(func(fd uintptr) {
+		var returned uint32
+		ioctlErr = windows.WSAIoctl(windows.Handle(fd), SIO_AF_UNIX_GETPEERPID, nil, 0, (*byte)(unsafe.Pointer(&pid)), uint32(unsafe.Sizeof(pid)), &returned, nil, 0)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: SIO_AF_UNIX_GETPEERPID failed: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+
+	return verifyProcessOwner(pid)
+}
+
+func verifyProcessOwner(pid uint32) (*PeerCredType, error) {
+	peer := &PeerCredType{PID: pid}
+
+	proc, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return peer, fmt.Errorf("%w: cannot open process: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+	defer windows.CloseHandle(proc)
+
+	exeName := make([]uint16, windows.MAX_LONG_PATH)
+	exeNameLen := uint32(len(exeName))
+	err = windows.QueryFullProcessImageName(proc, 0, &exeName[0], &exeNameLen)
+	if err != nil {
+		Logger.Error("PeerCred: cannot resolve executable of pid %v. Error: %v", pid, err)
+	} else {
+		peer.Executable = windows.UTF16ToString(exeName[:exeNameLen])
+	}
+
+	var token windows.Token
+	err = windows.OpenProcessToken(proc, windows.TOKEN_QUERY, &token)
+	if err != nil {
+		return peer, fmt.Errorf("%w: cannot open process token: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+	defer token.Close()
+
+	tokenUser, err := token.GetTokenUser()
+	if err != nil {
+		return peer, fmt.Errorf("%w: cannot query token user: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+	peer.User = tokenUser.User.Sid.String()
+
+	ourself, err := GetUserSID()
+	if err != nil {
+		return peer, fmt.Errorf("%w: cannot query own SID: %v", PROXYERR_PEER_UNKNOWN, err)
+	}
+	if !windows.EqualSid(tokenUser.User.Sid, ourself) {
+		return peer, PROXYERR_PEER_FOREIGN_USER
+	}
+	return peer, nil
+}
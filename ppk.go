@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	PPK_HEADER_PREFIX     = "PuTTY-User-Key-File-"
+	PPK_ENCRYPTION_NONE   = "none"
+	PPK_ENCRYPTION_AES256 = "aes256-cbc"
+
+	PPK_KDF_ARGON2ID = "Argon2id"
+	PPK_KDF_ARGON2I  = "Argon2i"
+	PPK_KDF_ARGON2D  = "Argon2d"
+
+	PPK_AES_KEY_LENGTH = 32
+	PPK_AES_IV_LENGTH  = 16
+	PPK_V3_MAC_KEY_LEN = 32
+
+	// what PuTTYgen uses for new files
+	PPK_ARGON2_MEMORY      = 8192
+	PPK_ARGON2_PASSES      = 13
+	PPK_ARGON2_PARALLELISM = 1
+	PPK_ARGON2_SALT_LENGTH = 16
+	PPK_LINE_LENGTH        = 64
+
+	// a file can ask for any cost, more than this is refused before deriving the key. PuTTYgen's
+	// defaults stay far below, 1 GiB of memory in KiB.
+	PPK_ARGON2_MAX_MEMORY = 1 << 20
+	PPK_ARGON2_MAX_PASSES = 100
+
+	// version 2 derives the MAC key from this prefix and the passphrase, the AES key from the passphrase alone
+	PPK_V2_MAC_KEY_PREFIX = "putty-private-key-file-mac-key"
+)
+
+// PpkFileType is a parsed but not yet decrypted PuTTY private key file. The public key and
+// comment are in the clear, the private blob may still be encrypted.
+type PpkFileType struct {
+	Version    int
+	Algorithm  string
+	Encryption string
+	Comment    string
+	PublicBlob []byte
+
+	privateBlob []byte
+	privateMac  []byte
+
+	kdf               string
+	argon2Memory      uint32
+	argon2Passes      uint32
+	argon2Parallelism uint8
+	argon2Salt        []byte
+}
+
+// PassphrasePromptFunc asks the user for a passphrase, ok is false when the user cancelled
+type PassphrasePromptFunc func(title string, message string) (passphrase string, ok bool)
+
+// PpkKeyType is a decrypted PuTTY private key
+type PpkKeyType struct {
+	Algorithm  string
+	Comment    string
+	PublicBlob []byte
+	PrivateKey crypto.PrivateKey
+}
+
+func (f *PpkFileType) IsEncrypted() bool {
+	return f.Encryption != PPK_ENCRYPTION_NONE
+}
+
+// ParsePpk reads the headers and blobs of a PPK file, it does not decrypt anything yet.
+// The file format is described in the PuTTY manual, appendix C.
+func ParsePpk(content []byte) (*PpkFileType, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 4096), AGENT_MAX_MESSAGE_LENGTH)
+	f := &PpkFileType{}
+
+	// next returns the next "Key: value" line, the key must be the expected one
+	next := func(expected string) (string, error) {
+		if !scanner.Scan() {
+			return "", fmt.Errorf("%w: missing %v", PPKERR_INVALID_FORMAT, expected)
+		}
+		line := strings.TrimRight(scanner.Text(), "\r")
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 || parts[0] != expected {
+			return "", fmt.Errorf("%w: expected %v, found %q", PPKERR_INVALID_FORMAT, expected, line)
+		}
+		return parts[1], nil
+	}
+	// lines reads the base64 block announced by a "...-Lines: n" header
+	lines := func(header string) ([]byte, error) {
+		value, err := next(header)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 || count > AGENT_MAX_MESSAGE_LENGTH/64 {
+			return nil, fmt.Errorf("%w: invalid %v %q", PPKERR_INVALID_FORMAT, header, value)
+		}
+		encoded := strings.Builder{}
+		for i := 0; i < count; i++ {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("%w: %v announces %v lines, file ends after %v", PPKERR_INVALID_FORMAT, header, count, i)
+			}
+			encoded.WriteString(strings.TrimSpace(scanner.Text()))
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded.String())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v: %v", PPKERR_INVALID_FORMAT, header, err)
+		}
+		return decoded, nil
+	}
+
+	if !scanner.Scan() {
+		return nil, PPKERR_INVALID_FORMAT
+	}
+	first := strings.TrimPrefix(strings.TrimRight(scanner.Text(), "\r"), "\ufeff")
+	if !strings.HasPrefix(first, PPK_HEADER_PREFIX) {
+		return nil, PPKERR_INVALID_FORMAT
+	}
+	parts := strings.SplitN(strings.TrimPrefix(first, PPK_HEADER_PREFIX), ": ", 2)
+	if len(parts) != 2 {
+		return nil, PPKERR_INVALID_FORMAT
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil || (version != 2 && version != 3) {
+		return nil, fmt.Errorf("%w: %v", PPKERR_UNSUPPORTED_VERSION, parts[0])
+	}
+	f.Version = version
+	f.Algorithm = parts[1]
+
+	if f.Encryption, err = next("Encryption"); err != nil {
+		return nil, err
+	}
+	if f.Encryption != PPK_ENCRYPTION_NONE && f.Encryption != PPK_ENCRYPTION_AES256 {
+		return nil, fmt.Errorf("%w: %v", PPKERR_UNSUPPORTED_ENCRYPTION, f.Encryption)
+	}
+	if f.Comment, err = next("Comment"); err != nil {
+		return nil, err
+	}
+	if f.PublicBlob, err = lines("Public-Lines"); err != nil {
+		return nil, err
+	}
+
+	if f.Version == 3 && f.IsEncrypted() {
+		if err = f.parseArgon2Headers(next); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.privateBlob, err = lines("Private-Lines"); err != nil {
+		return nil, err
+	}
+	mac, err := next("Private-MAC")
+	if err != nil {
+		return nil, err
+	}
+	if f.privateMac, err = hex.DecodeString(mac); err != nil {
+		return nil, fmt.Errorf("%w: Private-MAC: %v", PPKERR_INVALID_FORMAT, err)
+	}
+
+	if KeyTypeOf(f.PublicBlob) != f.Algorithm {
+		return nil, fmt.Errorf("%w: header says %v, public key is %v", PPKERR_INVALID_FORMAT, f.Algorithm, KeyTypeOf(f.PublicBlob))
+	}
+	return f, nil
+}
+
+func (f *PpkFileType) parseArgon2Headers(next func(string) (string, error)) error {
+	var err error
+	if f.kdf, err = next("Key-Derivation"); err != nil {
+		return err
+	}
+	if f.kdf == PPK_KDF_ARGON2D {
+		return fmt.Errorf("%w: %v, save the key again with %v in PuTTYgen", PPKERR_UNSUPPORTED_DERIVATION, f.kdf, PPK_KDF_ARGON2ID)
+	}
+	if f.kdf != PPK_KDF_ARGON2ID && f.kdf != PPK_KDF_ARGON2I {
+		return fmt.Errorf("%w: %v", PPKERR_UNSUPPORTED_DERIVATION, f.kdf)
+	}
+
+	numbers := []struct {
+		header string
+		value  *uint32
+		max    uint64
+	}{{"Argon2-Memory", &f.argon2Memory, PPK_ARGON2_MAX_MEMORY}, {"Argon2-Passes", &f.argon2Passes, PPK_ARGON2_MAX_PASSES}}
+	for _, number := range numbers {
+		text, err := next(number.header)
+		if err != nil {
+			return err
+		}
+		value, err := strconv.ParseUint(text, 10, 32)
+		if err != nil || value == 0 {
+			return fmt.Errorf("%w: invalid %v %q", PPKERR_INVALID_FORMAT, number.header, text)
+		}
+		if value > number.max {
+			return fmt.Errorf("%w: %v %v is above %v", PPKERR_UNSUPPORTED_DERIVATION, number.header, value, number.max)
+		}
+		*number.value = uint32(value)
+	}
+
+	text, err := next("Argon2-Parallelism")
+	if err != nil {
+		return err
+	}
+	parallelism, err := strconv.ParseUint(text, 10, 8)
+	if err != nil || parallelism == 0 {
+		return fmt.Errorf("%w: invalid Argon2-Parallelism %q", PPKERR_INVALID_FORMAT, text)
+	}
+	f.argon2Parallelism = uint8(parallelism)
+
+	if text, err = next("Argon2-Salt"); err != nil {
+		return err
+	}
+	if f.argon2Salt, err = hex.DecodeString(text); err != nil {
+		return fmt.Errorf("%w: Argon2-Salt: %v", PPKERR_INVALID_FORMAT, err)
+	}
+	return nil
+}
+
+// Decrypt decrypts and verifies the private key. passphrase is ignored for unencrypted files.
+// A MAC mismatch of an encrypted file means the passphrase was wrong.
+func (f *PpkFileType) Decrypt(passphrase []byte) (*PpkKeyType, error) {
+	if f.IsEncrypted() && len(passphrase) == 0 {
+		return nil, PPKERR_PASSPHRASE_REQUIRED
+	}
+	if !f.IsEncrypted() {
+		passphrase = nil
+	}
+
+	cipherKey, iv, macKey := f.deriveKeys(passphrase)
+
+	privateBlob := make([]byte, len(f.privateBlob))
+	copy(privateBlob, f.privateBlob)
+	if f.IsEncrypted() {
+		if len(privateBlob)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("%w: private blob is not a multiple of the block size", PPKERR_INVALID_FORMAT)
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(privateBlob, privateBlob)
+	}
+
+	if !hmac.Equal(f.computeMac(macKey, privateBlob), f.privateMac) {
+		if f.IsEncrypted() {
+			return nil, PPKERR_WRONG_PASSPHRASE
+		}
+		return nil, PPKERR_MAC_MISMATCH
+	}
+
+	privateKey, err := ppkPrivateKey(f.Algorithm, f.PublicBlob, privateBlob)
+	if err != nil {
+		return nil, err
+	}
+	return &PpkKeyType{
+		Algorithm:  f.Algorithm,
+		Comment:    f.Comment,
+		PublicBlob: f.PublicBlob,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// DecryptPpk decrypts f, asking for the passphrase with prompt if the file is encrypted.
+// A wrong passphrase is asked again, up to PPK_PASSPHRASE_ATTEMPTS times.
+func DecryptPpk(f *PpkFileType, prompt PassphrasePromptFunc) (*PpkKeyType, error) {
+	if !f.IsEncrypted() {
+		return f.Decrypt(nil)
+	}
+	return promptDecrypt("Unlock PuTTY key", f.Comment, prompt, f.Decrypt)
+}
+
+// promptDecrypt asks for the passphrase of the key named name until decrypt accepts it
+func promptDecrypt(title string, name string, prompt PassphrasePromptFunc, decrypt func(passphrase []byte) (*PpkKeyType, error)) (*PpkKeyType, error) {
+	message := fmt.Sprintf("Passphrase for key '%v':", name)
+	for attempt := 1; attempt <= PPK_PASSPHRASE_ATTEMPTS; attempt++ {
+		passphrase, ok := prompt(title, message)
+		if !ok {
+			return nil, PPKERR_PASSPHRASE_REQUIRED
+		}
+		key, err := decrypt([]byte(passphrase))
+		if !errors.Is(err, PPKERR_WRONG_PASSPHRASE) {
+			return key, err
+		}
+		message = fmt.Sprintf("Wrong passphrase, try again. Passphrase for key '%v':", name)
+	}
+	return nil, PPKERR_WRONG_PASSPHRASE
+}
+
+// MarshalPpk writes key as a PPK file of version 2 or 3. The file is encrypted with aes256-cbc when
+// passphrase is not empty, version 3 derives the keys with Argon2id like PuTTYgen does.
+func MarshalPpk(key *PpkKeyType, version int, passphrase []byte) ([]byte, error) {
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("%w: %v", PPKERR_UNSUPPORTED_VERSION, version)
+	}
+	privateBlob, err := ppkPrivateBlob(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &PpkFileType{
+		Version:    version,
+		Algorithm:  key.Algorithm,
+		Encryption: PPK_ENCRYPTION_NONE,
+		Comment:    strings.NewReplacer("\r", " ", "\n", " ").Replace(key.Comment),
+		PublicBlob: key.PublicBlob,
+	}
+	if len(passphrase) > 0 {
+		f.Encryption = PPK_ENCRYPTION_AES256
+		if version == 3 {
+			f.kdf = PPK_KDF_ARGON2ID
+			f.argon2Memory = PPK_ARGON2_MEMORY
+			f.argon2Passes = PPK_ARGON2_PASSES
+			f.argon2Parallelism = PPK_ARGON2_PARALLELISM
+			f.argon2Salt = make([]byte, PPK_ARGON2_SALT_LENGTH)
+			if _, err = rand.Read(f.argon2Salt); err != nil {
+				return nil, err
+			}
+		}
+		// the padding is covered by the MAC, readers ignore it when parsing the private blob
+		padding := make([]byte, aes.BlockSize-len(privateBlob)%aes.BlockSize)
+		if _, err = rand.Read(padding); err != nil {
+			return nil, err
+		}
+		privateBlob = append(privateBlob, padding...)
+	}
+
+	cipherKey, iv, macKey := f.deriveKeys(passphrase)
+	f.privateMac = f.computeMac(macKey, privateBlob)
+	f.privateBlob = privateBlob
+	if f.IsEncrypted() {
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(f.privateBlob, f.privateBlob)
+	}
+	return f.marshal(), nil
+}
+
+func (f *PpkFileType) marshal() []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "%v%v: %v\r\n", PPK_HEADER_PREFIX, f.Version, f.Algorithm)
+	fmt.Fprintf(out, "Encryption: %v\r\n", f.Encryption)
+	fmt.Fprintf(out, "Comment: %v\r\n", f.Comment)
+	writeLines := func(header string, blob []byte) {
+		encoded := base64.StdEncoding.EncodeToString(blob)
+		fmt.Fprintf(out, "%v: %v\r\n", header, (len(encoded)+PPK_LINE_LENGTH-1)/PPK_LINE_LENGTH)
+		for len(encoded) > PPK_LINE_LENGTH {
+			fmt.Fprintf(out, "%v\r\n", encoded[:PPK_LINE_LENGTH])
+			encoded = encoded[PPK_LINE_LENGTH:]
+		}
+		fmt.Fprintf(out, "%v\r\n", encoded)
+	}
+	writeLines("Public-Lines", f.PublicBlob)
+	if f.Version == 3 && f.IsEncrypted() {
+		fmt.Fprintf(out, "Key-Derivation: %v\r\n", f.kdf)
+		fmt.Fprintf(out, "Argon2-Memory: %v\r\n", f.argon2Memory)
+		fmt.Fprintf(out, "Argon2-Passes: %v\r\n", f.argon2Passes)
+		fmt.Fprintf(out, "Argon2-Parallelism: %v\r\n", f.argon2Parallelism)
+		fmt.Fprintf(out, "Argon2-Salt: %v\r\n", hex.EncodeToString(f.argon2Salt))
+	}
+	writeLines("Private-Lines", f.privateBlob)
+	fmt.Fprintf(out, "Private-MAC: %v\r\n", hex.EncodeToString(f.privateMac))
+	return out.Bytes()
+}
+
+// ImportPpk decrypts a PPK file, asking for the passphrase with prompt, and adds the key to the agent at address
+func ImportPpk(content []byte, address string, constraints AgentConstraintsType, prompt PassphrasePromptFunc) (*PpkKeyType, error) {
+	ppkFile, err := ParsePpk(content)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := DecryptPpk(ppkFile, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = AddKeyToAgent(address, key, constraints); err != nil {
+		return nil, err
+	}
+	Logger.Info("Ppk: added PuTTY v%v %v key '%v' to %v", ppkFile.Version, key.Algorithm, key.Comment, address)
+	return key, nil
+}
+
+// deriveKeys returns the AES key, the AES IV and the MAC key. Version 3 derives all of them with Argon2,
+// an unencrypted file has an empty MAC key. Version 2 uses SHA-1 and a zero IV.
+func (f *PpkFileType) deriveKeys(passphrase []byte) (cipherKey []byte, iv []byte, macKey []byte) {
+	if f.Version == 2 {
+		return ppkV2Keys(passphrase)
+	}
+	if !f.IsEncrypted() {
+		return nil, nil, []byte{}
+	}
+
+	length := uint32(PPK_AES_KEY_LENGTH + PPK_AES_IV_LENGTH + PPK_V3_MAC_KEY_LEN)
+	var derived []byte
+	if f.kdf == PPK_KDF_ARGON2I {
+		derived = argon2.Key(passphrase, f.argon2Salt, f.argon2Passes, f.argon2Memory, f.argon2Parallelism, length)
+	} else {
+		derived = argon2.IDKey(passphrase, f.argon2Salt, f.argon2Passes, f.argon2Memory, f.argon2Parallelism, length)
+	}
+	return derived[:PPK_AES_KEY_LENGTH], derived[PPK_AES_KEY_LENGTH : PPK_AES_KEY_LENGTH+PPK_AES_IV_LENGTH], derived[PPK_AES_KEY_LENGTH+PPK_AES_IV_LENGTH:]
+}
+
+func ppkV2Keys(passphrase []byte) (cipherKey []byte, iv []byte, macKey []byte) {
+	for counter := uint32(0); counter < 2; counter++ {
+		digest := sha1.Sum(append(appendAgentUint32(nil, counter), passphrase...))
+		cipherKey = append(cipherKey, digest[:]...)
+	}
+	macDigest := sha1.Sum(append([]byte(PPK_V2_MAC_KEY_PREFIX), passphrase...))
+	return cipherKey[:PPK_AES_KEY_LENGTH], make([]byte, PPK_AES_IV_LENGTH), macDigest[:]
+}
+
+// computeMac returns the MAC over the headers, the public blob and the decrypted private blob
+func (f *PpkFileType) computeMac(macKey []byte, privateBlob []byte) []byte {
+	mac := hmac.New(f.macHash(), macKey)
+	for _, field := range [][]byte{[]byte(f.Algorithm), []byte(f.Encryption), []byte(f.Comment), f.PublicBlob, privateBlob} {
+		mac.Write(appendAgentString(nil, field))
+	}
+	return mac.Sum(nil)
+}
+
+func (f *PpkFileType) macHash() func() hash.Hash {
+	if f.Version == 2 {
+		return sha1.New
+	}
+	return sha256.New
+}
+
+// ppkPrivateKey builds the private key from PuTTY's public and private blobs, and checks that both belong together
+func ppkPrivateKey(algorithm string, publicBlob []byte, privateBlob []byte) (crypto.PrivateKey, error) {
+	public := &agentWireReader{buf: publicBlob}
+	public.readString("key type")
+	private := &agentWireReader{buf: privateBlob}
+
+	switch algorithm {
+	case "ssh-rsa":
+		e := readMpint(public, "e")
+		n := readMpint(public, "n")
+		d := readMpint(private, "d")
+		p := readMpint(private, "p")
+		q := readMpint(private, "q")
+		readMpint(private, "iqmp")
+		if public.err != nil || private.err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("%w: %v", PPKERR_INVALID_FORMAT, firstError(public.err, private.err))
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", PPKERR_INVALID_KEY, err)
+		}
+		key.Precompute()
+		return key, nil
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		curve := map[string]elliptic.Curve{
+			"nistp256": elliptic.P256(),
+			"nistp384": elliptic.P384(),
+			"nistp521": elliptic.P521(),
+		}[string(public.readString("curve"))]
+		point := public.readString("public point")
+		d := readMpint(private, "private exponent")
+		if curve == nil {
+			return nil, fmt.Errorf("%w: %v with unknown curve", PPKERR_UNSUPPORTED_ALGORITHM, algorithm)
+		}
+		if public.err != nil || private.err != nil {
+			return nil, fmt.Errorf("%w: %v", PPKERR_INVALID_FORMAT, firstError(public.err, private.err))
+		}
+		key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: d}
+		key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+		if !bytes.Equal(elliptic.Marshal(curve, key.PublicKey.X, key.PublicKey.Y), point) {
+			return nil, PPKERR_INVALID_KEY
+		}
+		return key, nil
+
+	case "ssh-ed25519":
+		point := public.readString("public point")
+		// PuTTY writes the 32 byte seed as a string
+		seed := private.readString("private key")
+		if public.err != nil || private.err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%w: %v", PPKERR_INVALID_FORMAT, firstError(public.err, private.err))
+		}
+		key := ed25519.NewKeyFromSeed(seed)
+		if !bytes.Equal(key.Public().(ed25519.PublicKey), point) {
+			return nil, PPKERR_INVALID_KEY
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %v", PPKERR_UNSUPPORTED_ALGORITHM, algorithm)
+}
+
+// ppkPrivateBlob is the private blob of PuTTY's format for key, the inverse of ppkPrivateKey
+func ppkPrivateBlob(key crypto.PrivateKey) ([]byte, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if len(key.Primes) != 2 {
+			return nil, fmt.Errorf("%w: RSA key with %v primes", PPKERR_UNSUPPORTED_ALGORITHM, len(key.Primes))
+		}
+		p, q := key.Primes[0], key.Primes[1]
+		blob := appendAgentMpint(nil, key.D)
+		blob = appendAgentMpint(blob, p)
+		blob = appendAgentMpint(blob, q)
+		return appendAgentMpint(blob, new(big.Int).ModInverse(q, p)), nil
+	case *ecdsa.PrivateKey:
+		return appendAgentMpint(nil, key.D), nil
+	case ed25519.PrivateKey:
+		return appendAgentString(nil, key.Seed()), nil
+	}
+	return nil, fmt.Errorf("%w: %T", PPKERR_UNSUPPORTED_ALGORITHM, key)
+}
+
+// NewPpkKey wraps a private key of crypto/rsa, crypto/ecdsa or crypto/ed25519, filling in the public blob
+func NewPpkKey(privateKey crypto.PrivateKey, comment string) (*PpkKeyType, error) {
+	if key, ok := privateKey.(*ed25519.PrivateKey); ok {
+		privateKey = *key
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", PPKERR_UNSUPPORTED_ALGORITHM, err)
+	}
+	publicBlob := signer.PublicKey().Marshal()
+	return &PpkKeyType{
+		Algorithm:  KeyTypeOf(publicBlob),
+		Comment:    comment,
+		PublicBlob: publicBlob,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+func readMpint(reader *agentWireReader, field string) *big.Int {
+	return new(big.Int).SetBytes(reader.readString(field))
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return errors.New("invalid key values")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StepProfileType is one CA the user works with. A profile is either bootstrapped from CaUrl and
+// Fingerprint, or configured through a Smallstep team like the Config StepCli dialog does.
+type StepProfileType struct {
+	Name                   string
+	CaUrl                  string
+	Fingerprint            string
+	StepTeamUrl            string
+	StepTeamName           string
+	StepDefaultProvisioner string
+	StepUsername           string
+	Principals             []string
+
+	// SHA256 fingerprints of the CA keys signing user certificates, fetched from /ssh/roots when the
+	// profile is switched to. Certificates of other CAs do not count for this profile.
+	UserCaFingerprints []string
+
+	// Hosts the host CA keys of this profile are trusted for in known_hosts, Configs.KnownHostsPatterns when empty
+	KnownHostsPatterns []string
+}
+
+// ProfilesType switches between Configs.Profiles. The active profile is copied into the Step* fields
+// of Configs, which is what StepCli and the dashboard use.
+type ProfilesType struct {
+	// mu serializes switches, profilesMu guards the profiles and Configs.ActiveProfile a switch changes
+	mu         sync.Mutex
+	profilesMu sync.Mutex
+}
+
+var Profiles *ProfilesType = &ProfilesType{}
+
+// Names returns the names of the configured profiles
+func (p *ProfilesType) Names() []string {
+	p.profilesMu.Lock()
+	defer p.profilesMu.Unlock()
+
+	names := []string{}
+	for _, profile := range Configs.Profiles {
+		names = append(names, profile.Name)
+	}
+	return names
+}
+
+// List returns a copy of the configured profiles
+func (p *ProfilesType) List() []StepProfileType {
+	p.profilesMu.Lock()
+	defer p.profilesMu.Unlock()
+	return append([]StepProfileType{}, Configs.Profiles...)
+}
+
+// Active returns a copy of the active profile, nil when profiles are not in use
+func (p *ProfilesType) Active() *StepProfileType {
+	p.profilesMu.Lock()
+	defer p.profilesMu.Unlock()
+
+	active := p.find(Configs.ActiveProfile)
+	if active == nil {
+		return nil
+	}
+	profile := *active
+	return &profile
+}
+
+// Switch saves the dashboard values into the active profile, makes name the active profile and reconfigures
+// step for its CA. When step fails, the previous profile stays active and the configs are not stored.
+func (p *ProfilesType) Switch(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.profilesMu.Lock()
+	profile := p.find(name)
+	if profile == nil {
+		p.profilesMu.Unlock()
+		return fmt.Errorf("%w: %v", STEPERR_PROFILE_NOT_FOUND, name)
+	}
+	p.saveActive()
+	previous := p.current()
+	p.profilesMu.Unlock()
+
+	Logger.Info("Profiles: switching from '%v' to '%v'", previous.Name, name)
+	// ReConfigure reads the team from the configs
+	p.apply(profile)
+	var err error
+	if profile.CaUrl != "" {
+		err = StepCli.Bootstrap(profile.CaUrl, profile.Fingerprint)
+	} else {
+		err = StepCli.ReConfigure()
+	}
+	if err != nil {
+		Logger.Error("Profiles: failed to switch to '%v', '%v' stays active. Error: %v", name, previous.Name, err)
+		p.apply(&previous)
+		return err
+	}
+	Configs.StoreConfigs()
+
+	if _, err = StepCli.GetProvisionersSetWithRefreshing(); err != nil {
+		Logger.Error("Profiles: failed to refresh provisioners of '%v'. Error: %v", name, err)
+	}
+	p.refreshUserCaFingerprints(profile)
+	if err = KnownHosts.Sync(); err != nil {
+		Logger.Error("Profiles: failed to update the host CAs of '%v' in known_hosts. Error: %v", name, err)
+	}
+	if err = SshConfig.Generate(); err != nil {
+		Logger.Error("Profiles: failed to generate the ssh config of '%v'. Error: %v", name, err)
+	}
+	Configs.StoreConfigs()
+	return nil
+}
+
+// CertificateStatus describes the user certificate of profile among certificates, for the profile menu
+func (p *ProfilesType) CertificateStatus(profile *StepProfileType, certificates []*SshCertificateType) string {
+	var best *SshCertificateType
+	for _, certificate := range certificates {
+		if profile.Matches(certificate) && (best == nil || certificate.ValidBefore.After(best.ValidBefore)) {
+			best = certificate
+		}
+	}
+
+	switch {
+	case best == nil:
+		return "no certificate"
+	case best.ValidForever:
+		return "certificate valid"
+	case best.ValidAt(time.Now()):
+		return "certificate valid until " + best.ValidBefore.Local().Format("15:04")
+	}
+	return "certificate expired"
+}
+
+// Matches reports whether certificate is a user certificate of this profile: for its user or one of
+// its principals, and signed by its CA if the CA keys are known
+func (profile *StepProfileType) Matches(certificate *SshCertificateType) bool {
+	if certificate.Type != SSH_CERT_TYPE_USER {
+		return false
+	}
+	if len(profile.UserCaFingerprints) > 0 && !containsString(profile.UserCaFingerprints, certificate.SigningCa) {
+		return false
+	}
+	if profile.StepUsername != "" && certificate.HasPrincipal(profile.StepUsername) {
+		return true
+	}
+	for _, principal := range profile.Principals {
+		if certificate.HasPrincipal(principal) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the profile the Step* fields of Configs hold, the caller holds profilesMu
+func (p *ProfilesType) current() StepProfileType {
+	return StepProfileType{
+		Name:                   Configs.ActiveProfile,
+		StepTeamUrl:            Configs.StepTeamUrl,
+		StepTeamName:           Configs.StepTeamName,
+		StepDefaultProvisioner: Configs.StepDefaultProvisioner,
+		StepUsername:           Configs.StepUsername,
+		Principals:             Principals(),
+	}
+}
+
+// apply copies profile into the Step* fields of Configs and makes it the active profile
+func (p *ProfilesType) apply(profile *StepProfileType) {
+	p.profilesMu.Lock()
+	defer p.profilesMu.Unlock()
+
+	Configs.ActiveProfile = profile.Name
+	Configs.StepTeamUrl = profile.StepTeamUrl
+	Configs.StepTeamName = profile.StepTeamName
+	Configs.StepDefaultProvisioner = profile.StepDefaultProvisioner
+	Configs.StepUsername = profile.StepUsername
+	SetPrincipals(profile.Principals)
+}
+
+// saveActive keeps what was changed in the dashboard, e.g. the provisioner, in the active profile.
+// The caller holds profilesMu.
+func (p *ProfilesType) saveActive() {
+	active := p.find(Configs.ActiveProfile)
+	if active == nil {
+		return
+	}
+	active.StepTeamUrl = Configs.StepTeamUrl
+	active.StepTeamName = Configs.StepTeamName
+	active.StepDefaultProvisioner = Configs.StepDefaultProvisioner
+	active.StepUsername = Configs.StepUsername
+}
+
+func (p *ProfilesType) refreshUserCaFingerprints(profile *StepProfileType) {
+	client, err := StepCli.caClient()
+	if err != nil {
+		Logger.Error("Profiles: cannot reach the CA of '%v'. Error: %v", profile.Name, err)
+		return
+	}
+	sshRoots, err := client.SshRoots()
+	if err != nil {
+		Logger.Error("Profiles: cannot read the SSH CA keys of '%v'. Error: %v", profile.Name, err)
+		return
+	}
+
+	fingerprints := []string{}
+	for _, key := range sshRoots.UserKeys {
+		fingerprints = append(fingerprints, KeyFingerprint(key.Marshal()))
+	}
+	p.profilesMu.Lock()
+	profile.UserCaFingerprints = fingerprints
+	p.profilesMu.Unlock()
+	Logger.Info("Profiles: user CA keys of '%v': %v", profile.Name, strings.Join(fingerprints, ", "))
+}
+
+func (p *ProfilesType) find(name string) *StepProfileType {
+	if name == "" {
+		return nil
+	}
+	for i := range Configs.Profiles {
+		if Configs.Profiles[i].Name == name {
+			return &Configs.Profiles[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// useTestProfiles configures a production profile bootstrapped from a CA url and a staging profile of a
+// team, with production active, and runs StepCli against recording
+func useTestProfiles(t *testing.T, recording string) {
+	useTestConfigs(t)
+	stepCli, principals := StepCli, Principals()
+	t.Cleanup(func() {
+		StepCli = stepCli
+		SetPrincipals(principals)
+	})
+	StepCli = newReplayStepCli(t, recording)
+
+	Configs.Profiles = []StepProfileType{
+		{Name: "production", CaUrl: "https://ca.example.com", Fingerprint: "6f3b4d2ab8a0a9a0d4b1c4f7d1e5b2c39b6e0f1ea4c3b2a1908f7e6d5c4b3a29", StepUsername: "alice", Principals: []string{"alice"}},
+		{Name: "staging", StepTeamName: "ops", StepUsername: "alice-staging", Principals: []string{"staging"}},
+	}
+	Profiles.apply(&Configs.Profiles[0])
+}
+
+func TestSwitchProfileKeepsActiveProfileOnError(t *testing.T) {
+	useTestProfiles(t, "empty.json")
+	Configs.Profiles[1].StepTeamName = ""
+
+	if err := Profiles.Switch("staging"); !errors.Is(err, STEPERR_NO_STEP_TEAM_CONFIGURED) {
+		t.Fatalf("err = %v, expected %v", err, STEPERR_NO_STEP_TEAM_CONFIGURED)
+	}
+	if Configs.ActiveProfile != "production" || Configs.StepUsername != "alice" || !reflect.DeepEqual(Principals(), []string{"alice"}) {
+		t.Errorf("active profile %q, user %q, principals %v after the failed switch", Configs.ActiveProfile, Configs.StepUsername, Principals())
+	}
+	if _, err := os.Stat(APP_CONFS_FILE); !os.IsNotExist(err) {
+		t.Errorf("configs were stored after the failed switch: %v", err)
+	}
+
+	if err := Profiles.Switch("development"); !errors.Is(err, STEPERR_PROFILE_NOT_FOUND) {
+		t.Errorf("unknown profile: err = %v, expected %v", err, STEPERR_PROFILE_NOT_FOUND)
+	}
+}
+
+func TestSwitchProfile(t *testing.T) {
+	useTestProfiles(t, "bootstrap.json")
+	Profiles.apply(&Configs.Profiles[1])
+
+	// the CA step was bootstrapped for
+	userKey := readTestPublicKey(t, "ed25519")
+	serveTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case STEP_CA_SSH_ROOTS_PATH:
+			writeJson(w, http.StatusOK, map[string][][]byte{"userKey": {userKey.Marshal()}})
+		case STEP_CA_PROVISIONERS_PATH:
+			writeJson(w, http.StatusOK, map[string]interface{}{"provisioners": []interface{}{}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	// the certificate check and the profiles menu read the profiles while the switch runs
+	done := make(chan struct{})
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if active := Profiles.Active(); active != nil {
+				active.Matches(&SshCertificateType{Type: SSH_CERT_TYPE_USER, Principals: []string{"alice"}})
+			}
+			for _, profile := range Profiles.List() {
+				Profiles.CertificateStatus(&profile, nil)
+			}
+		}
+	}()
+	err := Profiles.Switch("production")
+	close(done)
+	<-checked
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active := Profiles.Active()
+	if active == nil || active.Name != "production" || Configs.StepUsername != "alice" || !reflect.DeepEqual(Principals(), []string{"alice"}) {
+		t.Fatalf("active profile %+v, user %q, principals %v", active, Configs.StepUsername, Principals())
+	}
+	if !reflect.DeepEqual(active.UserCaFingerprints, []string{KeyFingerprint(userKey.Marshal())}) {
+		t.Errorf("user CA fingerprints = %v", active.UserCaFingerprints)
+	}
+	// the dashboard values of staging were kept in its profile
+	if Configs.Profiles[1].StepUsername != "alice-staging" || Configs.Profiles[1].StepTeamName != "ops" {
+		t.Errorf("staging profile = %+v", Configs.Profiles[1])
+	}
+
+	stored := ConfigType{}
+	content, err := ioutil.ReadFile(APP_CONFS_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(content, &stored); err != nil || stored.ActiveProfile != "production" {
+		t.Errorf("stored active profile %q, error %v", stored.ActiveProfile, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PuTTY's Pageant extensions, from the PuTTY manual, appendix "Pageant extensions"
+const (
+	PUTTY_EXT_LIST_EXTENSIONS = "list-extensions@putty.projects.tartarus.org"
+	PUTTY_EXT_ADD_PPK         = "add-ppk@putty.projects.tartarus.org"
+)
+
+// Key constraints of SSH_AGENTC_ADD_ID_CONSTRAINED, also used by add-ppk
+const (
+	SSH_AGENT_CONSTRAIN_LIFETIME  = 1
+	SSH_AGENT_CONSTRAIN_CONFIRM   = 2
+	SSH_AGENT_CONSTRAIN_EXTENSION = 255
+)
+
+const PPK_PASSPHRASE_ATTEMPTS = 3
+
+var PUTTY_EXTENSIONS = []string{PUTTY_EXT_LIST_EXTENSIONS, PUTTY_EXT_ADD_PPK}
+
+type AgentConstraintsType struct {
+	LifetimeSecs     uint32
+	ConfirmBeforeUse bool
+}
+
+// handlePuttyExtension answers the PuTTY extensions the proxy implements itself, OpenSSH does not know them.
+// handled is false for every other request, those go to the upstream agent.
+func (p *PageantProxyType) handlePuttyExtension(request []byte) (response []byte, handled bool) {
+	if messageTypeOf(request) != SSH_AGENTC_EXTENSION {
+		return nil, false
+	}
+	reader := &agentWireReader{buf: request[5:]}
+	name := string(reader.readString("extension name"))
+	if reader.err != nil {
+		return nil, false
+	}
+
+	switch name {
+	case PUTTY_EXT_LIST_EXTENSIONS:
+		Logger.Info("PageantProxy: answering %v", name)
+		body := []byte{SSH_AGENT_SUCCESS}
+		for _, extension := range PUTTY_EXTENSIONS {
+			body = appendAgentString(body, []byte(extension))
+		}
+		return frameAgentMessage(body), true
+
+	case PUTTY_EXT_ADD_PPK:
+		Logger.Info("PageantProxy: handling %v", name)
+		if err := p.addPpk(reader); err != nil {
+			Logger.Error("PageantProxy: %v failed. Error: %v", name, err)
+			if !errors.Is(err, PPKERR_PASSPHRASE_REQUIRED) {
+				App.PushErrNoti("Could not add the PuTTY key to the agent. Error: %v", err)
+			}
+			return AgentFailureFrame(), true
+		}
+		return frameAgentMessage([]byte{SSH_AGENT_SUCCESS}), true
+	}
+	return nil, false
+}
+
+// addPpk adds the key of an add-ppk request upstream. An encrypted key is registered with DeferredKeys instead,
+// its passphrase is asked when it is first used.
+func (p *PageantProxyType) addPpk(reader *agentWireReader) error {
+	content := reader.readString("ppk file")
+	if reader.err != nil {
+		return reader.err
+	}
+	constraints, err := parseAgentConstraints(reader)
+	if err != nil {
+		return err
+	}
+
+	ppkFile, err := ParsePpk(content)
+	if err != nil {
+		return err
+	}
+	if ppkFile.IsEncrypted() {
+		DeferredKeys.Add(ppkFile, constraints)
+		App.PushInfoNoti("Added encrypted PuTTY key '%v', its passphrase will be asked on first use", ppkFile.Comment)
+		return nil
+	}
+
+	key, err := ImportPpk(content, p.UpstreamAddress(), constraints, App.PromptPassphrase)
+	if err != nil {
+		return err
+	}
+	App.PushInfoNoti("Added PuTTY key '%v' to the agent", key.Comment)
+	return nil
+}
+
+// parseAgentConstraints reads the key constraints at the end of an add request
+func parseAgentConstraints(reader *agentWireReader) (AgentConstraintsType, error) {
+	constraints := AgentConstraintsType{}
+	for len(reader.buf) > 0 {
+		switch constraint := reader.readByte("constraint"); constraint {
+		case SSH_AGENT_CONSTRAIN_LIFETIME:
+			constraints.LifetimeSecs = reader.readUint32("lifetime")
+		case SSH_AGENT_CONSTRAIN_CONFIRM:
+			constraints.ConfirmBeforeUse = true
+		case SSH_AGENT_CONSTRAIN_EXTENSION:
+			name := reader.readString("constraint extension name")
+			return constraints, fmt.Errorf("unsupported key constraint %v", string(name))
+		default:
+			return constraints, fmt.Errorf("unknown key constraint %v", constraint)
+		}
+	}
+	return constraints, reader.err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startTestAgent serves an in-memory keyring on a unix socket and makes it the upstream agent of the configs
+func startTestAgent(t *testing.T) (agent.Agent, string) {
+	keyring := agent.NewKeyring()
+	return keyring, serveTestAgent(t, keyring)
+}
+
+// serveTestAgent serves keyring on a unix socket and makes it the upstream agent of the configs
+func serveTestAgent(t *testing.T, keyring agent.Agent) string {
+	address := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	upstreamAgent := Configs.UpstreamAgent
+	Configs.UpstreamAgent = address
+	t.Cleanup(func() { Configs.UpstreamAgent = upstreamAgent })
+	return address
+}
+
+// notificationRecorderType keeps the notifications App pushed, as "msgtype: message"
+type notificationRecorderType struct {
+	mu            sync.Mutex
+	notifications []string
+}
+
+// recordNotifications makes App push its notifications to the returned recorder until the test ends
+func recordNotifications(t *testing.T) *notificationRecorderType {
+	recorder := &notificationRecorderType{}
+	previous := SetNotifier(func(msgtype string, message string) {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		recorder.notifications = append(recorder.notifications, msgtype+": "+message)
+	})
+	t.Cleanup(func() { SetNotifier(previous) })
+	return recorder
+}
+
+func (r *notificationRecorderType) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.notifications...)
+}
+
+func puttyExtensionRequest(name string, payload []byte) []byte {
+	return frameAgentMessage(append(appendAgentString([]byte{SSH_AGENTC_EXTENSION}, []byte(name)), payload...))
+}
+
+func TestListExtensions(t *testing.T) {
+	response, handled := PageantProxy.handlePuttyExtension(puttyExtensionRequest(PUTTY_EXT_LIST_EXTENSIONS, nil))
+	if !handled || messageTypeOf(response) != SSH_AGENT_SUCCESS {
+		t.Fatalf("list-extensions = %x, %v", response, handled)
+	}
+
+	reader := &agentWireReader{buf: response[5:]}
+	for _, expected := range PUTTY_EXTENSIONS {
+		if name := string(reader.readString("extension")); name != expected {
+			t.Errorf("extension %q, expected %q", name, expected)
+		}
+	}
+	if reader.err != nil || len(reader.buf) != 0 {
+		t.Errorf("extension list ends with %x, error %v", reader.buf, reader.err)
+	}
+}
+
+func TestOtherRequestsAreNotHandled(t *testing.T) {
+	for _, request := range [][]byte{
+		{0, 0, 0, 1, SSH_AGENTC_REQUEST_IDENTITIES},
+		puttyExtensionRequest("session-bind@openssh.com", nil),
+	} {
+		if response, handled := PageantProxy.handlePuttyExtension(request); handled {
+			t.Errorf("%x was answered with %x", request, response)
+		}
+	}
+}
+
+func TestAddPpk(t *testing.T) {
+	keyring, _ := startTestAgent(t)
+	notifications := recordNotifications(t)
+
+	for _, name := range []string{"rsa2048.v2.ppk", "ed25519.v3.ppk"} {
+		content := readTestPpk(t, name)
+		constraints := appendAgentUint32([]byte{SSH_AGENT_CONSTRAIN_LIFETIME}, 600)
+		response, handled := PageantProxy.handlePuttyExtension(puttyExtensionRequest(PUTTY_EXT_ADD_PPK, append(appendAgentString(nil, content), constraints...)))
+		if !handled || messageTypeOf(response) != SSH_AGENT_SUCCESS {
+			t.Fatalf("add-ppk of %v = %x, %v", name, response, handled)
+		}
+	}
+
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Comment != "rsa2048 test key" || keys[1].Comment != "ed25519 test key" {
+		t.Errorf("upstream keys = %v", keys)
+	}
+	expected := []string{"INFO: Added PuTTY key 'rsa2048 test key' to the agent", "INFO: Added PuTTY key 'ed25519 test key' to the agent"}
+	if !reflect.DeepEqual(notifications.list(), expected) {
+		t.Errorf("notifications = %q", notifications.list())
+	}
+}
+
+func TestAddEncryptedPpkIsDeferred(t *testing.T) {
+	keyring, _ := startTestAgent(t)
+	notifications := recordNotifications(t)
+	content := readTestPpk(t, "ecdsa256.v3.encrypted.ppk")
+	file, err := ParsePpk(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeferredKeys.Prepare(frameAgentMessage([]byte{SSH_AGENTC_REMOVE_ALL_IDENTITIES}), nil) })
+
+	response, handled := PageantProxy.handlePuttyExtension(puttyExtensionRequest(PUTTY_EXT_ADD_PPK, appendAgentString(nil, content)))
+	if !handled || messageTypeOf(response) != SSH_AGENT_SUCCESS {
+		t.Fatalf("add-ppk = %x, %v", response, handled)
+	}
+	if DeferredKeys.get(file.PublicBlob) == nil {
+		t.Error("encrypted key was not registered")
+	}
+	if keys, _ := keyring.List(); len(keys) != 0 {
+		t.Errorf("encrypted key was added upstream before it was used: %v", keys)
+	}
+	expected := []string{"INFO: Added encrypted PuTTY key 'ecdsa256 test key', its passphrase will be asked on first use"}
+	if !reflect.DeepEqual(notifications.list(), expected) {
+		t.Errorf("notifications = %q", notifications.list())
+	}
+}
+
+func TestAddPpkFailures(t *testing.T) {
+	startTestAgent(t)
+	valid := readTestPpk(t, "ed25519.v2.ppk")
+
+	tests := map[string][]byte{
+		"truncated file":       appendAgentString(nil, valid)[:20],
+		"not a PPK file":       appendAgentString(nil, []byte("ssh-ed25519 AAAA")),
+		"corrupt MAC":          appendAgentString(nil, bytes.Replace(valid, []byte("Private-MAC: "), []byte("Private-MAC: 00"), 1)),
+		"unknown constraint":   append(appendAgentString(nil, valid), 42),
+		"extension constraint": append(appendAgentString(nil, valid), append([]byte{SSH_AGENT_CONSTRAIN_EXTENSION}, appendAgentString(nil, []byte("restrict-destination-v00@openssh.com"))...)...),
+	}
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			notifications := recordNotifications(t)
+			response, handled := PageantProxy.handlePuttyExtension(puttyExtensionRequest(PUTTY_EXT_ADD_PPK, payload))
+			if !handled || messageTypeOf(response) != SSH_AGENT_FAILURE {
+				t.Errorf("add-ppk = %x, %v, expected SSH_AGENT_FAILURE", response, handled)
+			}
+			if list := notifications.list(); len(list) != 1 || !strings.HasPrefix(list[0], "ERROR: Could not add the PuTTY key to the agent. Error: ") {
+				t.Errorf("notifications = %q", list)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CERT_RENEWAL_RETRY_BASE = 30 * time.Second
+	CERT_RENEWAL_RETRY_MAX  = 30 * time.Minute
+)
+
+// CertRenewalType renews the user certificate before it expires. Observe is fed with the result of every
+// certificate check, renewal starts at CertRenewalPercent of the certificate's lifetime. Failed renewals
+// are retried with exponential backoff, renewals that need the user are only announced.
+type CertRenewalType struct {
+	// Renew gets a new certificate, StepCli.Renew when nil
+	Renew func() error
+
+	// 1 while a renewal runs, so a timer and a manual trigger never renew at the same time
+	running int32
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	serial   uint64
+	expiry   time.Time
+	attempt  int
+	notified bool
+}
+
+var CertRenewal *CertRenewalType = &CertRenewalType{}
+
+// Observe schedules the renewal of certificate. err is the error of the check, STEPERR_USERCERT_EXPIRED
+// renews right away. Without certificate nothing happens, the user has never logged in.
+func (r *CertRenewalType) Observe(certificate *SshCertificateType, err error) {
+	if Configs.CertRenewalDisabled || certificate == nil || certificate.ValidForever {
+		return
+	}
+	if err != nil && !errors.Is(err, STEPERR_USERCERT_EXPIRED) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if certificate.Serial == r.serial && certificate.ValidBefore.Equal(r.expiry) {
+		// already scheduled, or retrying with backoff
+		return
+	}
+	r.serial, r.expiry, r.attempt, r.notified = certificate.Serial, certificate.ValidBefore, 0, false
+
+	percent := Configs.CertRenewalPercent
+	if percent <= 0 || percent >= 100 {
+		percent = 75
+	}
+	lifetime := certificate.ValidBefore.Sub(certificate.ValidAfter)
+	renewAt := certificate.ValidAfter.Add(lifetime * time.Duration(percent) / 100)
+	Logger.Info("CertRenewal: certificate %v expires at %v, renewing at %v", certificate.KeyId,
+		certificate.ValidBefore.Format(time.RFC3339), renewAt.Format(time.RFC3339))
+	r.scheduleLocked(time.Until(renewAt))
+}
+
+// Trigger renews now, unless a renewal is already running
+func (r *CertRenewalType) Trigger() {
+	go r.run()
+}
+
+// Stop cancels the scheduled renewal
+func (r *CertRenewalType) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+func (r *CertRenewalType) scheduleLocked(delay time.Duration) {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	r.timer = time.AfterFunc(delay, r.run)
+}
+
+func (r *CertRenewalType) run() {
+	if !atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		Logger.Info("CertRenewal: renewal already running")
+		return
+	}
+	defer atomic.StoreInt32(&r.running, 0)
+
+	renew := r.Renew
+	if renew == nil {
+		renew = StepCli.Renew
+	}
+	Logger.Info("CertRenewal: renewing certificate of %v", Configs.StepUsername)
+	err := renew()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case err == nil:
+		Logger.Info("CertRenewal: renewed certificate of %v", Configs.StepUsername)
+		r.attempt = 0
+		App.PushInfoNoti("Certificate of %v has been renewed", Configs.StepUsername)
+		go func() { refreshCertCheck <- true }()
+
+	case errors.Is(err, STEPERR_LOGIN_IN_PROGRESS):
+		// e.g. the user logs in from the Dashboard, the certificate check after it schedules again
+		Logger.Info("CertRenewal: a login is already running, checking again in %v", CERT_RENEWAL_RETRY_BASE)
+		r.scheduleLocked(CERT_RENEWAL_RETRY_BASE)
+
+	case errors.Is(err, STEPERR_INTERACTIVE_LOGIN_REQUIRED), errors.Is(err, STEPERR_UNAUTHORIZED):
+		// retrying does not help, the next certificate check after a login schedules again
+		Logger.Info("CertRenewal: renewal needs an interactive login. Error: %v", err)
+		if !r.notified {
+			r.notified = true
+			App.PushWarnNoti("Certificate of %v expires at %v. Please login from the Dashboard to renew it.",
+				Configs.StepUsername, r.expiry.Local().Format("15:04"))
+		}
+
+	default:
+		delay := CERT_RENEWAL_RETRY_BASE << uint(r.attempt)
+		if delay > CERT_RENEWAL_RETRY_MAX || delay <= 0 {
+			delay = CERT_RENEWAL_RETRY_MAX
+		}
+		r.attempt++
+		Logger.Error("CertRenewal: renewal attempt %v failed, retrying in %v. Error: %v", r.attempt, delay, err)
+		if r.attempt == 1 {
+			App.PushErrNoti("Failed to renew certificate of %v, retrying in the background. Error: %v", Configs.StepUsername, err)
+		}
+		r.scheduleLocked(delay)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	SSH_CERT_TYPE_USER = "user"
+	SSH_CERT_TYPE_HOST = "host"
+)
+
+// SshCertificateType is what GetUserCertOk and the doctor need to know about an OpenSSH certificate
+type SshCertificateType struct {
+	Type            string
+	Algorithm       string
+	KeyId           string
+	Serial          uint64
+	Principals      []string
+	ValidAfter      time.Time
+	ValidBefore     time.Time
+	ValidForever    bool
+	CriticalOptions map[string]string
+	Extensions      map[string]string
+	SigningCa       string
+	SigningCaType   string
+	Comment         string
+	Blob            []byte
+}
+
+// ParseSshCertificate reads an OpenSSH certificate from its wire encoding, as found in SSH_AGENT_IDENTITIES_ANSWER.
+// Plain public keys give SSHCERTERR_NOT_A_CERTIFICATE.
+func ParseSshCertificate(blob []byte, comment string) (*SshCertificateType, error) {
+	publicKey, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", SSHCERTERR_INVALID_CERTIFICATE, err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v key", SSHCERTERR_NOT_A_CERTIFICATE, publicKey.Type())
+	}
+
+	certificate := &SshCertificateType{
+		Type:            SSH_CERT_TYPE_USER,
+		Algorithm:       cert.Type(),
+		KeyId:           cert.KeyId,
+		Serial:          cert.Serial,
+		Principals:      cert.ValidPrincipals,
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0),
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+		SigningCa:       ssh.FingerprintSHA256(cert.SignatureKey),
+		SigningCaType:   cert.SignatureKey.Type(),
+		Comment:         comment,
+		Blob:            blob,
+	}
+	if cert.CertType == ssh.HostCert {
+		certificate.Type = SSH_CERT_TYPE_HOST
+	}
+	if cert.ValidAfter > math.MaxInt64 {
+		certificate.ValidAfter = time.Unix(math.MaxInt64/2, 0)
+	}
+	if cert.ValidBefore > math.MaxInt64 {
+		// ssh.CertTimeInfinity
+		certificate.ValidForever = true
+		certificate.ValidBefore = time.Unix(math.MaxInt64/2, 0)
+	} else {
+		certificate.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+	return certificate, nil
+}
+
+// ListAgentCertificates returns the certificates among the keys of the agent at address, of every key type
+func ListAgentCertificates(address string) ([]*SshCertificateType, error) {
+	identities, err := ListAgentIdentities(address)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates := []*SshCertificateType{}
+	for _, identity := range identities {
+		certificate, err := ParseSshCertificate(identity.Blob, string(identity.Comment))
+		if err != nil {
+			continue
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// ValidAt reports whether t is within the validity period
+func (c *SshCertificateType) ValidAt(t time.Time) bool {
+	return !t.Before(c.ValidAfter) && t.Before(c.ValidBefore)
+}
+
+func (c *SshCertificateType) HasPrincipal(principal string) bool {
+	return containsString(c.Principals, principal)
+}
+
+// ValidBeforeText is the end of the validity period in RFC 3339, or "forever"
+func (c *SshCertificateType) ValidBeforeText() string {
+	if c.ValidForever {
+		return "forever"
+	}
+	return c.ValidBefore.Format(time.RFC3339)
+}
+
+// ExtensionNames are the names of the extensions, sorted
+func (c *SshCertificateType) ExtensionNames() []string {
+	names := make([]string, 0, len(c.Extensions))
+	for name := range c.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *SshCertificateType) String() string {
+	return fmt.Sprintf("%v certificate %v (serial %v, %v), principals %v, valid %v to %v, signed by %v %v",
+		c.Type, c.KeyId, c.Serial, c.Algorithm, c.Principals, c.ValidAfter.Format(time.RFC3339), c.ValidBeforeText(),
+		c.SigningCaType, c.SigningCa)
+}
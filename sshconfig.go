@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	SSH_CONFIG_FILE_NAME        = "winssh-pageant-ui.conf"
+	SSH_CONFIG_USER_CERT_FILE   = "ssh-user-cert.pub"
+	SSH_CONFIG_FILE_PERMISSION  = 0644
+	SSH_CONFIG_INCLUDE_KEYWORD  = "Include"
+	SSH_CONFIG_INCLUDE_COMMENT  = "# Hosts of step-ca, generated by winssh-pageant-ui"
+	SSH_CONFIG_GENERATED_PREFIX = "# Generated by winssh-pageant-ui"
+	SSH_CONFIG_GENERATED_HEADER = SSH_CONFIG_GENERATED_PREFIX + " from the hosts of %v, changes are overwritten.\n\n"
+
+	// SSH_CONFIG_DEFAULT_TEMPLATE is run for every host, see SshConfigHostType for what it can use
+	SSH_CONFIG_DEFAULT_TEMPLATE = `Host {{.Hostname}}
+    User {{.User}}
+    IdentityAgent {{quote .IdentityAgent}}
+{{- if .CertificateFile}}
+    CertificateFile {{quote .CertificateFile}}
+{{- end}}
+
+`
+)
+
+// SshConfigType writes an ssh_config file with a Host entry for every host registered with step-ca,
+// and includes it from the user's ssh config
+type SshConfigType struct {
+	mu sync.Mutex
+}
+
+var SshConfig *SshConfigType = &SshConfigType{}
+
+// SshConfigHostType is what the template of a host entry can use
+type SshConfigHostType struct {
+	Hostname string
+	Id       string
+	// Tags of the host, by name
+	Tags map[string]string
+	// StepUsername of the configs
+	User string
+	// The named pipe of this app's agent
+	IdentityAgent string
+	// The user certificate, written next to the configs. Empty when there is no valid one.
+	CertificateFile string
+	// The active profile, empty when profiles are not in use
+	Profile string
+}
+
+// Path returns the generated file of the configs, or the default one next to the user's ssh config
+func (s *SshConfigType) Path() string {
+	if Configs.SshConfigPath != "" {
+		return Configs.SshConfigPath
+	}
+	return filepath.Join(USER_HOME_DIR, ".ssh", SSH_CONFIG_FILE_NAME)
+}
+
+// Generate rewrites the generated file from the hosts of the CA, when ManagedSshConfig is on.
+// When it is off, what an earlier Generate wrote is removed.
+func (s *SshConfigType) Generate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !Configs.ManagedSshConfig {
+		return s.remove()
+	}
+
+	hostTemplate, err := s.template()
+	if err != nil {
+		return err
+	}
+	defaults, err := LoadStepDefaults()
+	if err != nil {
+		return err
+	}
+	client, err := NewStepCaClient(defaults)
+	if err != nil {
+		return err
+	}
+	hosts, err := client.SshHosts()
+	if err != nil {
+		return err
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Hostname < hosts[j].Hostname })
+
+	identityAgent, err := PageantProxy.GetPagentPipeName()
+	if err != nil {
+		return err
+	}
+	profile := ""
+	if active := Profiles.Active(); active != nil {
+		profile = active.Name
+	}
+	certificateFile := s.writeUserCertificate()
+
+	content := bytes.NewBufferString(fmt.Sprintf(SSH_CONFIG_GENERATED_HEADER, defaults.CaUrl))
+	for _, host := range hosts {
+		tags := map[string]string{}
+		for _, tag := range host.Tags {
+			tags[tag.Name] = tag.Value
+		}
+		err = hostTemplate.Execute(content, SshConfigHostType{
+			Hostname:        host.Hostname,
+			Id:              host.Id,
+			Tags:            tags,
+			User:            Configs.StepUsername,
+			IdentityAgent:   identityAgent,
+			CertificateFile: certificateFile,
+			Profile:         profile,
+		})
+		if err != nil {
+			return fmt.Errorf("%w: host %v: %v", SSHCONFIGERR_INVALID_TEMPLATE, host.Hostname, err)
+		}
+	}
+
+	path := s.Path()
+	Logger.Info("SshConfig: writing %v hosts of %v into %v", len(hosts), defaults.CaUrl, path)
+	if err = WriteFileAtomically(path, content.Bytes(), SSH_CONFIG_FILE_PERMISSION); err != nil {
+		return err
+	}
+	return s.include(path)
+}
+
+// Remove deletes what Generate wrote, see remove
+func (s *SshConfigType) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove()
+}
+
+// remove deletes the generated file and the user certificate, and the Include of the file with its
+// SSH_CONFIG_INCLUDE_COMMENT from the user's ssh config. A file at Path that was not generated is kept.
+func (s *SshConfigType) remove() error {
+	path := s.Path()
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && strings.HasPrefix(string(content), SSH_CONFIG_GENERATED_PREFIX) {
+		Logger.Info("SshConfig: removing %v, the ssh config is not managed", path)
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	certificateFile := filepath.Join(APP_HOME_DIR, SSH_CONFIG_USER_CERT_FILE)
+	if err = os.Remove(certificateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.exclude(path)
+}
+
+// template parses SshConfigTemplateFile, or the default template
+func (s *SshConfigType) template() (*template.Template, error) {
+	text := SSH_CONFIG_DEFAULT_TEMPLATE
+	if Configs.SshConfigTemplateFile != "" {
+		content, err := ioutil.ReadFile(Configs.SshConfigTemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+
+	hostTemplate, err := template.New("host").Funcs(template.FuncMap{"quote": quoteSshConfigArg}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", SSHCONFIGERR_INVALID_TEMPLATE, err)
+	}
+	return hostTemplate, nil
+}
+
+// writeUserCertificate writes the user certificate from the agent for CertificateFile, so ssh offers the
+// certificate of the agent's key. It returns the file, or "" when there is no valid certificate.
+func (s *SshConfigType) writeUserCertificate() string {
+	certificate, err := StepCli.UserCertificate()
+	if err != nil {
+		Logger.Info("SshConfig: no user certificate for the host entries. Error: %v", err)
+		return ""
+	}
+	key, err := ssh.ParsePublicKey(certificate.Blob)
+	if err != nil {
+		Logger.Error("SshConfig: cannot parse the user certificate. Error: %v", err)
+		return ""
+	}
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if certificate.Comment != "" {
+		authorizedKey += " " + certificate.Comment
+	}
+	path := filepath.Join(APP_HOME_DIR, SSH_CONFIG_USER_CERT_FILE)
+	if err = WriteFileAtomically(path, []byte(authorizedKey+"\n"), SSH_CONFIG_FILE_PERMISSION); err != nil {
+		Logger.Error("SshConfig: cannot write the user certificate to %v. Error: %v", path, err)
+		return ""
+	}
+	return path
+}
+
+// include adds an Include of path at the top of the user's ssh config, where it applies to all hosts.
+// The rest of the file is left as it is.
+func (s *SshConfigType) include(path string) error {
+	userConfig := s.userConfig()
+	content, err := ioutil.ReadFile(userConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	target := includeTarget(path, userConfig)
+	for _, line := range strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], SSH_CONFIG_INCLUDE_KEYWORD) {
+			for _, field := range fields[1:] {
+				if strings.Trim(field, `"`) == target {
+					return nil
+				}
+			}
+		}
+	}
+
+	newline := "\n"
+	if bytes.Contains(content, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	Logger.Info("SshConfig: including %v in %v", target, userConfig)
+	header := SSH_CONFIG_INCLUDE_COMMENT + newline + SSH_CONFIG_INCLUDE_KEYWORD + " " + quoteSshConfigArg(target) + newline + newline
+	return WriteFileAtomically(userConfig, append([]byte(header), content...), SSH_CONFIG_FILE_PERMISSION)
+}
+
+// exclude removes what include added from the user's ssh config: the Include of path, the
+// SSH_CONFIG_INCLUDE_COMMENT above it and the empty line below it. The rest of the file is left as it is.
+func (s *SshConfigType) exclude(path string) error {
+	userConfig := s.userConfig()
+	content, err := ioutil.ReadFile(userConfig)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	newline := "\n"
+	if bytes.Contains(content, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	target := includeTarget(path, userConfig)
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	kept := []string{}
+	for i := 0; i < len(lines); i++ {
+		// an Include the user wrote without our comment is theirs
+		line := strings.TrimSpace(lines[i])
+		included := line == SSH_CONFIG_INCLUDE_KEYWORD+" "+quoteSshConfigArg(target) || line == SSH_CONFIG_INCLUDE_KEYWORD+" "+target
+		if !included || len(kept) == 0 || strings.TrimSpace(kept[len(kept)-1]) != SSH_CONFIG_INCLUDE_COMMENT {
+			kept = append(kept, lines[i])
+			continue
+		}
+		kept = kept[:len(kept)-1]
+		if i+1 < len(lines)-1 && strings.TrimSpace(lines[i+1]) == "" {
+			i++
+		}
+	}
+	if len(kept) == len(lines) {
+		return nil
+	}
+
+	Logger.Info("SshConfig: removing the include of %v from %v", target, userConfig)
+	return WriteFileAtomically(userConfig, []byte(strings.Join(kept, newline)), SSH_CONFIG_FILE_PERMISSION)
+}
+
+func (s *SshConfigType) userConfig() string {
+	return filepath.Join(USER_HOME_DIR, ".ssh", "config")
+}
+
+// includeTarget is how the user's ssh config includes path. ssh resolves relative includes against ~/.ssh.
+func includeTarget(path string, userConfig string) string {
+	if filepath.Dir(path) == filepath.Dir(userConfig) {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(path)
+}
+
+// quoteSshConfigArg quotes an ssh_config argument. ssh reads backslashes as escapes, so the ones of
+// windows paths like \\.\pipe\... are doubled.
+func quoteSshConfigArg(arg string) string {
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+}
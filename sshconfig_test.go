@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name       string
+		userConfig string
+		expected   string
+	}{
+		{"no user config", "",
+			SSH_CONFIG_INCLUDE_COMMENT + "\nInclude \"" + SSH_CONFIG_FILE_NAME + "\"\n\n"},
+		{"user config", "Host example.com\n  User alice\n",
+			SSH_CONFIG_INCLUDE_COMMENT + "\nInclude \"" + SSH_CONFIG_FILE_NAME + "\"\n\nHost example.com\n  User alice\n"},
+		{"user config with CRLF", "Host *\r\n",
+			SSH_CONFIG_INCLUDE_COMMENT + "\r\nInclude \"" + SSH_CONFIG_FILE_NAME + "\"\r\n\r\nHost *\r\n"},
+		{"user include of the file", "Host *\n  User bob\nInclude " + SSH_CONFIG_FILE_NAME + "\n",
+			"Host *\n  User bob\nInclude " + SSH_CONFIG_FILE_NAME + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfigs(t)
+			server := serveTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != STEP_CA_SSH_HOSTS_PATH {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				writeJson(w, http.StatusOK, map[string][]StepSshHostType{"hosts": {
+					{Id: "2", Hostname: "web.example.com"},
+					{Id: "1", Hostname: "db.example.com", Tags: []StepSshHostTagType{{Name: "env", Value: "production"}}},
+				}})
+			}))
+			userConfig := filepath.Join(USER_HOME_DIR, ".ssh", "config")
+			if err := os.MkdirAll(filepath.Dir(userConfig), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if test.userConfig != "" {
+				if err := ioutil.WriteFile(userConfig, []byte(test.userConfig), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			identityAgent, err := PageantProxy.GetPagentPipeName()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			Configs.ManagedSshConfig = true
+			// twice, the include is added once
+			for i := 0; i < 2; i++ {
+				if err := SshConfig.Generate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			content, err := ioutil.ReadFile(SshConfig.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			quotedAgent := `"` + strings.ReplaceAll(identityAgent, `\`, `\\`) + `"`
+			expected := "# Generated by winssh-pageant-ui from the hosts of " + server.URL + ", changes are overwritten.\n\n" +
+				"Host db.example.com\n    User alice\n    IdentityAgent " + quotedAgent + "\n\n" +
+				"Host web.example.com\n    User alice\n    IdentityAgent " + quotedAgent + "\n\n"
+			if string(content) != expected {
+				t.Errorf("generated =\n%q\nexpected\n%q", content, expected)
+			}
+			if content, _ = ioutil.ReadFile(userConfig); string(content) != test.expected {
+				t.Errorf("user config = %q, expected %q", content, test.expected)
+			}
+		})
+	}
+}
+
+func TestQuoteSshConfigArg(t *testing.T) {
+	tests := []struct {
+		arg      string
+		expected string
+	}{
+		{`\\.\pipe\pageant.alice`, `"\\\\.\\pipe\\pageant.alice"`},
+		{`C:\Users\Alice Smith\.ssh\hosts`, `"C:\\Users\\Alice Smith\\.ssh\\hosts"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"hosts", `"hosts"`},
+	}
+	for _, test := range tests {
+		if quoted := quoteSshConfigArg(test.arg); quoted != test.expected {
+			t.Errorf("quoteSshConfigArg(%q) = %v, expected %v", test.arg, quoted, test.expected)
+		}
+	}
+}
+
+func TestUpdateConfigRemovesSshConfig(t *testing.T) {
+	useTestConfigs(t)
+	Configs.ManagedSshConfig = true
+	path := SshConfig.Path()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(SSH_CONFIG_GENERATED_PREFIX+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SshConfig.include(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new Configs, like at loading
+	newConfigs := *Configs
+	newConfigs.ManagedSshConfig = false
+	Configs.UpdateConfig(newConfigs)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%v was not removed: %v", path, err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(USER_HOME_DIR, ".ssh", "config")); len(content) != 0 {
+		t.Errorf("user config = %q, expected it empty", content)
+	}
+}
+
+func TestGenerateRemovesWhenNotManaged(t *testing.T) {
+	tests := []struct {
+		name       string
+		userConfig string
+		expected   string
+	}{
+		{"no user config", "", ""},
+		{"user config", "Host example.com\n  User alice\n", "Host example.com\n  User alice\n"},
+		{"user config with CRLF", "# mine\r\nInclude \"work\"\r\n\r\nHost *\r\n", "# mine\r\nInclude \"work\"\r\n\r\nHost *\r\n"},
+		{"user include of the file", "Include \"" + SSH_CONFIG_FILE_NAME + "\"\n", "Include \"" + SSH_CONFIG_FILE_NAME + "\"\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfigs(t)
+			userConfig := filepath.Join(USER_HOME_DIR, ".ssh", "config")
+			if err := os.MkdirAll(filepath.Dir(userConfig), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if test.userConfig != "" {
+				if err := ioutil.WriteFile(userConfig, []byte(test.userConfig), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// what Generate wrote while ManagedSshConfig was on
+			path := SshConfig.Path()
+			certificateFile := filepath.Join(APP_HOME_DIR, SSH_CONFIG_USER_CERT_FILE)
+			for file, content := range map[string]string{
+				path:            "# Generated by winssh-pageant-ui from the hosts of https://ca.example.com, changes are overwritten.\n\nHost web.example.com\n",
+				certificateFile: "ssh-ed25519-cert-v01@openssh.com AAAA\n",
+			} {
+				if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := SshConfig.include(path); err != nil {
+				t.Fatal(err)
+			}
+
+			Configs.ManagedSshConfig = false
+			if err := SshConfig.Generate(); err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range []string{path, certificateFile} {
+				if _, err := os.Stat(file); !os.IsNotExist(err) {
+					t.Errorf("%v was not removed: %v", file, err)
+				}
+			}
+			content, err := ioutil.ReadFile(userConfig)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("user config = %q, expected %q", content, test.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateKeepsUserFileWhenNotManaged(t *testing.T) {
+	useTestConfigs(t)
+	Configs.SshConfigPath = filepath.Join(USER_HOME_DIR, "hosts")
+	if err := ioutil.WriteFile(Configs.SshConfigPath, []byte("Host web.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	Configs.ManagedSshConfig = false
+	if err := SshConfig.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(Configs.SshConfigPath); err != nil {
+		t.Errorf("file that was not generated: %v", err)
+	}
+}
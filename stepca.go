@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	STEP_CA_HEALTH_PATH       = "/health"
+	STEP_CA_PROVISIONERS_PATH = "/provisioners"
+	STEP_CA_ROOTS_PATH        = "/roots"
+	STEP_CA_SSH_ROOTS_PATH    = "/ssh/roots"
+	STEP_CA_SSH_SIGN_PATH     = "/ssh/sign"
+	STEP_CA_SSH_HOSTS_PATH    = "/ssh/hosts"
+
+	STEP_CA_TIMEOUT = 10 * time.Second
+	// a client is made per check, its keep-alive connections must not outlive it for long
+	STEP_CA_IDLE_CONN_TIMEOUT  = 30 * time.Second
+	STEP_CA_PROVISIONERS_LIMIT = 100
+	STEP_CA_MAX_RESPONSE_SIZE  = 4 << 20
+	STEP_CA_HEALTH_OK          = "ok"
+)
+
+// StepCaClientType talks to the REST API of a step-ca server, without the step CLI
+type StepCaClientType struct {
+	baseUrl string
+	client  *http.Client
+}
+
+type StepCaHealthType struct {
+	Status string `json:"status"`
+}
+
+// StepProvisionerType is one entry of /provisioners. Raw keeps the whole entry, the fields
+// depend on the provisioner type.
+type StepProvisionerType struct {
+	Type string          `json:"type"`
+	Name string          `json:"name"`
+	Raw  json.RawMessage `json:"-"`
+}
+
+// StepSshRootsType are the CA keys of /ssh/roots: UserKeys sign user certificates, HostKeys host certificates
+type StepSshRootsType struct {
+	UserKeys []ssh.PublicKey
+	HostKeys []ssh.PublicKey
+}
+
+// StepSshSignRequestType is the body of /ssh/sign. PublicKey is the wire encoding of the key to certify,
+// Ott the one-time token of the provisioner, for OIDC provisioners the ID token.
+type StepSshSignRequestType struct {
+	PublicKey  []byte   `json:"publicKey"`
+	Ott        string   `json:"ott"`
+	CertType   string   `json:"certType,omitempty"`
+	KeyId      string   `json:"keyID,omitempty"`
+	Principals []string `json:"principals,omitempty"`
+}
+
+// StepSshHostType is one host of /ssh/hosts
+type StepSshHostType struct {
+	Id       string               `json:"hid"`
+	Hostname string               `json:"hostname"`
+	Tags     []StepSshHostTagType `json:"host_tags"`
+}
+
+type StepSshHostTagType struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// NewStepCaClient returns a client for the CA of a step configuration, trusting its root certificate
+func NewStepCaClient(defaults *StepDefaultsType) (*StepCaClientType, error) {
+	client, err := newStepCaHttpClient(defaults, STEP_CA_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return NewStepCaClientWithHttpClient(defaults.CaUrl, client)
+}
+
+// NewStepCaClientWithHttpClient returns a client for the CA at caUrl that sends its requests with client
+func NewStepCaClientWithHttpClient(caUrl string, client *http.Client) (*StepCaClientType, error) {
+	parsed, err := url.Parse(caUrl)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: invalid CA url %q", STEPERR_STEPCA_NOT_CONFIGURED, caUrl)
+	}
+	return &StepCaClientType{baseUrl: strings.TrimSuffix(caUrl, "/"), client: client}, nil
+}
+
+// Health returns nil when /health answers "ok"
+func (c *StepCaClientType) Health() error {
+	health := StepCaHealthType{}
+	if err := c.get(STEP_CA_HEALTH_PATH, &health); err != nil {
+		return err
+	}
+	if health.Status != STEP_CA_HEALTH_OK {
+		return fmt.Errorf("%w: status %q", STEPCAERR_UNHEALTHY, health.Status)
+	}
+	return nil
+}
+
+// Provisioners returns all provisioners, following the cursor of /provisioners page by page
+func (c *StepCaClientType) Provisioners() ([]StepProvisionerType, error) {
+	provisioners := []StepProvisionerType{}
+	cursor := ""
+	seen := map[string]bool{}
+	for {
+		query := url.Values{"limit": {strconv.Itoa(STEP_CA_PROVISIONERS_LIMIT)}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		page := struct {
+			Provisioners []json.RawMessage `json:"provisioners"`
+			NextCursor   string            `json:"nextCursor"`
+		}{}
+		if err := c.get(STEP_CA_PROVISIONERS_PATH+"?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+
+		for _, raw := range page.Provisioners {
+			provisioner := StepProvisionerType{Raw: raw}
+			if err := json.Unmarshal(raw, &provisioner); err != nil {
+				return nil, fmt.Errorf("%w: provisioner: %v", STEPCAERR_INVALID_RESPONSE, err)
+			}
+			provisioners = append(provisioners, provisioner)
+		}
+
+		if page.NextCursor == "" || len(page.Provisioners) == 0 {
+			return provisioners, nil
+		}
+		if seen[page.NextCursor] {
+			return nil, fmt.Errorf("%w: provisioner cursor %q repeats", STEPCAERR_INVALID_RESPONSE, page.NextCursor)
+		}
+		seen[page.NextCursor] = true
+		cursor = page.NextCursor
+	}
+}
+
+// Roots returns the root certificates of /roots
+func (c *StepCaClientType) Roots() ([]*x509.Certificate, error) {
+	response := struct {
+		Certificates []string `json:"crts"`
+	}{}
+	if err := c.get(STEP_CA_ROOTS_PATH, &response); err != nil {
+		return nil, err
+	}
+
+	roots := []*x509.Certificate{}
+	for _, encoded := range response.Certificates {
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil {
+			return nil, fmt.Errorf("%w: root is not PEM encoded", STEPCAERR_INVALID_RESPONSE)
+		}
+		root, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: root: %v", STEPCAERR_INVALID_RESPONSE, err)
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// SshRoots returns the SSH CA keys of /ssh/roots
+func (c *StepCaClientType) SshRoots() (*StepSshRootsType, error) {
+	// step-ca sends each key as the base64 of its wire encoding, which is how encoding/json reads []byte
+	response := struct {
+		UserKeys [][]byte `json:"userKey"`
+		HostKeys [][]byte `json:"hostKey"`
+	}{}
+	if err := c.get(STEP_CA_SSH_ROOTS_PATH, &response); err != nil {
+		return nil, err
+	}
+
+	roots := &StepSshRootsType{}
+	for _, keys := range []struct {
+		blobs  [][]byte
+		parsed *[]ssh.PublicKey
+	}{{response.UserKeys, &roots.UserKeys}, {response.HostKeys, &roots.HostKeys}} {
+		for _, blob := range keys.blobs {
+			key, err := ssh.ParsePublicKey(blob)
+			if err != nil {
+				return nil, fmt.Errorf("%w: ssh root: %v", STEPCAERR_INVALID_RESPONSE, err)
+			}
+			*keys.parsed = append(*keys.parsed, key)
+		}
+	}
+	return roots, nil
+}
+
+// SshSign asks the CA to certify the public key of request and returns the certificate
+func (c *StepCaClientType) SshSign(request StepSshSignRequestType) (*ssh.Certificate, error) {
+	// like /ssh/roots, the certificate is the base64 of its wire encoding
+	response := struct {
+		Certificate []byte `json:"crt"`
+	}{}
+	if err := c.post(STEP_CA_SSH_SIGN_PATH, request, &response); err != nil {
+		return nil, err
+	}
+
+	key, err := ssh.ParsePublicKey(response.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ssh certificate: %v", STEPCAERR_INVALID_RESPONSE, err)
+	}
+	certificate, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", STEPCAERR_INVALID_RESPONSE, SSHCERTERR_NOT_A_CERTIFICATE)
+	}
+	return certificate, nil
+}
+
+// SshHosts returns the hosts registered with the CA. step-ca only lists them to clients with an X.509 identity.
+func (c *StepCaClientType) SshHosts() ([]StepSshHostType, error) {
+	response := struct {
+		Hosts []StepSshHostType `json:"hosts"`
+	}{}
+	if err := c.get(STEP_CA_SSH_HOSTS_PATH, &response); err != nil {
+		return nil, err
+	}
+	return response.Hosts, nil
+}
+
+// get sends a GET request for path and decodes the JSON answer into result. An error status
+// becomes one of the STEPERR_CASERVER_* errors or STEPCAERR_REQUEST_FAILED.
+func (c *StepCaClientType) get(path string, result interface{}) error {
+	response, err := c.client.Get(c.baseUrl + path)
+	return readStepCaResponse(path, response, err, result)
+}
+
+// post sends body as JSON to path and decodes the JSON answer into result, like get
+func (c *StepCaClientType) post(path string, body interface{}, result interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	response, err := c.client.Post(c.baseUrl+path, "application/json", bytes.NewReader(content))
+	return readStepCaResponse(path, response, err, result)
+}
+
+// readStepCaResponse decodes the JSON answer to a request for path into result
+func readStepCaResponse(path string, response *http.Response, err error, result interface{}) error {
+	if err != nil {
+		return fmt.Errorf("%w: %v", STEPCAERR_UNREACHABLE, err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, STEP_CA_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return fmt.Errorf("%w: %v", STEPCAERR_UNREACHABLE, err)
+	}
+	// /ssh/sign answers 201 Created
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return stepCaStatusError(path, response.StatusCode, body)
+	}
+	if err = json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("%w: %v: %v", STEPCAERR_INVALID_RESPONSE, path, err)
+	}
+	return nil
+}
+
+// stepCaStatusError reads the {"status": ..., "message": ...} body step-ca sends with errors
+func stepCaStatusError(path string, status int, body []byte) error {
+	apiError := struct {
+		Message string `json:"message"`
+	}{}
+	json.Unmarshal(body, &apiError)
+	message := apiError.Message
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		// like step's own 401 and 403, see stepErrorStatusCategories
+		return fmt.Errorf("%w: %v: HTTP %v: %v", STEPERR_UNAUTHORIZED, path, status, message)
+	case http.StatusInternalServerError:
+		return fmt.Errorf("%w: %v: %v", STEPERR_CASERVER_ERROR_INTERNAL_SERVER_ERROR, path, message)
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: %v: %v", STEPERR_CASERVER_ERROR_SERVICE_UNAVAILABLE, path, message)
+	}
+	return fmt.Errorf("%w: %v: HTTP %v: %v", STEPCAERR_REQUEST_FAILED, path, status, message)
+}
+
+// newStepCaHttpClient trusts the root certificate of the step configuration, or the system roots if there is none.
+// It authenticates with the identity certificate of the configuration when there is one.
+func newStepCaHttpClient(defaults *StepDefaultsType, timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if defaults.IdentityCert != "" {
+		// without it only /ssh/hosts fails, the other endpoints need no client certificate
+		identity, err := tls.LoadX509KeyPair(defaults.IdentityCert, defaults.IdentityKey)
+		if err != nil {
+			Logger.Error("StepCa: cannot load identity %v. Error: %v", defaults.IdentityCert, err)
+		} else {
+			tlsConfig.Certificates = []tls.Certificate{identity}
+		}
+	}
+	if defaults.Root != "" {
+		content, err := ioutil.ReadFile(defaults.Root)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(content) {
+			return nil, errors.New("no certificate found in " + defaults.Root)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment, IdleConnTimeout: STEP_CA_IDLE_CONN_TIMEOUT},
+	}, nil
+}
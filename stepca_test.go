@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestStepCa serves handler over TLS and returns a client of it that trusts its certificate
+func newTestStepCa(t *testing.T, handler http.Handler) (*StepCaClientType, *httptest.Server) {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	client, err := NewStepCaClientWithHttpClient(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// serveTestStepCa serves handler as the CA of the step configuration in STEPPATH, see useTestConfigs
+func serveTestStepCa(t *testing.T, handler http.Handler) *httptest.Server {
+	_, server := newTestStepCa(t, handler)
+	stepPath := os.Getenv(STEP_PATH_ENV)
+	root := filepath.Join(stepPath, "certs", "root_ca.crt")
+	defaults, _ := json.Marshal(StepDefaultsType{CaUrl: server.URL, Root: root})
+	for path, content := range map[string][]byte{
+		root: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		filepath.Join(stepPath, STEP_CONFIG_DIR, STEP_DEFAULTS_FILE): defaults,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+// writeJson answers with the JSON of value, like step-ca does
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func TestStepCaHealth(t *testing.T) {
+	status := "ok"
+	client, _ := newTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != STEP_CA_HEALTH_PATH {
+			t.Errorf("request for %v", r.URL)
+		}
+		writeJson(w, http.StatusOK, map[string]string{"status": status})
+	}))
+
+	if err := client.Health(); err != nil {
+		t.Errorf("healthy CA: %v", err)
+	}
+	status = "starting"
+	if err := client.Health(); !errors.Is(err, STEPCAERR_UNHEALTHY) || !strings.Contains(err.Error(), "starting") {
+		t.Errorf("unhealthy CA: err = %v, expected %v", err, STEPCAERR_UNHEALTHY)
+	}
+}
+
+func TestStepCaProvisioners(t *testing.T) {
+	pages := map[string]interface{}{
+		"": map[string]interface{}{
+			"provisioners": []map[string]string{{"type": "OIDC", "name": "google", "clientID": "step"}, {"type": "JWK", "name": "admin"}},
+			"nextCursor":   "page2",
+		},
+		"page2": map[string]interface{}{
+			"provisioners": []map[string]string{{"type": "SSHPOP", "name": "renewal"}},
+			"nextCursor":   "page3",
+		},
+		// the last page of step-ca is empty but still has a cursor
+		"page3": map[string]interface{}{"provisioners": []map[string]string{}, "nextCursor": "page4"},
+	}
+	client, _ := newTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != STEP_CA_PROVISIONERS_PATH || r.URL.Query().Get("limit") != "100" {
+			t.Errorf("request for %v", r.URL)
+		}
+		page, ok := pages[r.URL.Query().Get("cursor")]
+		if !ok {
+			t.Errorf("request for %v", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJson(w, http.StatusOK, page)
+	}))
+
+	provisioners, err := client.Provisioners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, provisioner := range provisioners {
+		names = append(names, provisioner.Type+" "+provisioner.Name)
+	}
+	if strings.Join(names, ", ") != "OIDC google, JWK admin, SSHPOP renewal" {
+		t.Errorf("provisioners = %v", names)
+	}
+	if !strings.Contains(string(provisioners[0].Raw), `"clientID":"step"`) {
+		t.Errorf("raw provisioner = %s", provisioners[0].Raw)
+	}
+}
+
+func TestStepCaProvisionersRepeatedCursor(t *testing.T) {
+	requests := 0
+	client, _ := newTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		cursor := "again"
+		if requests == 1 {
+			cursor = "first"
+		}
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"provisioners": []map[string]string{{"type": "JWK", "name": "admin"}},
+			"nextCursor":   cursor,
+		})
+	}))
+
+	if _, err := client.Provisioners(); !errors.Is(err, STEPCAERR_INVALID_RESPONSE) {
+		t.Errorf("err = %v, expected %v", err, STEPCAERR_INVALID_RESPONSE)
+	}
+	if requests != 3 {
+		t.Errorf("%v requests, expected 3", requests)
+	}
+}
+
+func TestStepCaRoots(t *testing.T) {
+	roots := []string{}
+	client, server := newTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != STEP_CA_ROOTS_PATH {
+			t.Errorf("request for %v", r.URL)
+		}
+		writeJson(w, http.StatusOK, map[string][]string{"crts": roots})
+	}))
+	roots = append(roots, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+
+	certificates, err := client.Roots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificates) != 1 || !certificates[0].Equal(server.Certificate()) {
+		t.Errorf("roots = %v", certificates)
+	}
+
+	roots = []string{"MIIBkTCB+wIJAKHHIG"}
+	if _, err = client.Roots(); !errors.Is(err, STEPCAERR_INVALID_RESPONSE) {
+		t.Errorf("root without PEM: err = %v, expected %v", err, STEPCAERR_INVALID_RESPONSE)
+	}
+	roots = []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not DER")}))}
+	if _, err = client.Roots(); !errors.Is(err, STEPCAERR_INVALID_RESPONSE) {
+		t.Errorf("root that is not a certificate: err = %v, expected %v", err, STEPCAERR_INVALID_RESPONSE)
+	}
+}
+
+func TestStepCaSshRoots(t *testing.T) {
+	userKey, hostKey := readTestPublicKey(t, "ed25519"), readTestPublicKey(t, "ecdsa256")
+	response := map[string][][]byte{"userKey": {userKey.Marshal()}, "hostKey": {hostKey.Marshal()}}
+	client, _ := newTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != STEP_CA_SSH_ROOTS_PATH {
+			t.Errorf("request for %v", r.URL)
+		}
+		// encoding/json writes []byte as base64, like step-ca
+		writeJson(w, http.StatusOK, response)
+	}))
+
+	roots, err := client.SshRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots.UserKeys) != 1 || ssh.FingerprintSHA256(roots.UserKeys[0]) != ssh.FingerprintSHA256(userKey) {
+		t.Errorf("user keys = %v", roots.UserKeys)
+	}
+	if len(roots.HostKeys) != 1 || ssh.FingerprintSHA256(roots.HostKeys[0]) != ssh.FingerprintSHA256(hostKey) {
+		t.Errorf("host keys = %v", roots.HostKeys)
+	}
+
+	response["hostKey"] = [][]byte{[]byte("not a key")}
+	if _, err = client.SshRoots(); !errors.Is(err, STEPCAERR_INVALID_RESPONSE) {
+		t.Errorf("invalid key: err = %v, expected %v", err, STEPCAERR_INVALID_RESPONSE)
+	}
+}
+
+func TestStepCaStatusErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		err    error
+		text   string
+	}{
+		{http.StatusInternalServerError, `{"status":500,"message":"The certificate authority encountered an Internal Server Error."}`, STEPERR_CASERVER_ERROR_INTERNAL_SERVER_ERROR, "Internal Server Error."},
+		{http.StatusServiceUnavailable, "", STEPERR_CASERVER_ERROR_SERVICE_UNAVAILABLE, "Service Unavailable"},
+		{http.StatusUnauthorized, `{"status":401,"message":"The request lacked necessary authorization to be completed."}`, STEPERR_UNAUTHORIZED, "HTTP 401: The request lacked"},
+		{http.StatusForbidden, `{"status":403,"message":"The request was forbidden by the certificate authority."}`, STEPERR_UNAUTHORIZED, "HTTP 403: The request was forbidden"},
+		{http.StatusNotFound, "404 page not found", STEPCAERR_REQUEST_FAILED, "HTTP 404: Not Found"},
+		{http.StatusOK, "<html>", STEPCAERR_INVALID_RESPONSE, STEP_CA_HEALTH_PATH},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			client, _ := newTestStepCa(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+
+			err := client.Health()
+			if !errors.Is(err, test.err) || !strings.Contains(err.Error(), test.text) {
+				t.Errorf("err = %v, expected %v with %q", err, test.err, test.text)
+			}
+		})
+	}
+
+	client, server := newTestStepCa(t, http.NotFoundHandler())
+	server.Close()
+	if err := client.Health(); !errors.Is(err, STEPCAERR_UNREACHABLE) {
+		t.Errorf("stopped CA: err = %v, expected %v", err, STEPCAERR_UNREACHABLE)
+	}
+}
+
+func TestNewStepCaClientTrustsRoot(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]string{"status": STEP_CA_HEALTH_OK})
+	}))
+	t.Cleanup(server.Close)
+
+	root := filepath.Join(t.TempDir(), "root_ca.crt")
+	if err := ioutil.WriteFile(root, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewStepCaClient(&StepDefaultsType{CaUrl: server.URL, Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Health(); err != nil {
+		t.Errorf("CA with the configured root: %v", err)
+	}
+	// CheckCaHealth makes a client every time, its connections are closed when they stay idle
+	if transport := client.client.Transport.(*http.Transport); transport.IdleConnTimeout != STEP_CA_IDLE_CONN_TIMEOUT {
+		t.Errorf("idle connection timeout = %v", transport.IdleConnTimeout)
+	}
+
+	// without the root, the test certificate is not trusted
+	client, err = NewStepCaClient(&StepDefaultsType{CaUrl: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Health(); !errors.Is(err, STEPCAERR_UNREACHABLE) {
+		t.Errorf("CA without the root: err = %v, expected %v", err, STEPCAERR_UNREACHABLE)
+	}
+}
+
+func readTestPublicKey(t *testing.T, name string) ssh.PublicKey {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "keys", name+".pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
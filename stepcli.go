@@ -1,88 +1,129 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
-var PRINCIPALS []string
+var (
+	PRINCIPALS []string
+	// principalsMu guards PRINCIPALS, the health checks add to it while a profile switch replaces it
+	principalsMu sync.Mutex
+)
 
-func anyStdContains(stdOut StdOut, stdErr StdErr, str string) bool {
-	return strings.Contains(string(stdOut), str) || strings.Contains(string(stdErr), str)
+// Principals returns a copy of PRINCIPALS
+func Principals() []string {
+	principalsMu.Lock()
+	defer principalsMu.Unlock()
+	return append([]string{}, PRINCIPALS...)
 }
 
-func parseStepCliError(stdOut StdOut, stdErr StdErr, err error) error {
-	if anyStdContains(stdOut, stdErr, "requires the '--ca-url' flag") {
-		return STEPERR_STEPCA_NOT_CONFIGURED
-	}
-
-	if anyStdContains(stdOut, stdErr, "no key found") {
-		return STEPERR_NO_USERCERT_FOUND
-	}
-
-	if anyStdContains(stdOut, stdErr, "Internal Server Error") {
-		return STEPERR_CASERVER_ERROR_INTERNAL_SERVER_ERROR
-	}
-
-	if anyStdContains(stdOut, stdErr, "Service Unavailable") {
-		return STEPERR_CASERVER_ERROR_SERVICE_UNAVAILABLE
-	}
-
-	if anyStdContains(stdOut, stdErr, "Identity not found") {
-		return STEPERR_IDENTITY_NOT_FOUND
-	}
+// SetPrincipals replaces PRINCIPALS with a copy of principals
+func SetPrincipals(principals []string) {
+	principalsMu.Lock()
+	defer principalsMu.Unlock()
+	PRINCIPALS = append([]string{}, principals...)
+}
 
-	if stdErr != "" || err != nil {
-		var errorStr string
-		errorStr = string(stdErr)
-		if err != nil {
-			errorStr = errorStr + " | " + err.Error()
+// addPrincipals adds the principals that are not in PRINCIPALS yet
+func addPrincipals(principals []string) {
+	principalsMu.Lock()
+	defer principalsMu.Unlock()
+	for _, principal := range principals {
+		if !containsString(PRINCIPALS, principal) {
+			PRINCIPALS = append(PRINCIPALS, principal)
 		}
-		return errors.New(errorStr)
 	}
-
-	return nil
 }
 
-const STEP_VALID_CA_TYPE = "OIDC" // only allow OIDC ca type
+// Provisioner types Login supports
+const (
+	STEP_PROVISIONER_OIDC   = "OIDC"
+	STEP_PROVISIONER_JWK    = "JWK"
+	STEP_PROVISIONER_X5C    = "X5C"
+	STEP_PROVISIONER_SSHPOP = "SSHPOP"
+)
+
+var STEP_LOGIN_PROVISIONER_TYPES = []string{STEP_PROVISIONER_OIDC, STEP_PROVISIONER_JWK, STEP_PROVISIONER_X5C, STEP_PROVISIONER_SSHPOP}
 
 type StepType struct {
-	stepExePath     string
-	ps              *PowerShellType
-	provisionersSet *HashSet
+	// Runner runs step.exe, Init sets ExecCommandRunner when it is nil. A ReplayCommandRunnerType
+	// runs StepType against recorded step.exe output.
+	Runner CommandRunner
+
+	// 1 while Login runs, so the Dashboard and CertRenewal never log in at the same time
+	loggingIn int32
+
+	stepExePath      string
+	provisionersSet  *HashSet
+	provisionerTypes map[string]string
+	mu               sync.Mutex
 }
 
 var (
 	StepCli *StepType = &StepType{}
 )
 
+// Init prepares running step.exe. The runner looks it up in PATH on every run, a missing step.exe
+// makes the run fail with STEPERR_STEPCLI_NOT_FOUND, see NewStepError.
 func (stepcli *StepType) Init() error {
-	var err error
-	//path, err := exec.LookPath("step.exe")
-	if err != nil {
-		Logger.Error("Could not found %v . Error: %v", "step.exe", err)
-		return STEPERR_STEPCLI_NOT_FOUND
-	}
-
-	//stepcli.stepExePath = escapePowershellPath(path)
 	stepcli.stepExePath = "step.exe"
-	var psErr error
-	stepcli.ps, psErr = NewPowershell()
-	if psErr != nil {
-		Logger.Error("Failed to iniailize StepCLi util. Error: %v", psErr)
-		return psErr
+	if stepcli.Runner == nil {
+		stepcli.Runner = ExecCommandRunner
 	}
 
 	stepcli.provisionersSet = NewHashSet()
+	stepcli.provisionerTypes = map[string]string{}
+
+	return nil
+}
+
+// run runs step.exe with args, feeding it stdin, and turns a failure into a *StepErrorType
+func (stepcli *StepType) run(name string, stdin string, args ...string) (StdOut, error) {
+	command := CommandRunType{Argv: append([]string{stepcli.stepExePath}, args...), Stdin: stdin}
+	Logger.Info("Invoking StepCli.%v. Executing: %v", name, command)
+	result, err := stepcli.Runner.Run(command)
+	stepErr := NewStepError(command, result, err)
+	if stepErr != nil {
+		Logger.Error("StepCli.%v failed. Exit code: %v, stderr: %v", name, result.ExitCode, strings.TrimSpace(string(result.Stderr)))
+	}
+	return result.Stdout, stepErr
+}
 
+// Login gets a user certificate from the default provisioner, the way its type requires:
+//   - OIDC logs in with the browser
+//   - JWK decrypts the provisioner key with StepPasswordFile, or a password asked with prompt
+//   - X5C authenticates with StepX5cCert and StepX5cKey
+//   - SSHPOP renews StepSshpopCert with its key StepSshpopKey and adds it to the agent
+//
+// prompt may be nil when nobody can be asked, JWK then needs StepPasswordFile.
+// After a login, the ssh config of the CA's hosts is generated again.
+// While a login runs, another one fails with STEPERR_LOGIN_IN_PROGRESS.
+func (stepcli *StepType) Login(prompt PassphrasePromptFunc) error {
+	if !atomic.CompareAndSwapInt32(&stepcli.loggingIn, 0, 1) {
+		Logger.Info("StepCli: login already running")
+		return STEPERR_LOGIN_IN_PROGRESS
+	}
+	defer atomic.StoreInt32(&stepcli.loggingIn, 0)
+
+	if err := stepcli.login(prompt); err != nil {
+		return err
+	}
+	if err := SshConfig.Generate(); err != nil {
+		Logger.Error("StepCli: failed to generate the ssh config. Error: %v", err)
+	}
 	return nil
 }
 
-func (stepcli *StepType) Login() error {
+func (stepcli *StepType) login(prompt PassphrasePromptFunc) error {
 	stepUserName := Configs.StepUsername
 	if stepUserName == "" {
 		return STEPERR_NO_USER_CONFIGURED
@@ -93,26 +134,148 @@ func (stepcli *StepType) Login() error {
 		return STEPERR_NO_PROVISIONER_CONFIGURED
 	}
 
-	cmdStr := fmt.Sprintf(`%s ssh login %s --provisioner=%s`, stepcli.stepExePath, stepUserName, currentProvisioner)
-	Logger.Info("Invoking StepCli.Login Executing: " + cmdStr)
-	stdOut, stdErr, psErr := stepcli.ps.ExecuteQuiet(cmdStr)
+	provisionerType, stepErr := stepcli.ProvisionerType(currentProvisioner)
+	if stepErr != nil {
+		return stepErr
+	}
+
+	args := []string{"ssh", "login", stepUserName, "--provisioner=" + currentProvisioner}
+	switch provisionerType {
+	case STEP_PROVISIONER_OIDC:
+		if !Configs.StepCliOidcLogin {
+			return stepcli.oidcLogin(currentProvisioner, stepUserName)
+		}
+
+	case STEP_PROVISIONER_JWK:
+		passwordFile := Configs.StepPasswordFile
+		if passwordFile == "" {
+			if prompt == nil {
+				return fmt.Errorf("%w: JWK provisioner %v needs its password", STEPERR_INTERACTIVE_LOGIN_REQUIRED, currentProvisioner)
+			}
+			password, ok := prompt("Provisioner password", fmt.Sprintf("Password of provisioner '%v':", currentProvisioner))
+			if !ok {
+				return STEPERR_LOGIN_CANCELLED
+			}
+			// step reads the password from a file when it has no console to ask on
+			file, err := writeSecretFile(password)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(file)
+			passwordFile = file
+		}
+		args = append(args, "--password-file="+passwordFile)
+
+	case STEP_PROVISIONER_X5C:
+		if Configs.StepX5cCert == "" || Configs.StepX5cKey == "" {
+			return STEPERR_X5C_NOT_CONFIGURED
+		}
+		args = append(args, "--x5c-cert="+Configs.StepX5cCert, "--x5c-key="+Configs.StepX5cKey)
+		if Configs.StepPasswordFile != "" {
+			args = append(args, "--password-file="+Configs.StepPasswordFile)
+		}
+
+	case STEP_PROVISIONER_SSHPOP:
+		return stepcli.renewSshpop()
+
+	default:
+		return fmt.Errorf("%w: %v", STEPERR_UNSUPPORTED_PROVISIONER, provisionerType)
+	}
 
-	stepErr := parseStepCliError(stdOut, stdErr, psErr)
+	_, stepErr = stepcli.run("Login", "", args...)
 	return stepErr
 }
 
+// oidcLogin logs in with the OIDC provisioner natively, see OidcLoginType
+func (stepcli *StepType) oidcLogin(provisioner string, username string) error {
+	client, err := stepcli.caClient()
+	if err != nil {
+		return err
+	}
+	login := NewOidcLogin(client, provisioner)
+	login.LoginHint = username
+	_, err = login.Login()
+	return err
+}
+
+// renewSshpop renews the certificate file with the SSHPOP provisioner, proving possession of its key,
+// and adds the renewed certificate with its key to the upstream agent
+func (stepcli *StepType) renewSshpop() error {
+	certPath, keyPath := Configs.StepSshpopCert, Configs.StepSshpopKey
+	if certPath == "" || keyPath == "" {
+		return STEPERR_SSHPOP_NOT_CONFIGURED
+	}
+
+	// step ssh renew overwrites the certificate file
+	if _, stepErr := stepcli.run("Login", "", "ssh", "renew", certPath, keyPath, "--force"); stepErr != nil {
+		return stepErr
+	}
+
+	content, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return fmt.Errorf("%w: %v", SSHCERTERR_INVALID_CERTIFICATE, err)
+	}
+	certificate, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("%w: %v", SSHCERTERR_NOT_A_CERTIFICATE, certPath)
+	}
+
+	content, err = ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	key, err := ReadPrivateKey(content, func(string, string) (string, bool) { return "", false })
+	if err != nil {
+		return err
+	}
+	return AddCertificateToAgent(PageantProxy.UpstreamAddress(), key, certificate)
+}
+
+// ProvisionerType returns the type of the provisioner name, listing the provisioners of the CA when it is not known yet
+func (stepcli *StepType) ProvisionerType(name string) (string, error) {
+	stepcli.mu.Lock()
+	provisionerType, ok := stepcli.provisionerTypes[name]
+	stepcli.mu.Unlock()
+	if ok {
+		return provisionerType, nil
+	}
+
+	if _, err := stepcli.GetProvisionersSetWithRefreshing(); err != nil {
+		return "", err
+	}
+	stepcli.mu.Lock()
+	provisionerType, ok = stepcli.provisionerTypes[name]
+	stepcli.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%w: %v", STEPERR_UNSUPPORTED_PROVISIONER, name)
+	}
+	return provisionerType, nil
+}
+
+// ProvisionerTypes returns the types of the provisioners found by the last refresh, by name
+func (stepcli *StepType) ProvisionerTypes() map[string]string {
+	stepcli.mu.Lock()
+	defer stepcli.mu.Unlock()
+
+	types := map[string]string{}
+	for name, provisionerType := range stepcli.provisionerTypes {
+		types[name] = provisionerType
+	}
+	return types
+}
+
 func (stepcli *StepType) Logout() error {
 	stepUserName := Configs.StepUsername
 	if stepUserName == "" {
 		return STEPERR_NO_USER_CONFIGURED
 	}
 
-	for _, principal := range PRINCIPALS {
-		cmdStr := fmt.Sprintf(`%s ssh logout %s`, stepcli.stepExePath, principal)
-		Logger.Info("Invoking StepCli.Logout() Executing: " + cmdStr)
-		stdOut, stdErr, psErr := stepcli.ps.ExecuteQuiet(cmdStr)
-
-		stepErr := parseStepCliError(stdOut, stdErr, psErr)
+	for _, principal := range Principals() {
+		_, stepErr := stepcli.run("Logout", "", "ssh", "logout", principal)
 		if stepErr == nil {
 			return nil
 		}
@@ -127,28 +290,37 @@ func (stepcli *StepType) ReConfigure() error {
 		return STEPERR_NO_STEP_TEAM_CONFIGURED
 	}
 
-	var cmdStr string
+	var args []string
 	if teamName != "" && teamUrl != "" {
-		cmdStr = fmt.Sprintf(`%s ssh config --force --team="." --team-url=%s`, stepcli.stepExePath, strings.ReplaceAll(teamUrl, "<>", teamName))
+		args = []string{"ssh", "config", "--force", "--team=.", "--team-url=" + strings.ReplaceAll(teamUrl, "<>", teamName)}
 	} else if teamName != "" {
-		cmdStr = fmt.Sprintf(`%s ssh config --force --team=%s`, stepcli.stepExePath, teamName)
+		args = []string{"ssh", "config", "--force", "--team=" + teamName}
 	} else if teamUrl != "" {
 		_, err := url.ParseRequestURI(teamUrl)
 		if err != nil {
 			Logger.Error("invalid team url %v. Error: %v", err, teamUrl)
 			return STEPERR_INVALID_TEAM_URL
 		} else {
-			cmdStr = fmt.Sprintf(`%s ssh config --force --team-url=%s --team="."`, stepcli.stepExePath, teamUrl)
+			args = []string{"ssh", "config", "--force", "--team-url=" + teamUrl, "--team=."}
 		}
 	} else {
 		return STEPERR_NO_STEP_TEAM_CONFIGURED
 	}
 
-	Logger.Info("Invoking StepCli.ReConfigure Executing: " + cmdStr)
-	cmdFields := strings.Fields(cmdStr)
-	stdOut, stdErr, psErr := stepcli.ps.ExecuteQuiet(cmdFields...)
+	_, stepErr := stepcli.run("ReConfigure", "", args...)
+	return stepErr
+}
 
-	stepErr := parseStepCliError(stdOut, stdErr, psErr)
+// Bootstrap points step at the CA at caUrl, trusting the root certificate with fingerprint
+func (stepcli *StepType) Bootstrap(caUrl string, fingerprint string) error {
+	if _, err := url.ParseRequestURI(caUrl); err != nil {
+		return fmt.Errorf("%w: invalid CA url %v", STEPERR_STEPCA_NOT_CONFIGURED, caUrl)
+	}
+	if fingerprint == "" {
+		return fmt.Errorf("%w: no root fingerprint for %v", STEPERR_STEPCA_NOT_CONFIGURED, caUrl)
+	}
+
+	_, stepErr := stepcli.run("Bootstrap", "", "ca", "bootstrap", "--ca-url="+caUrl, "--fingerprint="+fingerprint, "--force")
 	return stepErr
 }
 
@@ -165,121 +337,127 @@ func (stepcli *StepType) GetProvisionersSet(refresh bool) (*HashSet, error) {
 		return stepcli.provisionersSet, nil
 	}
 
-	cmdStr := fmt.Sprintf(`%s ca provisioner list`, stepcli.stepExePath)
-	Logger.Info("Invoking StepCli.GetProvisionersSet with refreshing. Executing: " + cmdStr)
-	stdOut, stdErr, psErr := stepcli.ps.ExecuteQuiet(cmdStr)
-	stepErr := parseStepCliError(stdOut, stdErr, psErr)
+	Logger.Info("Invoking StepCli.GetProvisionersSet with refreshing")
+	client, stepErr := stepcli.caClient()
+	if stepErr != nil {
+		return stepcli.provisionersSet, stepErr
+	}
+	provisioners, stepErr := client.Provisioners()
 	if stepErr != nil {
 		return stepcli.provisionersSet, stepErr
 	}
 
-	var provisionerList []map[string]interface{}
-	json.Unmarshal([]byte(stdOut), &provisionerList)
-	for _, provisioner := range provisionerList {
-		name := fmt.Sprintf("%v", provisioner["name"])
-		ptype := fmt.Sprintf("%v", provisioner["type"])
-		if ptype == STEP_VALID_CA_TYPE {
-			stepcli.provisionersSet.Add(name)
+	stepcli.mu.Lock()
+	defer stepcli.mu.Unlock()
+	stepcli.provisionersSet = NewHashSet()
+	stepcli.provisionerTypes = map[string]string{}
+	for _, provisioner := range provisioners {
+		if containsString(STEP_LOGIN_PROVISIONER_TYPES, provisioner.Type) {
+			stepcli.provisionersSet.Add(provisioner.Name)
+			stepcli.provisionerTypes[provisioner.Name] = provisioner.Type
 		}
 	}
 	return stepcli.provisionersSet, nil
 }
 
 func (stepcli *StepType) GetCaHealth() (bool, error) {
-	cmdStr := fmt.Sprintf(`%s ca health`, stepcli.stepExePath)
-	Logger.Info("Invoking StepCli.GetCaHealth. Executing: " + cmdStr)
-	stdOut, stdErr, psErr := stepcli.ps.ExecuteQuiet(cmdStr)
-	stepErr := parseStepCliError(stdOut, stdErr, psErr)
+	client, stepErr := stepcli.caClient()
 	if stepErr != nil {
 		return false, stepErr
 	}
+	if stepErr = client.Health(); stepErr != nil {
+		return false, stepErr
+	}
+	return true, nil
+}
 
-	caHealthOk := strings.HasPrefix(string(stdOut), "ok")
-	if caHealthOk {
-		return caHealthOk, nil
-	} else {
-		return false, STEPERR_STEPCA_NOT_CONFIGURED
+// caClient talks to the CA of the current step configuration directly, monitoring does not run step.exe
+func (stepcli *StepType) caClient() (*StepCaClientType, error) {
+	defaults, err := LoadStepDefaults()
+	if err != nil {
+		return nil, err
 	}
+	return NewStepCaClient(defaults)
 }
 
+// GetUserCertOk looks for a valid certificate of the configured user among the keys of the upstream agent
 func (stepcli *StepType) GetUserCertOk() (bool, error) {
+	_, err := stepcli.UserCertificate()
+	return err == nil, err
+}
+
+// UserCertificate returns the user certificate of the configured user that is valid the longest. When all
+// of them expired, it returns the last one to expire together with STEPERR_USERCERT_EXPIRED.
+func (stepcli *StepType) UserCertificate() (*SshCertificateType, error) {
 	username := Configs.StepUsername
 	if username == "" {
-		return false, STEPERR_NO_USER_CONFIGURED
+		return nil, STEPERR_NO_USER_CONFIGURED
 	}
 
-	// Get lists of user certs
-	cmdStr := fmt.Sprintf("step ssh list --raw")
-	Logger.Info("Invoking StepCli.GetUserCertOk. Executing: " + cmdStr)
-	stdOut, stdErr, psErr := stepcli.ps.ExecuteQuiet(cmdStr)
-	stepErr := parseStepCliError(stdOut, stdErr, psErr)
-	if stepErr != nil {
-		return false, stepErr
+	address := PageantProxy.UpstreamAddress()
+	Logger.Info("Invoking StepCli.UserCertificate. Listing certificates of %v", address)
+	certificates, err := ListAgentCertificates(address)
+	if err != nil {
+		return nil, err
 	}
 
-	certs := strings.Split(strings.ReplaceAll(string(stdOut), "\r\n", "\n"), "\n")
-	foundUserCert := false
-	for _, cert := range certs {
-		if cert == "" {
-			continue
-		}
+	// with profiles, only certificates of the active profile's CA count
+	profile := StepProfileType{StepUsername: username}
+	if active := Profiles.Active(); active != nil {
+		profile.Principals = active.Principals
+		profile.UserCaFingerprints = active.UserCaFingerprints
+	}
 
-		cmdStr = fmt.Sprintf(`echo %s | %s ssh inspect --format json`, cert, stepcli.stepExePath)
-		Logger.Info("Invoking StepCli.GetUserCertOk. Executing: " + cmdStr)
-		stdOut, stdErr, psErr = stepcli.ps.ExecuteQuiet(cmdStr)
-		stepErr = parseStepCliError(stdOut, stdErr, psErr)
-		if stepErr != nil {
-			if strings.Contains(cert, "imported-openssh-key") {
-				Logger.Info("Skipping imported-openssh-key: %v", cert)
-			} else if strings.HasPrefix(cert, "ssh-rsa") {
-				Logger.Info("Skipping RSA key: %v", cert)
-			} else {
-				Logger.Error("Error while checking certificate: %v", cert)
-			}
+	var userCert *SshCertificateType
+	for _, certificate := range certificates {
+		if !profile.Matches(certificate) {
 			continue
 		}
-
-		var certDetailMap map[string]interface{}
-		json.Unmarshal([]byte(stdOut), &certDetailMap)
-		principals := certDetailMap["Principals"]
-		for _, p := range principals.([]interface{}) {
-			principal := p.(string)
-			if principal == username {
-				foundUserCert = true
-
-				for _, _p := range principals.([]interface{}) {
-					pp := _p.(string)
-					PRINCIPALS = append(PRINCIPALS, pp)
-				}
-
-				validAfterDateStr := fmt.Sprintf("%v", certDetailMap["ValidAfter"])
-				validBeforeDateStr := fmt.Sprintf("%v", certDetailMap["ValidBefore"])
-
-				//2021-11-02T09:56:30+01:00
-				validAfterDate, err := time.Parse(time.RFC3339, validAfterDateStr)
-				if err != nil {
-					return false, STEPERR_INVALID_USERCERT_VALID_DATE
-				}
-				validBeforeDate, err := time.Parse(time.RFC3339, validBeforeDateStr)
-				if err != nil {
-					return false, STEPERR_INVALID_USERCERT_VALID_DATE
-				}
-				vad := validAfterDate.UTC().Unix()
-				now := time.Now().UTC().Unix()
-				vbd := validBeforeDate.UTC().Unix()
-
-				valid := (vad <= now) && (now <= vbd)
-				if valid {
-					return valid, nil
-				}
-			}
+		addPrincipals(certificate.Principals)
+		if userCert == nil || certificate.ValidBefore.After(userCert.ValidBefore) {
+			userCert = certificate
 		}
 	}
 
-	if foundUserCert {
-		return false, STEPERR_USERCERT_EXPIRED
-	} else {
-		return false, STEPERR_NO_USERCERT_FOUND
+	if userCert == nil {
+		return nil, STEPERR_NO_USERCERT_FOUND
+	}
+	if !userCert.ValidAt(time.Now()) {
+		return userCert, STEPERR_USERCERT_EXPIRED
+	}
+	return userCert, nil
+}
+
+// Renew gets a new user certificate without asking the user. OIDC provisioners need a browser login,
+// which is only started when CertRenewalBrowserLogin allows it, JWK provisioners need StepPasswordFile.
+func (stepcli *StepType) Renew() error {
+	provisionerType, err := stepcli.ProvisionerType(Configs.StepDefaultProvisioner)
+	if err != nil {
+		return err
+	}
+	if provisionerType == STEP_PROVISIONER_OIDC && !Configs.CertRenewalBrowserLogin {
+		return fmt.Errorf("%w: provisioner %v logs in with the browser", STEPERR_INTERACTIVE_LOGIN_REQUIRED, Configs.StepDefaultProvisioner)
 	}
+	return stepcli.Login(nil)
+}
 
+// writeSecretFile writes secret to a new file only the current user can read and returns its path.
+// The file is restricted before the secret is written, it never has the inherited permissions with the secret in it.
+func writeSecretFile(secret string) (string, error) {
+	file, err := ioutil.TempFile(APP_HOME_DIR, "secret-*")
+	if err != nil {
+		return "", err
+	}
+	if err = RestrictFileToOwner(file.Name()); err == nil {
+		_, err = file.WriteString(secret)
+	}
+	// a failed close may have written the secret, the file is removed either way
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTestConfigs restores the configs after the test and keeps the files of the app and of step in a
+// temporary home directory
+func useTestConfigs(t *testing.T) {
+	configs := *Configs
+	userHomeDir, appHomeDir, appConfsDir, appConfsFile := USER_HOME_DIR, APP_HOME_DIR, APP_CONFS_DIR, APP_CONFS_FILE
+	t.Cleanup(func() {
+		*Configs = configs
+		USER_HOME_DIR, APP_HOME_DIR, APP_CONFS_DIR, APP_CONFS_FILE = userHomeDir, appHomeDir, appConfsDir, appConfsFile
+	})
+
+	USER_HOME_DIR = t.TempDir()
+	APP_HOME_DIR = filepath.Join(USER_HOME_DIR, ".winssh_pageantui")
+	APP_CONFS_DIR = filepath.Join(APP_HOME_DIR, "configs")
+	APP_CONFS_FILE = filepath.Join(APP_CONFS_DIR, "default-conf.json")
+	if err := os.MkdirAll(APP_CONFS_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(STEP_PATH_ENV, filepath.Join(USER_HOME_DIR, STEP_DEFAULT_DIR))
+	Configs.StepUsername = "alice"
+}
+
+// newReplayStepCli returns a StepType that answers its step.exe runs from testdata/stepcli/recording.
+// The test fails when not all recorded runs were made.
+func newReplayStepCli(t *testing.T, recording string) *StepType {
+	file, err := os.Open(filepath.Join("testdata", "stepcli", recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	runner, err := LoadReplayCommandRunner(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if remaining := runner.Remaining(); remaining != 0 {
+			t.Errorf("%v recorded runs of %v were not made", remaining, recording)
+		}
+	})
+
+	stepcli := &StepType{Runner: runner}
+	if err = stepcli.Init(); err != nil {
+		t.Fatal(err)
+	}
+	stepcli.provisionerTypes = map[string]string{
+		"admin":    STEP_PROVISIONER_JWK,
+		"machines": STEP_PROVISIONER_X5C,
+		"renewal":  STEP_PROVISIONER_SSHPOP,
+	}
+	return stepcli
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		recording   string
+		provisioner string
+		configure   func()
+		err         error
+	}{
+		{"login-jwk.json", "admin", func() { Configs.StepPasswordFile = "testdata/stepcli/password.txt" }, nil},
+		{"login-x5c.json", "machines", func() {
+			Configs.StepX5cCert, Configs.StepX5cKey = "testdata/stepcli/alice.crt", "testdata/stepcli/alice.key"
+		}, nil},
+		{"login-unauthorized.json", "admin", func() { Configs.StepPasswordFile = "testdata/stepcli/password.txt" }, STEPERR_UNAUTHORIZED},
+		{"login-not-started.json", "admin", func() { Configs.StepPasswordFile = "testdata/stepcli/password.txt" }, STEPERR_STEPCLI_NOT_FOUND},
+	}
+	for _, test := range tests {
+		t.Run(test.recording, func(t *testing.T) {
+			useTestConfigs(t)
+			stepcli := newReplayStepCli(t, test.recording)
+			Configs.StepDefaultProvisioner = test.provisioner
+			test.configure()
+
+			err := stepcli.Login(nil)
+			if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+				t.Errorf("err = %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+// blockingCommandRunnerType holds every run until release is closed
+type blockingCommandRunnerType struct {
+	runner  CommandRunner
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingCommandRunnerType) Run(command CommandRunType) (CommandResultType, error) {
+	r.started <- struct{}{}
+	<-r.release
+	return r.runner.Run(command)
+}
+
+func TestLoginInProgress(t *testing.T) {
+	useTestConfigs(t)
+	stepcli := newReplayStepCli(t, "login-jwk.json")
+	Configs.StepDefaultProvisioner = "admin"
+	Configs.StepPasswordFile = "testdata/stepcli/password.txt"
+	runner := &blockingCommandRunnerType{runner: stepcli.Runner, started: make(chan struct{}, 1), release: make(chan struct{})}
+	stepcli.Runner = runner
+
+	done := make(chan error)
+	go func() { done <- stepcli.Login(nil) }()
+	<-runner.started
+
+	// e.g. CertRenewal while the user logs in from the Dashboard
+	if err := stepcli.Renew(); !errors.Is(err, STEPERR_LOGIN_IN_PROGRESS) {
+		t.Errorf("second login: err = %v, expected %v", err, STEPERR_LOGIN_IN_PROGRESS)
+	}
+	close(runner.release)
+	if err := <-done; err != nil {
+		t.Errorf("first login: err = %v", err)
+	}
+}
+
+// commandRunnerFunc runs programs with a function
+type commandRunnerFunc func(command CommandRunType) (CommandResultType, error)
+
+func (f commandRunnerFunc) Run(command CommandRunType) (CommandResultType, error) {
+	return f(command)
+}
+
+func TestLoginWithPromptedPassword(t *testing.T) {
+	useTestConfigs(t)
+	stepcli := newReplayStepCli(t, "empty.json")
+	Configs.StepDefaultProvisioner = "admin"
+	if err := os.MkdirAll(APP_HOME_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	passwordFile := ""
+	stepcli.Runner = commandRunnerFunc(func(command CommandRunType) (CommandResultType, error) {
+		passwordFile = strings.TrimPrefix(command.Argv[len(command.Argv)-1], "--password-file=")
+		if filepath.Dir(passwordFile) != APP_HOME_DIR {
+			t.Errorf("password file %v", passwordFile)
+		}
+		if info, err := os.Stat(passwordFile); err != nil || info.Mode().Perm() != AGENT_SOCKET_FILE_MODE {
+			t.Errorf("password file mode %v, error %v", info.Mode(), err)
+		}
+		if content, err := ioutil.ReadFile(passwordFile); err != nil || string(content) != "provisioner password" {
+			t.Errorf("password file holds %q, error %v", content, err)
+		}
+		return CommandResultType{}, nil
+	})
+
+	err := stepcli.Login(func(title string, message string) (string, bool) {
+		return "provisioner password", true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(passwordFile); !os.IsNotExist(err) {
+		t.Errorf("password file was not removed: %v", err)
+	}
+
+	if err = stepcli.Login(func(string, string) (string, bool) { return "", false }); !errors.Is(err, STEPERR_LOGIN_CANCELLED) {
+		t.Errorf("cancelled prompt: err = %v, expected %v", err, STEPERR_LOGIN_CANCELLED)
+	}
+}
+
+func TestLoginNeedsConfiguration(t *testing.T) {
+	tests := []struct {
+		name        string
+		provisioner string
+		err         error
+	}{
+		{"JWK without password", "admin", STEPERR_INTERACTIVE_LOGIN_REQUIRED},
+		{"X5C without certificate", "machines", STEPERR_X5C_NOT_CONFIGURED},
+		{"SSHPOP without certificate", "renewal", STEPERR_SSHPOP_NOT_CONFIGURED},
+		{"no provisioner", "", STEPERR_NO_PROVISIONER_CONFIGURED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfigs(t)
+			stepcli := newReplayStepCli(t, "empty.json")
+			Configs.StepDefaultProvisioner = test.provisioner
+
+			if err := stepcli.Login(nil); !errors.Is(err, test.err) {
+				t.Errorf("err = %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLoginSshpop(t *testing.T) {
+	useTestConfigs(t)
+	keyring, _ := startTestAgent(t)
+	stepcli := newReplayStepCli(t, "login-sshpop.json")
+	Configs.StepDefaultProvisioner = "renewal"
+	Configs.StepSshpopCert, Configs.StepSshpopKey = "testdata/stepcli/sshpop-cert.pub", "testdata/keys/ed25519"
+
+	if err := stepcli.Login(nil); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Type() != "ssh-ed25519-cert-v01@openssh.com" || keys[0].Comment != "alice@example.com" {
+		t.Errorf("upstream keys = %v, expected the renewed certificate", keys)
+	}
+}
+
+func TestUserCertificateWhilePrincipalsAreReplaced(t *testing.T) {
+	useTestConfigs(t)
+	principals := Principals()
+	t.Cleanup(func() { SetPrincipals(principals) })
+	_, address := startTestAgent(t)
+	key, certificate := newTestCertificate(t, time.Now().Add(time.Hour))
+	if err := AddCertificateToAgent(address, key, certificate); err != nil {
+		t.Fatal(err)
+	}
+
+	// the health checks add the principals of the certificate while a profile switch replaces them
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := StepCli.UserCertificate(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			SetPrincipals([]string{"admins"})
+		}()
+	}
+	wg.Wait()
+
+	if _, err := StepCli.UserCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if principals := Principals(); !containsString(principals, "admins") || !containsString(principals, "alice") {
+		t.Errorf("principals = %v", principals)
+	}
+}
+
+func TestWriteSecretFile(t *testing.T) {
+	useTestConfigs(t)
+	path, err := writeSecretFile("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != APP_HOME_DIR {
+		t.Errorf("secret file %v is not in %v", path, APP_HOME_DIR)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "hunter2" {
+		t.Errorf("secret file content %q, error %v", content, err)
+	}
+
+	APP_HOME_DIR = filepath.Join(APP_HOME_DIR, "missing")
+	if path, err = writeSecretFile("hunter2"); err == nil || path != "" {
+		t.Errorf("path %q, error %v, expected an error and no file", path, err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	useTestConfigs(t)
+	principals := Principals()
+	t.Cleanup(func() { SetPrincipals(principals) })
+
+	// the first principal has no certificate in the agent
+	SetPrincipals([]string{"alice", "admins"})
+	if err := newReplayStepCli(t, "logout.json").Logout(); err != nil {
+		t.Errorf("err = %v", err)
+	}
+
+	SetPrincipals(nil)
+	if err := newReplayStepCli(t, "empty.json").Logout(); !errors.Is(err, STEPERR_LOGOUT_FAILED) {
+		t.Errorf("without principals: err = %v, expected %v", err, STEPERR_LOGOUT_FAILED)
+	}
+}
+
+func TestReConfigure(t *testing.T) {
+	useTestConfigs(t)
+	stepcli := newReplayStepCli(t, "reconfigure.json")
+
+	for _, team := range []struct{ name, url string }{
+		{"ops", "https://example.com/teams/<>"},
+		{"ops", ""},
+		{"", "https://example.com/teams/ops"},
+	} {
+		Configs.StepTeamName, Configs.StepTeamUrl = team.name, team.url
+		if err := stepcli.ReConfigure(); err != nil {
+			t.Errorf("team %q, url %q: err = %v", team.name, team.url, err)
+		}
+	}
+
+	Configs.StepTeamName, Configs.StepTeamUrl = "", "not a url"
+	if err := stepcli.ReConfigure(); !errors.Is(err, STEPERR_INVALID_TEAM_URL) {
+		t.Errorf("invalid url: err = %v, expected %v", err, STEPERR_INVALID_TEAM_URL)
+	}
+	Configs.StepTeamName, Configs.StepTeamUrl = "", ""
+	if err := stepcli.ReConfigure(); !errors.Is(err, STEPERR_NO_STEP_TEAM_CONFIGURED) {
+		t.Errorf("no team: err = %v, expected %v", err, STEPERR_NO_STEP_TEAM_CONFIGURED)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	useTestConfigs(t)
+	stepcli := newReplayStepCli(t, "bootstrap.json")
+
+	if err := stepcli.Bootstrap("https://ca.example.com", "6f3b4d2ab8a0a9a0d4b1c4f7d1e5b2c39b6e0f1ea4c3b2a1908f7e6d5c4b3a29"); err != nil {
+		t.Errorf("err = %v", err)
+	}
+	if err := stepcli.Bootstrap("ca.example.com", "6f3b"); !errors.Is(err, STEPERR_STEPCA_NOT_CONFIGURED) {
+		t.Errorf("invalid url: err = %v, expected %v", err, STEPERR_STEPCA_NOT_CONFIGURED)
+	}
+	if err := stepcli.Bootstrap("https://ca.example.com", ""); !errors.Is(err, STEPERR_STEPCA_NOT_CONFIGURED) {
+		t.Errorf("no fingerprint: err = %v, expected %v", err, STEPERR_STEPCA_NOT_CONFIGURED)
+	}
+}
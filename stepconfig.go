@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	STEP_PATH_ENV              = "STEPPATH"
+	STEP_DEFAULT_DIR           = ".step"
+	STEP_CONTEXTS_FILE         = "contexts.json"
+	STEP_CURRENT_CONTEXT_FILE  = "current-context.json"
+	STEP_DEFAULTS_FILE         = "defaults.json"
+	STEP_AUTHORITIES_DIR       = "authorities"
+	STEP_CONFIG_DIR            = "config"
+	STEP_CONTEXT_AUTHORITY_KEY = "authority"
+	STEP_IDENTITY_DIR          = "identity"
+	STEP_IDENTITY_CERT_FILE    = "identity.crt"
+	STEP_IDENTITY_KEY_FILE     = "identity.key"
+)
+
+// StepDefaultsType is what "step ca bootstrap" and "step ssh config" store in defaults.json
+type StepDefaultsType struct {
+	CaUrl       string `json:"ca-url"`
+	Fingerprint string `json:"fingerprint"`
+	Root        string `json:"root"`
+	Path        string `json:"-"`
+
+	// X.509 identity of a Smallstep team setup, step-ca wants it for /ssh/hosts. Empty when there is none.
+	IdentityCert string `json:"-"`
+	IdentityKey  string `json:"-"`
+}
+
+// StepPath is the step configuration directory, $STEPPATH or ~/.step
+func StepPath() string {
+	if stepPath := os.Getenv(STEP_PATH_ENV); stepPath != "" {
+		return stepPath
+	}
+	return filepath.Join(USER_HOME_DIR, STEP_DEFAULT_DIR)
+}
+
+// LoadStepDefaults reads the defaults.json of the current step context, or of the plain step path
+// when contexts are not in use.
+func LoadStepDefaults() (*StepDefaultsType, error) {
+	stepPath := StepPath()
+	defaultsPath := filepath.Join(stepPath, STEP_CONFIG_DIR, STEP_DEFAULTS_FILE)
+
+	authority, err := currentStepAuthority(stepPath)
+	if err != nil {
+		return nil, err
+	}
+	if authority != "" {
+		defaultsPath = filepath.Join(stepPath, STEP_AUTHORITIES_DIR, authority, STEP_CONFIG_DIR, STEP_DEFAULTS_FILE)
+	}
+
+	content, err := ioutil.ReadFile(defaultsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %v does not exist", STEPERR_STEPCA_NOT_CONFIGURED, defaultsPath)
+		}
+		return nil, err
+	}
+
+	defaults := &StepDefaultsType{Path: defaultsPath}
+	if err = json.Unmarshal(content, defaults); err != nil {
+		return nil, fmt.Errorf("cannot parse %v: %w", defaultsPath, err)
+	}
+	if defaults.CaUrl == "" {
+		return nil, fmt.Errorf("%w: no ca-url in %v", STEPERR_STEPCA_NOT_CONFIGURED, defaultsPath)
+	}
+
+	identityDir := filepath.Join(filepath.Dir(filepath.Dir(defaultsPath)), STEP_IDENTITY_DIR)
+	identityCert := filepath.Join(identityDir, STEP_IDENTITY_CERT_FILE)
+	identityKey := filepath.Join(identityDir, STEP_IDENTITY_KEY_FILE)
+	if _, err = os.Stat(identityCert); err == nil {
+		if _, err = os.Stat(identityKey); err == nil {
+			defaults.IdentityCert, defaults.IdentityKey = identityCert, identityKey
+		}
+	}
+	return defaults, nil
+}
+
+// currentStepAuthority is the authority of the current context, empty when step runs without contexts
+func currentStepAuthority(stepPath string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(stepPath, STEP_CURRENT_CONTEXT_FILE))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	current := struct {
+		Context string `json:"context"`
+	}{}
+	if err = json.Unmarshal(content, &current); err != nil || current.Context == "" {
+		return "", nil
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(stepPath, STEP_CONTEXTS_FILE))
+	if err != nil {
+		return "", fmt.Errorf("current step context is %v, but contexts cannot be read: %w", current.Context, err)
+	}
+	contexts := map[string]map[string]string{}
+	if err = json.Unmarshal(content, &contexts); err != nil {
+		return "", fmt.Errorf("cannot parse step contexts: %w", err)
+	}
+	context, ok := contexts[current.Context]
+	if !ok || context[STEP_CONTEXT_AUTHORITY_KEY] == "" {
+		return "", fmt.Errorf("current step context %v is not defined", current.Context)
+	}
+	return context[STEP_CONTEXT_AUTHORITY_KEY], nil
+}
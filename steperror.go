@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StepErrorCategoryType groups step failures by what the user can do about them
+type StepErrorCategoryType string
+
+const (
+	STEP_ERROR_NOT_CONFIGURED     StepErrorCategoryType = "not-configured"
+	STEP_ERROR_NO_CERTIFICATE     StepErrorCategoryType = "no-certificate"
+	STEP_ERROR_IDENTITY_NOT_FOUND StepErrorCategoryType = "identity-not-found"
+	STEP_ERROR_UNAUTHORIZED       StepErrorCategoryType = "unauthorized"
+	STEP_ERROR_UNTRUSTED_CA       StepErrorCategoryType = "untrusted-ca"
+	STEP_ERROR_UNREACHABLE        StepErrorCategoryType = "unreachable"
+	STEP_ERROR_CA_INTERNAL_ERROR  StepErrorCategoryType = "ca-internal-error"
+	STEP_ERROR_CA_UNAVAILABLE     StepErrorCategoryType = "ca-unavailable"
+	STEP_ERROR_NOT_STARTED        StepErrorCategoryType = "not-started"
+	STEP_ERROR_UNKNOWN            StepErrorCategoryType = "unknown"
+)
+
+// StepErrorType is a failed step.exe run. errors.Is matches it against the STEPERR_* error of its
+// category, and against PSERR_NON_ZERO_EXIZCODE when step exited with an error code.
+type StepErrorType struct {
+	Category StepErrorCategoryType
+	Command  string
+	// ExitCode of step.exe, -1 when it did not run
+	ExitCode int
+	// HttpStatus the CA answered with, 0 when step's output does not tell
+	HttpStatus int
+	Stdout     StdOut
+	Stderr     StdErr
+	// Err is the error of the runner, e.g. step.exe could not be started
+	Err error
+}
+
+// stepErrorCategoryInfoType is what a category means to the user
+type stepErrorCategoryInfoType struct {
+	sentinel error
+	message  string
+	hint     string
+}
+
+var STEP_ERROR_CATEGORIES = map[StepErrorCategoryType]stepErrorCategoryInfoType{
+	STEP_ERROR_NOT_CONFIGURED: {STEPERR_STEPCA_NOT_CONFIGURED,
+		"No step CA is configured.",
+		"Configure your team in Config StepCli, or switch to a profile."},
+	STEP_ERROR_NO_CERTIFICATE: {STEPERR_NO_USERCERT_FOUND,
+		"No user certificate was found.",
+		"Log in from the Dashboard to get a new certificate."},
+	STEP_ERROR_IDENTITY_NOT_FOUND: {STEPERR_IDENTITY_NOT_FOUND,
+		"The step identity was not found.",
+		"Save Config StepCli again to recreate the identity of your team."},
+	STEP_ERROR_UNAUTHORIZED: {STEPERR_UNAUTHORIZED,
+		"The CA did not accept the credentials.",
+		"Log in again, or check the provisioner and its password, certificate or key in the configs."},
+	STEP_ERROR_UNTRUSTED_CA: {STEPERR_UNTRUSTED_CA,
+		"The certificate of the CA is not trusted.",
+		"Bootstrap the CA again with the fingerprint your administrators published."},
+	STEP_ERROR_UNREACHABLE: {STEPCAERR_UNREACHABLE,
+		"The CA could not be reached.",
+		"Check the network connection, VPN and proxy, and the CA url."},
+	STEP_ERROR_CA_INTERNAL_ERROR: {STEPERR_CASERVER_ERROR_INTERNAL_SERVER_ERROR,
+		"The CA failed with an internal error.",
+		"Try again later, and report it to your CA administrators if it keeps failing."},
+	STEP_ERROR_CA_UNAVAILABLE: {STEPERR_CASERVER_ERROR_SERVICE_UNAVAILABLE,
+		"The CA is temporarily unavailable.",
+		"Wait until the CA health in the Dashboard is OK and try again."},
+	STEP_ERROR_NOT_STARTED: {STEPERR_STEPCLI_NOT_FOUND,
+		"step.exe could not be started.",
+		"Install the step CLI and make sure step.exe is on the PATH."},
+	STEP_ERROR_UNKNOWN: {STEPERR_UNKNOWN_ERROR,
+		"step failed.",
+		"See the log for the output of step."},
+}
+
+// stepErrorPatternType recognizes a category by a text in the output of step, the first match wins
+type stepErrorPatternType struct {
+	text     string
+	category StepErrorCategoryType
+}
+
+var stepErrorPatterns = []stepErrorPatternType{
+	{"requires the '--ca-url' flag", STEP_ERROR_NOT_CONFIGURED},
+	{"no key found", STEP_ERROR_NO_CERTIFICATE},
+	{"Identity not found", STEP_ERROR_IDENTITY_NOT_FOUND},
+	{"certificate signed by unknown authority", STEP_ERROR_UNTRUSTED_CA},
+	{"fingerprint does not match", STEP_ERROR_UNTRUSTED_CA},
+	{"Internal Server Error", STEP_ERROR_CA_INTERNAL_ERROR},
+	{"Service Unavailable", STEP_ERROR_CA_UNAVAILABLE},
+	{"Unauthorized", STEP_ERROR_UNAUTHORIZED},
+	{"Forbidden", STEP_ERROR_UNAUTHORIZED},
+	{"could not be authorized", STEP_ERROR_UNAUTHORIZED},
+	{"connection refused", STEP_ERROR_UNREACHABLE},
+	{"no such host", STEP_ERROR_UNREACHABLE},
+	{"i/o timeout", STEP_ERROR_UNREACHABLE},
+}
+
+// step prints the status of CA errors as JSON or in the text of the error
+var stepErrorStatusPattern = regexp.MustCompile(`(?i)(?:"status"\s*:\s*|status code:?\s*|HTTP/[\d.]+\s+)([45]\d\d)\b`)
+
+var stepErrorStatusTexts = []struct {
+	text   string
+	status int
+}{
+	{"Internal Server Error", 500},
+	{"Service Unavailable", 503},
+	{"Unauthorized", 401},
+	{"Forbidden", 403},
+}
+
+var stepErrorStatusCategories = map[int]StepErrorCategoryType{
+	401: STEP_ERROR_UNAUTHORIZED,
+	403: STEP_ERROR_UNAUTHORIZED,
+	500: STEP_ERROR_CA_INTERNAL_ERROR,
+	502: STEP_ERROR_CA_UNAVAILABLE,
+	503: STEP_ERROR_CA_UNAVAILABLE,
+	504: STEP_ERROR_CA_UNAVAILABLE,
+}
+
+// NewStepError classifies a step.exe run. It returns nil when step succeeded, i.e. the runner did not fail
+// and step exited with 0, whatever step printed.
+func NewStepError(command CommandRunType, result CommandResultType, err error) error {
+	if err == nil && result.ExitCode == 0 {
+		return nil
+	}
+
+	output := string(result.Stdout) + "\n" + string(result.Stderr)
+	category := StepErrorCategoryType("")
+	for _, pattern := range stepErrorPatterns {
+		if strings.Contains(output, pattern.text) {
+			category = pattern.category
+			break
+		}
+	}
+
+	httpStatus := 0
+	if match := stepErrorStatusPattern.FindStringSubmatch(output); match != nil {
+		httpStatus, _ = strconv.Atoi(match[1])
+	} else {
+		for _, statusText := range stepErrorStatusTexts {
+			if strings.Contains(output, statusText.text) {
+				httpStatus = statusText.status
+				break
+			}
+		}
+	}
+
+	if category == "" {
+		category = stepErrorStatusCategories[httpStatus]
+	}
+	if category == "" && err != nil {
+		category = STEP_ERROR_NOT_STARTED
+	}
+	if category == "" {
+		category = STEP_ERROR_UNKNOWN
+	}
+
+	exitCode := result.ExitCode
+	if err != nil {
+		exitCode = -1
+	}
+	return &StepErrorType{
+		Category:   category,
+		Command:    command.String(),
+		ExitCode:   exitCode,
+		HttpStatus: httpStatus,
+		Stdout:     result.Stdout,
+		Stderr:     result.Stderr,
+		Err:        err,
+	}
+}
+
+func (e *StepErrorType) Error() string {
+	text := e.info().sentinel.Error()
+	if detail := e.Detail(); detail != "" {
+		text += ": " + detail
+	}
+	if e.Err != nil {
+		text += ": " + e.Err.Error()
+	} else if e.ExitCode != 0 {
+		text += fmt.Sprintf(" (exit code %v)", e.ExitCode)
+	}
+	return text
+}
+
+// Unwrap returns the error of the runner
+func (e *StepErrorType) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the STEPERR_* error of the category, and PSERR_NON_ZERO_EXIZCODE when step exited with an error code
+func (e *StepErrorType) Is(target error) bool {
+	if target == PSERR_NON_ZERO_EXIZCODE {
+		return e.ExitCode > 0
+	}
+	return target == e.info().sentinel
+}
+
+// Detail is the last line step printed to stderr, which is where it reports what failed
+func (e *StepErrorType) Detail() string {
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(string(e.Stderr), "\r\n", "\n")), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Message describes the category to the user
+func (e *StepErrorType) Message() string {
+	return e.info().message
+}
+
+// Hint tells the user how to fix the failure
+func (e *StepErrorType) Hint() string {
+	return e.info().hint
+}
+
+func (e *StepErrorType) info() stepErrorCategoryInfoType {
+	if info, ok := STEP_ERROR_CATEGORIES[e.Category]; ok {
+		return info
+	}
+	return STEP_ERROR_CATEGORIES[STEP_ERROR_UNKNOWN]
+}
+
+// StepErrorText describes err for the user: the message and hint of its category, followed by the error.
+// Errors that are not from step, or match no category, are described by their text alone.
+func StepErrorText(err error) string {
+	var stepErr *StepErrorType
+	if errors.As(err, &stepErr) {
+		return fmt.Sprintf("%v %v\n\n%v", stepErr.Message(), stepErr.Hint(), stepErr.Error())
+	}
+	for _, info := range STEP_ERROR_CATEGORIES {
+		if errors.Is(err, info.sentinel) {
+			return fmt.Sprintf("%v %v\n\n%v", info.message, info.hint, err)
+		}
+	}
+	return err.Error()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestStepErrorStatusPattern(t *testing.T) {
+	tests := []struct {
+		output string
+		status string
+	}{
+		{`{"status":401,"message":"Unauthorized"}`, "401"},
+		{`{"status" : 503}`, "503"},
+		{"client POST https://ca.example.com/1.0/sign failed: status code: 500", "500"},
+		{"Status Code 404", "404"},
+		{"HTTP/1.1 403 Forbidden", "403"},
+		{"HTTP/2 502 Bad Gateway", "502"},
+		{`{"status":200}`, ""},
+		{"status code: 4011", ""},
+		{"retried 500 times", ""},
+	}
+	for _, test := range tests {
+		status := ""
+		if match := stepErrorStatusPattern.FindStringSubmatch(test.output); match != nil {
+			status = match[1]
+		}
+		if status != test.status {
+			t.Errorf("status of %q = %q, expected %q", test.output, status, test.status)
+		}
+	}
+}
+
+func TestNewStepError(t *testing.T) {
+	notFound := &exec.Error{Name: "step.exe", Err: exec.ErrNotFound}
+	tests := []struct {
+		name       string
+		stderr     string
+		exitCode   int
+		err        error
+		category   StepErrorCategoryType
+		httpStatus int
+	}{
+		{"ca url missing", "'step ssh login' requires the '--ca-url' flag", 1, nil, STEP_ERROR_NOT_CONFIGURED, 0},
+		{"no certificate", "no key found", 1, nil, STEP_ERROR_NO_CERTIFICATE, 0},
+		{"identity", "Identity not found", 1, nil, STEP_ERROR_IDENTITY_NOT_FOUND, 0},
+		{"unknown authority", "x509: certificate signed by unknown authority", 1, nil, STEP_ERROR_UNTRUSTED_CA, 0},
+		{"fingerprint", "the root fingerprint does not match", 1, nil, STEP_ERROR_UNTRUSTED_CA, 0},
+		{"internal error", "The certificate authority encountered an Internal Server Error.", 1, nil, STEP_ERROR_CA_INTERNAL_ERROR, 500},
+		{"unavailable", "Service Unavailable", 1, nil, STEP_ERROR_CA_UNAVAILABLE, 503},
+		{"unauthorized", "The request lacked necessary authorization to be completed: Unauthorized", 1, nil, STEP_ERROR_UNAUTHORIZED, 401},
+		{"forbidden", "Forbidden", 1, nil, STEP_ERROR_UNAUTHORIZED, 403},
+		{"not authorized", "token could not be authorized", 1, nil, STEP_ERROR_UNAUTHORIZED, 0},
+		{"refused", "dial tcp 127.0.0.1:443: connect: connection refused", 1, nil, STEP_ERROR_UNREACHABLE, 0},
+		{"no such host", "lookup ca.example.com: no such host", 1, nil, STEP_ERROR_UNREACHABLE, 0},
+		{"timeout", "read tcp: i/o timeout", 1, nil, STEP_ERROR_UNREACHABLE, 0},
+		// categorized by the status alone
+		{"status 403", `{"status":403,"message":"The request was denied."}`, 1, nil, STEP_ERROR_UNAUTHORIZED, 403},
+		{"status 502", "status code: 502", 1, nil, STEP_ERROR_CA_UNAVAILABLE, 502},
+		{"status 504", "HTTP/1.1 504 Gateway Timeout", 1, nil, STEP_ERROR_CA_UNAVAILABLE, 504},
+		{"status 404", `{"status":404}`, 1, nil, STEP_ERROR_UNKNOWN, 404},
+		{"not started", "", 0, notFound, STEP_ERROR_NOT_STARTED, 0},
+		{"not started with output", "Unauthorized", 0, notFound, STEP_ERROR_UNAUTHORIZED, 401},
+		{"unknown", "something else went wrong", 2, nil, STEP_ERROR_UNKNOWN, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := CommandResultType{Stderr: StdErr(test.stderr), ExitCode: test.exitCode}
+			err := NewStepError(CommandRunType{Argv: []string{"step.exe", "ssh", "login"}}, result, test.err)
+
+			var stepErr *StepErrorType
+			if !errors.As(err, &stepErr) {
+				t.Fatalf("err = %v, expected a StepErrorType", err)
+			}
+			if stepErr.Category != test.category || stepErr.HttpStatus != test.httpStatus {
+				t.Errorf("category %v, status %v, expected %v, %v", stepErr.Category, stepErr.HttpStatus, test.category, test.httpStatus)
+			}
+			for category, info := range STEP_ERROR_CATEGORIES {
+				if errors.Is(err, info.sentinel) != (category == test.category) {
+					t.Errorf("errors.Is(err, %v) = %v", info.sentinel, category != test.category)
+				}
+			}
+			if errors.Is(err, PSERR_NON_ZERO_EXIZCODE) != (test.err == nil) {
+				t.Errorf("errors.Is(err, %v) = %v", PSERR_NON_ZERO_EXIZCODE, test.err != nil)
+			}
+			if test.err != nil && (!errors.Is(err, test.err) || stepErr.ExitCode != -1) {
+				t.Errorf("runner error %v, exit code %v", stepErr.Err, stepErr.ExitCode)
+			}
+		})
+	}
+}
+
+func TestNewStepErrorSuccess(t *testing.T) {
+	// step prints failures it recovered from, e.g. of a token it renewed
+	for _, stderr := range []string{"", "Unauthorized", `{"status":500}`, "no key found"} {
+		result := CommandResultType{Stdout: StdOut("✔ SSH Agent: yes"), Stderr: StdErr(stderr)}
+		if err := NewStepError(CommandRunType{Argv: []string{"step.exe", "ssh", "login"}}, result, nil); err != nil {
+			t.Errorf("exit code 0 with %q: err = %v", stderr, err)
+		}
+	}
+}
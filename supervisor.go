@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ListenerRunFunc runs a listener until stop is closed (returning nil) or until it fails.
+type ListenerRunFunc func(stop <-chan struct{}) error
+
+type SupervisorStatsType struct {
+	Name          string
+	Running       bool
+	GaveUp        bool
+	Restarts      int
+	LastFailure   string
+	LastFailureAt time.Time
+}
+
+// SupervisorType keeps a listener running. A failed listener is restarted with exponential backoff
+// plus jitter, until MaxAttempts restarts in a row failed.
+type SupervisorType struct {
+	Name        string
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	// OnRestart is called before waiting for the next attempt, OnGiveUp once the attempts are exhausted
+	OnRestart func(name string, attempt int, delay time.Duration, err error)
+	OnGiveUp  func(name string, attempts int, err error)
+
+	run    ListenerRunFunc
+	random *rand.Rand
+
+	mu            sync.Mutex
+	running       bool
+	gaveUp        bool
+	restarts      int
+	lastFailure   error
+	lastFailureAt time.Time
+	stopChn       chan struct{}
+	stoppedChn    chan struct{}
+}
+
+func NewSupervisor(name string, run ListenerRunFunc) *SupervisorType {
+	return &SupervisorType{
+		Name:        name,
+		MaxAttempts: 8,
+		BaseDelay:   1 * time.Second,
+		MaxDelay:    60 * time.Second,
+		run:         run,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *SupervisorType) Start() {
+	s.mu.Lock()
+	s.stopChn = make(chan struct{})
+	s.stoppedChn = make(chan struct{})
+	s.gaveUp = false
+	s.mu.Unlock()
+
+	go s.loop(s.stopChn, s.stoppedChn)
+}
+
+// Stop stops the listener and waits until it has exited.
+func (s *SupervisorType) Stop() {
+	s.mu.Lock()
+	stopChn, stoppedChn := s.stopChn, s.stoppedChn
+	s.stopChn = nil
+	s.mu.Unlock()
+
+	if stopChn == nil {
+		return
+	}
+	close(stopChn)
+	<-stoppedChn
+}
+
+func (s *SupervisorType) Stats() SupervisorStatsType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := SupervisorStatsType{
+		Name:          s.Name,
+		Running:       s.running,
+		GaveUp:        s.gaveUp,
+		Restarts:      s.restarts,
+		LastFailureAt: s.lastFailureAt,
+	}
+	if s.lastFailure != nil {
+		stats.LastFailure = s.lastFailure.Error()
+	}
+	return stats
+}
+
+func (s *SupervisorType) loop(stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+
+	attempt := 0
+	for {
+		s.setRunning(true)
+		startedAt := time.Now()
+		err := s.run(stop)
+		s.setRunning(false)
+
+		select {
+		case <-stop:
+			Logger.Info("Supervisor: %v stopped", s.Name)
+			return
+		default:
+		}
+
+		if err == nil {
+			err = PROXYERR_LISTENER_EXITED
+		}
+		// a listener that stayed up longer than the longest backoff starts counting from scratch
+		if time.Since(startedAt) > s.MaxDelay {
+			attempt = 0
+		}
+		attempt++
+		s.recordFailure(err)
+
+		if attempt > s.MaxAttempts {
+			Logger.Error("Supervisor: %v failed %v times in a row, giving up. Error: %v", s.Name, s.MaxAttempts, err)
+			s.mu.Lock()
+			s.gaveUp = true
+			s.mu.Unlock()
+			if s.OnGiveUp != nil {
+				s.OnGiveUp(s.Name, s.MaxAttempts, err)
+			}
+			<-stop
+			return
+		}
+
+		delay := s.backoff(attempt)
+		Logger.Error("Supervisor: %v failed, restarting in %v (attempt %v/%v). Error: %v", s.Name, delay, attempt, s.MaxAttempts, err)
+		if s.OnRestart != nil {
+			s.OnRestart(s.Name, attempt, delay, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			Logger.Info("Supervisor: %v stopped while waiting to restart", s.Name)
+			return
+		}
+	}
+}
+
+// backoff doubles BaseDelay per attempt up to MaxDelay, and adds up to 50% jitter
+func (s *SupervisorType) backoff(attempt int) time.Duration {
+	delay := s.BaseDelay
+	for i := 1; i < attempt && delay < s.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxDelay {
+		delay = s.MaxDelay
+	}
+	jitter := time.Duration(s.random.Int63n(int64(delay)/2 + 1))
+	return delay + jitter
+}
+
+func (s *SupervisorType) setRunning(running bool) {
+	s.mu.Lock()
+	s.running = running
+	s.mu.Unlock()
+}
+
+func (s *SupervisorType) recordFailure(err error) {
+	s.mu.Lock()
+	s.restarts++
+	s.lastFailure = err
+	s.lastFailureAt = time.Now()
+	s.mu.Unlock()
+}
@@ -0,0 +1,267 @@
+#!/usr/bin/env python3
+"""Writes the PPK test vectors from the ssh-keygen keys in ../keys.
+
+PuTTYgen does not run everywhere, so this is a separate implementation of the PPK format of the
+PuTTY manual, appendix C: it shares no code with ppk.go. Argon2 is implemented here from RFC 9106
+and checked against its test vectors, AES-256-CBC comes from the openssl command.
+
+    python3 make_vectors.py
+"""
+
+import base64
+import hashlib
+import hmac
+import os
+import struct
+import subprocess
+
+HERE = os.path.dirname(os.path.abspath(__file__))
+KEYS = os.path.join(HERE, "..", "keys")
+PASSPHRASE = b"puttygen test"
+# small Argon2 parameters keep the tests fast, PuTTY reads whatever the file says
+ARGON2_MEMORY, ARGON2_PASSES, ARGON2_PARALLELISM = 256, 2, 1
+
+MASK = (1 << 64) - 1
+
+
+def le32(value):
+    return struct.pack("<I", value)
+
+
+def blake2b(data, size=64):
+    return hashlib.blake2b(data, digest_size=size).digest()
+
+
+def argon2_hash(size, data):
+    """H' of RFC 9106, section 3.3"""
+    if size <= 64:
+        return blake2b(le32(size) + data, size)
+    rounds = (size + 31) // 32 - 2
+    v = blake2b(le32(size) + data)
+    out = v[:32]
+    for _ in range(rounds - 1):
+        v = blake2b(v)
+        out += v[:32]
+    return out + blake2b(v, size - 32 * rounds)
+
+
+def gb(v, a, b, c, d):
+    def mix(x, y):
+        return (x + y + 2 * (x & 0xFFFFFFFF) * (y & 0xFFFFFFFF)) & MASK
+
+    def rotr(x, n):
+        return ((x >> n) | (x << (64 - n))) & MASK
+
+    v[a] = mix(v[a], v[b])
+    v[d] = rotr(v[d] ^ v[a], 32)
+    v[c] = mix(v[c], v[d])
+    v[b] = rotr(v[b] ^ v[c], 24)
+    v[a] = mix(v[a], v[b])
+    v[d] = rotr(v[d] ^ v[a], 16)
+    v[c] = mix(v[c], v[d])
+    v[b] = rotr(v[b] ^ v[c], 63)
+
+
+def permute(v, idx):
+    w = [v[i] for i in idx]
+    for a, b, c, d in ((0, 4, 8, 12), (1, 5, 9, 13), (2, 6, 10, 14), (3, 7, 11, 15),
+                       (0, 5, 10, 15), (1, 6, 11, 12), (2, 7, 8, 13), (3, 4, 9, 14)):
+        gb(w, a, b, c, d)
+    for i, j in enumerate(idx):
+        v[j] = w[i]
+
+
+def compress(x, y):
+    r = [a ^ b for a, b in zip(x, y)]
+    z = list(r)
+    for i in range(8):
+        permute(z, list(range(16 * i, 16 * i + 16)))
+    for i in range(8):
+        permute(z, [2 * i + 16 * j + k for j in range(8) for k in (0, 1)])
+    return [a ^ b for a, b in zip(z, r)]
+
+
+def words(block):
+    return list(struct.unpack("<128Q", block))
+
+
+def argon2(kind, password, salt, passes, memory, lanes, size, secret=b"", data=b""):
+    """kind is 0 for Argon2d, 1 for Argon2i and 2 for Argon2id"""
+    h0 = blake2b(le32(lanes) + le32(size) + le32(memory) + le32(passes) + le32(0x13) + le32(kind)
+                 + le32(len(password)) + password + le32(len(salt)) + salt
+                 + le32(len(secret)) + secret + le32(len(data)) + data)
+    columns = (memory // (4 * lanes)) * 4
+    segment = columns // 4
+    blocks = [[None] * columns for _ in range(lanes)]
+    for lane in range(lanes):
+        for i in (0, 1):
+            blocks[lane][i] = words(argon2_hash(1024, h0 + le32(i) + le32(lane)))
+
+    zero = [0] * 128
+    for r in range(passes):
+        for s in range(4):
+            for lane in range(lanes):
+                independent = kind == 1 or (kind == 2 and r == 0 and s < 2)
+                counter, addresses = 0, None
+                start = 2 if r == 0 and s == 0 else 0
+                for i in range(start, segment):
+                    if independent and (addresses is None or i % 128 == 0):
+                        counter += 1
+                        z = [r, lane, s, columns * lanes, passes, kind, counter] + [0] * 121
+                        addresses = compress(zero, compress(zero, z))
+                    column = s * segment + i
+                    previous = blocks[lane][column - 1 if column else columns - 1]
+                    rand = addresses[i % 128] if independent else previous[0]
+                    j1, j2 = rand & 0xFFFFFFFF, rand >> 32
+
+                    ref_lane = lane if r == 0 and s == 0 else j2 % lanes
+                    if r == 0:
+                        area = s * segment + i - 1 if ref_lane == lane else s * segment - (1 if i == 0 else 0)
+                    else:
+                        area = columns - segment + i - 1 if ref_lane == lane else columns - segment - (1 if i == 0 else 0)
+                    relative = area - 1 - ((area * ((j1 * j1) >> 32)) >> 32)
+                    first = 0 if r == 0 or s == 3 else (s + 1) * segment
+                    ref = blocks[ref_lane][(first + relative) % columns]
+
+                    block = compress(previous, ref)
+                    if r > 0:
+                        block = [a ^ b for a, b in zip(block, blocks[lane][column])]
+                    blocks[lane][column] = block
+
+    final = blocks[0][columns - 1]
+    for lane in range(1, lanes):
+        final = [a ^ b for a, b in zip(final, blocks[lane][columns - 1])]
+    return argon2_hash(size, struct.pack("<128Q", *final))
+
+
+def check_argon2():
+    # RFC 9106, sections 5.1 to 5.3
+    expected = {
+        0: "512b391b6f1162975371d30919734294f868e3be3984f3c1a13a4db9fabe4acb",
+        1: "c814d9d1dc7f37aa13f0d77f2494bda1c8de6b016dd388d29952a4c4672b6ce8",
+        2: "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659",
+    }
+    for kind, tag in expected.items():
+        got = argon2(kind, b"\x01" * 32, b"\x02" * 16, 3, 32, 4, 32, b"\x03" * 8, b"\x04" * 12).hex()
+        assert got == tag, "argon2 type %d: %s" % (kind, got)
+
+
+def ssh_string(data):
+    return struct.pack(">I", len(data)) + data
+
+
+def ssh_mpint(value):
+    data = value.to_bytes((value.bit_length() + 8) // 8, "big") if value else b""
+    return ssh_string(data)
+
+
+class Reader:
+    def __init__(self, data):
+        self.data = data
+
+    def string(self):
+        (length,) = struct.unpack(">I", self.data[:4])
+        value, self.data = self.data[4:4 + length], self.data[4 + length:]
+        return value
+
+    def mpint(self):
+        return int.from_bytes(self.string(), "big")
+
+    def uint32(self):
+        (value,) = struct.unpack(">I", self.data[:4])
+        self.data = self.data[4:]
+        return value
+
+
+def read_openssh_key(path):
+    """Returns algorithm, public blob, PuTTY's private blob and comment of an unencrypted openssh-key-v1 file"""
+    with open(path) as f:
+        body = "".join(line.strip() for line in f if not line.startswith("-----"))
+    reader = Reader(base64.b64decode(body)[len(b"openssh-key-v1\0"):])
+    assert reader.string() == b"none" and reader.string() == b"none"
+    reader.string()
+    assert reader.uint32() == 1
+    public_blob = reader.string()
+    private = Reader(reader.string())
+    assert private.uint32() == private.uint32()
+
+    algorithm = private.string().decode()
+    if algorithm == "ssh-rsa":
+        n, e, d, iqmp, p, q = [private.mpint() for _ in range(6)]
+        private_blob = ssh_mpint(d) + ssh_mpint(p) + ssh_mpint(q) + ssh_mpint(iqmp)
+    elif algorithm.startswith("ecdsa-sha2-"):
+        private.string()
+        private.string()
+        private_blob = ssh_mpint(private.mpint())
+    elif algorithm == "ssh-ed25519":
+        private.string()
+        private_blob = ssh_string(private.string()[:32])
+    else:
+        raise ValueError(algorithm)
+    return algorithm, public_blob, private_blob, private.string().decode()
+
+
+def aes256_cbc(key, iv, data):
+    return subprocess.run(["openssl", "enc", "-aes-256-cbc", "-nopad", "-K", key.hex(), "-iv", iv.hex()],
+                          input=data, stdout=subprocess.PIPE, check=True).stdout
+
+
+def lines(header, blob):
+    encoded = base64.b64encode(blob).decode()
+    chunks = [encoded[i:i + 64] for i in range(0, len(encoded), 64)]
+    return ["%s: %d" % (header, len(chunks))] + chunks
+
+
+def write_ppk(version, algorithm, public_blob, private_blob, comment, passphrase):
+    encryption = "aes256-cbc" if passphrase else "none"
+    kdf_lines = []
+    if passphrase:
+        if version == 2:
+            # PuTTY pads version 2 files with the SHA-1 of the private blob
+            private_blob += hashlib.sha1(private_blob).digest()[:16 - len(private_blob) % 16]
+        else:
+            private_blob += os.urandom(16 - len(private_blob) % 16)
+
+    if version == 2:
+        key = (hashlib.sha1(b"\0\0\0\0" + passphrase).digest() + hashlib.sha1(b"\0\0\0\1" + passphrase).digest())[:32]
+        iv = bytes(16)
+        mac_key = hashlib.sha1(b"putty-private-key-file-mac-key" + passphrase).digest()
+        digest = hashlib.sha1
+    elif passphrase:
+        salt = os.urandom(16)
+        derived = argon2(2, passphrase, salt, ARGON2_PASSES, ARGON2_MEMORY, ARGON2_PARALLELISM, 80)
+        key, iv, mac_key = derived[:32], derived[32:48], derived[48:]
+        digest = hashlib.sha256
+        kdf_lines = ["Key-Derivation: Argon2id", "Argon2-Memory: %d" % ARGON2_MEMORY,
+                     "Argon2-Passes: %d" % ARGON2_PASSES, "Argon2-Parallelism: %d" % ARGON2_PARALLELISM,
+                     "Argon2-Salt: %s" % salt.hex()]
+    else:
+        key, iv, mac_key, digest = None, None, b"", hashlib.sha256
+
+    mac = hmac.new(mac_key, b"".join(ssh_string(field) for field in (
+        algorithm.encode(), encryption.encode(), comment.encode(), public_blob, private_blob)), digest).hexdigest()
+    if passphrase:
+        private_blob = aes256_cbc(key, iv, private_blob)
+
+    out = ["PuTTY-User-Key-File-%d: %s" % (version, algorithm), "Encryption: %s" % encryption, "Comment: %s" % comment]
+    out += lines("Public-Lines", public_blob) + kdf_lines + lines("Private-Lines", private_blob)
+    out.append("Private-MAC: %s" % mac)
+    return "\r\n".join(out) + "\r\n"
+
+
+def main():
+    check_argon2()
+    for name in sorted(os.listdir(KEYS)):
+        if "." in name or name.endswith("-encrypted"):
+            continue
+        algorithm, public_blob, private_blob, comment = read_openssh_key(os.path.join(KEYS, name))
+        for version in (2, 3):
+            for suffix, passphrase in (("", b""), (".encrypted", PASSPHRASE)):
+                path = os.path.join(HERE, "%s.v%d%s.ppk" % (name, version, suffix))
+                with open(path, "w", newline="") as f:
+                    f.write(write_ppk(version, algorithm, public_blob, private_blob, comment, passphrase))
+                print(path)
+
+
+if __name__ == "__main__":
+    main()
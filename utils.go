@@ -5,8 +5,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"unsafe"
@@ -43,6 +45,31 @@ func IsFileExist(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// WriteFileAtomically replaces path with content in one rename, readers never see half of it
+func WriteFileAtomically(path string, content []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
 func CapiObfuscateString(realname string) string {
 	cryptlen := len(realname) + 1
 	cryptlen += CRYPTPROTECTMEMORY_BLOCK_SIZE - 1
@@ -124,3 +151,12 @@ func OpenHomeDir() error {
 	}
 	return psErr
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
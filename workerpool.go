@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// BoundedQueueType caps how many holders may run at once. Callers that find every slot taken
+// wait in a queue of limited length, and give up after the queue timeout.
+type BoundedQueueType struct {
+	name       string
+	slots      chan struct{}
+	waiting    int32
+	maxWaiting int32
+	timeout    time.Duration
+}
+
+func NewBoundedQueue(name string, capacity int, maxWaiting int, timeout time.Duration) *BoundedQueueType {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if maxWaiting < 0 {
+		maxWaiting = 0
+	}
+	return &BoundedQueueType{
+		name:       name,
+		slots:      make(chan struct{}, capacity),
+		maxWaiting: int32(maxWaiting),
+		timeout:    timeout,
+	}
+}
+
+// Acquire takes a slot, it returns PROXYERR_QUEUE_FULL or PROXYERR_QUEUE_TIMEOUT when no slot could be taken.
+// Every successful Acquire must be paired with a Release.
+func (q *BoundedQueueType) Acquire() error {
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt32(&q.waiting, 1) > q.maxWaiting {
+		atomic.AddInt32(&q.waiting, -1)
+		return fmt.Errorf("%w: %v (%v running, %v waiting)", PROXYERR_QUEUE_FULL, q.name, q.InUse(), q.maxWaiting)
+	}
+	defer atomic.AddInt32(&q.waiting, -1)
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w: %v after %v", PROXYERR_QUEUE_TIMEOUT, q.name, q.timeout)
+	}
+}
+
+func (q *BoundedQueueType) Release() {
+	<-q.slots
+}
+
+func (q *BoundedQueueType) InUse() int {
+	return len(q.slots)
+}
+
+func (q *BoundedQueueType) Waiting() int {
+	return int(atomic.LoadInt32(&q.waiting))
+}